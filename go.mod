@@ -8,6 +8,7 @@ require (
 	github.com/oschwald/geoip2-golang v1.8.0
 	github.com/pebbe/zmq4 v1.2.11
 	github.com/r3labs/diff/v2 v2.15.1
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/stretchr/testify v1.8.4
 	go.uber.org/dig v1.15.0
 	google.golang.org/grpc v1.56.3
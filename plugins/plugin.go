@@ -7,6 +7,7 @@ import (
 	"go.uber.org/dig"
 
 	logService "github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
 )
 
 var logger = logService.GetLoggerInstance()
@@ -39,6 +40,10 @@ type pluginInfo struct {
 	// a function built using the reflect package that will set
 	// the plugin value of this struct. Executed during Startup().
 	saverFunc interface{}
+
+	// stopSettings stops the re-injection of the settings of a
+	// SettingsInjectablePlugin.
+	stopSettings func()
 }
 
 type predicateInfo struct {
@@ -61,6 +66,10 @@ type PluginControl struct {
 
 	consumers          []consumer
 	enableStartupPanic bool
+
+	// settingsFile is where the settings of
+	// SettingsInjectablePlugins are read from.
+	settingsFile *settings.SettingsFile
 }
 
 // NewPluginControl creates an empty PluginControl
@@ -331,7 +340,9 @@ PluginLoop:
 // Startup constructs and then starts all registered plugins. It
 // panics if any don't start. So it will call the constructor passed
 // to RegisterPlugin with whatever arguments it requires (obtained via
-// the DI container), and then call the Startup() method. Finally, if
+// the DI container), and then call the Startup() method. Plugins
+// that are SettingsInjectablePlugins get their settings before they
+// are started, and again whenever they change. Finally, if
 // the plugin satisfies any of the interfaces ConnectionTrackerPlugin,
 // NetlogHandler, or PacketProcessorPlugin, their handler methods are
 // registered with the backend so they will receive these events.
@@ -360,8 +371,10 @@ func (control *PluginControl) Startup() {
 			continue
 		}
 		plugin := pluginInf.plugin
+		pluginInf.stopSettings = control.injectSettings(plugin)
 		logger.Info("Starting plugin: %s\n", plugin.Name())
 		if err := plugin.Startup(); err != nil {
+			pluginInf.stopSettings()
 
 			if control.enableStartupPanic {
 				panic(fmt.Sprintf("couldn't startup plugin %s: %s",
@@ -428,6 +441,9 @@ func (control *PluginControl) RegisterConsumer(theConsumer PluginConsumer) {
 func (control *PluginControl) Shutdown() {
 	for _, pluginInf := range control.pluginInfo {
 		plugin := pluginInf.plugin
+		if pluginInf.stopSettings != nil {
+			pluginInf.stopSettings()
+		}
 		if err := plugin.Shutdown(); err != nil {
 			logger.Warn("Plugin %s failed to stop: %s\n", plugin.Name(), err)
 		} else {
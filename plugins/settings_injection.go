@@ -0,0 +1,89 @@
+package plugins
+
+import (
+	"errors"
+	"os"
+
+	"github.com/untangle/golang-shared/services/alerts"
+	"github.com/untangle/golang-shared/services/settings"
+	protoAlerts "github.com/untangle/golang-shared/structs/protocolbuffers/Alerts"
+)
+
+// settingsAlertPublisher returns the publisher of the alerts raised
+// when the settings of a plugin don't decode. Replaced in tests.
+var settingsAlertPublisher = func() alerts.AlertPublisher {
+	return alerts.Publisher(logger)
+}
+
+// UseSettingsFile sets the settings file the settings of
+// SettingsInjectablePlugins are read from. By default it is the
+// settings file singleton.
+func (control *PluginControl) UseSettingsFile(file *settings.SettingsFile) {
+	control.settingsFile = file
+}
+
+// pluginSettingsFile returns the settings file plugin settings are
+// injected from.
+func (control *PluginControl) pluginSettingsFile() *settings.SettingsFile {
+	if control.settingsFile == nil {
+		file, err := settings.GetSettingsFileSingleton()
+		if err != nil {
+			logger.Warn("Unable to locate the settings file for plugin settings: %s\n", err.Error())
+		}
+		control.settingsFile = file
+	}
+	return control.settingsFile
+}
+
+// injectSettings gives plugin its settings, if it is a
+// SettingsInjectablePlugin, and keeps giving it new ones whenever its
+// settings subtree changes. It is called before the plugin is started,
+// the returned function stops the re-injection.
+func (control *PluginControl) injectSettings(plugin Plugin) (stop func()) {
+	injectable, ok := plugin.(SettingsInjectablePlugin)
+	if !ok {
+		return func() {}
+	}
+	file := control.pluginSettingsFile()
+	// watch first, so a change made while the settings are read
+	// isn't missed.
+	stop = file.Watch(settings.SplitPath(injectable.SettingsKey()), func(_, _ any) {
+		loadPluginSettings(file, injectable)
+	})
+	loadPluginSettings(file, injectable)
+	return stop
+}
+
+// loadPluginSettings decodes the settings subtree of plugin, at its
+// "/" separated key, into a new settings object and passes it to the
+// plugin. If they can't be
+// decoded the plugin keeps its previous settings.
+func loadPluginSettings(file *settings.SettingsFile, plugin SettingsInjectablePlugin) {
+	key := plugin.SettingsKey()
+	newSettings := plugin.GetNewSettings()
+	err := file.UnmarshalSettingsAtPaths(map[string]any{key: newSettings})
+
+	var notFound *settings.PathsNotFoundError
+	switch {
+	case err == nil:
+		plugin.SetSettings(newSettings)
+	case errors.As(err, &notFound):
+		logger.Info("No settings at %s for plugin %s\n", key, plugin.Name())
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, settings.ErrSettingsCorrupt):
+		// corrupt settings are alerted on by the settings service.
+		logger.Warn("Unable to read the settings of plugin %s: %s\n", plugin.Name(), err.Error())
+	default:
+		logger.Err("Unable to decode the settings of plugin %s, keeping the previous settings: %s\n",
+			plugin.Name(), err.Error())
+		settingsAlertPublisher().Send(&protoAlerts.Alert{
+			Type:     protoAlerts.AlertType_SETTINGS,
+			Severity: protoAlerts.AlertSeverity_ERROR,
+			Message:  "ALERT_PLUGIN_SETTINGS_INVALID",
+			Params: map[string]string{
+				"plugin": plugin.Name(),
+				"key":    key,
+				"error":  err.Error(),
+			},
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/alerts"
+	"github.com/untangle/golang-shared/services/settings"
+	"github.com/untangle/golang-shared/testing/mocks"
+)
+
+// injectablePlugin records the settings injected into it.
+type injectablePlugin struct {
+	mutex           sync.Mutex
+	key             string
+	injected        []*Config
+	startupSettings *Config
+}
+
+func (plugin *injectablePlugin) Startup() error {
+	plugin.startupSettings = plugin.current()
+	return nil
+}
+
+func (plugin *injectablePlugin) Name() string {
+	return "injectablePlugin"
+}
+
+func (plugin *injectablePlugin) Shutdown() error {
+	return nil
+}
+
+func (plugin *injectablePlugin) GetNewSettings() any {
+	return &Config{}
+}
+
+func (plugin *injectablePlugin) SettingsKey() string {
+	return plugin.key
+}
+
+func (plugin *injectablePlugin) SetSettings(value any) {
+	plugin.mutex.Lock()
+	defer plugin.mutex.Unlock()
+	plugin.injected = append(plugin.injected, value.(*Config))
+}
+
+// current returns the last injected settings.
+func (plugin *injectablePlugin) current() *Config {
+	plugin.mutex.Lock()
+	defer plugin.mutex.Unlock()
+	if len(plugin.injected) == 0 {
+		return nil
+	}
+	return plugin.injected[len(plugin.injected)-1]
+}
+
+// fakeSettingsAlerts records the alerts of the test.
+func fakeSettingsAlerts(t *testing.T) *mocks.MockAlertPublisher {
+	publisher := &mocks.MockAlertPublisher{}
+	orig := settingsAlertPublisher
+	settingsAlertPublisher = func() alerts.AlertPublisher { return publisher }
+	t.Cleanup(func() { settingsAlertPublisher = orig })
+	return publisher
+}
+
+// startInjectablePlugin starts a PluginControl with an
+// injectablePlugin for key and a settings file with contents.
+func startInjectablePlugin(t *testing.T, key string, contents string) (*PluginControl, *injectablePlugin, *settings.SettingsFile, string) {
+	filename := filepath.Join(t.TempDir(), "settings.json")
+	require.NoError(t, os.WriteFile(filename, []byte(contents), 0600))
+	file := settings.NewSettingsFile(filename)
+	plugin := &injectablePlugin{key: key}
+
+	control := NewPluginControl()
+	control.UseSettingsFile(file)
+	control.RegisterPlugin(func() *injectablePlugin { return plugin })
+	control.Startup()
+	return control, plugin, file, filename
+}
+
+func TestSettingsInjection(t *testing.T) {
+	publisher := fakeSettingsAlerts(t)
+	control, plugin, file, filename := startInjectablePlugin(t, "injected", `{"injected": {"name": "first"}}`)
+	require.NotNil(t, plugin.startupSettings)
+	assert.Equal(t, "first", plugin.startupSettings.Name)
+
+	// changes on disk are injected.
+	require.NoError(t, os.WriteFile(filename, []byte(`{"injected": {"name": "second"}}`), 0600))
+	require.NoError(t, file.CheckForChanges())
+	assert.Equal(t, "second", plugin.current().Name)
+
+	// changes through the API too.
+	require.NoError(t, file.SetSettingsNoSync([]string{"injected", "name"}, "third"))
+	assert.Equal(t, "third", plugin.current().Name)
+
+	// changes elsewhere in the file are not.
+	require.NoError(t, file.SetSettingsNoSync([]string{"other"}, 1))
+	assert.Len(t, plugin.injected, 3)
+
+	// settings that don't decode are alerted on, the plugin keeps
+	// the previous ones.
+	require.NoError(t, file.SetSettingsNoSync([]string{"injected", "name"}, 3))
+	assert.Len(t, plugin.injected, 3)
+	assert.Equal(t, "third", plugin.current().Name)
+	require.NotNil(t, publisher.GetLastAlert())
+	assert.Equal(t, "ALERT_PLUGIN_SETTINGS_INVALID", publisher.GetLastAlert().Message)
+	assert.Equal(t, "injected", publisher.GetLastAlert().Params["key"])
+
+	control.Shutdown()
+	require.NoError(t, file.SetSettingsNoSync([]string{"injected", "name"}, "fourth"))
+	assert.Equal(t, "third", plugin.current().Name)
+}
+
+func TestSettingsInjectionNestedKey(t *testing.T) {
+	fakeSettingsAlerts(t)
+	control, plugin, file, _ := startInjectablePlugin(t, "network/interfaces", `{"network": {"interfaces": {"name": "first"}}}`)
+	defer control.Shutdown()
+	require.NotNil(t, plugin.startupSettings)
+	assert.Equal(t, "first", plugin.startupSettings.Name)
+
+	require.NoError(t, file.SetSettingsNoSync([]string{"network", "interfaces", "name"}, "second"))
+	assert.Equal(t, "second", plugin.current().Name)
+}
+
+func TestSettingsInjectionMissingKey(t *testing.T) {
+	publisher := fakeSettingsAlerts(t)
+	control, plugin, _, _ := startInjectablePlugin(t, "missing", `{"injected": {"name": "first"}}`)
+	defer control.Shutdown()
+	assert.Nil(t, plugin.startupSettings)
+	assert.Nil(t, publisher.GetLastAlert())
+}
@@ -1,6 +1,10 @@
 package settingssync
 
 import (
+	"fmt"
+	"strings"
+	"sync"
+
 	"github.com/untangle/golang-shared/services/logger"
 )
 
@@ -19,39 +23,241 @@ type SettingsSyncer interface {
 	SyncSettings(interface{}) error
 }
 
+// DependentSyncer is a SettingsSyncer that has to be synced after
+// other syncers.
+type DependentSyncer interface {
+	SettingsSyncer
+
+	// SyncDependencies returns the names of the syncers to sync
+	// before this one. Names that are not registered are ignored.
+	SyncDependencies() []string
+}
+
+// RollbackSyncer is a SettingsSyncer that can undo a sync when a
+// syncer after it fails.
+type RollbackSyncer interface {
+	SettingsSyncer
+
+	// Rollback goes back to prev, the settings this syncer was last
+	// synced with before, or nil if there were none.
+	Rollback(prev interface{})
+}
+
+// namedSyncer is implemented by syncers that are plugins.
+type namedSyncer interface {
+	Name() string
+}
+
+// SyncerStatus is what happened to a syncer during SyncSettings.
+type SyncerStatus string
+
+const (
+	// SyncerInSync is a syncer whose settings had not changed.
+	SyncerInSync SyncerStatus = "in_sync"
+	// SyncerSynced is a syncer that applied new settings.
+	SyncerSynced SyncerStatus = "synced"
+	// SyncerFailed is the syncer whose failure stopped the sync.
+	SyncerFailed SyncerStatus = "failed"
+	// SyncerRolledBack is a syncer that applied new settings and
+	// was rolled back after a later failure.
+	SyncerRolledBack SyncerStatus = "rolled_back"
+	// SyncerSkipped is a syncer that did not run because of an
+	// earlier failure.
+	SyncerSkipped SyncerStatus = "skipped"
+)
+
+// SyncerResult is the outcome of one syncer.
+type SyncerResult struct {
+	Name   string
+	Status SyncerStatus
+	Err    error
+}
+
+// SyncResult is the outcome of SyncSettingsWithResult, with the
+// syncers in the order they were considered.
+type SyncResult struct {
+	Syncers []SyncerResult
+
+	// Err is the error that stopped the sync, if any.
+	Err error
+}
+
+// Failed returns true if the sync stopped on an error.
+func (result *SyncResult) Failed() bool {
+	return result.Err != nil
+}
+
+// String summarizes the result.
+func (result *SyncResult) String() string {
+	parts := make([]string, 0, len(result.Syncers))
+	for _, syncer := range result.Syncers {
+		parts = append(parts, fmt.Sprintf("%s: %s", syncer.Name, syncer.Status))
+	}
+	return strings.Join(parts, ", ")
+}
+
 type SettingsSync struct {
+	mutex sync.Mutex
+
 	// List of plugins implementing the SettingsSyncer interface
 	syncers []SettingsSyncer
+
+	// applied holds, per index in syncers, the settings the syncer
+	// was last synced with, for rolling back.
+	applied map[int]interface{}
 }
 
 // Returns a new instance of Settings Sync.
 func NewSettingsSyncHandler() *SettingsSync {
-	return &SettingsSync{}
+	return &SettingsSync{
+		applied: map[int]interface{}{},
+	}
 }
 
 // Registers a plugin as being managed by Settings Sync
 func (settingsSync *SettingsSync) RegisterPlugin(plug SettingsSyncer) {
+	settingsSync.mutex.Lock()
+	defer settingsSync.mutex.Unlock()
 	settingsSync.syncers = append(settingsSync.syncers, plug)
 }
 
+// syncerName returns the name of syncer in results and dependencies,
+// its Name() if it has one, or else its type.
+func syncerName(syncer SettingsSyncer) string {
+	if named, ok := syncer.(namedSyncer); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", syncer)
+}
+
+// order returns the indexes of the syncers so that each comes after
+// its dependencies, and otherwise in registration order. The mutex
+// must be held.
+func (settingsSync *SettingsSync) order() ([]int, error) {
+	byName := map[string][]int{}
+	for i, syncer := range settingsSync.syncers {
+		name := syncerName(syncer)
+		byName[name] = append(byName[name], i)
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make([]int, len(settingsSync.syncers))
+	ordered := make([]int, 0, len(settingsSync.syncers))
+	var visit func(i int, chain []string) error
+	visit = func(i int, chain []string) error {
+		name := syncerName(settingsSync.syncers[i])
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("settings sync: dependency cycle: %s", strings.Join(append(chain, name), " -> "))
+		}
+		state[i] = visiting
+		if dependent, ok := settingsSync.syncers[i].(DependentSyncer); ok {
+			for _, dependency := range dependent.SyncDependencies() {
+				for _, j := range byName[dependency] {
+					if err := visit(j, append(chain, name)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		state[i] = visited
+		ordered = append(ordered, i)
+		return nil
+	}
+	for i := range settingsSync.syncers {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
 // Syncs the settings of all plugins registered with Settings Sync
+// It can be registered with settings.RegisterSyncCallback, use
+// SyncSettingsWithResult to get the outcome.
 func (settingsSync *SettingsSync) SyncSettings() {
+	settingsSync.SyncSettingsWithResult()
+}
+
+// SyncSettingsWithResult syncs the settings of all plugins registered
+// with Settings Sync and returns the outcome. Syncers run after the syncers they depend on, and the sync stops at
+// the first failure: the syncers after it are skipped and the ones
+// that already applied new settings are rolled back, in reverse
+// order, if they are RollbackSyncers.
+func (settingsSync *SettingsSync) SyncSettingsWithResult() *SyncResult {
+	settingsSync.mutex.Lock()
+	defer settingsSync.mutex.Unlock()
 	logger.Info("Syncing Plugin Settings\n")
 
-	for _, syncer := range settingsSync.syncers {
+	result := &SyncResult{}
+	order, err := settingsSync.order()
+	if err != nil {
+		logger.Err("SettingsSync: %s\n", err.Error())
+		result.Err = err
+		for _, syncer := range settingsSync.syncers {
+			result.Syncers = append(result.Syncers, SyncerResult{Name: syncerName(syncer), Status: SyncerSkipped})
+		}
+		return result
+	}
 
-		updatedSettings, err := syncer.GetCurrentSettingsStruct()
-		if err != nil {
-			logger.Err("An error occurred and could not sync settings: %s\n", err.Error())
+	// synced are the positions in result.Syncers of the syncers
+	// that applied new settings, and their previous settings.
+	type syncedSyncer struct {
+		position int
+		index    int
+		prev     interface{}
+	}
+	synced := []syncedSyncer{}
+	for _, i := range order {
+		syncer := settingsSync.syncers[i]
+		syncerResult := SyncerResult{Name: syncerName(syncer)}
+		if result.Err != nil {
+			syncerResult.Status = SyncerSkipped
+			result.Syncers = append(result.Syncers, syncerResult)
 			continue
 		}
 
-		if !syncer.InSync(updatedSettings) {
+		updatedSettings, err := syncer.GetCurrentSettingsStruct()
+		if err != nil {
+			logger.Err("An error occurred and could not sync settings of %s: %s\n", syncerResult.Name, err.Error())
+		} else if syncer.InSync(updatedSettings) {
+			syncerResult.Status = SyncerInSync
+			settingsSync.applied[i] = updatedSettings
+		} else if err = syncer.SyncSettings(updatedSettings); err != nil {
+			logger.Err("SettingsSync: %s: %s\n", syncerResult.Name, err.Error())
+		} else {
+			syncerResult.Status = SyncerSynced
+			synced = append(synced, syncedSyncer{
+				position: len(result.Syncers),
+				index:    i,
+				prev:     settingsSync.applied[i],
+			})
+			settingsSync.applied[i] = updatedSettings
+		}
+		if err != nil {
+			syncerResult.Status = SyncerFailed
+			syncerResult.Err = err
+			result.Err = fmt.Errorf("settings sync: %s: %w", syncerResult.Name, err)
+		}
+		result.Syncers = append(result.Syncers, syncerResult)
+	}
 
-			if err := syncer.SyncSettings(updatedSettings); err != nil {
-				logger.Err("SettingsSync: %s\n", err.Error())
+	if result.Err != nil {
+		for i := len(synced) - 1; i >= 0; i-- {
+			rollback, ok := settingsSync.syncers[synced[i].index].(RollbackSyncer)
+			if !ok {
 				continue
 			}
+			logger.Info("SettingsSync: rolling back %s\n", result.Syncers[synced[i].position].Name)
+			rollback.Rollback(synced[i].prev)
+			settingsSync.applied[synced[i].index] = synced[i].prev
+			result.Syncers[synced[i].position].Status = SyncerRolledBack
 		}
 	}
+	return result
 }
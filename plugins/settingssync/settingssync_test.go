@@ -0,0 +1,138 @@
+package settingssync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSyncer is a syncer whose settings are an int.
+type fakeSyncer struct {
+	name       string
+	dependsOn  []string
+	settings   int
+	applied    int
+	failSync   error
+	calls      *[]string
+	rolledBack []interface{}
+}
+
+func (syncer *fakeSyncer) Name() string {
+	return syncer.name
+}
+
+func (syncer *fakeSyncer) InSync(settings interface{}) bool {
+	return settings.(int) == syncer.applied
+}
+
+func (syncer *fakeSyncer) GetCurrentSettingsStruct() (interface{}, error) {
+	return syncer.settings, nil
+}
+
+func (syncer *fakeSyncer) SyncSettings(settings interface{}) error {
+	*syncer.calls = append(*syncer.calls, syncer.name)
+	if syncer.failSync != nil {
+		return syncer.failSync
+	}
+	syncer.applied = settings.(int)
+	return nil
+}
+
+func (syncer *fakeSyncer) SyncDependencies() []string {
+	return syncer.dependsOn
+}
+
+// rollbackSyncer is a fakeSyncer that can roll back.
+type rollbackSyncer struct {
+	fakeSyncer
+}
+
+func (syncer *rollbackSyncer) Rollback(prev interface{}) {
+	syncer.rolledBack = append(syncer.rolledBack, prev)
+	if prev != nil {
+		syncer.applied = prev.(int)
+	}
+}
+
+func TestSyncSettingsOrder(t *testing.T) {
+	calls := []string{}
+	network := &fakeSyncer{name: "network", settings: 1, calls: &calls}
+	firewall := &fakeSyncer{name: "firewall", settings: 1, calls: &calls, dependsOn: []string{"network", "missing"}}
+	policy := &fakeSyncer{name: "policy", settings: 1, calls: &calls, dependsOn: []string{"firewall"}}
+	other := &fakeSyncer{name: "other", calls: &calls}
+
+	sync := NewSettingsSyncHandler()
+	sync.RegisterPlugin(policy)
+	sync.RegisterPlugin(firewall)
+	sync.RegisterPlugin(other)
+	sync.RegisterPlugin(network)
+
+	result := sync.SyncSettingsWithResult()
+	require.False(t, result.Failed())
+	assert.Equal(t, []string{"network", "firewall", "policy"}, calls)
+	assert.Equal(t, []SyncerResult{
+		{Name: "network", Status: SyncerSynced},
+		{Name: "firewall", Status: SyncerSynced},
+		{Name: "policy", Status: SyncerSynced},
+		{Name: "other", Status: SyncerInSync},
+	}, result.Syncers)
+	assert.Equal(t, "network: synced, firewall: synced, policy: synced, other: in_sync", result.String())
+
+	// a cycle syncs nothing.
+	network.dependsOn = []string{"policy"}
+	network.settings = 2
+	result = sync.SyncSettingsWithResult()
+	require.True(t, result.Failed())
+	assert.Contains(t, result.Err.Error(), "dependency cycle")
+	for _, syncer := range result.Syncers {
+		assert.Equal(t, SyncerSkipped, syncer.Status)
+	}
+	assert.Len(t, calls, 3)
+}
+
+// SyncSettings is registered as a settings sync callback.
+var _ func() = NewSettingsSyncHandler().SyncSettings
+
+func TestSyncSettingsRollback(t *testing.T) {
+	calls := []string{}
+	first := &rollbackSyncer{fakeSyncer{name: "first", settings: 1, calls: &calls}}
+	plain := &fakeSyncer{name: "plain", settings: 1, calls: &calls, dependsOn: []string{"first"}}
+	second := &rollbackSyncer{fakeSyncer{name: "second", settings: 1, calls: &calls, dependsOn: []string{"plain"}}}
+	failing := &fakeSyncer{name: "failing", calls: &calls, dependsOn: []string{"second"}}
+	last := &fakeSyncer{name: "last", settings: 1, calls: &calls, dependsOn: []string{"failing"}}
+
+	sync := NewSettingsSyncHandler()
+	for _, syncer := range []SettingsSyncer{first, plain, second, failing, last} {
+		sync.RegisterPlugin(syncer)
+	}
+	require.False(t, sync.SyncSettingsWithResult().Failed())
+
+	first.settings = 2
+	second.settings = 2
+	failing.settings = 2
+	failing.failSync = errors.New("boom")
+	calls = calls[:0]
+	result := sync.SyncSettingsWithResult()
+	require.True(t, result.Failed())
+	assert.ErrorIs(t, result.Err, failing.failSync)
+	assert.Equal(t, []string{"first", "second", "failing"}, calls)
+	assert.Equal(t, []SyncerResult{
+		{Name: "first", Status: SyncerRolledBack},
+		{Name: "plain", Status: SyncerInSync},
+		{Name: "second", Status: SyncerRolledBack},
+		{Name: "failing", Status: SyncerFailed, Err: failing.failSync},
+		{Name: "last", Status: SyncerSkipped},
+	}, result.Syncers)
+	assert.Equal(t, []interface{}{1}, first.rolledBack)
+	assert.Equal(t, []interface{}{1}, second.rolledBack)
+	assert.Equal(t, 1, first.applied)
+
+	// once fixed, the rolled back syncers apply again.
+	failing.failSync = nil
+	calls = calls[:0]
+	result = sync.SyncSettingsWithResult()
+	require.False(t, result.Failed())
+	assert.Equal(t, []string{"first", "second", "failing"}, calls)
+}
@@ -99,6 +99,21 @@ func NewDataTracker(
 	}
 }
 
+// newDataTrackerWithIntervals creates a data tracker like
+// NewDataTracker, holding the given intervals, which are trimmed to
+// maxInterval.
+func newDataTrackerWithIntervals(
+	intervals []DataUse,
+	binInterval time.Duration,
+	maxInterval time.Duration) *DataTracker {
+	dataTracker := NewDataTracker(binInterval, maxInterval)
+	if len(intervals) > 0 {
+		dataTracker.dataUseIntervals = append([]DataUse{}, intervals...)
+		dataTracker.RestrictTrackerToInterval(maxInterval)
+	}
+	return dataTracker
+}
+
 // IncrTx increments total tx bytes by tx, returns updated total.
 func (dataTracker *DataTracker) IncrTx(tx uint) {
 	dataTracker.IncrData(DataUseAmount{Tx: tx})
@@ -0,0 +1,444 @@
+package discovery
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Device classes assigned by the fingerprint rules. Rule files may use
+// other classes too.
+const (
+	DeviceClassPhone       = "phone"
+	DeviceClassPrinter     = "printer"
+	DeviceClassCamera      = "camera"
+	DeviceClassSwitch      = "switch"
+	DeviceClassRouter      = "router"
+	DeviceClassAccessPoint = "access_point"
+	DeviceClassServer      = "server"
+	DeviceClassComputer    = "computer"
+	DeviceClassTV          = "tv"
+	DeviceClassIoT         = "iot"
+)
+
+// Fingerprint is the classification of a device by a Fingerprinter.
+type Fingerprint struct {
+	Class string `json:"class,omitempty"`
+	// Confidence in the class, between 0 and 1.
+	Confidence float64 `json:"confidence"`
+	OSFamily   string  `json:"osFamily,omitempty"`
+	// OSConfidence is the confidence in the OS family, between 0 and 1.
+	OSConfidence float64 `json:"osConfidence,omitempty"`
+	// Rules are the names of the rules that matched the device.
+	Rules []string `json:"rules"`
+}
+
+// FingerprintRule assigns a class and/or an OS family to the devices
+// that match all its conditions, with a confidence between 0 and 1.
+type FingerprintRule struct {
+	Name       string           `json:"name"`
+	Class      string           `json:"class,omitempty"`
+	OSFamily   string           `json:"osFamily,omitempty"`
+	Confidence float64          `json:"confidence"`
+	Match      FingerprintMatch `json:"match"`
+}
+
+// FingerprintMatch are the conditions of a FingerprintRule. Each set
+// condition must match. Lists of patterns match when any pattern does,
+// the capabilities and ports must all be present.
+type FingerprintMatch struct {
+	// OUIs are MAC address prefixes, like 00:1B:63 or 70:B3:D5:1.
+	OUIs []string `json:"ouis,omitempty"`
+	// Vendors are regular expressions matched against the vendor of
+	// the MAC address in the OUI database, the NMAP MAC vendor and the
+	// LLDP inventory vendor.
+	Vendors []string `json:"vendors,omitempty"`
+	// LLDPCapabilities are enabled LLDP chassis or MED capabilities.
+	LLDPCapabilities []string `json:"lldpCapabilities,omitempty"`
+	// OpenPorts are ports NMAP found open.
+	OpenPorts []int32 `json:"openPorts,omitempty"`
+	// Hostnames are regular expressions matched against the NMAP
+	// hostnames and the LLDP system names.
+	Hostnames []string `json:"hostnames,omitempty"`
+	// OS are regular expressions matched against the NMAP OS and the
+	// LLDP system descriptions.
+	OS []string `json:"os,omitempty"`
+}
+
+// fingerprintRuleFile is the format of a rule file.
+type fingerprintRuleFile struct {
+	Rules []FingerprintRule `json:"rules"`
+}
+
+// compiledRule is a FingerprintRule ready to match.
+type compiledRule struct {
+	FingerprintRule
+	ouis      []string
+	vendors   []*regexp.Regexp
+	hostnames []*regexp.Regexp
+	os        []*regexp.Regexp
+}
+
+// Fingerprinter classifies devices with fingerprint rules.
+type Fingerprinter struct {
+	rules []compiledRule
+}
+
+// deviceFacts are the facts about a device the rules match against.
+type deviceFacts struct {
+	macs         []string
+	vendors      []string
+	capabilities map[string]bool
+	openPorts    map[int32]bool
+	hostnames    []string
+	os           []string
+}
+
+// NewFingerprinter returns a Fingerprinter applying rules, which are
+// validated.
+func NewFingerprinter(rules []FingerprintRule) (*Fingerprinter, error) {
+	fingerprinter := &Fingerprinter{}
+	names := map[string]bool{}
+	var errs []error
+	for index, rule := range rules {
+		compiled, err := compileFingerprintRule(rule)
+		if err == nil && names[rule.Name] {
+			err = errors.New("duplicate rule name")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fingerprint rule %d (%s): %w", index, rule.Name, err))
+			continue
+		}
+		names[rule.Name] = true
+		fingerprinter.rules = append(fingerprinter.rules, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return fingerprinter, nil
+}
+
+// ParseFingerprintRules parses a rule file, a JSON object with the
+// rules in a "rules" array.
+func ParseFingerprintRules(data []byte) ([]FingerprintRule, error) {
+	file := fingerprintRuleFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Rules, nil
+}
+
+// LoadFingerprintRules returns a Fingerprinter applying the rules of
+// the files at paths. The rules of a directory are read from its .json
+// files, in name order.
+func LoadFingerprintRules(paths ...string) (*Fingerprinter, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	var rules []FingerprintRule
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fileRules, err := ParseFingerprintRules(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the fingerprint rules %s: %w", file, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	return NewFingerprinter(rules)
+}
+
+// compileFingerprintRule validates rule and compiles its patterns.
+func compileFingerprintRule(rule FingerprintRule) (compiledRule, error) {
+	compiled := compiledRule{FingerprintRule: rule}
+	if rule.Name == "" {
+		return compiled, errors.New("missing name")
+	}
+	if rule.Class == "" && rule.OSFamily == "" {
+		return compiled, errors.New("a class or an OS family is required")
+	}
+	if rule.Confidence <= 0 || rule.Confidence > 1 {
+		return compiled, fmt.Errorf("confidence %v is not in (0, 1]", rule.Confidence)
+	}
+	match := rule.Match
+	if len(match.OUIs) == 0 && len(match.Vendors) == 0 && len(match.LLDPCapabilities) == 0 &&
+		len(match.OpenPorts) == 0 && len(match.Hostnames) == 0 && len(match.OS) == 0 {
+		return compiled, errors.New("no match conditions")
+	}
+
+	for _, oui := range match.OUIs {
+		prefix := normalizeMacHex(oui)
+		if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil || len(prefix) < 6 || len(prefix) > 12 {
+			return compiled, fmt.Errorf("invalid OUI %q", oui)
+		}
+		compiled.ouis = append(compiled.ouis, prefix)
+	}
+	var err error
+	if compiled.vendors, err = compilePatterns(match.Vendors); err != nil {
+		return compiled, err
+	}
+	if compiled.hostnames, err = compilePatterns(match.Hostnames); err != nil {
+		return compiled, err
+	}
+	if compiled.os, err = compilePatterns(match.OS); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Fingerprint classifies entry, returns nil if no rule matched it. The
+// confidences of the rules agreeing on a class or an OS family add up
+// as independent evidence, and the most likely class and OS family
+// win, the first one in the rules on a tie.
+func (fingerprinter *Fingerprinter) Fingerprint(entry *DeviceEntry) *Fingerprint {
+	facts := entry.fingerprintFacts()
+	var matched []compiledRule
+	for _, rule := range fingerprinter.rules {
+		if rule.matches(facts) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	fingerprint := &Fingerprint{Rules: make([]string, 0, len(matched))}
+	classDoubt := map[string]float64{}
+	osDoubt := map[string]float64{}
+	var classes, families []string
+	for _, rule := range matched {
+		fingerprint.Rules = append(fingerprint.Rules, rule.Name)
+		if rule.Class != "" {
+			if _, ok := classDoubt[rule.Class]; !ok {
+				classDoubt[rule.Class] = 1
+				classes = append(classes, rule.Class)
+			}
+			classDoubt[rule.Class] *= 1 - rule.Confidence
+		}
+		if rule.OSFamily != "" {
+			if _, ok := osDoubt[rule.OSFamily]; !ok {
+				osDoubt[rule.OSFamily] = 1
+				families = append(families, rule.OSFamily)
+			}
+			osDoubt[rule.OSFamily] *= 1 - rule.Confidence
+		}
+	}
+	for _, class := range classes {
+		if confidence := 1 - classDoubt[class]; confidence > fingerprint.Confidence {
+			fingerprint.Class, fingerprint.Confidence = class, confidence
+		}
+	}
+	for _, family := range families {
+		if confidence := 1 - osDoubt[family]; confidence > fingerprint.OSConfidence {
+			fingerprint.OSFamily, fingerprint.OSConfidence = family, confidence
+		}
+	}
+	return fingerprint
+}
+
+// matches returns true if every condition of the rule matches facts.
+func (rule *compiledRule) matches(facts deviceFacts) bool {
+	if len(rule.ouis) > 0 && !anyMacHasPrefix(facts.macs, rule.ouis) {
+		return false
+	}
+	if len(rule.vendors) > 0 && !anyMatches(rule.vendors, facts.vendors) {
+		return false
+	}
+	for _, capability := range rule.Match.LLDPCapabilities {
+		if !facts.capabilities[strings.ToLower(capability)] {
+			return false
+		}
+	}
+	for _, port := range rule.Match.OpenPorts {
+		if !facts.openPorts[port] {
+			return false
+		}
+	}
+	if len(rule.hostnames) > 0 && !anyMatches(rule.hostnames, facts.hostnames) {
+		return false
+	}
+	if len(rule.os) > 0 && !anyMatches(rule.os, facts.os) {
+		return false
+	}
+	return true
+}
+
+func anyMacHasPrefix(macs []string, prefixes []string) bool {
+	for _, mac := range macs {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(mac, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyMatches(patterns []*regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		for _, pattern := range patterns {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeMacHex returns the hex digits of a MAC address or prefix,
+// in upper case and without separators.
+func normalizeMacHex(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+}
+
+// fingerprintFacts collects what the collectors found about the
+// device.
+func (n *DeviceEntry) fingerprintFacts() deviceFacts {
+	facts := deviceFacts{capabilities: map[string]bool{}, openPorts: map[int32]bool{}}
+	addMac := func(mac string) {
+		if mac != "" {
+			facts.macs = append(facts.macs, normalizeMacHex(mac))
+		}
+	}
+	addValue := func(values *[]string, value string) {
+		if value != "" {
+			*values = append(*values, value)
+		}
+	}
+
+	addMac(n.MacAddress)
+	if db := ouiDatabase.Load(); db != nil {
+		addValue(&facts.vendors, db.Vendor(n.MacAddress))
+	}
+	for _, neigh := range n.Neigh {
+		addMac(neigh.GetMac())
+	}
+	for _, lldp := range n.Lldp {
+		addMac(lldp.GetMac())
+		addValue(&facts.vendors, lldp.GetInventoryVendor())
+		addValue(&facts.hostnames, lldp.GetSysName())
+		addValue(&facts.os, lldp.GetSysDesc())
+		for _, capability := range append(lldp.GetChassisCapabilities(), lldp.GetMedCapabilities()...) {
+			if capability.GetEnabled() {
+				facts.capabilities[strings.ToLower(capability.GetCapability())] = true
+			}
+		}
+	}
+	for _, nmap := range n.Nmap {
+		addMac(nmap.GetMac())
+		addValue(&facts.vendors, nmap.GetMacVendor())
+		addValue(&facts.hostnames, nmap.GetHostname())
+		addValue(&facts.os, nmap.GetOs())
+		for _, port := range nmap.GetOpenPorts() {
+			if port.GetState() == "" || port.GetState() == "open" {
+				facts.openPorts[port.GetPort()] = true
+			}
+		}
+	}
+	return facts
+}
+
+// Fingerprint returns the classification of the device, nil if the
+// list has no Fingerprinter or no rule matched the device.
+func (n *DeviceEntry) Fingerprint() *Fingerprint {
+	return n.fingerprint
+}
+
+// SetFingerprinter classifies every device of the list with
+// fingerprinter now and whenever they are added or updated. A nil
+// fingerprinter removes the classifications.
+func (list *DevicesList) SetFingerprinter(fingerprinter *Fingerprinter) {
+	list.Lock.Lock()
+	defer list.Lock.Unlock()
+	list.fingerprinter = fingerprinter
+	for _, entry := range list.Devices {
+		list.fingerprintUnsafe(entry)
+	}
+}
+
+// fingerprintUnsafe classifies entry without locking the list.
+func (list *DevicesList) fingerprintUnsafe(entry *DeviceEntry) {
+	if list.fingerprinter == nil {
+		entry.fingerprint = nil
+		return
+	}
+	entry.fingerprint = list.fingerprinter.Fingerprint(entry)
+}
+
+// WithDeviceClass returns a predicate accepting the devices classified
+// as one of classes.
+func WithDeviceClass(classes ...string) ListPredicate {
+	return func(entry *DeviceEntry) bool {
+		fingerprint := entry.Fingerprint()
+		if fingerprint == nil {
+			return false
+		}
+		for _, class := range classes {
+			if fingerprint.Class == class {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithOSFamily returns a predicate accepting the devices whose OS
+// family is one of families.
+func WithOSFamily(families ...string) ListPredicate {
+	return func(entry *DeviceEntry) bool {
+		fingerprint := entry.Fingerprint()
+		if fingerprint == nil {
+			return false
+		}
+		for _, family := range families {
+			if fingerprint.OSFamily == family {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithMinFingerprintConfidence returns a predicate accepting the
+// devices classified with at least confidence.
+func WithMinFingerprintConfidence(confidence float64) ListPredicate {
+	return func(entry *DeviceEntry) bool {
+		fingerprint := entry.Fingerprint()
+		return fingerprint != nil && fingerprint.Class != "" && fingerprint.Confidence >= confidence
+	}
+}
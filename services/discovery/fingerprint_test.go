@@ -0,0 +1,192 @@
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+)
+
+func fingerprintTestDevices() map[string]*DeviceEntry {
+	return map[string]*DeviceEntry{
+		"printer": {DiscoveryEntry: disco.DiscoveryEntry{
+			MacAddress: "00:1b:78:01:02:03",
+			Nmap: map[string]*disco.NMAP{"192.168.1.2": {Ip: "192.168.1.2", Os: "Linux 4.X",
+				OpenPorts: []*disco.NMAPPorts{
+					{Port: 631, Protocol: "tcp", State: "open"},
+					{Port: 9100, Protocol: "tcp", State: "open"},
+				}}},
+		}},
+		"phone": {DiscoveryEntry: disco.DiscoveryEntry{
+			MacAddress: "00:04:f2:01:02:03",
+			Lldp: map[string]*disco.LLDP{"192.168.1.3": {SysName: "SEP0004F2010203",
+				ChassisCapabilities: []*disco.LLDPCapabilities{
+					{Capability: "bridge", Enabled: false},
+					{Capability: "telephone", Enabled: true},
+				}}},
+		}},
+		"camera": {DiscoveryEntry: disco.DiscoveryEntry{
+			MacAddress: "ac:cc:8e:01:02:03",
+			Nmap: map[string]*disco.NMAP{"192.168.1.4": {Ip: "192.168.1.4", MacVendor: "Axis Communications AB",
+				OpenPorts: []*disco.NMAPPorts{{Port: 554, Protocol: "tcp", State: "filtered"}}}},
+		}},
+		"unknown": {DiscoveryEntry: disco.DiscoveryEntry{
+			MacAddress: "00:11:22:33:44:55",
+		}},
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprinter, err := LoadFingerprintRules("testdata/fingerprint_rules.json")
+	require.NoError(t, err)
+	devices := fingerprintTestDevices()
+
+	// the two printer rules add up, the OS is found separately.
+	fingerprint := fingerprinter.Fingerprint(devices["printer"])
+	require.NotNil(t, fingerprint)
+	assert.Equal(t, DeviceClassPrinter, fingerprint.Class)
+	assert.InDelta(t, 0.8, fingerprint.Confidence, 1e-9)
+	assert.Equal(t, "linux", fingerprint.OSFamily)
+	assert.InDelta(t, 0.7, fingerprint.OSConfidence, 1e-9)
+	assert.Equal(t, []string{"hp-printer-oui", "ipp-jetdirect", "linux-os"}, fingerprint.Rules)
+
+	// disabled capabilities do not match.
+	fingerprint = fingerprinter.Fingerprint(devices["phone"])
+	require.NotNil(t, fingerprint)
+	assert.Equal(t, DeviceClassPhone, fingerprint.Class)
+	assert.Equal(t, []string{"lldp-telephone"}, fingerprint.Rules)
+	assert.Empty(t, fingerprint.OSFamily)
+
+	// every condition of a rule must match, the port is not open.
+	assert.Nil(t, fingerprinter.Fingerprint(devices["camera"]))
+	devices["camera"].Nmap["192.168.1.4"].OpenPorts[0].State = "open"
+	fingerprint = fingerprinter.Fingerprint(devices["camera"])
+	require.NotNil(t, fingerprint)
+	assert.Equal(t, DeviceClassCamera, fingerprint.Class)
+
+	assert.Nil(t, fingerprinter.Fingerprint(devices["unknown"]))
+}
+
+func TestFingerprintConflictingRules(t *testing.T) {
+	fingerprinter, err := NewFingerprinter([]FingerprintRule{
+		{Name: "router", Class: DeviceClassRouter, Confidence: 0.5, Match: FingerprintMatch{LLDPCapabilities: []string{"router"}}},
+		{Name: "bridge", Class: DeviceClassSwitch, Confidence: 0.6, Match: FingerprintMatch{LLDPCapabilities: []string{"bridge"}}},
+		{Name: "router-name", Class: DeviceClassRouter, Confidence: 0.4, Match: FingerprintMatch{Hostnames: []string{"^rtr"}}},
+	})
+	require.NoError(t, err)
+
+	entry := &DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:11:22:33:44:55",
+		Lldp: map[string]*disco.LLDP{"192.168.1.1": {SysName: "rtr-core",
+			ChassisCapabilities: []*disco.LLDPCapabilities{
+				{Capability: "Router", Enabled: true},
+				{Capability: "Bridge", Enabled: true},
+			}}},
+	}}
+	fingerprint := fingerprinter.Fingerprint(entry)
+	require.NotNil(t, fingerprint)
+	assert.Equal(t, DeviceClassRouter, fingerprint.Class)
+	assert.InDelta(t, 0.7, fingerprint.Confidence, 1e-9)
+}
+
+func TestFingerprintRuleErrors(t *testing.T) {
+	match := FingerprintMatch{OpenPorts: []int32{22}}
+	tests := []struct {
+		name string
+		rule FingerprintRule
+	}{
+		{"missing name", FingerprintRule{Class: DeviceClassServer, Confidence: 0.5, Match: match}},
+		{"missing class", FingerprintRule{Name: "r", Confidence: 0.5, Match: match}},
+		{"zero confidence", FingerprintRule{Name: "r", Class: DeviceClassServer, Match: match}},
+		{"high confidence", FingerprintRule{Name: "r", Class: DeviceClassServer, Confidence: 1.5, Match: match}},
+		{"no conditions", FingerprintRule{Name: "r", Class: DeviceClassServer, Confidence: 0.5}},
+		{"bad OUI", FingerprintRule{Name: "r", Class: DeviceClassServer, Confidence: 0.5,
+			Match: FingerprintMatch{OUIs: []string{"00:1G:78"}}}},
+		{"short OUI", FingerprintRule{Name: "r", Class: DeviceClassServer, Confidence: 0.5,
+			Match: FingerprintMatch{OUIs: []string{"00:1B"}}}},
+		{"bad pattern", FingerprintRule{Name: "r", Class: DeviceClassServer, Confidence: 0.5,
+			Match: FingerprintMatch{Hostnames: []string{"("}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewFingerprinter([]FingerprintRule{test.rule})
+			assert.Error(t, err)
+		})
+	}
+
+	rule := FingerprintRule{Name: "r", Class: DeviceClassServer, Confidence: 0.5, Match: match}
+	_, err := NewFingerprinter([]FingerprintRule{rule, rule})
+	assert.Error(t, err)
+}
+
+func TestLoadFingerprintRulesDirectory(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile("testdata/fingerprint_rules.json")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "10-base.json"), data, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20-extra.json"),
+		[]byte(`{"rules": [{"name": "tv", "class": "tv", "confidence": 0.5, "match": {"openPorts": [8009]}}]}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not rules"), 0600))
+
+	fingerprinter, err := LoadFingerprintRules(dir)
+	require.NoError(t, err)
+	assert.Len(t, fingerprinter.rules, 8)
+	assert.Equal(t, "tv", fingerprinter.rules[7].Name)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "30-broken.json"), []byte("{"), 0600))
+	_, err = LoadFingerprintRules(dir)
+	assert.Error(t, err)
+	_, err = LoadFingerprintRules(filepath.Join(dir, "missing.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDevicesListFingerprint(t *testing.T) {
+	fingerprinter, err := LoadFingerprintRules("testdata/fingerprint_rules.json")
+	require.NoError(t, err)
+
+	list := NewDevicesList()
+	for _, entry := range fingerprintTestDevices() {
+		list.PutDevice(entry)
+	}
+	assert.Nil(t, list.Devices["00:1b:78:01:02:03"].Fingerprint())
+
+	// existing devices are classified, then the devices put later.
+	list.SetFingerprinter(fingerprinter)
+	require.NotNil(t, list.Devices["00:1b:78:01:02:03"].Fingerprint())
+	assert.Nil(t, list.Devices["00:11:22:33:44:55"].Fingerprint())
+	list.MergeOrAddDeviceEntrySilent(&DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:11:22:33:44:55",
+		Nmap: map[string]*disco.NMAP{"192.168.1.5": {Ip: "192.168.1.5", Hostname: "srv-files",
+			OpenPorts: []*disco.NMAPPorts{{Port: 22, Protocol: "tcp", State: "open"}}}},
+	}}, func() {})
+	assert.Equal(t, DeviceClassServer, list.Devices["00:11:22:33:44:55"].Fingerprint().Class)
+
+	macsOf := func(preds ...ListPredicate) []string {
+		macs := []string{}
+		list.ApplyToDeviceList(func(entries []*DeviceEntry) (interface{}, error) {
+			for _, entry := range entries {
+				macs = append(macs, entry.MacAddress)
+			}
+			return nil, nil
+		}, preds...)
+		return macs
+	}
+	assert.ElementsMatch(t, []string{"00:1b:78:01:02:03", "00:04:f2:01:02:03"},
+		macsOf(WithDeviceClass(DeviceClassPrinter, DeviceClassPhone)))
+	assert.Equal(t, []string{"00:1b:78:01:02:03"}, macsOf(WithOSFamily("linux")))
+	assert.ElementsMatch(t, []string{"00:1b:78:01:02:03", "00:04:f2:01:02:03"},
+		macsOf(WithMinFingerprintConfidence(0.75)))
+
+	output, err := json.Marshal(list.Devices["00:04:f2:01:02:03"])
+	require.NoError(t, err)
+	decoded := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(output, &decoded))
+	assert.Equal(t, "phone", decoded["fingerprint"].(map[string]interface{})["class"])
+
+	list.SetFingerprinter(nil)
+	assert.Empty(t, macsOf(WithDeviceClass(DeviceClassPrinter)))
+}
@@ -13,12 +13,18 @@ const (
 
 // CallCollectors is a stub for the RPC call
 func CallCollectors(args CallCollectorsRequest) (*CallCollectorsResponse, error) {
+	return CallCollectorsAt(address, args)
+}
+
+// CallCollectorsAt calls the collectors of the discovery service
+// listening on rpcAddress.
+func CallCollectorsAt(rpcAddress string, args CallCollectorsRequest) (*CallCollectorsResponse, error) {
 	logger.Debug("CallCollectors called\n")
 	if len(args.Collectors) == 0 {
 		logger.Warn("CallCollectors called but no collector specified!\n")
 	}
 
-	client, err := rpc.DialHTTP(network, address)
+	client, err := rpc.DialHTTP(network, rpcAddress)
 	if err != nil {
 		logger.Err("Failed to connect to discovery service: %s\n", err.Error())
 		return nil, err
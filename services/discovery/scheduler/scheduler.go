@@ -0,0 +1,388 @@
+// Package scheduler runs the discovery collectors on the intervals
+// configured in the discovery settings.
+package scheduler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/golang-shared/services/discovery"
+	logService "github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+	"github.com/untangle/golang-shared/services/settings/discovery_settings"
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+)
+
+var logger = logService.GetLoggerInstance()
+
+const pluginName = "discoveryscheduler"
+
+// DefaultMaxJitter bounds the random delay added to every run, see
+// WithMaxJitter.
+const DefaultMaxJitter = 5 * time.Minute
+
+// jitterFraction is the largest part of the interval added as jitter.
+const jitterFraction = 0.1
+
+// SettingsPath is the path of the discovery settings in the settings
+// file.
+var SettingsPath = []string{"discovery"}
+
+// Collectors are the collectors run by the scheduler.
+var Collectors = []discovery.CollectorName{discovery.Lldp, discovery.Neighbour, discovery.Nmap}
+
+// Clock is the time source of the Scheduler.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call of Clock.AfterFunc.
+type Timer interface {
+	Stop() bool
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// CollectorCaller triggers collectors, as discovery.CallCollectors
+// does.
+type CollectorCaller func(discovery.CallCollectorsRequest) (*discovery.CallCollectorsResponse, error)
+
+// RunStatus is the outcome of the last run of a collector.
+type RunStatus string
+
+const (
+	// StatusNever is the status of a collector that has not run yet.
+	StatusNever RunStatus = "never"
+	// StatusOK is the status of a collector whose last run succeeded.
+	StatusOK RunStatus = "ok"
+	// StatusFailed is the status of a collector whose last run failed.
+	StatusFailed RunStatus = "failed"
+)
+
+// CollectorStatus is the schedule and the last run of a collector.
+type CollectorStatus struct {
+	Collector discovery.CollectorName
+	Enabled   bool
+	Interval  time.Duration
+	// NextRun is zero when the collector is disabled.
+	NextRun time.Time
+
+	LastRun      time.Time
+	LastDuration time.Duration
+	Status       RunStatus
+	Error        string
+	// Running is set while a run is in progress.
+	Running bool
+	// Skipped counts the runs skipped because the previous run was
+	// still in progress.
+	Skipped int
+}
+
+// collector is the scheduling state of one collector.
+type collector struct {
+	status CollectorStatus
+	timer  Timer
+	// generation is incremented every time the collector is
+	// rescheduled, so that stale timers do nothing.
+	generation uint64
+	started    time.Time
+}
+
+// Scheduler runs every enabled collector on its AutoInterval. The
+// first run of a collector happens after a short random delay, and
+// every run is delayed by a random jitter so that collectors sharing
+// an interval do not run together. A run that is due while the
+// previous run of the same collector is in progress is skipped.
+type Scheduler struct {
+	mutex      sync.Mutex
+	collectors map[discovery.CollectorName]*collector
+	stopped    bool
+	runs       sync.WaitGroup
+
+	clock     Clock
+	call      CollectorCaller
+	maxJitter time.Duration
+	random    func() float64
+
+	stopWatch func()
+}
+
+// SchedulerOption is an option for NewScheduler.
+type SchedulerOption func(*Scheduler)
+
+// WithClock makes the scheduler use clock instead of the time
+// package.
+func WithClock(clock Clock) SchedulerOption {
+	return func(scheduler *Scheduler) {
+		scheduler.clock = clock
+	}
+}
+
+// WithCollectorCaller triggers the collectors with call instead of
+// discovery.CallCollectors.
+func WithCollectorCaller(call CollectorCaller) SchedulerOption {
+	return func(scheduler *Scheduler) {
+		scheduler.call = call
+	}
+}
+
+// WithRPCAddress triggers the collectors of the discovery service
+// listening on address.
+func WithRPCAddress(address string) SchedulerOption {
+	return func(scheduler *Scheduler) {
+		scheduler.call = func(request discovery.CallCollectorsRequest) (*discovery.CallCollectorsResponse, error) {
+			return discovery.CallCollectorsAt(address, request)
+		}
+	}
+}
+
+// WithMaxJitter bounds the random delay added to every run, which is
+// otherwise up to a tenth of the interval and at most
+// DefaultMaxJitter. Zero disables the jitter.
+func WithMaxJitter(maxJitter time.Duration) SchedulerOption {
+	return func(scheduler *Scheduler) {
+		scheduler.maxJitter = maxJitter
+	}
+}
+
+// NewScheduler returns a Scheduler with every collector disabled, see
+// Configure and Watch.
+func NewScheduler(opts ...SchedulerOption) *Scheduler {
+	scheduler := &Scheduler{
+		collectors: map[discovery.CollectorName]*collector{},
+		clock:      realClock{},
+		call:       discovery.CallCollectors,
+		maxJitter:  DefaultMaxJitter,
+		random:     rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(scheduler)
+	}
+	for _, name := range Collectors {
+		scheduler.collectors[name] = &collector{
+			status: CollectorStatus{Collector: name, Status: StatusNever},
+		}
+	}
+	return scheduler
+}
+
+// Name returns the name of the service.
+func (scheduler *Scheduler) Name() string {
+	return pluginName
+}
+
+// Startup starts the service, collectors run once configured.
+func (scheduler *Scheduler) Startup() error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.stopped = false
+	return nil
+}
+
+// Shutdown stops watching the settings and cancels every scheduled
+// run, then waits for the runs in progress.
+func (scheduler *Scheduler) Shutdown() error {
+	scheduler.mutex.Lock()
+	stopWatch := scheduler.stopWatch
+	scheduler.stopWatch = nil
+	scheduler.stopped = true
+	for _, c := range scheduler.collectors {
+		scheduler.disable(c)
+	}
+	scheduler.mutex.Unlock()
+
+	if stopWatch != nil {
+		stopWatch()
+	}
+	scheduler.runs.Wait()
+	return nil
+}
+
+// Watch configures the scheduler with the discovery settings of file
+// now and after every change of them.
+func (scheduler *Scheduler) Watch(file *settings.SettingsFile) {
+	configure := func() {
+		discoverySettings := discovery_settings.DiscoverySettingsObject{}
+		if err := file.UnmarshalSettingsAtPath(&discoverySettings, SettingsPath...); err != nil {
+			logger.Warn("Unable to read the discovery settings, collectors are not rescheduled: %s\n", err.Error())
+			return
+		}
+		scheduler.Configure(discoverySettings)
+	}
+	stopWatch := file.Watch(SettingsPath, func(_, _ any) {
+		configure()
+	})
+
+	scheduler.mutex.Lock()
+	previous := scheduler.stopWatch
+	scheduler.stopWatch = stopWatch
+	scheduler.mutex.Unlock()
+	if previous != nil {
+		previous()
+	}
+	configure()
+}
+
+// Configure schedules the collectors enabled in discoverySettings and
+// disables the others. Collectors whose settings did not change keep
+// their schedule, the others are rescheduled from their last run.
+func (scheduler *Scheduler) Configure(discoverySettings discovery_settings.DiscoverySettingsObject) {
+	collectorSettings := discoverySettings.CollectorSettings()
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.stopped {
+		return
+	}
+	for _, name := range Collectors {
+		c := scheduler.collectors[name]
+		collectorConfig, ok := collectorSettings[name]
+		if !discoverySettings.Enabled || !ok || !collectorConfig.Enabled {
+			if c.status.Enabled {
+				logger.Info("Discovery collector %s is disabled\n", name)
+			}
+			scheduler.disable(c)
+			continue
+		}
+
+		interval := time.Duration(collectorConfig.AutoInterval) * time.Minute
+		if c.status.Enabled && c.status.Interval == interval {
+			continue
+		}
+		c.status.Enabled = true
+		c.status.Interval = interval
+		next := scheduler.clock.Now().Add(scheduler.jitter(interval))
+		if !c.status.LastRun.IsZero() {
+			if fromLastRun := c.status.LastRun.Add(interval); fromLastRun.After(next) {
+				next = fromLastRun.Add(scheduler.jitter(interval))
+			}
+		}
+		logger.Info("Discovery collector %s runs every %v, next at %v\n", name, interval, next)
+		scheduler.arm(c, next)
+	}
+}
+
+// Status returns the status of every collector, sorted by name.
+func (scheduler *Scheduler) Status() []CollectorStatus {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	statuses := make([]CollectorStatus, 0, len(scheduler.collectors))
+	for _, c := range scheduler.collectors {
+		statuses = append(statuses, c.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Collector < statuses[j].Collector
+	})
+	return statuses
+}
+
+// CollectorStatus returns the status of the collector name.
+func (scheduler *Scheduler) CollectorStatus(name discovery.CollectorName) (CollectorStatus, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	c, ok := scheduler.collectors[name]
+	if !ok {
+		return CollectorStatus{}, false
+	}
+	return c.status, true
+}
+
+// jitter returns a random delay of up to a tenth of interval, bounded
+// by maxJitter.
+func (scheduler *Scheduler) jitter(interval time.Duration) time.Duration {
+	maxJitter := time.Duration(float64(interval) * jitterFraction)
+	if maxJitter > scheduler.maxJitter {
+		maxJitter = scheduler.maxJitter
+	}
+	return time.Duration(scheduler.random() * float64(maxJitter))
+}
+
+// disable cancels the next run of c, a run in progress completes. The
+// scheduler mutex must be held.
+func (scheduler *Scheduler) disable(c *collector) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.generation++
+	c.status.Enabled = false
+	c.status.Interval = 0
+	c.status.NextRun = time.Time{}
+}
+
+// arm schedules the next run of c at next, replacing the pending one.
+// The scheduler mutex must be held.
+func (scheduler *Scheduler) arm(c *collector, next time.Time) {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.generation++
+	generation := c.generation
+	name := c.status.Collector
+	c.status.NextRun = next
+	c.timer = scheduler.clock.AfterFunc(next.Sub(scheduler.clock.Now()), func() {
+		scheduler.run(name, generation)
+	})
+}
+
+// run starts a run of the collector name if its schedule is still the
+// one of generation, and schedules the next one.
+func (scheduler *Scheduler) run(name discovery.CollectorName, generation uint64) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	c := scheduler.collectors[name]
+	if scheduler.stopped || c.generation != generation {
+		return
+	}
+
+	now := scheduler.clock.Now()
+	scheduler.arm(c, now.Add(c.status.Interval+scheduler.jitter(c.status.Interval)))
+	if c.status.Running {
+		c.status.Skipped++
+		logger.Warn("Discovery collector %s is still running since %v, skipping this run\n", name, c.started)
+		return
+	}
+	c.status.Running = true
+	c.started = now
+	scheduler.runs.Add(1)
+	go scheduler.collect(c, now)
+}
+
+// collect calls the collector of c and records the outcome of the run
+// started at started.
+func (scheduler *Scheduler) collect(c *collector, started time.Time) {
+	defer scheduler.runs.Done()
+	name := c.status.Collector
+	logger.Debug("Running discovery collector %s\n", name)
+	response, err := scheduler.call(discovery.CallCollectorsRequest{Collectors: []discovery.CollectorName{name}})
+	if err == nil && response.Result != int32(disco.ResponseCode_OK) {
+		err = fmt.Errorf("discovery returned %v", disco.ResponseCode(response.Result))
+	}
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	c.status.Running = false
+	c.status.LastRun = started
+	c.status.LastDuration = scheduler.clock.Now().Sub(started)
+	if err != nil {
+		logger.Warn("Discovery collector %s failed: %s\n", name, err.Error())
+		c.status.Status = StatusFailed
+		c.status.Error = err.Error()
+		return
+	}
+	c.status.Status = StatusOK
+	c.status.Error = ""
+}
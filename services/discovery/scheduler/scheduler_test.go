@@ -0,0 +1,295 @@
+package scheduler
+
+import (
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/discovery"
+	"github.com/untangle/golang-shared/services/settings"
+	"github.com/untangle/golang-shared/services/settings/discovery_settings"
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+)
+
+// fakeClock only moves when advanced, firing the timers that are due.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	timer := &fakeTimer{clock: clock, at: clock.now.Add(d), f: f}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+	pending := !timer.stopped
+	timer.stopped = true
+	return pending
+}
+
+// Advance moves the clock by d, firing the due timers in order.
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	target := clock.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, timer := range clock.timers {
+			if !timer.stopped && !timer.at.After(target) && (next == nil || timer.at.Before(next.at)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.stopped = true
+		clock.now = next.at
+		clock.mutex.Unlock()
+		next.f()
+		clock.mutex.Lock()
+	}
+	clock.now = target
+	clock.mutex.Unlock()
+}
+
+// fakeDiscovery is a fake DiscoveryRPCService, served over HTTP as
+// the discovery service does.
+type fakeDiscovery struct {
+	mutex  sync.Mutex
+	calls  []string
+	result disco.ResponseCode
+	// release, when set, holds every call until it is closed.
+	release chan struct{}
+}
+
+func (service *fakeDiscovery) CallDiscovery(request *disco.CallDiscoveryRequest, response *disco.CallDiscoveryResponse) error {
+	service.mutex.Lock()
+	service.calls = append(service.calls, strings.Join(request.Collectors, ","))
+	release := service.release
+	response.Result = service.result
+	service.mutex.Unlock()
+	if release != nil {
+		<-release
+	}
+	return nil
+}
+
+func (service *fakeDiscovery) Calls() []string {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	return append([]string{}, service.calls...)
+}
+
+// startFakeDiscovery serves service and returns a scheduler calling
+// it, whose jitter is half of the maximum.
+func startFakeDiscovery(t *testing.T, service *fakeDiscovery) (*Scheduler, *fakeClock) {
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("DiscoveryRPCService", service))
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	clock := newFakeClock()
+	scheduler := NewScheduler(WithClock(clock), WithRPCAddress(httpServer.Listener.Addr().String()))
+	scheduler.random = func() float64 { return 0.5 }
+	t.Cleanup(func() { _ = scheduler.Shutdown() })
+	return scheduler, clock
+}
+
+func discoverySettings(enabled bool, plugins ...interface{}) discovery_settings.DiscoverySettingsObject {
+	return discovery_settings.DiscoverySettingsObject{
+		DiscoveryPluginSettings: discovery_settings.DiscoveryPluginSettings{Enabled: enabled},
+		Plugins:                 plugins,
+	}
+}
+
+func collectorSettings(name discovery.CollectorName, enabled bool, minutes uint) interface{} {
+	return map[string]interface{}{"type": name, "enabled": enabled, "autoInterval": minutes}
+}
+
+// waitIdle waits for the runs in progress to complete.
+func waitIdle(t *testing.T, scheduler *Scheduler) {
+	require.Eventually(t, func() bool {
+		for _, status := range scheduler.Status() {
+			if status.Running {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestSchedulerRunsEnabledCollectors(t *testing.T) {
+	service := &fakeDiscovery{result: disco.ResponseCode_OK}
+	scheduler, clock := startFakeDiscovery(t, service)
+	start := clock.Now()
+	scheduler.Configure(discoverySettings(true,
+		collectorSettings(discovery.Lldp, true, 60),
+		collectorSettings(discovery.Neighbour, true, 600),
+		collectorSettings(discovery.Nmap, false, 60),
+	))
+
+	// the first runs are only delayed by the jitter, a tenth of the
+	// interval up to five minutes.
+	lldp, _ := scheduler.CollectorStatus(discovery.Lldp)
+	assert.Equal(t, start.Add(150*time.Second), lldp.NextRun)
+	assert.Equal(t, time.Hour, lldp.Interval)
+	clock.Advance(150 * time.Second)
+	waitIdle(t, scheduler)
+	assert.ElementsMatch(t, []string{"lldp", "neighbour"}, service.Calls())
+
+	statuses := scheduler.Status()
+	require.Len(t, statuses, 3)
+	assert.Equal(t, CollectorStatus{
+		Collector: discovery.Lldp,
+		Enabled:   true,
+		Interval:  time.Hour,
+		NextRun:   start.Add(65 * time.Minute),
+		LastRun:   start.Add(150 * time.Second),
+		Status:    StatusOK,
+	}, statuses[0])
+	assert.Equal(t, discovery.Neighbour, statuses[1].Collector)
+	assert.Equal(t, StatusOK, statuses[1].Status)
+	assert.Equal(t, CollectorStatus{Collector: discovery.Nmap, Status: StatusNever}, statuses[2])
+
+	clock.Advance(time.Hour + 150*time.Second)
+	waitIdle(t, scheduler)
+	assert.Len(t, service.Calls(), 3)
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.Equal(t, start.Add(65*time.Minute), lldp.LastRun)
+}
+
+func TestSchedulerSkipsOverlappingRuns(t *testing.T) {
+	service := &fakeDiscovery{result: disco.ResponseCode_OK, release: make(chan struct{})}
+	scheduler, clock := startFakeDiscovery(t, service)
+	start := clock.Now()
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 60)))
+
+	clock.Advance(3 * time.Minute)
+	require.Eventually(t, func() bool { return len(service.Calls()) == 1 }, 5*time.Second, time.Millisecond)
+	lldp, _ := scheduler.CollectorStatus(discovery.Lldp)
+	assert.True(t, lldp.Running)
+	assert.Equal(t, StatusNever, lldp.Status)
+
+	clock.Advance(63 * time.Minute)
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.Equal(t, 1, lldp.Skipped)
+	assert.Equal(t, start.Add(127*time.Minute+30*time.Second), lldp.NextRun)
+
+	clock.Advance(time.Minute)
+	close(service.release)
+	waitIdle(t, scheduler)
+	assert.Len(t, service.Calls(), 1)
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.Equal(t, StatusOK, lldp.Status)
+	assert.Equal(t, start.Add(150*time.Second), lldp.LastRun)
+	assert.Equal(t, 64*time.Minute+30*time.Second, lldp.LastDuration)
+}
+
+func TestSchedulerFailures(t *testing.T) {
+	service := &fakeDiscovery{result: disco.ResponseCode_ERROR}
+	scheduler, clock := startFakeDiscovery(t, service)
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Nmap, true, 60)))
+	clock.Advance(5 * time.Minute)
+	waitIdle(t, scheduler)
+	nmap, _ := scheduler.CollectorStatus(discovery.Nmap)
+	assert.Equal(t, StatusFailed, nmap.Status)
+	assert.Equal(t, "discovery returned ERROR", nmap.Error)
+
+	// the discovery service is not running.
+	unreachable := NewScheduler(WithClock(clock), WithRPCAddress("127.0.0.1:1"), WithMaxJitter(0))
+	defer func() { _ = unreachable.Shutdown() }()
+	unreachable.Configure(discoverySettings(true, collectorSettings(discovery.Nmap, true, 60)))
+	clock.Advance(time.Second)
+	waitIdle(t, unreachable)
+	nmap, _ = unreachable.CollectorStatus(discovery.Nmap)
+	assert.Equal(t, StatusFailed, nmap.Status)
+	assert.NotEmpty(t, nmap.Error)
+}
+
+func TestSchedulerReconfigure(t *testing.T) {
+	service := &fakeDiscovery{result: disco.ResponseCode_OK}
+	scheduler, clock := startFakeDiscovery(t, service)
+	start := clock.Now()
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 60)))
+	clock.Advance(3 * time.Minute)
+	waitIdle(t, scheduler)
+
+	// unchanged settings keep the schedule.
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 60)))
+	lldp, _ := scheduler.CollectorStatus(discovery.Lldp)
+	assert.Equal(t, start.Add(65*time.Minute), lldp.NextRun)
+
+	// a new interval applies from the last run.
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 120)))
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.Equal(t, start.Add(125*time.Minute), lldp.NextRun)
+	clock.Advance(time.Hour)
+	assert.Len(t, service.Calls(), 1)
+
+	// invalid settings and disabling discovery stop the collector.
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 1)))
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.False(t, lldp.Enabled)
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 120)))
+	scheduler.Configure(discoverySettings(false, collectorSettings(discovery.Lldp, true, 120)))
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.False(t, lldp.Enabled)
+	assert.True(t, lldp.NextRun.IsZero())
+	clock.Advance(24 * time.Hour)
+	assert.Len(t, service.Calls(), 1)
+	assert.Equal(t, StatusOK, lldp.Status)
+
+	// shut down schedulers ignore new settings.
+	require.NoError(t, scheduler.Shutdown())
+	scheduler.Configure(discoverySettings(true, collectorSettings(discovery.Lldp, true, 60)))
+	lldp, _ = scheduler.CollectorStatus(discovery.Lldp)
+	assert.False(t, lldp.Enabled)
+}
+
+func TestSchedulerWatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "settings.json")
+	require.NoError(t, os.WriteFile(filename,
+		[]byte(`{"discovery": {"enabled": true, "plugins": [{"type": "lldp", "enabled": true, "autoInterval": 60}]}}`), 0600))
+	file := settings.NewSettingsFile(filename)
+
+	scheduler, _ := startFakeDiscovery(t, &fakeDiscovery{result: disco.ResponseCode_OK})
+	scheduler.Watch(file)
+	lldp, _ := scheduler.CollectorStatus(discovery.Lldp)
+	assert.True(t, lldp.Enabled)
+
+	require.NoError(t, file.SetSettingsNoSync([]string{"discovery", "enabled"}, false))
+	require.Eventually(t, func() bool {
+		lldp, _ := scheduler.CollectorStatus(discovery.Lldp)
+		return !lldp.Enabled
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,269 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+	"google.golang.org/protobuf/proto"
+)
+
+// DevicesSnapshotVersion is the version of the DevicesSnapshot
+// written by Snapshot. Snapshots of other versions are not restored.
+const DevicesSnapshotVersion uint32 = 1
+
+// default interval between two snapshots taken by a Snapshotter.
+const defaultSnapshotInterval = 15 * time.Minute
+
+// default age after which the entries of a snapshot are not restored,
+// the same as the tracked data use.
+const defaultSnapshotMaxAge = defaultTrackDuration
+
+const snapshotterName = "discoverysnapshot"
+
+// ErrUnsupportedSnapshotVersion is returned when restoring a snapshot
+// of another version than DevicesSnapshotVersion.
+var ErrUnsupportedSnapshotVersion = errors.New("unsupported devices snapshot version")
+
+// Snapshot returns a snapshot of the devices and their data use.
+func (list *DevicesList) Snapshot() *disco.DevicesSnapshot {
+	list.Lock.RLock()
+	defer list.Lock.RUnlock()
+
+	snapshot := &disco.DevicesSnapshot{
+		Version:   DevicesSnapshotVersion,
+		CreatedAt: time.Now().UnixNano(),
+		Devices:   make([]*disco.DeviceSnapshot, 0, len(list.Devices)),
+	}
+	for _, entry := range list.Devices {
+		device := &disco.DeviceSnapshot{
+			Entry: proto.Clone(&entry.DiscoveryEntry).(*disco.DiscoveryEntry),
+		}
+		if entry.dataTracker != nil {
+			for _, interval := range entry.dataTracker.dataUseIntervals {
+				device.DataUse = append(device.DataUse, &disco.DataUseInterval{
+					Start:   snapshotTime(interval.Start),
+					End:     snapshotTime(interval.End),
+					RxBytes: uint64(interval.RxBytes),
+					TxBytes: uint64(interval.TxBytes),
+				})
+			}
+		}
+		snapshot.Devices = append(snapshot.Devices, device)
+	}
+	return snapshot
+}
+
+// RestoreSnapshot merges the devices of snapshot into the list and
+// indexes them by IP. Devices whose LastUpdate is older than maxAge
+// are dropped, a maxAge of 0 keeps them all. Returns the number of
+// devices restored.
+func (list *DevicesList) RestoreSnapshot(snapshot *disco.DevicesSnapshot, maxAge time.Duration) (int, error) {
+	if snapshot.GetVersion() != DevicesSnapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedSnapshotVersion, snapshot.GetVersion())
+	}
+
+	restored := 0
+	for _, device := range snapshot.GetDevices() {
+		if device.GetEntry() == nil {
+			continue
+		}
+		if maxAge > 0 && time.Since(time.Unix(device.GetEntry().GetLastUpdate(), 0)) > maxAge {
+			continue
+		}
+
+		entry := &DeviceEntry{}
+		proto.Merge(&entry.DiscoveryEntry, device.GetEntry())
+		if len(device.GetDataUse()) > 0 {
+			intervals := make([]DataUse, 0, len(device.GetDataUse()))
+			for _, interval := range device.GetDataUse() {
+				intervals = append(intervals, DataUse{
+					Start:   restoredTime(interval.GetStart()),
+					End:     restoredTime(interval.GetEnd()),
+					RxBytes: uint(interval.GetRxBytes()),
+					TxBytes: uint(interval.GetTxBytes()),
+				})
+			}
+			entry.dataTracker = newDataTrackerWithIntervals(intervals, defaultBinInterval, defaultTrackDuration)
+		}
+
+		if processed, _ := list.mergeOrAdd(entry, func() {}); processed != nil {
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// SaveSnapshot writes a snapshot of the list to filename.
+func (list *DevicesList) SaveSnapshot(filename string) error {
+	data, err := proto.Marshal(list.Snapshot())
+	if err != nil {
+		return err
+	}
+	return writeSnapshotFile(filename, data)
+}
+
+// LoadSnapshot restores the snapshot written to filename by
+// SaveSnapshot, see RestoreSnapshot.
+func (list *DevicesList) LoadSnapshot(filename string, maxAge time.Duration) (int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	snapshot := &disco.DevicesSnapshot{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		return 0, fmt.Errorf("unable to read the devices snapshot %s: %w", filename, err)
+	}
+	return list.RestoreSnapshot(snapshot, maxAge)
+}
+
+// snapshotTime returns t in unix nanoseconds, 0 for the zero time.
+func snapshotTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// restoredTime is the reverse of snapshotTime.
+func restoredTime(nanoseconds int64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+// writeSnapshotFile replaces filename with data through a temporary
+// file, so a crash never leaves a partial snapshot.
+func writeSnapshotFile(filename string, data []byte) error {
+	tmpfile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	if _, err := tmpfile.Write(data); err != nil {
+		return err
+	}
+	if err := tmpfile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile.Name(), filename)
+}
+
+// Snapshotter restores a DevicesList from its snapshot file at
+// Startup, then saves it periodically and at Shutdown.
+type Snapshotter struct {
+	list     *DevicesList
+	filename string
+	interval time.Duration
+	maxAge   time.Duration
+
+	mutex sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// SnapshotterOption is an option for NewSnapshotter.
+type SnapshotterOption func(*Snapshotter)
+
+// WithSnapshotInterval sets how often the list is saved, every 15
+// minutes by default.
+func WithSnapshotInterval(interval time.Duration) SnapshotterOption {
+	return func(snapshotter *Snapshotter) {
+		snapshotter.interval = interval
+	}
+}
+
+// WithMaxSnapshotAge drops the devices not updated within maxAge when
+// restoring, 24 hours by default. Zero restores every device.
+func WithMaxSnapshotAge(maxAge time.Duration) SnapshotterOption {
+	return func(snapshotter *Snapshotter) {
+		snapshotter.maxAge = maxAge
+	}
+}
+
+// NewSnapshotter returns a Snapshotter of list to filename.
+func NewSnapshotter(list *DevicesList, filename string, opts ...SnapshotterOption) *Snapshotter {
+	snapshotter := &Snapshotter{
+		list:     list,
+		filename: filename,
+		interval: defaultSnapshotInterval,
+		maxAge:   defaultSnapshotMaxAge,
+	}
+	for _, opt := range opts {
+		opt(snapshotter)
+	}
+	return snapshotter
+}
+
+// Name returns the name of the service.
+func (snapshotter *Snapshotter) Name() string {
+	return snapshotterName
+}
+
+// Startup restores the list from the snapshot file, if there is a
+// valid one, and starts saving it periodically.
+func (snapshotter *Snapshotter) Startup() error {
+	restored, err := snapshotter.list.LoadSnapshot(snapshotter.filename, snapshotter.maxAge)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Info("No devices snapshot to restore at %s\n", snapshotter.filename)
+	case err != nil:
+		logger.Warn("Unable to restore the devices snapshot %s: %s\n", snapshotter.filename, err.Error())
+	default:
+		logger.Info("Restored %d devices from %s\n", restored, snapshotter.filename)
+	}
+
+	snapshotter.mutex.Lock()
+	defer snapshotter.mutex.Unlock()
+	if snapshotter.stop != nil {
+		return nil
+	}
+	snapshotter.stop = make(chan struct{})
+	snapshotter.done = make(chan struct{})
+	go snapshotter.run(snapshotter.stop, snapshotter.done)
+	return nil
+}
+
+// Shutdown stops the periodic saves and saves the list a last time.
+func (snapshotter *Snapshotter) Shutdown() error {
+	snapshotter.mutex.Lock()
+	stop, done := snapshotter.stop, snapshotter.done
+	snapshotter.stop, snapshotter.done = nil, nil
+	snapshotter.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return snapshotter.save()
+}
+
+// run saves the list every interval until stop is closed.
+func (snapshotter *Snapshotter) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(snapshotter.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := snapshotter.save(); err != nil {
+				logger.Warn("Unable to save the devices snapshot %s: %s\n", snapshotter.filename, err.Error())
+			}
+		}
+	}
+}
+
+func (snapshotter *Snapshotter) save() error {
+	return snapshotter.list.SaveSnapshot(snapshotter.filename)
+}
@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshotTestList returns a list with a recent device that used some
+// data and a device last updated two days ago.
+func snapshotTestList() *DevicesList {
+	list := NewDevicesList()
+	recent := &DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:11:22:33:44:55",
+		LastUpdate: time.Now().Unix(),
+		Neigh:      map[string]*disco.NEIGH{"192.168.1.2": {Ip: "192.168.1.2", State: "REACHABLE"}},
+		Nmap: map[string]*disco.NMAP{"192.168.1.2": {Hostname: "printer", Ip: "192.168.1.2",
+			OpenPorts: []*disco.NMAPPorts{{Port: 631, Protocol: "tcp", State: "open"}}}},
+	}}
+	recent.IncrData(DataUseAmount{Rx: 100, Tx: 50})
+	old := &DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:11:22:33:44:66",
+		LastUpdate: time.Now().Add(-48 * time.Hour).Unix(),
+		Neigh:      map[string]*disco.NEIGH{"192.168.1.3": {Ip: "192.168.1.3"}},
+	}}
+	list.PutDevice(recent)
+	list.PutDevice(old)
+	return list
+}
+
+func TestDevicesListSnapshot(t *testing.T) {
+	list := snapshotTestList()
+	filename := filepath.Join(t.TempDir(), "devices.snapshot")
+	require.NoError(t, list.SaveSnapshot(filename))
+
+	restored := NewDevicesList()
+	count, err := restored.LoadSnapshot(filename, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	require.Len(t, restored.Devices, 1)
+
+	entry := restored.GetDeviceEntryFromIP("192.168.1.2")
+	require.NotNil(t, entry)
+	assert.True(t, proto.Equal(&list.Devices["00:11:22:33:44:55"].DiscoveryEntry, entry))
+	assert.Nil(t, restored.GetDeviceEntryFromIP("192.168.1.3"))
+	assert.Equal(t, DataUseAmount{Rx: 100, Tx: 50}, restored.Devices["00:11:22:33:44:55"].GetDataUse())
+	assert.Equal(t,
+		list.Devices["00:11:22:33:44:55"].dataTracker.dataUseIntervals[0].Start.UnixNano(),
+		restored.Devices["00:11:22:33:44:55"].dataTracker.dataUseIntervals[0].Start.UnixNano())
+
+	// a zero maximum age keeps every device.
+	restored = NewDevicesList()
+	count, err = restored.LoadSnapshot(filename, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.NotNil(t, restored.GetDeviceEntryFromIP("192.168.1.3"))
+}
+
+func TestRestoreSnapshotErrors(t *testing.T) {
+	snapshot := snapshotTestList().Snapshot()
+	assert.Equal(t, DevicesSnapshotVersion, snapshot.Version)
+	assert.Len(t, snapshot.Devices, 2)
+
+	snapshot.Version = DevicesSnapshotVersion + 1
+	_, err := NewDevicesList().RestoreSnapshot(snapshot, 0)
+	assert.ErrorIs(t, err, ErrUnsupportedSnapshotVersion)
+
+	filename := filepath.Join(t.TempDir(), "devices.snapshot")
+	_, err = NewDevicesList().LoadSnapshot(filename, 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, os.WriteFile(filename, []byte("not a snapshot"), 0600))
+	_, err = NewDevicesList().LoadSnapshot(filename, 0)
+	assert.Error(t, err)
+}
+
+func TestSnapshotter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "devices.snapshot")
+
+	// nothing to restore at first, the list is saved periodically and
+	// at shutdown.
+	list := snapshotTestList()
+	snapshotter := NewSnapshotter(list, filename, WithSnapshotInterval(10*time.Millisecond), WithMaxSnapshotAge(0))
+	assert.Equal(t, "discoverysnapshot", snapshotter.Name())
+	require.NoError(t, snapshotter.Startup())
+	assert.Len(t, list.Devices, 2)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	list.PutDevice(&DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:11:22:33:44:77",
+		LastUpdate: time.Now().Unix(),
+		Neigh:      map[string]*disco.NEIGH{"192.168.1.4": {Ip: "192.168.1.4"}},
+	}})
+	require.NoError(t, snapshotter.Shutdown())
+
+	restored := NewDevicesList()
+	restoring := NewSnapshotter(restored, filename)
+	require.NoError(t, restoring.Startup())
+	defer func() { _ = restoring.Shutdown() }()
+	assert.Len(t, restored.Devices, 2)
+	assert.NotNil(t, restored.GetDeviceEntryFromIP("192.168.1.4"))
+}
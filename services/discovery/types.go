@@ -20,6 +20,7 @@ type DeviceEntry struct {
 	disco.DiscoveryEntry
 	sessions    []*ActiveSessions.Session
 	dataTracker *DataTracker
+	fingerprint *Fingerprint
 }
 
 // DevicesList is an in-memory 'list' of all known devices (stored as
@@ -33,6 +34,9 @@ type DevicesList struct {
 	// to 1.18+, swap these string type keys to net.HardwareAddr for Devices and net.IpAddr for devicesByIp
 	devicesByIP map[string]*DeviceEntry
 	Lock        sync.RWMutex
+
+	// fingerprinter classifies the devices put in the list, if set.
+	fingerprinter *Fingerprinter
 }
 
 // NewDevicesList returns a new DevicesList which is ready for use.
@@ -86,6 +90,7 @@ func TrimToDataUseSince(period time.Duration) ListElementTransformer {
 // putDeviceUnsafe puts the device in the list without locking it.
 func (list *DevicesList) putDeviceUnsafe(entry *DeviceEntry) {
 	list.Devices[entry.MacAddress] = entry
+	list.fingerprintUnsafe(entry)
 
 	for _, ip := range entry.GetDeviceIPs() {
 		list.putDevicesByIpUnsafe(ip, entry)
@@ -449,9 +454,13 @@ func (n *DeviceEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
 		*disco.DiscoveryEntry
 		SessionDetail SessionDetail `json:"sessionDetail"`
+		Vendor        string        `json:"vendor,omitempty"`
+		Fingerprint   *Fingerprint  `json:"fingerprint,omitempty"`
 	}{
 		DiscoveryEntry: &n.DiscoveryEntry,
 		SessionDetail:  n.calcSessionDetails(),
+		Vendor:         n.Vendor(),
+		Fingerprint:    n.fingerprint,
 	})
 }
 
@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"sort"
+	"sync/atomic"
+
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+	utilNet "github.com/untangle/golang-shared/util/net"
+)
+
+// ouiDatabase is the database used to compute the vendor of the
+// devices, nil until SetOUIDatabase is called.
+var ouiDatabase atomic.Pointer[utilNet.OUIDatabase]
+
+// SetOUIDatabase sets the database used by DeviceEntry.Vendor to find
+// the vendor of a MAC address. A nil db disables the lookups.
+func SetOUIDatabase(db *utilNet.OUIDatabase) {
+	ouiDatabase.Store(db)
+}
+
+// Vendor returns the vendor of the device: the organization its MAC
+// address is assigned to in the OUI database, else the vendor reported
+// by NMAP or LLDP. Returns an empty string if it is unknown, which is
+// always the case of randomized MAC addresses absent from the
+// collectors.
+func (n *DeviceEntry) Vendor() string {
+	if db := ouiDatabase.Load(); db != nil {
+		if vendor := db.Vendor(n.MacAddress); vendor != "" {
+			return vendor
+		}
+	}
+	if vendor := firstVendor(n.Nmap, func(nmap *disco.NMAP) string { return nmap.GetMacVendor() }); vendor != "" {
+		return vendor
+	}
+	return firstVendor(n.Lldp, func(lldp *disco.LLDP) string { return lldp.GetInventoryVendor() })
+}
+
+// firstVendor returns the first non empty vendor of the entries of a
+// collector, by IP address so the result is stable.
+func firstVendor[T any](entries map[string]T, vendorOf func(T) string) string {
+	ips := make([]string, 0, len(entries))
+	for ip := range entries {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		if vendor := vendorOf(entries[ip]); vendor != "" {
+			return vendor
+		}
+	}
+	return ""
+}
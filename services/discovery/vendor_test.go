@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	disco "github.com/untangle/golang-shared/structs/protocolbuffers/Discoverd"
+	utilNet "github.com/untangle/golang-shared/util/net"
+)
+
+func TestDeviceEntryVendor(t *testing.T) {
+	db, err := utilNet.LoadOUIDatabase("../../util/net/testdata/oui.csv")
+	require.NoError(t, err)
+
+	neighOnly := &DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:1b:63:84:45:e6",
+		Neigh:      map[string]*disco.NEIGH{"192.168.1.2": {Ip: "192.168.1.2"}},
+	}}
+	nmapOnly := &DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "de:a1:19:00:00:01",
+		Nmap:       map[string]*disco.NMAP{"192.168.1.3": {Ip: "192.168.1.3", MacVendor: "Nmap Vendor"}},
+		Lldp:       map[string]*disco.LLDP{"192.168.1.3": {InventoryVendor: "LLDP Vendor"}},
+	}}
+	lldpOnly := &DeviceEntry{DiscoveryEntry: disco.DiscoveryEntry{
+		MacAddress: "00:11:22:33:44:55",
+		Lldp:       map[string]*disco.LLDP{"192.168.1.4": {InventoryVendor: "LLDP Vendor"}},
+	}}
+
+	assert.Empty(t, neighOnly.Vendor())
+	SetOUIDatabase(db)
+	defer SetOUIDatabase(nil)
+	assert.Equal(t, "Apple, Inc.", neighOnly.Vendor())
+	assert.Equal(t, "Nmap Vendor", nmapOnly.Vendor())
+	assert.Equal(t, "LLDP Vendor", lldpOnly.Vendor())
+
+	output, err := json.Marshal(neighOnly)
+	require.NoError(t, err)
+	decoded := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(output, &decoded))
+	assert.Equal(t, "Apple, Inc.", decoded["vendor"])
+
+	// the vendor rules of the fingerprints match the computed vendor.
+	fingerprinter, err := NewFingerprinter([]FingerprintRule{{Name: "apple", OSFamily: "apple", Confidence: 0.5,
+		Match: FingerprintMatch{Vendors: []string{"^Apple"}}}})
+	require.NoError(t, err)
+	fingerprint := fingerprinter.Fingerprint(neighOnly)
+	require.NotNil(t, fingerprint)
+	assert.Equal(t, "apple", fingerprint.OSFamily)
+}
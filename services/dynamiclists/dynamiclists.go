@@ -0,0 +1,394 @@
+package dynamiclists
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/golang-shared/services/alerts"
+	logService "github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings/dynamic_lists"
+	protoAlerts "github.com/untangle/golang-shared/structs/protocolbuffers/Alerts"
+)
+
+var logger = logService.GetLoggerInstance()
+
+const pluginName = "dynamiclists"
+
+// maxListSize is the largest list body accepted, the fetch of a larger
+// one fails with ErrListTooLarge.
+const maxListSize = 32 << 20
+
+// requestTimeout bounds a single fetch of a list.
+const requestTimeout = time.Minute
+
+// ListSet is the parsed contents of a dynamic list.
+type ListSet struct {
+	ID   string
+	Name string
+	Type string
+
+	// Entries are the sorted, deduplicated valid entries: canonical
+	// IP addresses and CIDR networks, or lower case domain names.
+	Entries []string
+
+	// Invalid is how many entries of the source were not valid.
+	Invalid int
+
+	// FetchedAt is when the source was last fetched or found
+	// unmodified.
+	FetchedAt time.Time
+
+	// ETag and LastModified are the cache validators of the source.
+	ETag         string
+	LastModified string
+}
+
+// list is the state of a configured list.
+type list struct {
+	config   dynamic_lists.Config
+	interval time.Duration
+	parse    parser
+
+	set     ListSet
+	fetched bool
+	// failing is set after a failed fetch, until one succeeds, so
+	// each run of failures alerts once.
+	failing bool
+
+	stop chan struct{}
+}
+
+// Fetcher polls the enabled dynamic lists on their schedules and keeps
+// their parsed contents.
+type Fetcher struct {
+	mutex sync.Mutex
+	lists map[string]*list
+
+	client         *http.Client
+	insecureClient *http.Client
+	publisher      alerts.AlertPublisher
+	onUpdate       func(ListSet)
+}
+
+// FetcherOption is an option for NewFetcher.
+type FetcherOption func(*Fetcher)
+
+// WithAlertPublisher sends the DYNAMICLISTS alerts to publisher
+// instead of the alerts service.
+func WithAlertPublisher(publisher alerts.AlertPublisher) FetcherOption {
+	return func(fetcher *Fetcher) {
+		fetcher.publisher = publisher
+	}
+}
+
+// WithUpdateHandler calls handler with the new contents of a list
+// every time they change.
+func WithUpdateHandler(handler func(ListSet)) FetcherOption {
+	return func(fetcher *Fetcher) {
+		fetcher.onUpdate = handler
+	}
+}
+
+// NewFetcher returns a Fetcher with no lists, see Configure.
+func NewFetcher(opts ...FetcherOption) *Fetcher {
+	fetcher := &Fetcher{
+		lists:  map[string]*list{},
+		client: &http.Client{Timeout: requestTimeout},
+		insecureClient: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+	for _, opt := range opts {
+		opt(fetcher)
+	}
+	if fetcher.publisher == nil {
+		fetcher.publisher = alerts.Publisher(logger)
+	}
+	return fetcher
+}
+
+// Name returns the name of the service.
+func (fetcher *Fetcher) Name() string {
+	return pluginName
+}
+
+// Startup starts the service, lists are polled once configured.
+func (fetcher *Fetcher) Startup() error {
+	return nil
+}
+
+// Shutdown stops polling all lists.
+func (fetcher *Fetcher) Shutdown() error {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	for id, l := range fetcher.lists {
+		close(l.stop)
+		delete(fetcher.lists, id)
+	}
+	return nil
+}
+
+// PollingInterval returns how often the list of config is fetched.
+// PollingUnit is one of minutes, hours, days or weeks.
+func PollingInterval(config dynamic_lists.Config) (time.Duration, error) {
+	if config.PollingTime <= 0 {
+		return 0, fmt.Errorf("invalid polling time %d", config.PollingTime)
+	}
+	var unit time.Duration
+	switch strings.TrimSuffix(strings.ToLower(config.PollingUnit), "s") {
+	case "minute":
+		unit = time.Minute
+	case "hour":
+		unit = time.Hour
+	case "day":
+		unit = 24 * time.Hour
+	case "week":
+		unit = 7 * 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("unknown polling unit %q", config.PollingUnit)
+	}
+	return time.Duration(config.PollingTime) * unit, nil
+}
+
+// Configure sets the lists to poll. Enabled lists that are new or
+// whose configuration changed are fetched right away, lists that are
+// gone or disabled are dropped. It returns an error naming every list
+// that can't be polled, the other lists are still configured.
+func (fetcher *Fetcher) Configure(configs []dynamic_lists.Config) error {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+
+	wanted := map[string]dynamic_lists.Config{}
+	invalid := []string{}
+	for _, config := range configs {
+		if !config.Enabled {
+			continue
+		}
+		if config.ID == "" {
+			invalid = append(invalid, fmt.Sprintf("%s: missing id", config.Name))
+			continue
+		}
+		wanted[config.ID] = config
+	}
+
+	for id, l := range fetcher.lists {
+		if config, ok := wanted[id]; !ok || !reflect.DeepEqual(config, l.config) {
+			close(l.stop)
+			delete(fetcher.lists, id)
+		}
+	}
+	for id, config := range wanted {
+		if _, ok := fetcher.lists[id]; ok {
+			continue
+		}
+		interval, err := PollingInterval(config)
+		if err == nil && config.Type != ListTypeIP && config.Type != ListTypeDomain {
+			err = fmt.Errorf("unknown list type %q", config.Type)
+		}
+		var parse parser
+		if err == nil {
+			parse, err = newParser(config.Type, config.ParsingMethod)
+		}
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", id, err.Error()))
+			continue
+		}
+		l := &list{
+			config:   config,
+			interval: interval,
+			parse:    parse,
+			set:      ListSet{ID: config.ID, Name: config.Name, Type: config.Type},
+			stop:     make(chan struct{}),
+		}
+		fetcher.lists[id] = l
+		go fetcher.poll(l)
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+	sort.Strings(invalid)
+	return fmt.Errorf("dynamic lists: invalid lists: %s", strings.Join(invalid, "; "))
+}
+
+// poll fetches l now and then on its interval, until it is stopped.
+func (fetcher *Fetcher) poll(l *list) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := fetcher.refresh(l); err != nil {
+			logger.Warn("Unable to fetch dynamic list %s: %s\n", l.config.ID, err.Error())
+		}
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// List returns the contents of the list with the id, and false if it
+// isn't configured or was never fetched.
+func (fetcher *Fetcher) List(id string) (ListSet, bool) {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	l, ok := fetcher.lists[id]
+	if !ok || !l.fetched {
+		return ListSet{}, false
+	}
+	return l.set, true
+}
+
+// Lists returns the contents of every list that was fetched, sorted
+// by id.
+func (fetcher *Fetcher) Lists() []ListSet {
+	fetcher.mutex.Lock()
+	defer fetcher.mutex.Unlock()
+	sets := []ListSet{}
+	for _, l := range fetcher.lists {
+		if l.fetched {
+			sets = append(sets, l.set)
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].ID < sets[j].ID })
+	return sets
+}
+
+// Refresh fetches the list with the id now and returns its contents.
+func (fetcher *Fetcher) Refresh(id string) (ListSet, error) {
+	fetcher.mutex.Lock()
+	l, ok := fetcher.lists[id]
+	fetcher.mutex.Unlock()
+	if !ok {
+		return ListSet{}, fmt.Errorf("dynamic lists: no enabled list %s", id)
+	}
+	return fetcher.refresh(l)
+}
+
+// refresh fetches l and updates its contents, alerting on the first
+// of a run of failures.
+func (fetcher *Fetcher) refresh(l *list) (ListSet, error) {
+	fetcher.mutex.Lock()
+	previous := l.set
+	fetched := l.fetched
+	fetcher.mutex.Unlock()
+
+	set, err := fetcher.fetch(l, previous, fetched)
+
+	fetcher.mutex.Lock()
+	select {
+	case <-l.stop:
+		// the list was reconfigured or removed while fetching.
+		fetcher.mutex.Unlock()
+		return set, err
+	default:
+	}
+	if err != nil {
+		alert := !l.failing
+		l.failing = true
+		fetcher.mutex.Unlock()
+		if alert {
+			fetcher.alert(l.config, err)
+		}
+		return previous, err
+	}
+	if l.failing {
+		logger.Info("Dynamic list %s was fetched again\n", l.config.ID)
+	}
+	l.failing = false
+	changed := !fetched || !reflect.DeepEqual(set.Entries, previous.Entries)
+	l.set = set
+	l.fetched = true
+	fetcher.mutex.Unlock()
+
+	if changed {
+		logger.Info("Dynamic list %s has %d entries, %d invalid\n", set.ID, len(set.Entries), set.Invalid)
+		if fetcher.onUpdate != nil {
+			fetcher.onUpdate(set)
+		}
+	}
+	return set, nil
+}
+
+// fetch gets the source of l, with the cache validators of the
+// previous contents if there are any, and parses it.
+func (fetcher *Fetcher) fetch(l *list, previous ListSet, fetched bool) (ListSet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, l.config.Source, nil)
+	if err != nil {
+		return previous, err
+	}
+	if fetched {
+		if previous.ETag != "" {
+			request.Header.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			request.Header.Set("If-Modified-Since", previous.LastModified)
+		}
+	}
+
+	client := fetcher.client
+	if l.config.SkipCertCheck {
+		client = fetcher.insecureClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return previous, err
+	}
+	defer response.Body.Close()
+
+	set := previous
+	set.FetchedAt = time.Now()
+	switch {
+	case response.StatusCode == http.StatusNotModified && fetched:
+		return set, nil
+	case response.StatusCode != http.StatusOK:
+		return previous, fmt.Errorf("HTTP bad return code: %v", response.Status)
+	}
+
+	// a truncated body would still parse, with its last entry cut.
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxListSize+1))
+	if err != nil {
+		return previous, err
+	}
+	if len(body) > maxListSize {
+		return previous, fmt.Errorf("%w: over %d bytes", ErrListTooLarge, maxListSize)
+	}
+	set.Entries, set.Invalid, err = parseList(l.parse, l.config.Type, bytes.NewReader(body))
+	if err != nil {
+		return previous, err
+	}
+	set.ETag = response.Header.Get("ETag")
+	set.LastModified = response.Header.Get("Last-Modified")
+	return set, nil
+}
+
+// alert sends the DYNAMICLISTS alert of a failed fetch.
+func (fetcher *Fetcher) alert(config dynamic_lists.Config, err error) {
+	logger.Err("Unable to fetch dynamic list %s from %s: %s\n", config.ID, config.Source, err.Error())
+	fetcher.publisher.Send(&protoAlerts.Alert{
+		Type:     protoAlerts.AlertType_DYNAMICLISTS,
+		Severity: protoAlerts.AlertSeverity_ERROR,
+		Message:  "ALERT_DYNAMIC_LIST_FETCH_FAILED",
+		Params: map[string]string{
+			"id":     config.ID,
+			"name":   config.Name,
+			"source": config.Source,
+			"error":  err.Error(),
+		},
+	})
+}
@@ -0,0 +1,211 @@
+package dynamiclists
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/settings/dynamic_lists"
+	"github.com/untangle/golang-shared/testing/mocks"
+)
+
+// listServer serves a list body with an ETag, and records the
+// conditional headers of the requests.
+type listServer struct {
+	mutex        sync.Mutex
+	body         string
+	etag         string
+	status       int
+	requests     int
+	ifNoneMatch  []string
+	lastModified string
+}
+
+func (server *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.requests++
+	server.ifNoneMatch = append(server.ifNoneMatch, r.Header.Get("If-None-Match"))
+	if server.status != 0 {
+		w.WriteHeader(server.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == server.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", server.etag)
+	w.Header().Set("Last-Modified", server.lastModified)
+	_, _ = w.Write([]byte(server.body))
+}
+
+// set changes what the server serves.
+func (server *listServer) set(body string, etag string, status int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.body = body
+	server.etag = etag
+	server.status = status
+}
+
+func listConfig(id string, source string) dynamic_lists.Config {
+	return dynamic_lists.Config{
+		Name:        "list " + id,
+		ID:          id,
+		Type:        ListTypeIP,
+		Enabled:     true,
+		Source:      source,
+		PollingUnit: "Hours",
+		PollingTime: 1,
+	}
+}
+
+func TestPollingInterval(t *testing.T) {
+	config := listConfig("a", "")
+	for unit, expected := range map[string]time.Duration{
+		"minutes": time.Minute,
+		"Hour":    time.Hour,
+		"DAYS":    24 * time.Hour,
+		"weeks":   7 * 24 * time.Hour,
+	} {
+		config.PollingUnit = unit
+		config.PollingTime = 2
+		interval, err := PollingInterval(config)
+		require.NoError(t, err)
+		assert.Equal(t, 2*expected, interval)
+	}
+	config.PollingUnit = "fortnights"
+	_, err := PollingInterval(config)
+	assert.Error(t, err)
+	config.PollingUnit = "Hours"
+	config.PollingTime = 0
+	_, err = PollingInterval(config)
+	assert.Error(t, err)
+}
+
+func TestFetcher(t *testing.T) {
+	server := &listServer{body: "10.0.0.1\n10.0.0.0/8\n10.0.0.1\n", etag: `"v1"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	publisher := &mocks.MockAlertPublisher{}
+	updates := make(chan ListSet, 10)
+	fetcher := NewFetcher(WithAlertPublisher(publisher), WithUpdateHandler(func(set ListSet) { updates <- set }))
+	defer func() { _ = fetcher.Shutdown() }()
+
+	disabled := listConfig("disabled", httpServer.URL)
+	disabled.Enabled = false
+	require.NoError(t, fetcher.Configure([]dynamic_lists.Config{listConfig("blocked", httpServer.URL), disabled}))
+
+	// enabled lists are fetched right away.
+	var set ListSet
+	select {
+	case set = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the list was not fetched")
+	}
+	assert.Equal(t, "blocked", set.ID)
+	assert.Equal(t, []string{"10.0.0.0/8", "10.0.0.1"}, set.Entries)
+	assert.Equal(t, `"v1"`, set.ETag)
+	_, ok := fetcher.List("disabled")
+	assert.False(t, ok)
+
+	// unchanged lists are revalidated with their ETag.
+	set, err := fetcher.Refresh("blocked")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "10.0.0.1"}, set.Entries)
+	server.mutex.Lock()
+	assert.Equal(t, []string{"", `"v1"`}, server.ifNoneMatch)
+	server.mutex.Unlock()
+	assert.Len(t, updates, 0)
+
+	server.set("192.168.0.1\n", `"v2"`, 0)
+	set, err = fetcher.Refresh("blocked")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.0.1"}, set.Entries)
+	assert.Len(t, updates, 1)
+
+	// failures alert once and keep the last contents.
+	server.set("", "", http.StatusInternalServerError)
+	_, err = fetcher.Refresh("blocked")
+	require.Error(t, err)
+	alert := publisher.GetLastAlert()
+	require.NotNil(t, alert)
+	assert.Equal(t, "ALERT_DYNAMIC_LIST_FETCH_FAILED", alert.Message)
+	assert.Equal(t, "blocked", alert.Params["id"])
+	publisher.LastAlert = nil
+	_, err = fetcher.Refresh("blocked")
+	require.Error(t, err)
+	assert.Nil(t, publisher.GetLastAlert())
+	set, ok = fetcher.List("blocked")
+	require.True(t, ok)
+	assert.Equal(t, []string{"192.168.0.1"}, set.Entries)
+
+	// removed lists are forgotten.
+	require.NoError(t, fetcher.Configure(nil))
+	assert.Empty(t, fetcher.Lists())
+	_, err = fetcher.Refresh("blocked")
+	assert.Error(t, err)
+}
+
+func TestFetcherListTooLarge(t *testing.T) {
+	entry := "a.example.com\n"
+	body := strings.Repeat(entry, maxListSize/len(entry)+1)
+	server := httptest.NewServer(&listServer{body: body, etag: `"v1"`})
+	defer server.Close()
+	publisher := &mocks.MockAlertPublisher{}
+	fetcher := NewFetcher(WithAlertPublisher(publisher))
+	defer func() { _ = fetcher.Shutdown() }()
+	config := listConfig("large", server.URL)
+	config.Type = ListTypeDomain
+	require.NoError(t, fetcher.Configure([]dynamic_lists.Config{config}))
+
+	// the list is rejected rather than cut at the limit.
+	_, err := fetcher.Refresh("large")
+	assert.ErrorIs(t, err, ErrListTooLarge)
+	require.Eventually(t, func() bool { return publisher.GetLastAlert() != nil }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "large", publisher.GetLastAlert().Params["id"])
+	_, ok := fetcher.List("large")
+	assert.False(t, ok)
+}
+
+func TestFetcherConfigureErrors(t *testing.T) {
+	fetcher := NewFetcher(WithAlertPublisher(&mocks.MockAlertPublisher{}))
+	defer func() { _ = fetcher.Shutdown() }()
+
+	badUnit := listConfig("unit", "http://127.0.0.1:1/")
+	badUnit.PollingUnit = "never"
+	badMethod := listConfig("method", "http://127.0.0.1:1/")
+	badMethod.ParsingMethod = "xml"
+	err := fetcher.Configure([]dynamic_lists.Config{badUnit, badMethod})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "method: unknown parsing method")
+	assert.Contains(t, err.Error(), "unit: unknown polling unit")
+}
+
+func TestFetcherSkipCertCheck(t *testing.T) {
+	server := httptest.NewTLSServer(&listServer{body: "example.com\n", etag: `"v1"`})
+	defer server.Close()
+
+	publisher := &mocks.MockAlertPublisher{}
+	fetcher := NewFetcher(WithAlertPublisher(publisher))
+	defer func() { _ = fetcher.Shutdown() }()
+
+	checked := listConfig("checked", server.URL)
+	checked.Type = ListTypeDomain
+	skipped := checked
+	skipped.ID = "skipped"
+	skipped.SkipCertCheck = true
+	require.NoError(t, fetcher.Configure([]dynamic_lists.Config{checked, skipped}))
+
+	set, err := fetcher.Refresh("skipped")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, set.Entries)
+	_, err = fetcher.Refresh("checked")
+	assert.Error(t, err)
+}
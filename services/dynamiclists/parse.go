@@ -0,0 +1,258 @@
+package dynamiclists
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ListTypeIP is the type of lists of IP addresses and CIDR
+	// networks.
+	ListTypeIP = "IPList"
+
+	// ListTypeDomain is the type of lists of domain names.
+	ListTypeDomain = "DomainList"
+)
+
+const (
+	// ParsingMethodLines takes the first field of every line that
+	// isn't blank or a comment. It is the default. For domain lists
+	// hosts file lines, such as "0.0.0.0 example.com", give their
+	// host name.
+	ParsingMethodLines = "lines"
+
+	// ParsingMethodCSV takes a column of CSV records. It is followed by
+	// the 1-based column number, as in "csv:2".
+	ParsingMethodCSV = "csv"
+
+	// ParsingMethodJSON takes the values at a path of a JSON document.
+	// It is followed by the path, with "." between keys and "*" for
+	// every element of an array or object, as in
+	// "json:prefixes.*.ip_prefix".
+	ParsingMethodJSON = "json"
+)
+
+// ErrNoValidEntries is returned when a list has entries but none of
+// them are valid.
+var ErrNoValidEntries = errors.New("no valid entries")
+
+// ErrListTooLarge is returned when the body of a list is larger than
+// the lists accepted.
+var ErrListTooLarge = errors.New("list too large")
+
+// parser extracts the raw entries of a list.
+type parser func(body io.Reader) ([]string, error)
+
+// newParser returns the parser of a parsing method.
+func newParser(listType string, method string) (parser, error) {
+	name, argument, _ := strings.Cut(method, ":")
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", ParsingMethodLines:
+		return func(body io.Reader) ([]string, error) {
+			return parseLines(body, listType == ListTypeDomain)
+		}, nil
+	case ParsingMethodCSV:
+		column, err := strconv.Atoi(strings.TrimSpace(argument))
+		if err != nil || column < 1 {
+			return nil, fmt.Errorf("invalid CSV column in parsing method %q", method)
+		}
+		return func(body io.Reader) ([]string, error) {
+			return parseCSVColumn(body, column-1)
+		}, nil
+	case ParsingMethodJSON:
+		path := strings.TrimSpace(argument)
+		if path == "" {
+			return nil, fmt.Errorf("missing JSON path in parsing method %q", method)
+		}
+		return func(body io.Reader) ([]string, error) {
+			return parseJSONPath(body, strings.Split(path, "."))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown parsing method %q", method)
+}
+
+// parseLines returns the first field of every line, skipping blank
+// lines and comments. With hosts set the second field of lines whose
+// first field is an IP address is returned instead.
+func parseLines(body io.Reader, hosts bool) ([]string, error) {
+	entries := []string{}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		entry := fields[0]
+		if hosts && len(fields) > 1 {
+			if _, err := netip.ParseAddr(entry); err == nil {
+				entry = fields[1]
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// parseCSVColumn returns the 0-based column of every CSV record that
+// has it. Lines starting with '#' are comments.
+func parseCSVColumn(body io.Reader, column int) ([]string, error) {
+	reader := csv.NewReader(body)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	entries := []string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if column < len(record) {
+			entries = append(entries, record[column])
+		}
+	}
+}
+
+// parseJSONPath returns the strings at path in the JSON document. A
+// "*" segment matches every element of an array or object, and arrays
+// of strings at the end of the path give all their strings.
+func parseJSONPath(body io.Reader, path []string) ([]string, error) {
+	var document interface{}
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	entries := []string{}
+	collectJSONPath(document, path, &entries)
+	return entries, nil
+}
+
+// collectJSONPath appends the strings at path in value to entries.
+func collectJSONPath(value interface{}, path []string, entries *[]string) {
+	if len(path) == 0 {
+		switch typed := value.(type) {
+		case string:
+			*entries = append(*entries, typed)
+		case []interface{}:
+			for _, element := range typed {
+				if str, ok := element.(string); ok {
+					*entries = append(*entries, str)
+				}
+			}
+		}
+		return
+	}
+	segment, rest := path[0], path[1:]
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if segment == "*" {
+			for _, child := range typed {
+				collectJSONPath(child, rest, entries)
+			}
+		} else if child, ok := typed[segment]; ok {
+			collectJSONPath(child, rest, entries)
+		}
+	case []interface{}:
+		if segment == "*" {
+			for _, child := range typed {
+				collectJSONPath(child, rest, entries)
+			}
+		} else if index, err := strconv.Atoi(segment); err == nil && index >= 0 && index < len(typed) {
+			collectJSONPath(typed[index], rest, entries)
+		}
+	}
+}
+
+// normalizeIP returns the canonical form of an IP address or CIDR
+// network, host bits of networks are cleared.
+func normalizeIP(entry string) (string, bool) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return "", false
+		}
+		return prefix.Masked().String(), true
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
+
+// normalizeDomain returns the lower case form of a domain name without
+// a trailing dot. A leading "*." wildcard is kept.
+func normalizeDomain(entry string) (string, bool) {
+	domain := strings.TrimSuffix(strings.ToLower(entry), ".")
+	name := strings.TrimPrefix(domain, "*.")
+	if len(name) == 0 || len(name) > 253 || !strings.Contains(name, ".") {
+		return "", false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", false
+			}
+		}
+	}
+	return domain, true
+}
+
+// parseList parses body with parse into the entries of a list of the
+// type, see normalizeEntries.
+func parseList(parse parser, listType string, body io.Reader) ([]string, int, error) {
+	raw, err := parse(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return normalizeEntries(listType, raw)
+}
+
+// normalizeEntries returns the sorted, deduplicated valid entries of
+// raw for the list type and the number of invalid ones.
+func normalizeEntries(listType string, raw []string) ([]string, int, error) {
+	normalize := normalizeIP
+	if listType == ListTypeDomain {
+		normalize = normalizeDomain
+	} else if listType != ListTypeIP {
+		return nil, 0, fmt.Errorf("unknown list type %q", listType)
+	}
+
+	seen := make(map[string]bool, len(raw))
+	entries := make([]string, 0, len(raw))
+	invalid := 0
+	for _, entry := range raw {
+		normalized, ok := normalize(strings.TrimSpace(entry))
+		if !ok {
+			invalid++
+			continue
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			entries = append(entries, normalized)
+		}
+	}
+	if len(entries) == 0 && invalid > 0 {
+		return nil, invalid, fmt.Errorf("%w, %d invalid", ErrNoValidEntries, invalid)
+	}
+	sort.Strings(entries)
+	return entries, invalid, nil
+}
@@ -0,0 +1,89 @@
+package dynamiclists
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name     string
+		listType string
+		method   string
+		body     string
+		expected []string
+		invalid  int
+	}{
+		{
+			name:     "IP lines",
+			listType: ListTypeIP,
+			body:     "# blocked\n10.0.0.1\n10.0.0.0/8 ; private\n\n192.168.1.77/24 extra\n10.0.0.1\n2001:DB8::1\nnot-an-ip\n::ffff:1.2.3.4\n",
+			expected: []string{"1.2.3.4", "10.0.0.0/8", "10.0.0.1", "192.168.1.0/24", "2001:db8::1"},
+			invalid:  1,
+		},
+		{
+			name:     "domain lines and hosts file",
+			listType: ListTypeDomain,
+			method:   ParsingMethodLines,
+			body:     "Example.COM.\n0.0.0.0 ads.example.net\n*.tracker.org\nlocalhost\nbad_-.\n-bad.example.com\nexample.com\n",
+			expected: []string{"*.tracker.org", "ads.example.net", "example.com"},
+			invalid:  3,
+		},
+		{
+			name:     "CSV column",
+			listType: ListTypeIP,
+			method:   "csv:2",
+			body:     "# id,network\nid,network\n1,\"10.1.0.0/16\"\n2, 10.2.0.0/16,comment\n3\n",
+			expected: []string{"10.1.0.0/16", "10.2.0.0/16"},
+			invalid:  1,
+		},
+		{
+			name:     "JSON path",
+			listType: ListTypeIP,
+			method:   "json:prefixes.*.ip_prefix",
+			body:     `{"prefixes": [{"ip_prefix": "3.5.140.0/22"}, {"ip_prefix": "13.34.37.64/27"}, {"other": "x"}]}`,
+			expected: []string{"13.34.37.64/27", "3.5.140.0/22"},
+		},
+		{
+			name:     "JSON path to an array of strings",
+			listType: ListTypeDomain,
+			method:   "json:data.0.domains",
+			body:     `{"data": [{"domains": ["a.example.com", "b.example.com", 3]}]}`,
+			expected: []string{"a.example.com", "b.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse, err := newParser(tt.listType, tt.method)
+			require.NoError(t, err)
+			entries, invalid, err := parseList(parse, tt.listType, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, entries)
+			assert.Equal(t, tt.invalid, invalid)
+		})
+	}
+}
+
+func TestParseListErrors(t *testing.T) {
+	lines, err := newParser(ListTypeIP, "")
+	require.NoError(t, err)
+	_, _, err = parseList(lines, ListTypeIP, strings.NewReader("nothing\nvalid\n"))
+	assert.ErrorIs(t, err, ErrNoValidEntries)
+	entries, _, err := parseList(lines, ListTypeIP, strings.NewReader("# empty\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, _, err = parseList(lines, "Other", strings.NewReader("10.0.0.1"))
+	assert.Error(t, err)
+	jsonPath, err := newParser(ListTypeIP, "json:a")
+	require.NoError(t, err)
+	_, _, err = parseList(jsonPath, ListTypeIP, strings.NewReader("{"))
+	assert.Error(t, err)
+	for _, method := range []string{"csv", "csv:0", "csv:x", "json:", "xml"} {
+		_, err := newParser(ListTypeIP, method)
+		assert.Error(t, err, method)
+	}
+}
@@ -0,0 +1,460 @@
+package database_settings
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TypeSQLite is the type of sqlite databases.
+	TypeSQLite = "sqlite"
+	// TypePostgres is the type of PostgreSQL databases.
+	TypePostgres = "postgres"
+	// TypeMySQL is the type of MySQL and MariaDB databases.
+	TypeMySQL = "mysql"
+)
+
+// redactedPassword replaces passwords in redacted connection strings.
+const redactedPassword = "xxxxx"
+
+// typeAliases maps other names of database types, in connection
+// string schemes or the type field, to the type.
+var typeAliases = map[string]string{
+	"sqlite3":    TypeSQLite,
+	"file":       TypeSQLite,
+	"postgresql": TypePostgres,
+	"pgsql":      TypePostgres,
+	"mariadb":    TypeMySQL,
+}
+
+// driverNames are the database/sql driver names of the types, other
+// types use the type.
+var driverNames = map[string]string{
+	TypeSQLite:   "sqlite3",
+	TypePostgres: "postgres",
+	TypeMySQL:    "mysql",
+}
+
+// normalizeType returns the lower case type with aliases resolved.
+func normalizeType(dbType string) string {
+	dbType = strings.ToLower(strings.TrimSpace(dbType))
+	if alias, ok := typeAliases[dbType]; ok {
+		return alias
+	}
+	return dbType
+}
+
+// Descriptor is a database of the settings, normalized from its
+// fields and its connection string.
+type Descriptor struct {
+	ID      string
+	Name    string
+	Type    string
+	Enabled bool
+	Default bool
+
+	// Path is the file of sqlite databases.
+	Path string
+
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+
+	// Options are the connection options, such as sslmode.
+	Options url.Values
+}
+
+// Inconsistency is a field of a database that disagrees with its
+// connection string. Passwords are redacted.
+type Inconsistency struct {
+	Field           string
+	FieldValue      string
+	ConnectionValue string
+}
+
+// InconsistentDatabaseError is returned when the fields of a database
+// disagree with its connection string.
+type InconsistentDatabaseError struct {
+	ID              string
+	Inconsistencies []Inconsistency
+}
+
+// Error implements error.
+func (e *InconsistentDatabaseError) Error() string {
+	parts := make([]string, 0, len(e.Inconsistencies))
+	for _, inconsistency := range e.Inconsistencies {
+		parts = append(parts, fmt.Sprintf("%s is %q but the connection string has %q",
+			inconsistency.Field, inconsistency.FieldValue, inconsistency.ConnectionValue))
+	}
+	return fmt.Sprintf("database %s: %s", e.ID, strings.Join(parts, ", "))
+}
+
+// DatabasesError lists every problem of the database settings.
+type DatabasesError struct {
+	Problems []string
+}
+
+// Error implements error.
+func (e *DatabasesError) Error() string {
+	return "invalid databases: " + strings.Join(e.Problems, "; ")
+}
+
+// ParseDatabase returns the descriptor of db. The connection string is
+// parsed as a URL, such as "postgres://user@server:5432/reports", or as
+// a sqlite file path or PostgreSQL keyword/value string. Fields that
+// are empty take their value from the connection string and the other
+// way around. If they disagree the descriptor, with the values of the
+// connection string, is returned along with an
+// *InconsistentDatabaseError.
+func ParseDatabase(db Database) (*Descriptor, error) {
+	descriptor := &Descriptor{
+		ID:      db.ID,
+		Name:    db.Name,
+		Enabled: db.Enabled,
+		Default: db.Default,
+		Options: url.Values{},
+	}
+	fieldType := normalizeType(db.Type)
+	if err := descriptor.parseConnectionString(fieldType, strings.TrimSpace(db.ConnectionString)); err != nil {
+		return nil, fmt.Errorf("database %s: %w", db.ID, err)
+	}
+
+	check := &InconsistentDatabaseError{ID: db.ID}
+	reconcile := func(field string, fieldValue string, value *string, display func(string) string) {
+		switch {
+		case fieldValue == "":
+		case *value == "":
+			*value = fieldValue
+		case fieldValue != *value:
+			check.Inconsistencies = append(check.Inconsistencies, Inconsistency{
+				Field:           field,
+				FieldValue:      display(fieldValue),
+				ConnectionValue: display(*value),
+			})
+		}
+	}
+	plain := func(value string) string { return value }
+	reconcile("type", fieldType, &descriptor.Type, plain)
+	reconcile("db_server", stringValue(db.Server), &descriptor.Host, plain)
+	reconcile("db_username", stringValue(db.UserName), &descriptor.User, plain)
+	reconcile("db_password", stringValue(db.Password), &descriptor.Password, func(string) string { return redactedPassword })
+	if db.Port != nil && *db.Port != 0 {
+		port := ""
+		if descriptor.Port != 0 {
+			port = strconv.Itoa(descriptor.Port)
+		}
+		reconcile("db_port", strconv.Itoa(*db.Port), &port, plain)
+		descriptor.Port, _ = strconv.Atoi(port)
+	}
+	if descriptor.Type == TypeSQLite {
+		// db_name may be the file name or the whole path.
+		if db.Database != "" && descriptor.Path != "" && db.Database != descriptor.Path && db.Database != filepath.Base(descriptor.Path) {
+			reconcile("db_name", db.Database, &descriptor.Path, plain)
+		} else if descriptor.Path == "" {
+			descriptor.Path = db.Database
+		}
+	} else {
+		reconcile("db_name", db.Database, &descriptor.Database, plain)
+	}
+
+	if descriptor.Type == "" {
+		return nil, fmt.Errorf("database %s: unknown database type", db.ID)
+	}
+	if len(check.Inconsistencies) > 0 {
+		return descriptor, check
+	}
+	return descriptor, nil
+}
+
+// stringValue returns the value of an optional field.
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// parseConnectionString sets the descriptor from connection, of a
+// database of fieldType if it is known.
+func (descriptor *Descriptor) parseConnectionString(fieldType string, connection string) error {
+	if connection == "" {
+		return nil
+	}
+	scheme, rest, hasScheme := strings.Cut(connection, ":")
+	if !hasScheme || strings.ContainsAny(scheme, " =/") {
+		// no URL: a sqlite path or libpq keyword/value pairs.
+		switch {
+		case fieldType == TypePostgres || strings.Contains(connection, "="):
+			descriptor.Type = TypePostgres
+			return descriptor.parseKeywordValues(connection)
+		case fieldType == TypeSQLite || fieldType == "":
+			descriptor.Type = TypeSQLite
+			descriptor.Path = connection
+			return nil
+		}
+		return fmt.Errorf("unable to parse the connection string of a %s database", fieldType)
+	}
+
+	descriptor.Type = normalizeType(scheme)
+	if descriptor.Type == TypeSQLite {
+		// sqlite:///abs/path, sqlite://rel/path and sqlite:path.
+		path, query, _ := strings.Cut(rest, "?")
+		path = strings.TrimPrefix(path, "//")
+		descriptor.Path = path
+		options, err := url.ParseQuery(query)
+		if err != nil {
+			return fmt.Errorf("invalid connection string options: %w", err)
+		}
+		descriptor.Options = options
+		return nil
+	}
+
+	parsed, err := url.Parse(connection)
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %s", redactConnectionError(err))
+	}
+	descriptor.Host = parsed.Hostname()
+	if port := parsed.Port(); port != "" {
+		if descriptor.Port, err = strconv.Atoi(port); err != nil {
+			return fmt.Errorf("invalid port %q in the connection string", port)
+		}
+	}
+	if parsed.User != nil {
+		descriptor.User = parsed.User.Username()
+		descriptor.Password, _ = parsed.User.Password()
+	}
+	descriptor.Database = strings.TrimPrefix(parsed.Path, "/")
+	descriptor.Options = parsed.Query()
+	return nil
+}
+
+// redactConnectionError returns the message of a URL parsing error
+// without the URL, which may hold a password.
+func redactConnectionError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// parseKeywordValues parses a libpq keyword/value connection string,
+// such as "host=server port=5432 dbname=reports".
+func (descriptor *Descriptor) parseKeywordValues(connection string) error {
+	for _, field := range splitKeywordValues(connection) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid connection string field %q", key)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), "'")
+		switch key {
+		case "host":
+			descriptor.Host = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid port %q in the connection string", value)
+			}
+			descriptor.Port = port
+		case "user":
+			descriptor.User = value
+		case "password":
+			descriptor.Password = value
+		case "dbname":
+			descriptor.Database = value
+		default:
+			descriptor.Options.Set(key, value)
+		}
+	}
+	return nil
+}
+
+// splitKeywordValues splits a keyword/value string on the spaces that
+// are not quoted.
+func splitKeywordValues(connection string) []string {
+	fields := []string{}
+	var field strings.Builder
+	quoted := false
+	for _, c := range connection {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+			field.WriteRune(c)
+		case c == ' ' && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(c)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// DriverName returns the database/sql driver name of the database.
+func (descriptor *Descriptor) DriverName() string {
+	if name, ok := driverNames[descriptor.Type]; ok {
+		return name
+	}
+	return descriptor.Type
+}
+
+// DSN returns the data source name to open the database with its
+// driver, with the password. Never log it, see String.
+func (descriptor *Descriptor) DSN() string {
+	return descriptor.dsn(descriptor.Password)
+}
+
+// String returns the DSN with the password redacted, for logging.
+func (descriptor *Descriptor) String() string {
+	password := ""
+	if descriptor.Password != "" {
+		password = redactedPassword
+	}
+	return descriptor.dsn(password)
+}
+
+// ConnectionString returns the connection string of the database for
+// the settings, as a URL without the password.
+func (descriptor *Descriptor) ConnectionString() string {
+	if descriptor.Type == TypeSQLite {
+		return descriptor.sqliteDSN(TypeSQLite + "://")
+	}
+	return descriptor.url("")
+}
+
+// dsn returns the DSN with password.
+func (descriptor *Descriptor) dsn(password string) string {
+	switch descriptor.Type {
+	case TypeSQLite:
+		return descriptor.sqliteDSN("file:")
+	case TypeMySQL:
+		// user:password@tcp(host:port)/dbname?options
+		var dsn strings.Builder
+		if descriptor.User != "" {
+			dsn.WriteString(descriptor.User)
+			if password != "" {
+				dsn.WriteString(":" + password)
+			}
+			dsn.WriteString("@")
+		}
+		if descriptor.Host != "" {
+			dsn.WriteString("tcp(" + descriptor.hostPort() + ")")
+		}
+		dsn.WriteString("/" + descriptor.Database)
+		if len(descriptor.Options) > 0 {
+			dsn.WriteString("?" + descriptor.Options.Encode())
+		}
+		return dsn.String()
+	}
+	return descriptor.url(password)
+}
+
+// sqliteDSN returns the path of the database after prefix, with the
+// options.
+func (descriptor *Descriptor) sqliteDSN(prefix string) string {
+	dsn := prefix + descriptor.Path
+	if len(descriptor.Options) > 0 {
+		dsn += "?" + descriptor.Options.Encode()
+	}
+	return dsn
+}
+
+// hostPort returns the host and port, if any, of the database.
+func (descriptor *Descriptor) hostPort() string {
+	if descriptor.Port == 0 {
+		return descriptor.Host
+	}
+	return net.JoinHostPort(descriptor.Host, strconv.Itoa(descriptor.Port))
+}
+
+// url returns the database as a URL with password.
+func (descriptor *Descriptor) url(password string) string {
+	u := url.URL{
+		Scheme:   descriptor.Type,
+		Host:     descriptor.hostPort(),
+		Path:     "/" + descriptor.Database,
+		RawQuery: descriptor.Options.Encode(),
+	}
+	if descriptor.User != "" {
+		if password != "" {
+			u.User = url.UserPassword(descriptor.User, password)
+		} else {
+			u.User = url.User(descriptor.User)
+		}
+	}
+	return u.String()
+}
+
+// Default returns the default database, or nil if there isn't exactly
+// one.
+func (databases *Databases) Default() *Database {
+	var found *Database
+	for i := range databases.Databases {
+		if databases.Databases[i].Default {
+			if found != nil {
+				return nil
+			}
+			found = &databases.Databases[i]
+		}
+	}
+	return found
+}
+
+// Descriptors parses every database, see ParseDatabase. It checks that
+// ids are unique and that there is exactly one Default database, which
+// is enabled, and returns a *DatabasesError listing every problem along
+// with the descriptors of the databases that could be parsed.
+func (databases *Databases) Descriptors() ([]*Descriptor, error) {
+	problems := []string{}
+	descriptors := []*Descriptor{}
+	defaults := []string{}
+	ids := map[string]bool{}
+	for _, db := range databases.Databases {
+		if ids[db.ID] {
+			problems = append(problems, fmt.Sprintf("duplicate database id %s", db.ID))
+		}
+		ids[db.ID] = true
+		if db.Default {
+			defaults = append(defaults, db.ID)
+			if !db.Enabled {
+				problems = append(problems, fmt.Sprintf("the default database %s is disabled", db.ID))
+			}
+		}
+
+		descriptor, err := ParseDatabase(db)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if descriptor != nil {
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+	switch len(defaults) {
+	case 0:
+		problems = append(problems, "there is no default database")
+	case 1:
+	default:
+		sort.Strings(defaults)
+		problems = append(problems, fmt.Sprintf("there are %d default databases: %s",
+			len(defaults), strings.Join(defaults, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return descriptors, &DatabasesError{Problems: problems}
+	}
+	return descriptors, nil
+}
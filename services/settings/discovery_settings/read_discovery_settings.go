@@ -32,3 +32,24 @@ func readCollectorBytes(collectorName discovery.CollectorName, bytes []byte) (iC
 
 	return settings, true
 }
+
+// CollectorSettings returns the base settings of every valid collector in the plugins array, keyed by collector type.
+// Invalid collector settings are logged and left out.
+func (s *DiscoverySettingsObject) CollectorSettings() map[discovery.CollectorName]CollectorSettingsBase {
+	collectors := map[discovery.CollectorName]CollectorSettingsBase{}
+	for _, iPlugin := range s.Plugins {
+		if !validateOneCollector(iPlugin) {
+			continue
+		}
+		settingsBytes, err := json.Marshal(iPlugin)
+		if err != nil {
+			continue
+		}
+		baseSettings := CollectorSettingsBase{}
+		if err := json.Unmarshal(settingsBytes, &baseSettings); err != nil {
+			continue
+		}
+		collectors[baseSettings.Type] = baseSettings
+	}
+	return collectors
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/untangle/golang-shared/services/discovery"
 	"github.com/untangle/golang-shared/services/logger"
 )
 
@@ -33,3 +34,17 @@ func TestValidateDiscoverySettings(t *testing.T) {
 		assert.Equal(t, test.Valid, ValidateDiscoverySettings(bodyBytes), "wrong result for test case %v:%v", testIndex, test.Description)
 	}
 }
+
+func TestCollectorSettings(t *testing.T) {
+	settings := DiscoverySettingsObject{Plugins: []interface{}{
+		map[string]interface{}{"type": "lldp", "enabled": true, "autoInterval": 60},
+		map[string]interface{}{"type": "nmap", "enabled": false, "autoInterval": 120},
+		map[string]interface{}{"type": "neighbour", "enabled": true, "autoInterval": 1},
+		map[string]interface{}{"type": "unknown", "enabled": true, "autoInterval": 60},
+	}}
+
+	assert.Equal(t, map[discovery.CollectorName]CollectorSettingsBase{
+		discovery.Lldp: {Type: discovery.Lldp, Enabled: true, AutoInterval: 60},
+		discovery.Nmap: {Type: discovery.Nmap, Enabled: false, AutoInterval: 120},
+	}, settings.CollectorSettings())
+}
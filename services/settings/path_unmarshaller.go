@@ -1,9 +1,13 @@
 package settings
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const notFound = int64(-1)
@@ -286,3 +290,171 @@ func (unm *PathUnmarshaller) UnmarshalAtPath(output interface{}, path ...string)
 	}
 	return newDecoder.Decode(output)
 }
+
+// PathsNotFoundError is returned by UnmarshalPaths when some of the
+// requested paths are not in the JSON. The targets of all other paths
+// are still unmarshalled.
+type PathsNotFoundError struct {
+	// Paths are the missing paths, sorted.
+	Paths []string
+}
+
+// Error implements error.
+func (e *PathsNotFoundError) Error() string {
+	return fmt.Sprintf("path unmarshaller: couldn't find paths: %s",
+		strings.Join(e.Paths, ", "))
+}
+
+// pathNode is a node of the trie of paths searched for by
+// UnmarshalPaths.
+type pathNode struct {
+	// path of the node, as given to UnmarshalPaths.
+	path string
+
+	// target to unmarshal the value at the node into, if any.
+	target    any
+	hasTarget bool
+	found     bool
+
+	children map[string]*pathNode
+}
+
+// splitPath splits a path given to UnmarshalPaths into its
+// components, "a/b/0" is []string{"a", "b", "0"}.
+func SplitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// buildPathTrie builds the trie of the paths in targets.
+func buildPathTrie(targets map[string]any) *pathNode {
+	root := &pathNode{children: map[string]*pathNode{}}
+	for path, target := range targets {
+		node := root
+		for _, component := range SplitPath(path) {
+			child, ok := node.children[component]
+			if !ok {
+				child = &pathNode{children: map[string]*pathNode{}}
+				node.children[component] = child
+			}
+			node = child
+		}
+		node.path = path
+		node.target = target
+		node.hasTarget = true
+	}
+	return root
+}
+
+// missingPaths appends the paths of the nodes under node, including
+// it, that were not found.
+func (node *pathNode) missingPaths(missing []string) []string {
+	if node.hasTarget && !node.found {
+		missing = append(missing, node.path)
+	}
+	for _, child := range node.children {
+		missing = child.missingPaths(missing)
+	}
+	return missing
+}
+
+// decodeNode decodes the next value in the stream for node. A node
+// with a target takes the whole value; nodes below it are then
+// extracted from the same bytes.
+func (unm *PathUnmarshaller) decodeNode(node *pathNode) error {
+	if node.hasTarget && len(node.children) == 0 {
+		node.found = true
+		if err := unm.decoder.Decode(node.target); err != nil {
+			return fmt.Errorf("path unmarshaller: unable to unmarshal %s: %w", node.path, err)
+		}
+		return nil
+	}
+
+	if node.hasTarget {
+		var raw json.RawMessage
+		if err := unm.decoder.Decode(&raw); err != nil {
+			return fmt.Errorf("path unmarshaller: unable to unmarshal %s: %w", node.path, err)
+		}
+		node.found = true
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		if unm.useNumber {
+			decoder.UseNumber()
+		}
+		if err := decoder.Decode(node.target); err != nil {
+			return fmt.Errorf("path unmarshaller: unable to unmarshal %s: %w", node.path, err)
+		}
+		inner := NewPathUnmarshaller(bytes.NewReader(raw))
+		inner.useNumber = unm.useNumber
+		return inner.searchNodeChildren(node)
+	}
+	return unm.searchNodeChildren(node)
+}
+
+// searchNodeChildren reads the next value in the stream and decodes the
+// members or elements of it that are children of node, skipping the
+// others.
+func (unm *PathUnmarshaller) searchNodeChildren(node *pathNode) error {
+	next, err := unm.getToken()
+	if err != nil {
+		return err
+	}
+	delim, ok := next.(json.Delim)
+	if !ok {
+		// a scalar has no children to find.
+		return nil
+	}
+
+	for index := 0; unm.decoder.More(); index++ {
+		key := strconv.Itoa(index)
+		if delim == '{' {
+			keyToken, err := unm.getToken()
+			if err != nil {
+				return err
+			}
+			if key, ok = keyToken.(string); !ok {
+				return unm.formatError("unexpected JSON token: %T (%s)", keyToken, keyToken)
+			}
+		}
+		if child, ok := node.children[key]; ok {
+			if err := unm.decodeNode(child); err != nil {
+				return err
+			}
+		} else if err := unm.ignoreNextObject(); err != nil {
+			return err
+		}
+	}
+	// eat the closing delim.
+	_, err = unm.getToken()
+	return err
+}
+
+// UnmarshalPaths unmarshals the values at several paths of the JSON
+// in a single pass over the stream. The keys of targets are paths with
+// components separated by '/', numeric components index arrays, e.g.
+// "network/interfaces/0". Each value is a pointer to unmarshal the
+// value at its path into, as for json.Unmarshal. If some paths are
+// missing a *PathsNotFoundError listing them is returned, after all
+// other paths were unmarshalled.
+func (unm *PathUnmarshaller) UnmarshalPaths(targets map[string]any) error {
+	unm.searchedForPath = make([]string, 0, len(targets))
+	for path := range targets {
+		unm.searchedForPath = append(unm.searchedForPath, path)
+	}
+	sort.Strings(unm.searchedForPath)
+	if unm.useNumber {
+		unm.decoder.UseNumber()
+	}
+
+	root := buildPathTrie(targets)
+	if err := unm.decodeNode(root); err != nil {
+		return err
+	}
+	if missing := root.missingPaths(nil); len(missing) > 0 {
+		sort.Strings(missing)
+		return &PathsNotFoundError{Paths: missing}
+	}
+	return nil
+}
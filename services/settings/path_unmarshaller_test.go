@@ -3,7 +3,10 @@ package settings
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -171,6 +174,66 @@ func (suite *TestJSONUnmarshalSuite) TestNestedStructs() {
 	suite.Equal(expected, output.Inners)
 }
 
+// Test extracting several paths in one pass.
+func (suite *TestJSONUnmarshalSuite) TestUnmarshalPaths() {
+	type rule struct {
+		ID      string `json:"id"`
+		Enabled bool   `json:"enabled"`
+	}
+	jsonString := `
+{"ignore": [1, {"x": [2, 3]}, null],
+ "network": {"interfaces": [{"name": "eth0"}, {"name": "eth1", "mtu": 1500}]},
+ "policy_manager": {"rules": [{"id": "a", "enabled": true}, {"id": "b", "enabled": false}]},
+ "system": {"hostname": "box", "timeZone": {"value": "UTC"}}
+}`
+
+	var rules []rule
+	var second rule
+	var eth1 map[string]any
+	var mtu json.Number
+	var hostname string
+	var system map[string]any
+	var zone string
+	var missing, missingIndex, missingUnder any
+	unm := suite.getUnmarshallerForString(jsonString)
+	unm.UseNumber()
+	err := unm.UnmarshalPaths(map[string]any{
+		"policy_manager/rules":      &rules,
+		"policy_manager/rules/1":    &second,
+		"/network/interfaces/1":     &eth1,
+		"network/interfaces/1/mtu":  &mtu,
+		"system/hostname":           &hostname,
+		"system":                    &system,
+		"system/timeZone/value":     &zone,
+		"system/missing":            &missing,
+		"network/interfaces/7":      &missingIndex,
+		"system/hostname/notObject": &missingUnder,
+	})
+
+	var notFound *PathsNotFoundError
+	suite.Require().ErrorAs(err, &notFound)
+	suite.Equal([]string{"network/interfaces/7", "system/hostname/notObject", "system/missing"}, notFound.Paths)
+	suite.Equal([]rule{{ID: "a", Enabled: true}, {ID: "b"}}, rules)
+	suite.Equal(rule{ID: "b"}, second)
+	suite.Equal(map[string]any{"name": "eth1", "mtu": json.Number("1500")}, eth1)
+	suite.Equal(json.Number("1500"), mtu)
+	suite.Equal("box", hostname)
+	suite.Equal("box", system["hostname"])
+	suite.Equal("UTC", zone)
+
+	var whole map[string]any
+	unm = suite.getUnmarshallerForString(jsonString)
+	suite.NoError(unm.UnmarshalPaths(map[string]any{"": &whole, "system/hostname": &hostname}))
+	suite.Len(whole, 4)
+
+	for _, bad := range []string{`{"system": {"hostname": }}`, `{"system": [`, `[}`} {
+		unm = suite.getUnmarshallerForString(bad)
+		err := unm.UnmarshalPaths(map[string]any{"system/hostname": &hostname})
+		suite.Error(err)
+		suite.False(errors.As(err, &notFound))
+	}
+}
+
 func (suite *TestJSONUnmarshalSuite) getUnmarshallerForString(json string) *PathUnmarshaller {
 	reader := bytes.NewReader([]byte(json))
 	return NewPathUnmarshaller(reader)
@@ -180,3 +243,104 @@ func TestUnmarshaller(t *testing.T) {
 	testSuite := &TestJSONUnmarshalSuite{}
 	suite.Run(t, testSuite)
 }
+
+// largeSettingsJSON builds a settings file with many top level keys
+// and large arrays, for benchmarking.
+func largeSettingsJSON() []byte {
+	settings := map[string]any{}
+	for i := 0; i < 50; i++ {
+		rules := make([]any, 200)
+		for j := range rules {
+			rules[j] = map[string]any{
+				"id":          fmt.Sprintf("rule-%d-%d", i, j),
+				"enabled":     j%2 == 0,
+				"description": "a rule with a reasonably long description",
+				"conditions":  []any{map[string]any{"type": "SRC_ADDR", "value": "10.0.0.0/8"}},
+			}
+		}
+		settings[fmt.Sprintf("section%02d", i)] = map[string]any{"rules": rules, "enabled": true}
+	}
+	raw, _ := json.Marshal(settings)
+	return raw
+}
+
+// BenchmarkUnmarshalPaths compares extracting five subtrees with one
+// PathUnmarshaller per path against a single UnmarshalPaths pass. Only
+// object paths are used, as UnmarshalAtPath can't index arrays.
+func BenchmarkUnmarshalPaths(b *testing.B) {
+	raw := largeSettingsJSON()
+	paths := [][]string{
+		{"section05", "enabled"},
+		{"section12", "rules"},
+		{"section25", "enabled"},
+		{"section33", "rules"},
+		{"section49", "enabled"},
+	}
+
+	b.Run("per-path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				var output any
+				if err := NewPathUnmarshaller(bytes.NewReader(raw)).UnmarshalAtPath(&output, path...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("single-pass", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			targets := map[string]any{}
+			for _, path := range paths {
+				var output any
+				targets[strings.Join(path, "/")] = &output
+			}
+			if err := NewPathUnmarshaller(bytes.NewReader(raw)).UnmarshalPaths(targets); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkUnmarshalSettingsAtPaths compares reading five subtrees of a
+// large settings file with one UnmarshalSettingsAtPath call per path,
+// each streaming the file again, against a single
+// UnmarshalSettingsAtPaths call.
+func BenchmarkUnmarshalSettingsAtPaths(b *testing.B) {
+	filename := filepath.Join(b.TempDir(), "settings.json")
+	if err := writeSettingsBytes(filename, largeSettingsJSON()); err != nil {
+		b.Fatal(err)
+	}
+	file := NewSettingsFile(filename, WithSecretStore(NewSecretStore(filepath.Join(b.TempDir(), "settings.key"))))
+	paths := [][]string{
+		{"section05", "enabled"},
+		{"section12", "rules"},
+		{"section25", "enabled"},
+		{"section33", "rules"},
+		{"section49", "enabled"},
+	}
+
+	b.Run("per-path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				var output any
+				if err := file.UnmarshalSettingsAtPath(&output, path...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("single-pass", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			targets := map[string]any{}
+			for _, path := range paths {
+				var output any
+				targets[strings.Join(path, "/")] = &output
+			}
+			if err := file.UnmarshalSettingsAtPaths(targets); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
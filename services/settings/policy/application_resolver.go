@@ -0,0 +1,455 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/untangle/golang-shared/services/appclassmanager"
+	"github.com/untangle/golang-shared/services/appclassprovider"
+	logService "github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+var logger = logService.GetLoggerInstance()
+
+// applicationTableName is the table requested from the
+// ApplicationClassProvider to build the catalog.
+const applicationTableName = "application"
+
+// ApplicationCatalog is an index over the application table of an
+// ApplicationClassProvider, used to look applications up by name or
+// category.
+type ApplicationCatalog struct {
+	byGUID     map[string]*appclassmanager.ApplicationInfo
+	byName     map[string]*appclassmanager.ApplicationInfo
+	byCategory map[string][]*appclassmanager.ApplicationInfo
+}
+
+// NewApplicationCatalog builds an ApplicationCatalog from the JSON
+// application table returned by ApplicationClassProvider.GetTable.
+func NewApplicationCatalog(applicationTable string) (*ApplicationCatalog, error) {
+	var apps []*appclassmanager.ApplicationInfo
+	if err := json.Unmarshal([]byte(applicationTable), &apps); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal application table: %w", err)
+	}
+
+	catalog := &ApplicationCatalog{
+		byGUID:     make(map[string]*appclassmanager.ApplicationInfo, len(apps)),
+		byName:     make(map[string]*appclassmanager.ApplicationInfo, len(apps)),
+		byCategory: make(map[string][]*appclassmanager.ApplicationInfo),
+	}
+	for _, app := range apps {
+		if app == nil {
+			continue
+		}
+		catalog.byGUID[app.GUID] = app
+		catalog.byName[catalogKey(app.Name)] = app
+		category := catalogKey(app.Category)
+		catalog.byCategory[category] = append(catalog.byCategory[category], app)
+	}
+	return catalog, nil
+}
+
+// catalogKey normalizes names and categories, the providers do not
+// agree on casing.
+func catalogKey(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// LookupName returns the application with the given name, or the
+// given GUID if no application has that name.
+func (c *ApplicationCatalog) LookupName(name string) (*appclassmanager.ApplicationInfo, bool) {
+	if app, ok := c.byName[catalogKey(name)]; ok {
+		return app, true
+	}
+	app, ok := c.byGUID[name]
+	return app, ok
+}
+
+// CategoryApplicationIDs returns the sorted GUIDs of all applications
+// in category, and false if the catalog does not know the category.
+func (c *ApplicationCatalog) CategoryApplicationIDs(category string) ([]string, bool) {
+	apps, ok := c.byCategory[catalogKey(category)]
+	if !ok {
+		return nil, false
+	}
+	ids := make([]string, 0, len(apps))
+	for _, app := range apps {
+		ids = append(ids, app.GUID)
+	}
+	sort.Strings(ids)
+	return ids, true
+}
+
+// ApplicationIDsWhere returns the sorted GUIDs of the applications
+// accepted by match.
+func (c *ApplicationCatalog) ApplicationIDsWhere(match func(app *appclassmanager.ApplicationInfo) bool) []string {
+	ids := []string{}
+	for guid, app := range c.byGUID {
+		if match(app) {
+			ids = append(ids, guid)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Len returns the number of applications in the catalog.
+func (c *ApplicationCatalog) Len() int {
+	return len(c.byGUID)
+}
+
+// ResolvedApplicationCondition is a catalog-backed condition of a
+// condition object with its values resolved to application GUIDs.
+type ResolvedApplicationCondition struct {
+	// ID of the mfw-object-condition the condition belongs to.
+	ConditionID string `json:"conditionId"`
+	// Index of the condition in the object's items.
+	Index int `json:"index"`
+	// CType is the condition type, e.g. APPLICATION_CATEGORY.
+	CType string `json:"type"`
+	// Values as configured.
+	Values []string `json:"values"`
+	// ApplicationIDs are the GUIDs the values resolve to.
+	ApplicationIDs []string `json:"applicationIds"`
+}
+
+// ApplicationConditionProblem describes a condition value that the
+// catalog does not know about.
+type ApplicationConditionProblem struct {
+	ConditionID string `json:"conditionId"`
+	Index       int    `json:"index"`
+	CType       string `json:"type"`
+	Value       string `json:"value"`
+	Reason      string `json:"reason"`
+}
+
+// String returns a human readable description of the problem.
+func (p ApplicationConditionProblem) String() string {
+	return fmt.Sprintf("condition %s[%d] %s: %s %q", p.ConditionID, p.Index, p.CType, p.Reason, p.Value)
+}
+
+// ApplicationResolution is the result of resolving the application
+// conditions of a PolicySettings against an ApplicationCatalog.
+type ApplicationResolution struct {
+	Conditions []ResolvedApplicationCondition `json:"conditions"`
+	Problems   []ApplicationConditionProblem  `json:"problems"`
+}
+
+// Valid returns true if every application condition resolved.
+func (r *ApplicationResolution) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+// ApplicationIDs returns the application GUIDs resolved for the
+// conditions of the given condition object.
+func (r *ApplicationResolution) ApplicationIDs(conditionID string) []string {
+	ids := []string{}
+	for _, cond := range r.Conditions {
+		if cond.ConditionID == conditionID {
+			ids = append(ids, cond.ApplicationIDs...)
+		}
+	}
+	return ids
+}
+
+// ApplicationResolver validates APPLICATION_NAME,
+// APPLICATION_CATEGORY, APPLICATION_RISK and APPLICATION_PRODUCTIVITY
+// conditions against the catalog of an ApplicationClassProvider, and
+// expands them to the applications they match. Conditions on
+// mfw-object-application objects, which define applications by ports
+// and addresses rather than by catalog entry, are reported as
+// unsupported problems.
+type ApplicationResolver struct {
+	provider appclassprovider.ApplicationClassProvider
+	catalog  *ApplicationCatalog
+
+	// the last settings resolved, re-checked on Reload.
+	lastSettings *PolicySettings
+	mutex        sync.RWMutex
+}
+
+// NewApplicationResolver creates an ApplicationResolver that reads its
+// catalog from provider. The catalog is loaded on first use or by
+// calling Reload.
+func NewApplicationResolver(provider appclassprovider.ApplicationClassProvider) *ApplicationResolver {
+	return &ApplicationResolver{
+		provider: provider,
+	}
+}
+
+// loadCatalog reads the application table from the provider.
+func (r *ApplicationResolver) loadCatalog() (*ApplicationCatalog, error) {
+	table, err := r.provider.GetTable(applicationTableName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get application table from %s: %w", r.provider.Name(), err)
+	}
+	return NewApplicationCatalog(table)
+}
+
+// Reload reloads the catalog from the provider. The providers do not
+// notify updates of their classification data, so whoever updates it
+// must call Reload afterwards; WatchSettings also calls it whenever the
+// policy settings change. If settings were resolved before, they are
+// resolved again against the new catalog and every condition value
+// that no longer resolves is logged. The new resolution of those
+// settings is returned, or nil if nothing was resolved yet.
+func (r *ApplicationResolver) Reload() (*ApplicationResolution, error) {
+	catalog, err := r.loadCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	r.catalog = catalog
+	lastSettings := r.lastSettings
+	r.mutex.Unlock()
+
+	logger.Info("Loaded %d applications from %s\n", catalog.Len(), r.provider.Name())
+	if lastSettings == nil {
+		return nil, nil
+	}
+
+	resolution := resolveApplicationConditions(catalog, lastSettings)
+	for _, problem := range resolution.Problems {
+		logger.Warn("Application catalog reload: policy %s\n", problem.String())
+	}
+	return resolution, nil
+}
+
+// WatchSettings keeps the resolver up to date with the policy settings
+// in file: they are resolved now and, through Reload, whenever they
+// change, so conditions on applications missing from the catalog are
+// logged. The returned function stops watching.
+func (r *ApplicationResolver) WatchSettings(file *settings.SettingsFile) (cancel func()) {
+	// watch first, so a change made while the settings are read isn't
+	// missed.
+	cancel = file.Watch([]string{PolicyConfigName}, func(_, new any) {
+		r.settingsChanged(new)
+	})
+	var current any
+	if err := file.UnmarshalSettingsAtPath(&current, PolicyConfigName); err != nil {
+		logger.Warn("Unable to read the policy settings to resolve: %s\n", err.Error())
+		return cancel
+	}
+	r.settingsChanged(current)
+	return cancel
+}
+
+// settingsChanged resolves value, the decoded policy settings, against
+// a reloaded catalog.
+func (r *ApplicationResolver) settingsChanged(value any) {
+	var policySettings *PolicySettings
+	if value != nil {
+		policySettings = &PolicySettings{}
+		raw, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(raw, policySettings)
+		}
+		if err != nil {
+			logger.Warn("Unable to decode the policy settings to resolve: %s\n", err.Error())
+			return
+		}
+	}
+
+	r.mutex.Lock()
+	r.lastSettings = policySettings
+	r.mutex.Unlock()
+	if _, err := r.Reload(); err != nil {
+		logger.Warn("Unable to resolve the policy settings: %s\n", err.Error())
+	}
+}
+
+// Resolve resolves all application conditions in policySettings. It
+// only returns an error if the catalog can't be loaded, problems with
+// individual conditions are reported in the returned resolution.
+func (r *ApplicationResolver) Resolve(policySettings *PolicySettings) (*ApplicationResolution, error) {
+	r.mutex.RLock()
+	catalog := r.catalog
+	r.mutex.RUnlock()
+
+	if catalog == nil {
+		if _, err := r.Reload(); err != nil {
+			return nil, err
+		}
+		r.mutex.RLock()
+		catalog = r.catalog
+		r.mutex.RUnlock()
+	}
+
+	r.mutex.Lock()
+	r.lastSettings = policySettings
+	r.mutex.Unlock()
+
+	return resolveApplicationConditions(catalog, policySettings), nil
+}
+
+// resolveApplicationConditions walks the condition objects of
+// policySettings and resolves the catalog-backed conditions.
+func resolveApplicationConditions(catalog *ApplicationCatalog, policySettings *PolicySettings) *ApplicationResolution {
+	resolution := &ApplicationResolution{
+		Conditions: []ResolvedApplicationCondition{},
+		Problems:   []ApplicationConditionProblem{},
+	}
+
+	applicationObjects := map[string]bool{}
+	for _, obj := range policySettings.Objects {
+		if obj != nil && obj.Type == ApplicationType {
+			applicationObjects[obj.ID] = true
+		}
+	}
+
+	for _, obj := range policySettings.Conditions {
+		if obj == nil || obj.Type != ConditionType {
+			continue
+		}
+		conditions, ok := obj.Items.([]*PolicyCondition)
+		if !ok {
+			continue
+		}
+		for i, cond := range conditions {
+			if cond == nil {
+				continue
+			}
+			if reportUnsupportedCondition(resolution, applicationObjects, obj.ID, i, cond) {
+				continue
+			}
+			resolveCondition(catalog, resolution, obj.ID, i, cond)
+		}
+	}
+	return resolution
+}
+
+// isCatalogConditionType returns true for the condition types resolved
+// against the catalog.
+func isCatalogConditionType(ctype string) bool {
+	switch ctype {
+	case "APPLICATION_NAME", "APPLICATION_NAME_INFERRED",
+		"APPLICATION_CATEGORY", "APPLICATION_CATEGORY_INFERRED",
+		"APPLICATION_RISK", "APPLICATION_RISK_INFERRED",
+		"APPLICATION_PRODUCTIVITY", "APPLICATION_PRODUCTIVITY_INFERRED":
+		return true
+	}
+	return false
+}
+
+// reportUnsupportedCondition adds a problem to resolution for each
+// application object cond refers to, and for catalog conditions using
+// object references instead of values. Returns true if cond was
+// reported.
+func reportUnsupportedCondition(resolution *ApplicationResolution, applicationObjects map[string]bool,
+	conditionID string, index int, cond *PolicyCondition) bool {
+	reported := false
+	report := func(value string, reason string) {
+		resolution.Problems = append(resolution.Problems, ApplicationConditionProblem{
+			ConditionID: conditionID,
+			Index:       index,
+			CType:       cond.CType,
+			Value:       value,
+			Reason:      reason,
+		})
+		reported = true
+	}
+
+	references := append(append([]string{}, cond.GroupIDs...), cond.Value...)
+	for _, id := range references {
+		if applicationObjects[id] {
+			report(id, "unsupported application object")
+		}
+	}
+	if !reported && isCatalogConditionType(cond.CType) && len(cond.GroupIDs) > 0 {
+		for _, id := range cond.GroupIDs {
+			report(id, "unsupported object reference")
+		}
+	}
+	return reported
+}
+
+// compareApplicationValue returns a lookup of the applications whose
+// attribute, read by field, compares to the condition value with op.
+func compareApplicationValue(catalog *ApplicationCatalog, op string, field func(app *appclassmanager.ApplicationInfo) uint) func(value string) ([]string, string) {
+	var compare func(a uint, b uint) bool
+	switch op {
+	case "", "==":
+		compare = func(a uint, b uint) bool { return a == b }
+	case "!=":
+		compare = func(a uint, b uint) bool { return a != b }
+	case "<":
+		compare = func(a uint, b uint) bool { return a < b }
+	case "<=":
+		compare = func(a uint, b uint) bool { return a <= b }
+	case ">":
+		compare = func(a uint, b uint) bool { return a > b }
+	case ">=":
+		compare = func(a uint, b uint) bool { return a >= b }
+	}
+	return func(value string) ([]string, string) {
+		if compare == nil {
+			return nil, "unsupported operator " + op
+		}
+		level, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, "invalid level"
+		}
+		return catalog.ApplicationIDsWhere(func(app *appclassmanager.ApplicationInfo) bool {
+			return compare(field(app), uint(level))
+		}), ""
+	}
+}
+
+// resolveCondition resolves a single condition and adds the result to
+// resolution.
+func resolveCondition(catalog *ApplicationCatalog, resolution *ApplicationResolution, conditionID string, index int, cond *PolicyCondition) {
+	var lookup func(value string) ([]string, string)
+	switch cond.CType {
+	case "APPLICATION_NAME", "APPLICATION_NAME_INFERRED":
+		lookup = func(value string) ([]string, string) {
+			if app, ok := catalog.LookupName(value); ok {
+				return []string{app.GUID}, ""
+			}
+			return nil, "unknown application name"
+		}
+	case "APPLICATION_CATEGORY", "APPLICATION_CATEGORY_INFERRED":
+		lookup = func(value string) ([]string, string) {
+			if ids, ok := catalog.CategoryApplicationIDs(value); ok {
+				return ids, ""
+			}
+			return nil, "unknown application category"
+		}
+	case "APPLICATION_RISK", "APPLICATION_RISK_INFERRED":
+		lookup = compareApplicationValue(catalog, cond.Op,
+			func(app *appclassmanager.ApplicationInfo) uint { return app.Risk })
+	case "APPLICATION_PRODUCTIVITY", "APPLICATION_PRODUCTIVITY_INFERRED":
+		lookup = compareApplicationValue(catalog, cond.Op,
+			func(app *appclassmanager.ApplicationInfo) uint { return app.Productivity })
+	default:
+		return
+	}
+
+	resolved := ResolvedApplicationCondition{
+		ConditionID:    conditionID,
+		Index:          index,
+		CType:          cond.CType,
+		Values:         cond.Value,
+		ApplicationIDs: []string{},
+	}
+	for _, value := range cond.Value {
+		ids, reason := lookup(value)
+		if reason != "" {
+			resolution.Problems = append(resolution.Problems, ApplicationConditionProblem{
+				ConditionID: conditionID,
+				Index:       index,
+				CType:       cond.CType,
+				Value:       value,
+				Reason:      reason,
+			})
+			continue
+		}
+		resolved.ApplicationIDs = append(resolved.ApplicationIDs, ids...)
+	}
+	resolution.Conditions = append(resolution.Conditions, resolved)
+}
@@ -0,0 +1,200 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// fakeAppClassProvider is an ApplicationClassProvider returning a fixed
+// application table.
+type fakeAppClassProvider struct {
+	table string
+	err   error
+}
+
+func (f *fakeAppClassProvider) Startup() error  { return nil }
+func (f *fakeAppClassProvider) Shutdown() error { return nil }
+func (f *fakeAppClassProvider) Name() string    { return "fake" }
+func (f *fakeAppClassProvider) GetTable(table string) (string, error) {
+	if table != "application" {
+		return "", errors.New("failed_to_get_table")
+	}
+	return f.table, f.err
+}
+
+const testApplicationTable = `[
+	{"guid": "FACEBOOK", "index": 1, "name": "Facebook", "category": "Social Networking", "productivity": 1, "risk": 3},
+	{"guid": "TWITTER", "index": 2, "name": "Twitter", "category": "Social Networking", "productivity": 1, "risk": 3},
+	{"guid": "GMAIL", "index": 3, "name": "Gmail", "category": "Web Mail", "productivity": 4, "risk": 2}
+]`
+
+// testConditionSettings builds a PolicySettings with the given
+// conditions in a single condition object.
+func testConditionSettings(t *testing.T, conditions string) *PolicySettings {
+	policySettings := &PolicySettings{}
+	require.NoError(t, json.Unmarshal([]byte(`{"conditions": [{
+		"id": "cond-1",
+		"type": "mfw-object-condition",
+		"items": `+conditions+`}]}`), policySettings))
+	return policySettings
+}
+
+func TestApplicationResolver(t *testing.T) {
+	tests := []struct {
+		name             string
+		conditions       string
+		expectedIDs      []string
+		expectedProblems []ApplicationConditionProblem
+	}{
+		{
+			name:        "names resolve case insensitively",
+			conditions:  `[{"op": "==", "type": "APPLICATION_NAME", "value": ["facebook", "GMAIL"]}]`,
+			expectedIDs: []string{"FACEBOOK", "GMAIL"},
+		},
+		{
+			name:        "category expands to applications",
+			conditions:  `[{"op": "==", "type": "APPLICATION_CATEGORY_INFERRED", "value": ["Social Networking"]}]`,
+			expectedIDs: []string{"FACEBOOK", "TWITTER"},
+		},
+		{
+			name:        "unknown name and category are reported",
+			conditions:  `[{"op": "==", "type": "APPLICATION_NAME", "value": ["Myspace", "Twitter"]}, {"op": "==", "type": "APPLICATION_CATEGORY", "value": ["Gaming"]}]`,
+			expectedIDs: []string{"TWITTER"},
+			expectedProblems: []ApplicationConditionProblem{
+				{ConditionID: "cond-1", Index: 0, CType: "APPLICATION_NAME", Value: "Myspace", Reason: "unknown application name"},
+				{ConditionID: "cond-1", Index: 1, CType: "APPLICATION_CATEGORY", Value: "Gaming", Reason: "unknown application category"},
+			},
+		},
+		{
+			name:        "risk and productivity compare levels",
+			conditions:  `[{"op": "==", "type": "APPLICATION_RISK", "value": ["3"]}, {"op": "<", "type": "APPLICATION_PRODUCTIVITY_INFERRED", "value": ["4"]}, {"op": ">=", "type": "APPLICATION_PRODUCTIVITY", "value": ["4"]}]`,
+			expectedIDs: []string{"FACEBOOK", "TWITTER", "FACEBOOK", "TWITTER", "GMAIL"},
+		},
+		{
+			name:        "unsupported risk operator is reported",
+			conditions:  `[{"op": "~", "type": "APPLICATION_RISK", "value": ["3"]}]`,
+			expectedIDs: []string{},
+			expectedProblems: []ApplicationConditionProblem{
+				{ConditionID: "cond-1", Index: 0, CType: "APPLICATION_RISK", Value: "3", Reason: "unsupported operator ~"},
+			},
+		},
+		{
+			name:        "object references are reported",
+			conditions:  `[{"op": "in", "type": "APPLICATION_NAME", "object": ["group-1"]}]`,
+			expectedIDs: []string{},
+			expectedProblems: []ApplicationConditionProblem{
+				{ConditionID: "cond-1", Index: 0, CType: "APPLICATION_NAME", Value: "group-1", Reason: "unsupported object reference"},
+			},
+		},
+		{
+			name:        "other conditions are ignored",
+			conditions:  `[{"op": "==", "type": "SERVER_PORT", "value": ["80"]}]`,
+			expectedIDs: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := NewApplicationResolver(&fakeAppClassProvider{table: testApplicationTable})
+			resolution, err := resolver.Resolve(testConditionSettings(t, tt.conditions))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedIDs, resolution.ApplicationIDs("cond-1"))
+			if tt.expectedProblems == nil {
+				assert.True(t, resolution.Valid())
+				assert.Empty(t, resolution.Problems)
+			} else {
+				assert.False(t, resolution.Valid())
+				assert.Equal(t, tt.expectedProblems, resolution.Problems)
+			}
+		})
+	}
+}
+
+func TestApplicationResolverReload(t *testing.T) {
+	provider := &fakeAppClassProvider{table: testApplicationTable}
+	resolver := NewApplicationResolver(provider)
+
+	// nothing resolved yet, nothing to re-check.
+	resolution, err := resolver.Reload()
+	assert.NoError(t, err)
+	assert.Nil(t, resolution)
+
+	resolution, err = resolver.Resolve(testConditionSettings(t,
+		`[{"op": "==", "type": "APPLICATION_NAME", "value": ["Twitter"]}]`))
+	require.NoError(t, err)
+	assert.True(t, resolution.Valid())
+
+	// Twitter is dropped from the catalog.
+	provider.table = `[{"guid": "FACEBOOK", "index": 1, "name": "Facebook", "category": "Social Networking"}]`
+	resolution, err = resolver.Reload()
+	require.NoError(t, err)
+	assert.Equal(t,
+		[]ApplicationConditionProblem{
+			{ConditionID: "cond-1", Index: 0, CType: "APPLICATION_NAME", Value: "Twitter", Reason: "unknown application name"},
+		},
+		resolution.Problems)
+
+	provider.err = errors.New("no table")
+	_, err = resolver.Reload()
+	assert.Error(t, err)
+}
+
+func TestApplicationResolverWatchSettings(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "settings.json")
+	require.NoError(t, os.WriteFile(filename, []byte(`{"policy_manager": {"conditions": [{
+		"id": "cond-1",
+		"type": "mfw-object-condition",
+		"items": [{"op": "==", "type": "APPLICATION_NAME", "value": ["Twitter"]}]}]}}`), 0600))
+	file := settings.NewSettingsFile(filename)
+	provider := &fakeAppClassProvider{table: testApplicationTable}
+	resolver := NewApplicationResolver(provider)
+	cancel := resolver.WatchSettings(file)
+	defer cancel()
+
+	// the settings in the file are resolved right away.
+	provider.table = `[{"guid": "FACEBOOK", "index": 1, "name": "Facebook", "category": "Social Networking"}]`
+	resolution, err := resolver.Reload()
+	require.NoError(t, err)
+	require.Len(t, resolution.Problems, 1)
+	assert.Equal(t, "Twitter", resolution.Problems[0].Value)
+
+	// and again when they change.
+	require.NoError(t, file.SetSettingsNoSync([]string{"policy_manager"}, map[string]any{"conditions": []any{map[string]any{
+		"id":    "cond-1",
+		"type":  "mfw-object-condition",
+		"items": []any{map[string]any{"op": "==", "type": "APPLICATION_NAME", "value": []string{"Facebook"}}},
+	}}}))
+	resolution, err = resolver.Reload()
+	require.NoError(t, err)
+	assert.True(t, resolution.Valid())
+}
+
+func TestApplicationResolverApplicationObjects(t *testing.T) {
+	policySettings := &PolicySettings{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"objects": [{"id": "app-obj", "type": "mfw-object-application", "items": [{"port": ["8080"]}]}],
+		"conditions": [{"id": "cond-1", "type": "mfw-object-condition", "items": [
+			{"op": "match", "type": "APPLICATION", "object": ["app-obj"]},
+			{"op": "==", "type": "APPLICATION", "value": ["app-obj"]}
+		]}]}`), policySettings))
+
+	resolution, err := NewApplicationResolver(&fakeAppClassProvider{table: testApplicationTable}).Resolve(policySettings)
+	require.NoError(t, err)
+	assert.False(t, resolution.Valid())
+	assert.Equal(t, []ApplicationConditionProblem{
+		{ConditionID: "cond-1", Index: 0, CType: "APPLICATION", Value: "app-obj", Reason: "unsupported application object"},
+		{ConditionID: "cond-1", Index: 1, CType: "APPLICATION", Value: "app-obj", Reason: "unsupported application object"},
+	}, resolution.Problems)
+}
+
+func TestNewApplicationCatalogBadTable(t *testing.T) {
+	_, err := NewApplicationCatalog("not json")
+	assert.Error(t, err)
+}
@@ -0,0 +1,305 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/r3labs/diff/v2"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// SchemaVersionKey is the key in the policy_manager settings holding
+// the schema version of the policy settings. Settings without it are
+// at version 0.
+const SchemaVersionKey = "schema_version"
+
+// MigrationFunc transforms the raw policy_manager settings from one
+// schema version to the next, in place.
+type MigrationFunc func(policyManager map[string]interface{}) error
+
+// Migration is a single step upgrading the policy settings from
+// FromVersion to FromVersion + 1.
+type Migration struct {
+	FromVersion int
+	Description string
+	Migrate     MigrationFunc
+}
+
+// ErrMigrationGap is returned by Migrate when the registered steps do
+// not cover every version from 0 to the highest one.
+var ErrMigrationGap = errors.New("policy migration: missing migration step")
+
+// MigrationRegistry holds the migration steps for the policy settings
+// schema. Steps must be registered for every version from 0 up to the
+// latest version, without gaps.
+type MigrationRegistry struct {
+	migrations map[int]Migration
+}
+
+// MigrationReport describes what migrating the policy settings did, or
+// would do in a dry run.
+type MigrationReport struct {
+	FromVersion int  `json:"fromVersion"`
+	ToVersion   int  `json:"toVersion"`
+	DryRun      bool `json:"dryRun"`
+	// Descriptions of the steps applied, in order.
+	Steps []string `json:"steps"`
+	// Changes made to the policy_manager settings, paths are
+	// relative to policy_manager.
+	Changes diff.Changelog `json:"changes"`
+}
+
+// Changed returns true if the migration changed the settings.
+func (r *MigrationReport) Changed() bool {
+	return r.FromVersion != r.ToVersion || len(r.Changes) > 0
+}
+
+// NewMigrationRegistry returns an empty MigrationRegistry.
+func NewMigrationRegistry() *MigrationRegistry {
+	return &MigrationRegistry{
+		migrations: make(map[int]Migration),
+	}
+}
+
+// Register adds the step upgrading settings from fromVersion to
+// fromVersion + 1. Registering the same version twice is an error.
+func (r *MigrationRegistry) Register(fromVersion int, description string, migrate MigrationFunc) error {
+	if fromVersion < 0 {
+		return fmt.Errorf("policy migration: invalid version %d", fromVersion)
+	}
+	if migrate == nil {
+		return fmt.Errorf("policy migration: nil migration for version %d", fromVersion)
+	}
+	if _, ok := r.migrations[fromVersion]; ok {
+		return fmt.Errorf("policy migration: migration from version %d already registered", fromVersion)
+	}
+	r.migrations[fromVersion] = Migration{
+		FromVersion: fromVersion,
+		Description: description,
+		Migrate:     migrate,
+	}
+	return nil
+}
+
+// LatestVersion returns the schema version settings are at after
+// applying every registered step. Steps past a missing version are not
+// counted, Migrate fails until the gap is filled.
+func (r *MigrationRegistry) LatestVersion() int {
+	version := 0
+	for {
+		if _, ok := r.migrations[version]; !ok {
+			return version
+		}
+		version++
+	}
+}
+
+// Migrations returns the registered steps ordered by version.
+func (r *MigrationRegistry) Migrations() []Migration {
+	migrations := make([]Migration, 0, len(r.migrations))
+	for _, migration := range r.migrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].FromVersion < migrations[j].FromVersion
+	})
+	return migrations
+}
+
+// checkContiguous returns ErrMigrationGap if a step is missing between
+// version 0 and the highest registered version. Steps may be
+// registered in any order, so this is only checked when migrating.
+func (r *MigrationRegistry) checkContiguous() error {
+	for version, migration := range r.Migrations() {
+		if migration.FromVersion != version {
+			return fmt.Errorf("%w: no step from version %d, but one from version %d (%s)",
+				ErrMigrationGap, version, migration.FromVersion, migration.Description)
+		}
+	}
+	return nil
+}
+
+// Migrate applies the steps needed to bring policyManager up to the
+// latest version and records that version in it. With dryRun set,
+// policyManager is left untouched and the report describes what
+// would change.
+func (r *MigrationRegistry) Migrate(policyManager map[string]interface{}, dryRun bool) (*MigrationReport, error) {
+	if err := r.checkContiguous(); err != nil {
+		return nil, err
+	}
+	fromVersion, err := schemaVersion(policyManager)
+	if err != nil {
+		return nil, err
+	}
+	latest := r.LatestVersion()
+	if fromVersion > latest {
+		return nil, fmt.Errorf("policy migration: settings version %d is newer than supported version %d",
+			fromVersion, latest)
+	}
+
+	report := &MigrationReport{
+		FromVersion: fromVersion,
+		ToVersion:   latest,
+		DryRun:      dryRun,
+		Steps:       []string{},
+		Changes:     diff.Changelog{},
+	}
+	if fromVersion == latest {
+		return report, nil
+	}
+
+	// always migrate a copy, so a failing step leaves the original
+	// settings unchanged. The original is copied too so both sides of
+	// the diff hold plain JSON types.
+	original, err := copyJSONObject(policyManager)
+	if err != nil {
+		return nil, err
+	}
+	migrated, err := copyJSONObject(policyManager)
+	if err != nil {
+		return nil, err
+	}
+	for version := fromVersion; version < latest; version++ {
+		migration := r.migrations[version]
+		if err := migration.Migrate(migrated); err != nil {
+			return nil, fmt.Errorf("policy migration: step from version %d (%s) failed: %w",
+				version, migration.Description, err)
+		}
+		report.Steps = append(report.Steps, migration.Description)
+	}
+	migrated[SchemaVersionKey] = float64(latest)
+
+	if report.Changes, err = diff.Diff(original, migrated); err != nil {
+		return nil, fmt.Errorf("policy migration: unable to diff migrated settings: %w", err)
+	}
+
+	if !dryRun {
+		for key := range policyManager {
+			delete(policyManager, key)
+		}
+		for key, value := range migrated {
+			policyManager[key] = value
+		}
+	}
+	return report, nil
+}
+
+// schemaVersion returns the schema version recorded in policyManager.
+func schemaVersion(policyManager map[string]interface{}) (int, error) {
+	raw, ok := policyManager[SchemaVersionKey]
+	if !ok || raw == nil {
+		return 0, nil
+	}
+	switch version := raw.(type) {
+	case float64:
+		if version == float64(int(version)) {
+			return int(version), nil
+		}
+	case int:
+		return version, nil
+	case json.Number:
+		if v, err := version.Int64(); err == nil {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("policy migration: invalid %s: %v", SchemaVersionKey, raw)
+}
+
+// copyJSONObject deep copies a JSON object by round tripping it
+// through encoding/json.
+func copyJSONObject(obj map[string]interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("policy migration: unable to copy settings: %w", err)
+	}
+	copied := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &copied); err != nil {
+		return nil, fmt.Errorf("policy migration: unable to copy settings: %w", err)
+	}
+	return copied, nil
+}
+
+// DefaultMigrations is the registry of the migrations shipped with
+// this package, used by MigratePolicySettings.
+var DefaultMigrations = NewMigrationRegistry()
+
+// policyObjectLists are the keys of the policy_manager settings
+// holding lists of Objects.
+var policyObjectLists = []string{
+	"configurations", "objects", "object_groups", "conditions",
+	"condition_groups", "rules", "quotas", "policies",
+}
+
+func init() {
+	if err := DefaultMigrations.Register(0, "set enabled on objects missing it", migrateExplicitEnabled); err != nil {
+		panic(err)
+	}
+}
+
+// migrateExplicitEnabled writes out the enabled field on every object
+// that relies on Object.UnmarshalJSON defaulting it to true.
+func migrateExplicitEnabled(policyManager map[string]interface{}) error {
+	for _, key := range policyObjectLists {
+		list, ok := policyManager[key].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range list {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, ok := obj["enabled"]; !ok {
+				obj["enabled"] = true
+			}
+		}
+	}
+	return nil
+}
+
+// MigratePolicySettings brings the policy_manager settings in
+// settingsFile up to the latest schema version of DefaultMigrations. If
+// dryRun is false and anything changed, the migrated settings are
+// written back to the file without running sync-settings -- migrations
+// change the format, not the configuration.
+func MigratePolicySettings(settingsFile *settings.SettingsFile, dryRun bool) (*MigrationReport, error) {
+	return migratePolicySettings(DefaultMigrations, settingsFile, dryRun)
+}
+
+func migratePolicySettings(registry *MigrationRegistry, settingsFile *settings.SettingsFile, dryRun bool) (*MigrationReport, error) {
+	var policyManager map[string]interface{}
+	if err := settingsFile.UnmarshalSettingsAtPath(&policyManager, PolicyConfigName); err != nil {
+		return nil, err
+	}
+
+	report, err := registry.Migrate(policyManager, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || !report.Changed() {
+		return report, nil
+	}
+
+	logger.Info("Migrating %s settings from version %d to %d\n", PolicyConfigName, report.FromVersion, report.ToVersion)
+	if err := settingsFile.SetSettingsNoSync([]string{PolicyConfigName}, policyManager); err != nil {
+		return nil, fmt.Errorf("policy migration: unable to save migrated settings: %w", err)
+	}
+	return report, nil
+}
+
+// LoadPolicySettings loads the policy_manager settings from
+// settingsFile, migrating them to the latest schema version first. The
+// migrated settings are saved back to the file.
+func LoadPolicySettings(settingsFile *settings.SettingsFile) (*PolicySettings, *MigrationReport, error) {
+	report, err := MigratePolicySettings(settingsFile, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	policySettings := &PolicySettings{}
+	if err := settingsFile.UnmarshalSettingsAtPath(policySettings, PolicyConfigName); err != nil {
+		return nil, report, err
+	}
+	return policySettings, report, nil
+}
@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/settings"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// testMigrationRegistry returns a registry with two steps, renaming a
+// key and then adding one.
+func testMigrationRegistry(t *testing.T) *MigrationRegistry {
+	registry := NewMigrationRegistry()
+	require.NoError(t, registry.Register(1, "add flag", func(policyManager map[string]interface{}) error {
+		policyManager["flag"] = true
+		return nil
+	}))
+	require.NoError(t, registry.Register(0, "rename old_rules", func(policyManager map[string]interface{}) error {
+		policyManager["rules"] = policyManager["old_rules"]
+		delete(policyManager, "old_rules")
+		return nil
+	}))
+	return registry
+}
+
+func TestMigrationRegistryRegister(t *testing.T) {
+	registry := testMigrationRegistry(t)
+	assert.Equal(t, 2, registry.LatestVersion())
+	assert.Error(t, registry.Register(1, "again", func(map[string]interface{}) error { return nil }))
+	assert.Error(t, registry.Register(-1, "negative", func(map[string]interface{}) error { return nil }))
+	assert.Error(t, registry.Register(5, "nil", nil))
+
+	descriptions := []string{}
+	for _, migration := range registry.Migrations() {
+		descriptions = append(descriptions, migration.Description)
+	}
+	assert.Equal(t, []string{"rename old_rules", "add flag"}, descriptions)
+}
+
+func TestMigrationRegistryMigrate(t *testing.T) {
+	tests := []struct {
+		name          string
+		settings      map[string]interface{}
+		dryRun        bool
+		expected      map[string]interface{}
+		expectedSteps []string
+		expectedErr   bool
+	}{
+		{
+			name:          "from no version",
+			settings:      map[string]interface{}{"old_rules": []interface{}{"a"}},
+			expected:      map[string]interface{}{"rules": []interface{}{"a"}, "flag": true, SchemaVersionKey: float64(2)},
+			expectedSteps: []string{"rename old_rules", "add flag"},
+		},
+		{
+			name:          "from intermediate version",
+			settings:      map[string]interface{}{"rules": []interface{}{}, SchemaVersionKey: float64(1)},
+			expected:      map[string]interface{}{"rules": []interface{}{}, "flag": true, SchemaVersionKey: float64(2)},
+			expectedSteps: []string{"add flag"},
+		},
+		{
+			name:          "dry run leaves settings alone",
+			settings:      map[string]interface{}{"old_rules": "x"},
+			dryRun:        true,
+			expected:      map[string]interface{}{"old_rules": "x"},
+			expectedSteps: []string{"rename old_rules", "add flag"},
+		},
+		{
+			name:          "already latest",
+			settings:      map[string]interface{}{SchemaVersionKey: float64(2)},
+			expected:      map[string]interface{}{SchemaVersionKey: float64(2)},
+			expectedSteps: []string{},
+		},
+		{
+			name:        "newer than supported",
+			settings:    map[string]interface{}{SchemaVersionKey: float64(3)},
+			expectedErr: true,
+		},
+		{
+			name:        "bad version",
+			settings:    map[string]interface{}{SchemaVersionKey: "two"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := testMigrationRegistry(t).Migrate(tt.settings, tt.dryRun)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, tt.settings)
+			assert.Equal(t, tt.expectedSteps, report.Steps)
+			assert.Equal(t, tt.dryRun, report.DryRun)
+			assert.Equal(t, 2, report.ToVersion)
+			assert.Equal(t, len(tt.expectedSteps) > 0, report.Changed())
+		})
+	}
+}
+
+func TestMigrationRegistryMigrateFailure(t *testing.T) {
+	registry := testMigrationRegistry(t)
+	require.NoError(t, registry.Register(2, "broken", func(policyManager map[string]interface{}) error {
+		policyManager["partial"] = true
+		return errors.New("broken")
+	}))
+
+	policyManager := map[string]interface{}{"old_rules": "x"}
+	_, err := registry.Migrate(policyManager, false)
+	assert.Error(t, err)
+	assert.Equal(t, map[string]interface{}{"old_rules": "x"}, policyManager)
+}
+
+func TestMigrationRegistryMigrateGap(t *testing.T) {
+	registry := testMigrationRegistry(t)
+	require.NoError(t, registry.Register(3, "after a gap", func(policyManager map[string]interface{}) error {
+		policyManager["late"] = true
+		return nil
+	}))
+	assert.Equal(t, 2, registry.LatestVersion())
+
+	policyManager := map[string]interface{}{"old_rules": "x"}
+	_, err := registry.Migrate(policyManager, false)
+	assert.ErrorIs(t, err, ErrMigrationGap)
+	assert.Equal(t, map[string]interface{}{"old_rules": "x"}, policyManager)
+
+	// filling the gap makes every step apply.
+	require.NoError(t, registry.Register(2, "fill the gap", func(map[string]interface{}) error { return nil }))
+	report, err := registry.Migrate(policyManager, false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.ToVersion)
+	assert.Equal(t, true, policyManager["late"])
+}
+
+func TestMigratePolicySettings(t *testing.T) {
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "./testdata/test_settings.json")
+	defer cleanup()
+	settingsFile := settings.NewSettingsFile(tempfile)
+
+	report, err := MigratePolicySettings(settingsFile, true)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.FromVersion)
+	assert.Equal(t, DefaultMigrations.LatestVersion(), report.ToVersion)
+	assert.NotEmpty(t, report.Changes)
+
+	// the dry run did not write anything.
+	var version interface{}
+	assert.Error(t, settingsFile.UnmarshalSettingsAtPath(&version, PolicyConfigName, SchemaVersionKey))
+
+	policySettings, report, err := LoadPolicySettings(settingsFile)
+	require.NoError(t, err)
+	assert.True(t, report.Changed())
+	assert.Equal(t, DefaultMigrations.LatestVersion(), policySettings.SchemaVersion)
+
+	var rawRules []map[string]interface{}
+	require.NoError(t, settingsFile.UnmarshalSettingsAtPath(&rawRules, PolicyConfigName, "rules"))
+	for _, rule := range rawRules {
+		assert.Contains(t, rule, "enabled")
+	}
+
+	// loading again is a no-op.
+	_, report, err = LoadPolicySettings(settingsFile)
+	require.NoError(t, err)
+	assert.False(t, report.Changed())
+}
@@ -17,6 +17,7 @@ const (
 // Those arrays are loaded from the json primarily by mapstructure.
 // facilitate lookup.
 type PolicySettings struct {
+	SchemaVersion   int                    `json:"schema_version,omitempty"`
 	Enabled         bool                   `json:"enabled"`
 	Configurations  []*PolicyConfiguration `json:"configurations"`
 	Objects         []*Object              `json:"objects"`
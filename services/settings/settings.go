@@ -73,12 +73,19 @@ func Startup() {
 		settingsFile = locateOrDefault(settingsFile)
 		defaultsFile = locateOrDefault(defaultsFile)
 		currentFile = locateOrDefault(currentFile)
+		if err := LoadDefaultSchemas(); err != nil {
+			logger.Warn("Unable to load the settings schemas: %s\n", err.Error())
+		}
+		startTypesWatch()
 	})
 }
 
 // Shutdown settings service
 func Shutdown() {
-
+	if stopTypesWatch != nil {
+		stopTypesWatch()
+		stopTypesWatch = nil
+	}
 }
 
 // SetSighupProperties sets the properties of running sighup, such as if it should and the processes to sighup
@@ -123,17 +130,21 @@ func NewSettingsFileForTesting(filename string) *SettingsFile {
 	}
 }
 
-// GetCurrentSettings returns the current settings from the specified path
-// the current settings are the settings after being synced
+// GetCurrentSettings returns the effective settings at the specified
+// path: the current settings, the settings after being synced, over the
+// saved settings and the defaults. A missing file is skipped, so before
+// current.json is saved the saved settings are returned.
+// see GetLayeredSettings for where each value comes from
 func GetCurrentSettings(segments []string) (interface{}, error) {
-	// for backwards compatibility before we saved current.json
-	// if it does not exist, just read settings.json
-	// XXX this should be removed at some point in the future
-
-	if _, err := os.Stat(currentFile); os.IsNotExist(err) {
-		return GetSettingsFile(segments, settingsFile)
+	layered, err := GetLayeredSettings()
+	if err != nil {
+		return createJSONErrorObject(err), err
 	}
-	return GetSettingsFile(segments, currentFile)
+	value, _, err := layered.Get(segments)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	return value, nil
 }
 
 // Deprecated, use UnmarshallSettingsAtPath!
@@ -143,13 +154,15 @@ func GetSettings(segments []string) (interface{}, error) {
 }
 
 // SetSettings updates the settings
-func SetSettings(segments []string, value interface{}, force bool, skipEosConfig bool) (interface{}, error) {
-	return SetSettingsFile(segments, value, settingsFile, force, skipEosConfig)
+// the optional audit says who makes the change and why
+func SetSettings(segments []string, value interface{}, force bool, skipEosConfig bool, audit ...AuditInfo) (interface{}, error) {
+	return SetSettingsFile(segments, value, settingsFile, force, skipEosConfig, audit...)
 }
 
 // TrimSettings trims the settings
-func TrimSettings(segments []string) (interface{}, error) {
-	return TrimSettingsFile(segments, settingsFile)
+// the optional audit says who makes the change and why
+func TrimSettings(segments []string, audit ...AuditInfo) (interface{}, error) {
+	return TrimSettingsFile(segments, settingsFile, audit...)
 }
 
 // GetDefaultSettings returns the default settings from the specified path
@@ -164,15 +177,14 @@ func GetDefaultSettings(segments []string) (interface{}, error) {
 // PathUnmarshaller having been constructed with a reader that reads
 // from settingsFile.
 func UnmarshalSettingsAtPath(output interface{}, path ...string) error {
-	saveLocker.RLock()
-	defer saveLocker.RUnlock()
-	reader, err := os.Open(settingsFile)
-	if err != nil {
-		return err
-	}
-	unmarshaller := NewPathUnmarshaller(reader)
-	err = unmarshaller.UnmarshalAtPath(output, path...)
-	return err
+	return settingsFileAt(settingsFile).UnmarshalSettingsAtPath(output, path...)
+}
+
+// UnmarshalSettingsAtPaths reads the settings file once and
+// unmarshals the objects at each path of targets, see
+// PathUnmarshaller.UnmarshalPaths.
+func UnmarshalSettingsAtPaths(targets map[string]any) error {
+	return settingsFileAt(settingsFile).UnmarshalSettingsAtPaths(targets)
 }
 
 // GetSettingsFile returns the settings from the specified path of the specified filename
@@ -194,30 +206,30 @@ func GetSettingsFile(segments []string, filename string) (interface{}, error) {
 }
 
 // SetSettingsFile updates the settings
-func SetSettingsFile(segments []string, value interface{}, filename string, force bool, skipEosConfig bool) (interface{}, error) {
-	var ok bool
-	var err error
-	var jsonSettings map[string]interface{}
-	var newSettings interface{}
-
-	jsonSettings, err = readSettingsFileJSON(filename)
-	if err != nil {
-		return createJSONErrorObject(err), err
-	}
-
-	newSettings, err = setSettingsInJSON(jsonSettings, segments, value)
-	if err != nil {
-		return createJSONErrorObject(err), err
-	}
-	jsonSettings, ok = newSettings.(map[string]interface{})
-	if !ok {
-		err = errors.New("invalid global settings object")
-		return createJSONErrorObject(err), err
-	}
-
-	saveLocker.Lock()
-	output, err := syncAndSave(jsonSettings, filename, force, skipEosConfig)
-	saveLocker.Unlock()
+// the optional audit says who makes the change and why
+func SetSettingsFile(segments []string, value interface{}, filename string, force bool, skipEosConfig bool, audit ...AuditInfo) (interface{}, error) {
+	return settingsFileAt(filename).setSettings(AuditOperationSet, auditInfo(audit), segments, value, force, skipEosConfig)
+}
+
+// settingsFileAt returns the SettingsFile the package level functions
+// use for filename: the singleton if it is the same file, else one
+// locked with the same lock, so the secrets, audit, history and
+// watchers of the file are handled the same either way.
+func settingsFileAt(filename string) *SettingsFile {
+	initSettingsFileLocker.RLock()
+	singleton := settingsFileSingleton
+	initSettingsFileLocker.RUnlock()
+	if singleton != nil && singleton.filename == filename {
+		return singleton
+	}
+	return NewSettingsFile(filename, WithLock(&saveLocker))
+}
+
+// syncResponse builds the response object of a set settings call from
+// the output and error of syncAndSave. jsonSettings are the settings
+// that were attempted to be saved to filename. If sync-settings asked
+// for a confirmation the error is translated for the UI.
+func syncResponse(output string, err error, filename string, jsonSettings map[string]interface{}) (interface{}, error) {
 	if err != nil {
 		var errJSON map[string]interface{}
 		marshalErr := json.Unmarshal([]byte(err.Error()), &errJSON)
@@ -249,10 +261,17 @@ func RegisterSyncCallback(callback func()) {
 }
 
 // readSettingsFileJSON reads the settings file and return the corresponding JSON object
+// The secrets sealed with the package store are redacted, see WithSecrets.
 func readSettingsFileJSON(filename string) (map[string]interface{}, error) {
+	return readSettingsFileJSONSecrets(filename, false)
+}
+
+// readSettingsFileJSONSecrets is readSettingsFileJSON, with the secrets
+// in plaintext if withSecrets is set, for the sync.
+func readSettingsFileJSONSecrets(filename string, withSecrets bool) (map[string]interface{}, error) {
 	saveLocker.RLock()
 	defer saveLocker.RUnlock()
-	raw, err := os.ReadFile(filename)
+	raw, err := readSettingsBytes(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -263,7 +282,7 @@ func readSettingsFileJSON(filename string) (map[string]interface{}, error) {
 	}
 	j, ok := jsonObject.(map[string]interface{})
 	if ok {
-		return j, nil
+		return readableSecrets(settingsSecrets, j, withSecrets)
 	}
 
 	return nil, errors.New("invalid settings file format")
@@ -275,7 +294,7 @@ func writeSettingsFileJSON(jsonObject map[string]interface{}, file *os.File) (bo
 
 	// Marshal it back to a string (with ident)
 	var jsonBytes []byte
-	jsonBytes, err = json.MarshalIndent(jsonObject, "", "  ")
+	jsonBytes, err = encodeSettings(jsonObject)
 	if err != nil {
 		return false, err
 	}
@@ -303,7 +322,15 @@ func createJSONErrorObject(e error) map[string]interface{} {
 }
 
 // getArrayIndex get an array value by index as a string
+// the index may also select an element by its id, as in "[id=abc]"
 func getArrayIndex(array []interface{}, idx string) (interface{}, error) {
+	if isIDSelector(idx) {
+		i, err := findArrayIndex(array, idx)
+		if err != nil {
+			return nil, err
+		}
+		return array[i], nil
+	}
 	i, err := strconv.Atoi(idx)
 	if err != nil {
 		return nil, err
@@ -316,7 +343,16 @@ func getArrayIndex(array []interface{}, idx string) (interface{}, error) {
 
 // setArray index sets the value of element specified by the idx as a string
 // to the specified value
+// the index may also select an element by its id, as in "[id=abc]"
 func setArrayIndex(array []interface{}, idx string, value interface{}) ([]interface{}, error) {
+	if isIDSelector(idx) {
+		i, err := findArrayIndex(array, idx)
+		if err != nil {
+			return nil, err
+		}
+		array[i] = value
+		return array, nil
+	}
 	i, err := strconv.Atoi(idx)
 	if err != nil {
 		return nil, err
@@ -366,21 +402,17 @@ func setObjectIndex(obj interface{}, idx string, value interface{}) (interface{}
 }
 
 // TrimSettingsFile trims the settings in the specified file
-func TrimSettingsFile(segments []string, filename string) (interface{}, error) {
+// the optional audit says who makes the change and why
+func TrimSettingsFile(segments []string, filename string, audit ...AuditInfo) (interface{}, error) {
+	return settingsFileAt(filename).TrimSettings(segments, audit...)
+}
+
+// trimSettingsInJSON deletes the attribute specified by the segments
+// path from jsonSettings. A path that does not exist is not an error,
+// but a path going through a non-dict value is.
+func trimSettingsInJSON(jsonSettings map[string]interface{}, segments []string) error {
 	var ok bool
-	var err error
 	var iterJSONObject map[string]interface{}
-	var jsonSettings map[string]interface{}
-
-	if segments == nil {
-		err = errors.New("invalid trim settings path")
-		return createJSONErrorObject(err), err
-	}
-
-	jsonSettings, err = readSettingsFileJSON(filename)
-	if err != nil {
-		return createJSONErrorObject(err), err
-	}
 
 	iterJSONObject = jsonSettings
 
@@ -408,18 +440,11 @@ func TrimSettingsFile(segments []string, filename string) (interface{}, error) {
 				iterJSONObject[value] = j
 				iterJSONObject = j // for next iteration
 			} else {
-				err = errors.New("Non-dict found in path: " + string(value))
-				return createJSONErrorObject(err), err
+				return errors.New("Non-dict found in path: " + string(value))
 			}
 		}
 	}
-
-	output, err := syncAndSave(jsonSettings, filename, false, false)
-	if err != nil {
-		return map[string]interface{}{"error": err.Error(), "output": output}, err
-	}
-
-	return map[string]interface{}{"output": output}, err
+	return nil
 }
 
 // setSettingsInJSON sets the value attribute specified of the segments path to the specified value
@@ -473,6 +498,10 @@ func getSettingsFromJSON(jsonObject interface{}, segments []string) (interface{}
 	}
 }
 
+// syncSettingsRunner is the function syncAndSave uses to run
+// sync-settings, tests replace it.
+var syncSettingsRunner = runSyncSettings
+
 // runSyncSettings runs sync-settings on the specified filename
 func runSyncSettings(filename string, force bool, skipEosConfig bool) (string, error) {
 
@@ -539,7 +568,10 @@ func syncSystemFiles() {
 // it copies the tmp file to the destination specified in filename
 // if sync-settings does not succeed it returns the error and output
 // returns stdout, stderr, and an error
-func syncAndSave(jsonObject map[string]interface{}, filename string, force bool, skipEosConfig bool) (string, error) {
+// The secrets of jsonObject are plaintext, as the handlers and
+// sync-settings need them; they are sealed with secrets only in the
+// copy stored to filename.
+func syncAndSave(jsonObject map[string]interface{}, filename string, secrets *SecretStore, force bool, skipEosConfig bool) (string, error) {
 	// we want this to run after all files have been closed
 	// so we defer it as soon as possible
 	defer syncSystemFiles()
@@ -551,14 +583,37 @@ func syncAndSave(jsonObject map[string]interface{}, filename string, force bool,
 	}
 	defer tmpfile.Close()
 
+	// keys with an in-process handler are applied by it, sync-settings
+	// only runs for the others.
+	plan, err := syncHandlers.plan(readCurrentSettingsForSync(filename, secrets), jsonObject)
+	if err != nil {
+		return "Failed to order sync handlers.", err
+	}
+	if err = plan.validate(); err != nil {
+		return "", err
+	}
+
+	// sync-settings is not given the keys with a handler, they are
+	// merged back into the settings it leaves before they are stored.
 	logger.Info("Writing settings to %v\n", tmpfile.Name())
-	_, syncError := writeSettingsFileJSON(jsonObject, tmpfile)
+	_, syncError := writeSettingsFileJSON(plan.externalSettings(jsonObject), tmpfile)
 	if syncError != nil {
 		logger.Warn("Failed to write settings file: %v\n", syncError.Error())
 		return "Failed to write settings.", syncError
 	}
 
-	output, err := runSyncSettings(tmpfile.Name(), force, skipEosConfig)
+	applied, err := plan.apply()
+	if err != nil {
+		plan.rollback(applied)
+		return plan.output(false), err
+	}
+
+	output := plan.output(false)
+	if plan.external {
+		var externalOutput string
+		externalOutput, err = syncSettingsRunner(tmpfile.Name(), force, skipEosConfig)
+		output += externalOutput
+	}
 	scanner := bufio.NewScanner(strings.NewReader(output))
 	for scanner.Scan() {
 		logger.Info("sync-settings: %v\n", scanner.Text())
@@ -566,25 +621,37 @@ func syncAndSave(jsonObject map[string]interface{}, filename string, force bool,
 
 	if err != nil {
 		logger.Warn("sync-settings return an error: %v\n", err.Error())
+		plan.rollback(applied)
 		return output, err
 	}
 
 	logger.Info("Copy settings from %v to  %v\n", tmpfile.Name(), filename)
-	outfile, err := os.Create(filename)
-	if err != nil {
-		return output, err
-	}
-	defer outfile.Close()
-
 	// go back to start of file
 	if _, err = tmpfile.Seek(0, 0); err != nil {
 		logger.Warn("Failed to set offset for read/write on a file: %v\n", err.Error())
 	}
-	_, err = io.Copy(outfile, tmpfile)
+	synced, err := io.ReadAll(tmpfile)
 	if err != nil {
+		logger.Warn("Failed to read file: %v\n", err.Error())
+		plan.rollback(applied)
+		return output, err
+	}
+	if synced, err = plan.mergeHandled(synced); err != nil {
+		logger.Warn("Failed to merge the settings applied in-process: %v\n", err.Error())
+		plan.rollback(applied)
+		return output, err
+	}
+	if synced, err = sealSettingsBytes(secrets, filename, synced); err != nil {
+		logger.Warn("Failed to seal the settings secrets: %v\n", err.Error())
+		plan.rollback(applied)
+		return output, err
+	}
+	if err = writeSettingsBytes(filename, synced); err != nil {
 		logger.Warn("Failed to copy file: %v\n", err.Error())
+		plan.rollback(applied)
 		return output, err
 	}
+	syncHandlers.recordApplied(filename, plan)
 
 	logger.Debug("Calling registered callbacks\n")
 	for _, cb := range syncCallbacks {
@@ -0,0 +1,475 @@
+package settings
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r3labs/diff/v2"
+)
+
+const (
+	// DefaultMaxAuditRecords is the number of records kept by an
+	// AuditLog unless WithMaxAuditRecords is used.
+	DefaultMaxAuditRecords = 1000
+
+	// auditSuffix is appended to the name of a settings file to get its
+	// audit log.
+	auditSuffix = ".audit"
+
+	// maxAuditChanges is the number of changes kept in the summary of a
+	// record.
+	maxAuditChanges = 20
+
+	// maxAuditValueLength is the length values in the summary are
+	// truncated to.
+	maxAuditValueLength = 80
+)
+
+// Operations of AuditRecords.
+const (
+	AuditOperationSet         = "set"
+	AuditOperationSetNoSync   = "set_no_sync"
+	AuditOperationTrim        = "trim"
+	AuditOperationTransaction = "transaction"
+	AuditOperationRestore     = "restore"
+	AuditOperationRotateKey   = "rotate_key"
+)
+
+// Results of AuditRecords.
+const (
+	AuditResultOK      = "ok"
+	AuditResultFailed  = "failed"
+	AuditResultConfirm = "confirm"
+)
+
+// AuditInfo says who makes a settings change and why. The mutating
+// settings calls take it as an optional last argument.
+type AuditInfo struct {
+	Actor  string `json:"actor,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditContextKey is the context key of AuditInfo.
+type auditContextKey struct{}
+
+// ContextWithAuditInfo returns a copy of ctx carrying info, for
+// AuditInfoFromContext.
+func ContextWithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, info)
+}
+
+// AuditInfoFromContext returns the AuditInfo carried by ctx, if any.
+func AuditInfoFromContext(ctx context.Context) AuditInfo {
+	info, _ := ctx.Value(auditContextKey{}).(AuditInfo)
+	return info
+}
+
+// auditInfo returns the optional AuditInfo argument of a call.
+func auditInfo(audit []AuditInfo) AuditInfo {
+	if len(audit) == 0 {
+		return AuditInfo{}
+	}
+	return audit[0]
+}
+
+// AuditChange is a single change in the summary of an AuditRecord.
+// Values are compact JSON, truncated, with secrets redacted.
+type AuditChange struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// AuditRecord describes a change of a settings file.
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Operation string    `json:"operation"`
+	Filename  string    `json:"filename"`
+	// Paths are the "/" separated paths the change was made at, or the
+	// paths of the changes if it was made at the root.
+	Paths []string `json:"paths"`
+	// Changes summarizes the difference made, or attempted if the
+	// change failed. TotalChanges counts all of them.
+	Changes      []AuditChange `json:"changes"`
+	TotalChanges int           `json:"totalChanges"`
+	Result       string        `json:"result"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// matchesPathPrefix returns whether a path of the record or of its
+// changes starts with prefix.
+func (record *AuditRecord) matchesPathPrefix(prefix string) bool {
+	for _, path := range record.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, change := range record.Changes {
+		if strings.HasPrefix(change.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditQuery selects AuditRecords. Zero fields select everything.
+type AuditQuery struct {
+	// Since and Until bound the timestamps, inclusive.
+	Since time.Time
+	Until time.Time
+	Actor string
+	// PathPrefix is a "/" separated path prefix, such as "wan" or
+	// "network/interfaces".
+	PathPrefix string
+	// Limit is the maximum number of records returned.
+	Limit int
+}
+
+// matches returns whether the record is selected by the query.
+func (query *AuditQuery) matches(record *AuditRecord) bool {
+	if !query.Since.IsZero() && record.Timestamp.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && record.Timestamp.After(query.Until) {
+		return false
+	}
+	if query.Actor != "" && record.Actor != query.Actor {
+		return false
+	}
+	prefix := strings.Trim(query.PathPrefix, "/")
+	return prefix == "" || record.matchesPathPrefix(prefix)
+}
+
+// AuditLog is a bounded local log of AuditRecords, stored as JSON
+// lines. Once it grows half again past its limit, the oldest records
+// are dropped.
+type AuditLog struct {
+	filename   string
+	maxRecords int
+	now        func() time.Time
+
+	mutex sync.Mutex
+	// count of records in the file, -1 until it is read.
+	count int
+}
+
+// AuditLogOption is an option for NewAuditLog.
+type AuditLogOption func(*AuditLog)
+
+// WithMaxAuditRecords sets how many records are kept.
+func WithMaxAuditRecords(max int) AuditLogOption {
+	return func(log *AuditLog) {
+		log.maxRecords = max
+	}
+}
+
+// NewAuditLog creates an AuditLog stored in filename.
+func NewAuditLog(filename string, opts ...AuditLogOption) *AuditLog {
+	log := &AuditLog{
+		filename:   filename,
+		maxRecords: DefaultMaxAuditRecords,
+		now:        time.Now,
+		count:      -1,
+	}
+	for _, opt := range opts {
+		opt(log)
+	}
+	if log.maxRecords < 1 {
+		log.maxRecords = 1
+	}
+	return log
+}
+
+// auditLogs holds the audit logs of the settings files auditing is
+// enabled for, so every SettingsFile of a file shares it. Only the
+// system settings file is audited unless EnableAuditLog is called.
+var auditLogs = struct {
+	sync.Mutex
+	logs map[string]*AuditLog
+}{logs: map[string]*AuditLog{}}
+
+// EnableAuditLog enables auditing the changes made to the settings file
+// filename, including through the package level functions, and returns
+// its audit log, which is stored next to it.
+func EnableAuditLog(filename string) *AuditLog {
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+	return auditLogForLocked(filename)
+}
+
+// DisableAuditLog stops auditing the settings file filename. The
+// SettingsFiles already created with its audit log keep using it.
+func DisableAuditLog(filename string) {
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+	delete(auditLogs.logs, filename)
+}
+
+// GetAuditLog returns the audit log of the settings file filename, or
+// nil if it is not audited.
+func GetAuditLog(filename string) *AuditLog {
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+	if log, ok := auditLogs.logs[filename]; ok {
+		return log
+	}
+	if filename == settingsFile {
+		return auditLogForLocked(filename)
+	}
+	return nil
+}
+
+// auditLogForLocked returns the audit log of the settings file,
+// creating it if needed. The auditLogs lock must be held.
+func auditLogForLocked(filename string) *AuditLog {
+	log, ok := auditLogs.logs[filename]
+	if !ok {
+		log = NewAuditLog(filename + auditSuffix)
+		auditLogs.logs[filename] = log
+	}
+	return log
+}
+
+// WithAuditLog records the changes made through the SettingsFile in
+// log. Without it only the changes of the system settings file, or of
+// a file EnableAuditLog was called for, are recorded.
+func WithAuditLog(log *AuditLog) SettingsOption {
+	return func(file *SettingsFile) {
+		file.audit = log
+	}
+}
+
+// AuditLog returns the audit log of the settings file, or nil if its
+// changes are not audited.
+func (file *SettingsFile) AuditLog() *AuditLog {
+	return file.audit
+}
+
+// readRecordsLocked reads all records, oldest first. Malformed lines
+// are skipped. The mutex must be held.
+func (log *AuditLog) readRecordsLocked() ([]AuditRecord, error) {
+	raw, err := os.ReadFile(log.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return []AuditRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Append adds the record to the log, timestamped now unless it has a
+// timestamp.
+func (log *AuditLog) Append(record AuditRecord) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if record.Timestamp.IsZero() {
+		record.Timestamp = log.now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if log.count < 0 {
+		records, err := log.readRecordsLocked()
+		if err != nil {
+			return err
+		}
+		log.count = len(records)
+	}
+
+	output, err := os.OpenFile(log.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(append(line, '\n'))
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.count++
+
+	if log.count > log.maxRecords+log.maxRecords/2 {
+		return log.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked drops the oldest records beyond the limit. The mutex
+// must be held.
+func (log *AuditLog) compactLocked() error {
+	records, err := log.readRecordsLocked()
+	if err != nil {
+		return err
+	}
+	if len(records) > log.maxRecords {
+		records = records[len(records)-log.maxRecords:]
+	}
+	var buffer bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+	if err := writeFileAtomic(log.filename, buffer.Bytes()); err != nil {
+		return err
+	}
+	log.count = len(records)
+	return nil
+}
+
+// Query returns the records selected by query, newest first.
+func (log *AuditLog) Query(query AuditQuery) ([]AuditRecord, error) {
+	log.mutex.Lock()
+	records, err := log.readRecordsLocked()
+	log.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []AuditRecord{}
+	for i := len(records) - 1; i >= 0; i-- {
+		if !query.matches(&records[i]) {
+			continue
+		}
+		selected = append(selected, records[i])
+		if query.Limit > 0 && len(selected) >= query.Limit {
+			break
+		}
+	}
+	return selected, nil
+}
+
+// auditedChange collects the AuditRecord of a change while it is made.
+type auditedChange struct {
+	log     *AuditLog
+	secrets *SecretStore
+	record  AuditRecord
+	before  map[string]interface{}
+}
+
+// beginAudit starts the audit of a change of filename at paths, reading
+// the settings before the change.
+func beginAudit(log *AuditLog, secrets *SecretStore, filename string, operation string, info AuditInfo, paths ...[]string) *auditedChange {
+	change := &auditedChange{
+		log:     log,
+		secrets: secrets,
+		record: AuditRecord{
+			Actor:     info.Actor,
+			Reason:    info.Reason,
+			Operation: operation,
+			Filename:  filename,
+			Paths:     []string{},
+		},
+	}
+	if log == nil {
+		return change
+	}
+	for _, path := range paths {
+		if len(path) > 0 {
+			change.record.Paths = append(change.record.Paths, strings.Join(path, "/"))
+		}
+	}
+	if raw, err := readSettingsBytes(filename); err == nil {
+		_ = json.Unmarshal(raw, &change.before)
+	}
+	return change
+}
+
+// beginAudit starts the audit of a change of the settings file.
+func (file *SettingsFile) beginAudit(operation string, info AuditInfo, paths ...[]string) *auditedChange {
+	return beginAudit(file.audit, file.secrets, file.filename, operation, info, paths...)
+}
+
+// finish records the change. after are the settings it made, or
+// attempted if err is set. Failing to record is only logged.
+func (change *auditedChange) finish(after map[string]interface{}, err error) {
+	if change.log == nil {
+		return
+	}
+	record := &change.record
+	record.Result = AuditResultOK
+	if err != nil {
+		record.Result = AuditResultFailed
+		if strings.Contains(err.Error(), "CONFIRM") {
+			record.Result = AuditResultConfirm
+		}
+		record.Error = truncateAuditValue(err.Error())
+	}
+
+	record.Changes = []AuditChange{}
+	changelog, diffErr := diff.Diff(change.secrets.Redact(change.before), change.secrets.Redact(after))
+	if diffErr != nil {
+		logger.Debug("Unable to summarize the settings change: %s\n", diffErr.Error())
+	}
+	sort.SliceStable(changelog, func(i, j int) bool {
+		return strings.Join(changelog[i].Path, "/") < strings.Join(changelog[j].Path, "/")
+	})
+	record.TotalChanges = len(changelog)
+	for i, entry := range changelog {
+		if i >= maxAuditChanges {
+			break
+		}
+		record.Changes = append(record.Changes, AuditChange{
+			Type: entry.Type,
+			Path: strings.Join(entry.Path, "/"),
+			From: auditValue(entry.From),
+			To:   auditValue(entry.To),
+		})
+	}
+	if len(record.Paths) == 0 {
+		for _, auditChange := range record.Changes {
+			record.Paths = append(record.Paths, auditChange.Path)
+		}
+	}
+
+	if err := change.log.Append(*record); err != nil {
+		logger.Warn("Unable to record the settings change of %s in the audit log: %s\n", record.Filename, err.Error())
+	}
+}
+
+// auditValue renders a value for the summary.
+func auditValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return truncateAuditValue(string(raw))
+}
+
+// truncateAuditValue truncates value to maxAuditValueLength.
+func truncateAuditValue(value string) string {
+	if len(value) <= maxAuditValueLength {
+		return value
+	}
+	return value[:maxAuditValueLength-3] + "..."
+}
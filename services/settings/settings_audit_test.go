@@ -0,0 +1,194 @@
+package settings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+func TestAuditLogQuery(t *testing.T) {
+	log := NewAuditLog(filepath.Join(t.TempDir(), "settings.json.audit"), WithMaxAuditRecords(4))
+	start := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		actor := "alice"
+		if i%2 == 1 {
+			actor = "bob"
+		}
+		require.NoError(t, log.Append(AuditRecord{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Actor:     actor,
+			Operation: AuditOperationSet,
+			Paths:     []string{fmt.Sprintf("wan/policies/%d", i)},
+			Result:    AuditResultOK,
+		}))
+	}
+
+	// the log grew past half again its limit once, at the 7th record,
+	// and kept the newest 4.
+	records, err := log.Query(AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, start.Add(6*time.Minute), records[0].Timestamp)
+	assert.Equal(t, start.Add(3*time.Minute), records[3].Timestamp)
+
+	records, err = log.Query(AuditQuery{Actor: "bob"})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{"wan/policies/5"}, records[0].Paths)
+
+	records, err = log.Query(AuditQuery{
+		Since: start.Add(4 * time.Minute),
+		Until: start.Add(5 * time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	records, err = log.Query(AuditQuery{PathPrefix: "/wan/policies/6"})
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+	records, err = log.Query(AuditQuery{PathPrefix: "network"})
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	records, err = log.Query(AuditQuery{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestSettingsFileAudit(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	log := EnableAuditLog(tempfile)
+	defer DisableAuditLog(tempfile)
+	sf := NewSettingsFile(tempfile)
+	require.Same(t, log, sf.AuditLog())
+
+	_, err := sf.SetSettings([]string{"a", "b", "foo"}, "changed", false, false,
+		AuditInfo{Actor: "alice", Reason: "rename"})
+	require.NoError(t, err)
+	require.NoError(t, sf.SetSettingsNoSync([]string{"c"}, 1))
+	_, err = TrimSettingsFile([]string{"a", "b", "bar"}, tempfile, AuditInfo{Actor: "bob"})
+	require.NoError(t, err)
+	_, err = sf.MergePatchSettings([]string{"a"}, map[string]interface{}{"d": true}, false, false,
+		AuditInfoFromContext(ContextWithAuditInfo(context.Background(), AuditInfo{Actor: "carol"})))
+	require.NoError(t, err)
+
+	fakeSyncSettings(t, errors.New("sync failed"))
+	_, err = sf.SetSettings([]string{"a", "b", "foo"}, "again", false, false, AuditInfo{Actor: "alice"})
+	require.Error(t, err)
+
+	records, err := sf.AuditLog().Query(AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+
+	failed := records[0]
+	assert.Equal(t, AuditResultFailed, failed.Result)
+	assert.Equal(t, "sync failed", failed.Error)
+	assert.Equal(t, []AuditChange{{Type: "update", Path: "a/b/foo", From: `"changed"`, To: `"again"`}}, failed.Changes)
+
+	patched := records[1]
+	assert.Equal(t, "carol", patched.Actor)
+	assert.Equal(t, AuditOperationTransaction, patched.Operation)
+	assert.Equal(t, []string{"a"}, patched.Paths)
+	assert.Equal(t, []AuditChange{{Type: "create", Path: "a/d", To: "true"}}, patched.Changes)
+
+	trimmed := records[2]
+	assert.Equal(t, AuditOperationTrim, trimmed.Operation)
+	assert.Equal(t, "bob", trimmed.Actor)
+	assert.Equal(t, []AuditChange{{Type: "delete", Path: "a/b/bar", From: "1"}}, trimmed.Changes)
+
+	noSync := records[3]
+	assert.Equal(t, AuditOperationSetNoSync, noSync.Operation)
+	assert.Empty(t, noSync.Actor)
+
+	set := records[4]
+	assert.Equal(t, "alice", set.Actor)
+	assert.Equal(t, "rename", set.Reason)
+	assert.Equal(t, AuditOperationSet, set.Operation)
+	assert.Equal(t, tempfile, set.Filename)
+	assert.Equal(t, []string{"a/b/foo"}, set.Paths)
+	assert.Equal(t, 1, set.TotalChanges)
+	assert.Equal(t, AuditResultOK, set.Result)
+
+	records, err = sf.AuditLog().Query(AuditQuery{Actor: "alice", PathPrefix: "a/b"})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestAuditLogOptIn(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+
+	// only the system settings file is audited by default.
+	assert.Nil(t, GetAuditLog(tempfile))
+	assert.NotNil(t, GetAuditLog(settingsFile))
+	sf := NewSettingsFile(tempfile)
+	assert.Nil(t, sf.AuditLog())
+	_, err := sf.SetSettings([]string{"a", "b", "foo"}, "changed", false, false)
+	require.NoError(t, err)
+	_, err = os.Stat(tempfile + auditSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	log := EnableAuditLog(tempfile)
+	assert.Same(t, log, GetAuditLog(tempfile))
+	_, err = SetSettingsFile([]string{"a", "b", "foo"}, "again", tempfile, false, false)
+	require.NoError(t, err)
+	records, err := log.Query(AuditQuery{})
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	DisableAuditLog(tempfile)
+	assert.Nil(t, GetAuditLog(tempfile))
+	assert.NotContains(t, auditLogs.logs, tempfile)
+}
+
+func TestAuditRedactsSecrets(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/secret_settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithSecretStore(newTestSecretStore(t)),
+		WithAuditLog(NewAuditLog(filepath.Join(t.TempDir(), "audit"))))
+
+	_, err := sf.SetSettings([]string{"cloud"}, map[string]interface{}{"token": "new token", "enabled": false}, false, false)
+	require.NoError(t, err)
+
+	records, err := sf.AuditLog().Query(AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	// the token changed too, but its redacted value didn't.
+	assert.Equal(t, []AuditChange{{Type: "update", Path: "cloud/enabled", From: "true", To: "false"}}, records[0].Changes)
+}
+
+func TestAuditRestore(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/restore_settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithAuditLog(NewAuditLog(filepath.Join(t.TempDir(), "audit"))))
+
+	_, err := sf.RestoreSettingsFromFileWithAudit(
+		[]byte(`{"system": {"hostName": "restored", "httpPort": "1", "httpsPort": "2"}, "firewall": {"enabled": false}}`),
+		AuditInfo{Actor: "support", Reason: "rollback"}, "firewall")
+	require.NoError(t, err)
+
+	records, err := sf.AuditLog().Query(AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, AuditOperationRestore, records[0].Operation)
+	assert.Equal(t, "support", records[0].Actor)
+	assert.Equal(t, "rollback", records[0].Reason)
+	assert.Equal(t, AuditResultOK, records[0].Result)
+	assert.Equal(t, []AuditChange{
+		{Type: "delete", Path: "network", From: `{"interfaces":[]}`},
+		{Type: "update", Path: "system/hostName", From: `"current"`, To: `"restored"`},
+	}, records[0].Changes)
+}
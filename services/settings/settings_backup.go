@@ -0,0 +1,375 @@
+package settings
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/untangle/golang-shared/platform"
+	"github.com/untangle/golang-shared/util"
+)
+
+const (
+	// BackupManifestName is the name of the manifest in a backup.
+	BackupManifestName = "manifest.json"
+
+	// BackupSettingsName is the name of the settings file in a backup.
+	BackupSettingsName = "settings.json"
+
+	// backupFormatVersion is the version of the backup layout written
+	// by CreateBackup.
+	backupFormatVersion = 1
+
+	// backupDirTimeFormat names the directory all files of a backup
+	// are in, after the time it was created.
+	backupDirTimeFormat = "20060102-150405"
+)
+
+var (
+	// ErrBackupManifestMissing is returned when reading a backup that
+	// has no manifest, such as a backup made by the external script.
+	ErrBackupManifestMissing = errors.New("backup has no manifest")
+
+	// ErrBackupChecksumMismatch is returned when a file of a backup
+	// does not match the checksum in its manifest, or is missing.
+	ErrBackupChecksumMismatch = errors.New("backup file does not match its manifest")
+
+	// ErrBackupPlatformMismatch is returned when restoring a backup
+	// made on another platform.
+	ErrBackupPlatformMismatch = errors.New("backup was made on another platform")
+
+	// ErrBackupNotArchive is returned when reading a backup that is not
+	// a gzipped tar, such as a plain JSON backup.
+	ErrBackupNotArchive = errors.New("backup is not a gzipped tar")
+
+	// ErrBackupManifestInvalid is returned when the manifest of a
+	// backup can't be read.
+	ErrBackupManifestInvalid = errors.New("backup manifest is invalid")
+
+	// ErrBackupFormatVersion is returned when reading a backup made by
+	// a newer version of this package.
+	ErrBackupFormatVersion = errors.New("backup format version is not supported")
+)
+
+// BackupManifest describes a backup created by CreateBackup.
+type BackupManifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	Platform      string    `json:"platform"`
+	Version       string    `json:"version"`
+	UID           string    `json:"uid"`
+	Timestamp     time.Time `json:"timestamp"`
+	// Files maps the name of every other file in the backup to its
+	// SHA-256, hex encoded.
+	Files map[string]string `json:"files"`
+}
+
+// Backup is a verified backup read by ReadBackup.
+type Backup struct {
+	Manifest BackupManifest
+	// Files holds the contents of the files listed in the manifest.
+	Files map[string][]byte
+}
+
+// backupConfig holds the options of CreateBackup.
+type backupConfig struct {
+	platform   string
+	version    string
+	uid        string
+	extraFiles map[string]string
+	now        func() time.Time
+}
+
+// BackupOption is an option for CreateBackup.
+type BackupOption func(*backupConfig)
+
+// WithBackupVersion sets the software version recorded in the
+// manifest.
+func WithBackupVersion(version string) BackupOption {
+	return func(config *backupConfig) {
+		config.version = version
+	}
+}
+
+// WithBackupUID sets the UID recorded in the manifest, instead of the
+// UID of the system.
+func WithBackupUID(uid string) BackupOption {
+	return func(config *backupConfig) {
+		config.uid = uid
+	}
+}
+
+// WithBackupPlatform sets the platform recorded in the manifest,
+// instead of the detected platform.
+func WithBackupPlatform(name string) BackupOption {
+	return func(config *backupConfig) {
+		config.platform = name
+	}
+}
+
+// WithBackupFile adds the file at filename to the backup, under name.
+func WithBackupFile(name string, filename string) BackupOption {
+	return func(config *backupConfig) {
+		config.extraFiles[name] = filename
+	}
+}
+
+// currentBackupPlatform returns the name of the platform backups are
+// made on and restored to. Replaced in tests.
+var currentBackupPlatform = func() string {
+	return platform.DetectPlatform().Name
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of data.
+func fileSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateBackup creates a gzipped tar backup of the settings file,
+// along with a manifest and the files added with WithBackupFile. All
+// files are in a directory named after the creation time, so the
+// backup can still be restored by RestoreSettingsFromFile of older
+// versions.
+func (file *SettingsFile) CreateBackup(opts ...BackupOption) ([]byte, *BackupManifest, error) {
+	config := &backupConfig{
+		extraFiles: map[string]string{},
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if config.platform == "" {
+		config.platform = currentBackupPlatform()
+	}
+	if config.uid == "" {
+		if uid, err := GetUIDOpenwrt(); err == nil {
+			config.uid = uid
+		}
+	}
+
+	file.mutex.RLock()
+	settingsData, err := readSettingsBytes(file.filename)
+	file.mutex.RUnlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("backup: unable to read %s: %w", file.filename, err)
+	}
+	if settingsData, err = file.redactSecretsBytes(settingsData); err != nil {
+		return nil, nil, fmt.Errorf("backup: unable to redact %s: %w", file.filename, err)
+	}
+
+	files := map[string][]byte{BackupSettingsName: settingsData}
+	for name, filename := range config.extraFiles {
+		if name == BackupSettingsName || name == BackupManifestName || !isBackupName(name) {
+			return nil, nil, fmt.Errorf("backup: invalid file name %q", name)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup: unable to read %s: %w", filename, err)
+		}
+		files[name] = data
+	}
+
+	manifest := &BackupManifest{
+		FormatVersion: backupFormatVersion,
+		Platform:      config.platform,
+		Version:       config.version,
+		UID:           config.uid,
+		Timestamp:     config.now().UTC(),
+		Files:         make(map[string]string, len(files)),
+	}
+	for name, data := range files {
+		manifest.Files[name] = fileSHA256(data)
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dir := manifest.Timestamp.Format(backupDirTimeFormat)
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	if err := addTarFile(tarWriter, path.Join(dir, BackupManifestName), manifestData, manifest.Timestamp); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if err := addTarFile(tarWriter, path.Join(dir, name), files[name], manifest.Timestamp); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buffer.Bytes(), manifest, nil
+}
+
+// isBackupName returns whether name is a relative path that stays
+// inside the backup directory.
+func isBackupName(name string) bool {
+	return name != "" && !path.IsAbs(name) && path.Clean(name) == name && !strings.HasPrefix(name, "..")
+}
+
+// addTarFile adds a regular file to the tar.
+func addTarFile(tarWriter *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0660,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("backup: unable to add %s: %w", name, err)
+	}
+	if _, err := tarWriter.Write(data); err != nil {
+		return fmt.Errorf("backup: unable to add %s: %w", name, err)
+	}
+	return nil
+}
+
+// ReadBackup reads a backup created by CreateBackup and verifies every
+// file against the manifest. Backups without a manifest return
+// ErrBackupManifestMissing, and data that is not a gzipped tar
+// ErrBackupNotArchive.
+func ReadBackup(data []byte) (*Backup, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotArchive, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	// the files are in a single directory, named after the time.
+	files := map[string][]byte{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("backup: corrupt tar: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := header.Name
+		if slash := strings.Index(name, "/"); slash >= 0 {
+			name = name[slash+1:]
+		}
+		if files[name], err = io.ReadAll(tarReader); err != nil {
+			return nil, fmt.Errorf("backup: corrupt tar: %w", err)
+		}
+	}
+
+	manifestData, ok := files[BackupManifestName]
+	if !ok {
+		return nil, ErrBackupManifestMissing
+	}
+	backup := &Backup{Files: map[string][]byte{}}
+	if err := json.Unmarshal(manifestData, &backup.Manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackupManifestInvalid, err)
+	}
+	if backup.Manifest.FormatVersion > backupFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrBackupFormatVersion, backup.Manifest.FormatVersion)
+	}
+	if _, ok := backup.Manifest.Files[BackupSettingsName]; !ok {
+		return nil, fmt.Errorf("%w: %s is not in the manifest", ErrBackupChecksumMismatch, BackupSettingsName)
+	}
+	for name, checksum := range backup.Manifest.Files {
+		data, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is missing", ErrBackupChecksumMismatch, name)
+		}
+		if fileSHA256(data) != checksum {
+			return nil, fmt.Errorf("%w: %s", ErrBackupChecksumMismatch, name)
+		}
+		backup.Files[name] = data
+	}
+	return backup, nil
+}
+
+// RestoreReport describes a settings restore.
+type RestoreReport struct {
+	// Manifest of the backup, nil for backups without one.
+	Manifest *BackupManifest `json:"manifest,omitempty"`
+	// PreservedKeys are the keys of the exceptions whose current
+	// settings were kept, sorted.
+	PreservedKeys []string `json:"preservedKeys"`
+}
+
+// RestoreBackup restores the settings from a backup. Backups with a
+// manifest are verified and must come from the current platform;
+// older tar and plain JSON backups are restored unverified. For each of
+// the exceptions the current settings are kept; the report lists the
+// exceptions that were.
+func (file *SettingsFile) RestoreBackup(fileData []byte, exceptions ...string) (*RestoreReport, interface{}, error) {
+	return file.RestoreBackupWithAudit(fileData, AuditInfo{}, exceptions...)
+}
+
+// RestoreBackupWithAudit is RestoreBackup, audit says who restores the
+// backup and why.
+func (file *SettingsFile) RestoreBackupWithAudit(fileData []byte, audit AuditInfo, exceptions ...string) (*RestoreReport, interface{}, error) {
+	report := &RestoreReport{PreservedKeys: []string{}}
+	backup, err := ReadBackup(fileData)
+	var settingsData []byte
+	switch {
+	case err == nil:
+		if current := currentBackupPlatform(); backup.Manifest.Platform != current {
+			err = fmt.Errorf("%w: made on %s, restoring on %s", ErrBackupPlatformMismatch, backup.Manifest.Platform, current)
+			return report, createJSONErrorObject(err), err
+		}
+		report.Manifest = &backup.Manifest
+		settingsData = backup.Files[BackupSettingsName]
+	case errors.Is(err, ErrBackupManifestMissing):
+		settingsData = legacyBackupSettings(fileData)
+	case errors.Is(err, ErrBackupNotArchive):
+		// not a tar either, it should be the JSON itself.
+		settingsData = fileData
+	default:
+		// a backup that fails its verification is not restored.
+		return report, createJSONErrorObject(err), err
+	}
+
+	var settingsJson map[string]interface{}
+	if err := json.Unmarshal(settingsData, &settingsJson); err != nil {
+		return report, createJSONErrorObject(err), err
+	}
+
+	response, preserved, err := file.setAllSettingsWithExceptions(settingsJson, audit, exceptions...)
+	report.PreservedKeys = preserved
+	return report, response, err
+}
+
+// legacyBackupSettings returns the settings of a backup made before
+// manifests, which is either a tar with a settings.json or the JSON
+// itself.
+func legacyBackupSettings(fileData []byte) []byte {
+	foundFiles, err := util.ExtractFilesFromTar(fileData, true, BackupSettingsName)
+	if err != nil {
+		logger.Warn("Failed to extract the settings restore file as a tar. Attempting to use the settings restore file as a JSON\n")
+		return fileData
+	}
+	if data, ok := foundFiles[BackupSettingsName]; ok {
+		logger.Debug("Retrieved settings restore file from tar.\n")
+		return data
+	}
+	return fileData
+}
@@ -0,0 +1,146 @@
+package settings
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// usePlatform makes the test run on the named platform.
+func usePlatform(t *testing.T, name string) {
+	orig := currentBackupPlatform
+	currentBackupPlatform = func() string { return name }
+	t.Cleanup(func() { currentBackupPlatform = orig })
+}
+
+// rewriteBackup returns the backup with the contents of the files
+// whose name ends in one of the keys of replace replaced.
+func rewriteBackup(t *testing.T, data []byte, replace map[string][]byte) []byte {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			break
+		}
+		contents, err := io.ReadAll(tarReader)
+		require.NoError(t, err)
+		if replacement, ok := replace[filepath.Base(header.Name)]; ok {
+			contents = replacement
+		}
+		header.Size = int64(len(contents))
+		require.NoError(t, tarWriter.WriteHeader(header))
+		_, err = tarWriter.Write(contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return buffer.Bytes()
+}
+
+func TestCreateAndReadBackup(t *testing.T) {
+	usePlatform(t, "OpenWrt")
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/restore_settings.json")
+	defer cleanup()
+	extra := filepath.Join(t.TempDir(), "uid")
+	require.NoError(t, os.WriteFile(extra, []byte("extra contents"), 0660))
+	sf := NewSettingsFile(tempfile)
+
+	data, manifest, err := sf.CreateBackup(
+		WithBackupVersion("1.2.3"),
+		WithBackupUID("uid-1"),
+		WithBackupFile("extra/uid", extra))
+	require.NoError(t, err)
+	assert.Equal(t, "OpenWrt", manifest.Platform)
+	assert.Equal(t, "1.2.3", manifest.Version)
+	assert.Equal(t, "uid-1", manifest.UID)
+	assert.WithinDuration(t, time.Now(), manifest.Timestamp, time.Minute)
+	assert.Len(t, manifest.Files, 2)
+
+	backup, err := ReadBackup(data)
+	require.NoError(t, err)
+	assert.Equal(t, *manifest, backup.Manifest)
+	assert.Equal(t, []byte("extra contents"), backup.Files["extra/uid"])
+	settingsData, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, settingsData, backup.Files[BackupSettingsName])
+
+	_, err = ReadBackup(rewriteBackup(t, data, map[string][]byte{"uid": []byte("tampered")}))
+	assert.ErrorIs(t, err, ErrBackupChecksumMismatch)
+	_, err = ReadBackup([]byte(`{}`))
+	assert.ErrorIs(t, err, ErrBackupNotArchive)
+	_, err = ReadBackup(rewriteBackup(t, data, map[string][]byte{BackupManifestName: []byte("{")}))
+	assert.ErrorIs(t, err, ErrBackupManifestInvalid)
+	_, err = ReadBackup(rewriteBackup(t, data, map[string][]byte{BackupManifestName: []byte(`{"formatVersion": 99}`)}))
+	assert.ErrorIs(t, err, ErrBackupFormatVersion)
+
+	_, _, err = sf.CreateBackup(WithBackupFile("../escape", extra))
+	assert.Error(t, err)
+	_, _, err = sf.CreateBackup(WithBackupFile(BackupManifestName, extra))
+	assert.Error(t, err)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	usePlatform(t, "OpenWrt")
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/restore_settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile)
+	data, _, err := sf.CreateBackup()
+	require.NoError(t, err)
+
+	// change the current settings, then restore the backup keeping
+	// some of them.
+	_, err = sf.SetSettings([]string{"system", "hostName"}, "changed", false, false)
+	require.NoError(t, err)
+	_, err = sf.SetSettings([]string{"firewall", "enabled"}, false, false, false)
+	require.NoError(t, err)
+
+	report, _, err := sf.RestoreBackup(data, "system", "missing", "system")
+	require.NoError(t, err)
+	require.NotNil(t, report.Manifest)
+	assert.Equal(t, []string{"system"}, report.PreservedKeys)
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "changed", settings["system"].(map[string]interface{})["hostName"])
+	assert.Equal(t, true, settings["firewall"].(map[string]interface{})["enabled"])
+
+	// backups failing their verification are refused, not restored as
+	// JSON.
+	before, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	for expected, backup := range map[error][]byte{
+		ErrBackupChecksumMismatch: rewriteBackup(t, data, map[string][]byte{BackupSettingsName: []byte(`{}`)}),
+		ErrBackupManifestInvalid:  rewriteBackup(t, data, map[string][]byte{BackupManifestName: []byte("{")}),
+		ErrBackupFormatVersion:    rewriteBackup(t, data, map[string][]byte{BackupManifestName: []byte(`{"formatVersion": 99}`)}),
+	} {
+		_, _, err = sf.RestoreBackup(backup)
+		assert.ErrorIs(t, err, expected)
+	}
+	after, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// backups from another platform are refused.
+	usePlatform(t, "Eos")
+	_, _, err = sf.RestoreBackup(data)
+	assert.ErrorIs(t, err, ErrBackupPlatformMismatch)
+
+	// plain JSON backups still work, through RestoreSettingsFromFile.
+	response, err := sf.RestoreSettingsFromFile([]byte(`{"system": {"httpPort": "1", "httpsPort": "2"}, "firewall": {}}`), "firewall")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"firewall"}, response.(map[string]interface{})["preservedKeys"])
+}
@@ -143,7 +143,13 @@ func TestDetermineSettingsError(t *testing.T) {
 		err = json.Unmarshal(raw, &test)
 		assert.Nil(t, err, fmt.Sprintf("Cannot unmarshal testFile %s", testFile))
 
-		result, err := buildIndividualMessage(test.Id, test.InvalidReason, test.BuildFrom, test.SettingsError)
+		// the affected values sync-settings reported for the change
+		ids, err := getInvalidItemIds(test.Id, test.BuildFrom, test.SettingsError)
+		result := make([]AffectedValue, 0, len(ids))
+		for _, id := range ids {
+			invalidItem := test.SettingsError.Confirm.InvalidItems[id]
+			result = append(result, AffectedValue{AffectedType: invalidItem.Type, AffectedValue: invalidItem.Value})
+		}
 
 		if test.ExpectError {
 			assert.NotNil(t, err, testFile)
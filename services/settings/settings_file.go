@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 
@@ -24,6 +25,22 @@ type SettingsFile struct {
 
 	// Mutex to lock the file.
 	mutex *sync.RWMutex
+
+	// watchers registered with Watch.
+	watch settingsWatchState
+
+	// schemas the settings are validated against before sync.
+	schemas *SchemaRegistry
+
+	// secrets seals the secret fields of the settings.
+	secrets *SecretStore
+
+	// withSecrets is set for the readers of the secrets in plaintext,
+	// see WithSecrets.
+	withSecrets bool
+
+	// audit records the changes of the settings.
+	audit *AuditLog
 }
 
 // SettingsOption is an option for the constructor of SettingsFile.
@@ -50,6 +67,15 @@ func NewSettingsFile(filename string, opts ...SettingsOption) *SettingsFile {
 	if file.mutex == nil {
 		file.mutex = &sync.RWMutex{}
 	}
+	if file.schemas == nil {
+		file.schemas = settingsSchemas
+	}
+	if file.secrets == nil {
+		file.secrets = settingsSecrets
+	}
+	if file.audit == nil {
+		file.audit = GetAuditLog(filename)
+	}
 	return file
 }
 
@@ -58,14 +84,67 @@ func NewSettingsFile(filename string, opts ...SettingsOption) *SettingsFile {
 func (file *SettingsFile) UnmarshalSettingsAtPath(value interface{}, settings ...string) error {
 	file.mutex.RLock()
 	defer file.mutex.RUnlock()
-	reader, err := os.Open(file.filename)
+	reader, err := openSettingsReader(file.filename)
 	if err != nil {
 		return fmt.Errorf("settings file: unable to open file %s: %w",
 			file.filename,
 			err)
 	}
+	defer reader.Close()
 	unmarshaller := NewPathUnmarshaller(reader)
-	return unmarshaller.UnmarshalAtPath(value, settings...)
+	if !file.secrets.matchesUnder(settings) {
+		return unmarshaller.UnmarshalAtPath(value, settings...)
+	}
+
+	// a value holding secrets is decoded generically first, to redact
+	// or open them.
+	var raw json.RawMessage
+	if err := unmarshaller.UnmarshalAtPath(&raw, settings...); err != nil {
+		return err
+	}
+	return file.unmarshalReadable(settings, raw, value)
+}
+
+// UnmarshalSettingsAtPaths wraps PathUnmarshaller.UnmarshalPaths,
+// taking out a read lock on the file object's lock first. All paths
+// are extracted in a single streaming pass over the file; only the
+// values holding secrets are held in memory, to redact or open them.
+func (file *SettingsFile) UnmarshalSettingsAtPaths(targets map[string]any) error {
+	file.mutex.RLock()
+	defer file.mutex.RUnlock()
+	reader, err := openSettingsReader(file.filename)
+	if err != nil {
+		return fmt.Errorf("settings file: unable to open file %s: %w",
+			file.filename,
+			err)
+	}
+	defer reader.Close()
+
+	streamed := make(map[string]any, len(targets))
+	withSecrets := map[string]*json.RawMessage{}
+	for path, target := range targets {
+		if file.secrets.matchesUnder(SplitPath(path)) {
+			raw := &json.RawMessage{}
+			withSecrets[path] = raw
+			target = raw
+		}
+		streamed[path] = target
+	}
+	err = NewPathUnmarshaller(reader).UnmarshalPaths(streamed)
+	var notFound *PathsNotFoundError
+	if err != nil && !errors.As(err, &notFound) {
+		return err
+	}
+	for path, raw := range withSecrets {
+		if len(*raw) == 0 {
+			// missing, listed in err.
+			continue
+		}
+		if readableErr := file.unmarshalReadable(SplitPath(path), *raw, targets[path]); readableErr != nil {
+			return readableErr
+		}
+	}
+	return err
 }
 
 // Returns a JSON structure(map[string]interface{}) of the current settings
@@ -73,7 +152,7 @@ func (file *SettingsFile) GetAllSettings() (map[string]interface{}, error) {
 	file.mutex.RLock()
 	defer file.mutex.RUnlock()
 
-	raw, err := os.ReadFile(file.filename)
+	raw, err := readSettingsBytes(file.filename)
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +163,7 @@ func (file *SettingsFile) GetAllSettings() (map[string]interface{}, error) {
 	}
 	j, ok := jsonObject.(map[string]interface{})
 	if ok {
-		return j, nil
+		return file.readerSecrets(j)
 	}
 
 	return nil, errors.New("invalid settings file format")
@@ -92,7 +171,8 @@ func (file *SettingsFile) GetAllSettings() (map[string]interface{}, error) {
 
 // SetSettingsNoSync writes the settings to the settings file but does
 // not call sync-settings. Likely _not_ what you want most of the time.
-func (file *SettingsFile) SetSettingsNoSync(segments []string, value any) error {
+// The optional audit says who makes the change and why.
+func (file *SettingsFile) SetSettingsNoSync(segments []string, value any, audit ...AuditInfo) error {
 	var ok bool
 	var err error
 	var jsonSettings map[string]interface{}
@@ -112,27 +192,45 @@ func (file *SettingsFile) SetSettingsNoSync(segments []string, value any) error
 		err = errors.New("invalid settings object returned from setSetingsInJSON")
 		return err
 	}
+	info := auditInfo(audit)
+	file.recordRevision("", "")
+	change := file.beginAudit(AuditOperationSetNoSync, info, segments)
+	err = file.writeSettings(jsonSettings)
+	change.finish(jsonSettings, err)
+	if err != nil {
+		return err
+	}
+	file.recordRevision(info.Actor, info.Reason)
+	settingsFileChanged(file.filename)
+	return nil
+}
+
+// writeSettings writes jsonSettings to the settings file, holding the
+// write lock.
+func (file *SettingsFile) writeSettings(jsonSettings map[string]interface{}) error {
 	file.mutex.Lock()
 	defer file.mutex.Unlock()
 
-	var openedFile *os.File
-	var marshalled []byte
-	defer openedFile.Close()
-	if openedFile, err = os.Create(file.filename); err != nil {
-		return err
-	}
-	if marshalled, err = json.Marshal(jsonSettings); err != nil {
+	jsonSettings, err := file.sealSecrets(jsonSettings)
+	if err != nil {
 		return err
 	}
-	if _, err := openedFile.Write(marshalled); err != nil {
+	marshalled, err := encodeSettings(jsonSettings)
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return writeSettingsBytes(file.filename, marshalled)
 }
 
 // SetSettings updates the settings. Calls lock/unlock on the SettingsFile's mutex
-func (file *SettingsFile) SetSettings(segments []string, value interface{}, force bool, skipEosConfig bool) (interface{}, error) {
+// The optional audit says who makes the change and why.
+func (file *SettingsFile) SetSettings(segments []string, value interface{}, force bool, skipEosConfig bool, audit ...AuditInfo) (interface{}, error) {
+	return file.setSettings(AuditOperationSet, auditInfo(audit), segments, value, force, skipEosConfig)
+}
+
+// setSettings implements SetSettings, the change is audited as
+// operation.
+func (file *SettingsFile) setSettings(operation string, info AuditInfo, segments []string, value interface{}, force bool, skipEosConfig bool) (interface{}, error) {
 	var ok bool
 	var err error
 	var jsonSettings map[string]interface{}
@@ -152,63 +250,85 @@ func (file *SettingsFile) SetSettings(segments []string, value interface{}, forc
 		err = errors.New("invalid global settings object")
 		return createJSONErrorObject(err), err
 	}
+	if response, err := validateSettings(file.schemas, jsonSettings); err != nil {
+		return response, err
+	}
 
+	file.recordRevision("", "")
 	file.mutex.Lock()
-	output, err := syncAndSave(jsonSettings, file.filename, force, skipEosConfig)
+	if jsonSettings, err = file.plaintextSecrets(jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	change := file.beginAudit(operation, info, segments)
+	output, err := syncAndSave(jsonSettings, file.filename, file.secrets, force, skipEosConfig)
 	file.mutex.Unlock()
+	change.finish(jsonSettings, err)
+	if err == nil {
+		file.recordRevision(info.Actor, info.Reason)
+		settingsFileChanged(file.filename)
+	}
+	return syncResponse(output, err, file.filename, jsonSettings)
+}
+
+// TrimSettings removes the settings at the segments path, a path that
+// does not exist is not an error. Calls lock/unlock on the
+// SettingsFile's mutex. The optional audit says who makes the change
+// and why.
+func (file *SettingsFile) TrimSettings(segments []string, audit ...AuditInfo) (interface{}, error) {
+	if segments == nil {
+		err := errors.New("invalid trim settings path")
+		return createJSONErrorObject(err), err
+	}
+
+	jsonSettings, err := file.GetAllSettings()
 	if err != nil {
-		var errJSON map[string]interface{}
-		marshalErr := json.Unmarshal([]byte(err.Error()), &errJSON)
-		if marshalErr != nil {
-			logger.Warn("Failed to marshal into json: %s\n", marshalErr.Error())
-			if strings.Contains(err.Error(), "CONFIRM") {
-				return determineSetSettingsError(err, output, file.filename, jsonSettings)
-			}
-		} else {
-			if _, ok := errJSON["CONFIRM"]; ok {
-				return determineSetSettingsError(err, output, file.filename, jsonSettings)
-			}
-		}
-		logger.Warn("Failed to save settings: %s\n", err.Error())
-		responseErr := err.Error()
-		if len(responseErr) == 0 {
-			responseErr = "failed_sync_settings"
-		}
-		return map[string]interface{}{"error": responseErr, "output": output}, err
+		return createJSONErrorObject(err), err
+	}
+	if err = trimSettingsInJSON(jsonSettings, segments); err != nil {
+		return createJSONErrorObject(err), err
+	}
+	if response, err := validateSettings(file.schemas, jsonSettings); err != nil {
+		return response, err
 	}
 
+	info := auditInfo(audit)
+	file.recordRevision("", "")
+	file.mutex.Lock()
+	if jsonSettings, err = file.plaintextSecrets(jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	change := file.beginAudit(AuditOperationTrim, info, segments)
+	output, err := syncAndSave(jsonSettings, file.filename, file.secrets, false, false)
+	file.mutex.Unlock()
+	change.finish(jsonSettings, err)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error(), "output": output}, err
+	}
+	file.recordRevision(info.Actor, info.Reason)
+	settingsFileChanged(file.filename)
+
 	return map[string]interface{}{"output": output}, err
 }
 
 // Restores settings from a backups file. The backup file should be in the form of a tar.gz with structure
 // /<directory named after date/time created>/settings.json. Initially, backups were restored with just the
 // settings.json file, so for the time being the old settings.json backups are still supported.
+// Backups made by CreateBackup are verified against their manifest first, see RestoreBackup. The
+// response lists the exceptions whose current settings were kept under "preservedKeys".
 func (file *SettingsFile) RestoreSettingsFromFile(fileData []byte, exceptions ...string) (interface{}, error) {
-	// Set settings data with what could potentially be a JSON string.
-	// If it's not, the settings data will get swapped out for what was in
-	// a tar file
-	settingsData := fileData
-
-	// A user uploaded settings file was originally a single JSON file. For
-	// backwards compatibility, if the file uploaded wasn't a JSON
-	// try treating it as a JSON
-	fileName := "settings.json"
-	foundFiles, err := util.ExtractFilesFromTar(fileData, true, fileName)
-	if err != nil {
-		logger.Warn("Failed to extract the settings restore file as a tar. Attempting to use the settings restore file as a JSON\n")
-	} else {
-		if data, ok := foundFiles[fileName]; ok {
-			settingsData = data
-			logger.Debug("Retrieved settings restore file from tar.\n")
-		}
-	}
+	return file.RestoreSettingsFromFileWithAudit(fileData, AuditInfo{}, exceptions...)
+}
 
-	var settingsJson map[string]interface{}
-	if err := json.Unmarshal(settingsData, &settingsJson); err != nil {
-		return createJSONErrorObject(err), err
+// RestoreSettingsFromFileWithAudit is RestoreSettingsFromFile, audit says
+// who restores the settings and why.
+func (file *SettingsFile) RestoreSettingsFromFileWithAudit(fileData []byte, audit AuditInfo, exceptions ...string) (interface{}, error) {
+	report, response, err := file.RestoreBackupWithAudit(fileData, audit, exceptions...)
+	if responseMap, ok := response.(map[string]interface{}); ok {
+		responseMap["preservedKeys"] = report.PreservedKeys
 	}
-
-	return file.SetAllSettingsWithExceptions(settingsJson, exceptions...)
+	return response, err
 }
 
 // Updates settings with the new settings passed in. newSettings needs to be a valid
@@ -218,21 +338,35 @@ func (file *SettingsFile) RestoreSettingsFromFile(fileData []byte, exceptions ..
 //		with an error JSON. If the settings were set, no error will be returned and a JSON response
 //	 object will be. !!!Only works for settings at the highest level in the settings json
 func (file *SettingsFile) SetAllSettingsWithExceptions(newSettings map[string]interface{}, exceptions ...string) (interface{}, error) {
+	response, _, err := file.setAllSettingsWithExceptions(newSettings, AuditInfo{}, exceptions...)
+	return response, err
+}
+
+// setAllSettingsWithExceptions implements SetAllSettingsWithExceptions,
+// it also returns the sorted exceptions that were in the current
+// settings and so were preserved. The change is audited as a restore.
+func (file *SettingsFile) setAllSettingsWithExceptions(newSettings map[string]interface{}, audit AuditInfo, exceptions ...string) (interface{}, []string, error) {
+	preserved := []string{}
 	currentSettings, err := file.GetAllSettings()
 	if err != nil {
-		return createJSONErrorObject(err), err
+		return createJSONErrorObject(err), preserved, err
 	}
 
 	for _, exception := range exceptions {
+		if _, ok := currentSettings[exception]; ok && !util.ContainsString(preserved, exception) {
+			preserved = append(preserved, exception)
+		}
 		newSettings[exception] = currentSettings[exception]
 	}
+	sort.Strings(preserved)
 
 	// Default exception: Web admin ports will be set to current settings
 	logger.Info("System settings for web admin ports will not be restored\n")
 	newSettings["system"].(map[string]interface{})["httpPort"] = currentSettings["system"].(map[string]interface{})["httpPort"].(string)
 	newSettings["system"].(map[string]interface{})["httpsPort"] = currentSettings["system"].(map[string]interface{})["httpsPort"].(string)
 
-	return file.SetSettings(nil, newSettings, true, false)
+	response, err := file.setSettings(AuditOperationRestore, audit, nil, newSettings, true, false)
+	return response, preserved, err
 }
 
 // Generates a backup of a settings file using a provided script. Locks the settings file before generation.
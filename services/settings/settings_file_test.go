@@ -28,6 +28,24 @@ func TestSettings(t *testing.T) {
 			Bar: 1})
 }
 
+// Tests unmarshalling several paths with one read
+func TestUnmarshalSettingsAtPaths(t *testing.T) {
+	s := NewSettingsFile(testSettingsFilePath)
+	var foo string
+	var bar int
+	var missing any
+	err := s.UnmarshalSettingsAtPaths(map[string]any{
+		"a/b/foo": &foo,
+		"a/b/bar": &bar,
+		"a/c":     &missing,
+	})
+	var notFound *PathsNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, []string{"a/c"}, notFound.Paths)
+	assert.Equal(t, "hello", foo)
+	assert.Equal(t, 1, bar)
+}
+
 // Tests retrieving all settings
 func TestGetAllSettings(t *testing.T) {
 	s := NewSettingsFile(testSettingsFilePath)
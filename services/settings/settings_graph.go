@@ -0,0 +1,508 @@
+package settings
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ItemKind is the kind of a settings item in a DependencyGraph. The
+// kinds are also the affected types shown by the UI.
+type ItemKind string
+
+const (
+	// ItemInterface is a network interface, identified by its interfaceId.
+	ItemInterface ItemKind = "interface"
+	// ItemPolicy is a WAN policy or a policy manager policy.
+	ItemPolicy ItemKind = "policy"
+	// ItemRule is a WAN, firewall or policy manager rule.
+	ItemRule ItemKind = "rule"
+	// ItemCondition is a policy manager condition.
+	ItemCondition ItemKind = "condition"
+	// ItemConditionGroup is a policy manager condition group.
+	ItemConditionGroup ItemKind = "condition_group"
+	// ItemObject is a policy manager object.
+	ItemObject ItemKind = "object"
+	// ItemObjectGroup is a policy manager object group.
+	ItemObjectGroup ItemKind = "object_group"
+	// ItemConfiguration is a policy manager configuration.
+	ItemConfiguration ItemKind = "configuration"
+	// ItemQuota is a policy manager quota.
+	ItemQuota ItemKind = "quota"
+	// ItemService is a whole service section, such as geoip.
+	ItemService ItemKind = "service"
+)
+
+// graphServices are the top level settings sections that are items of
+// their own.
+var graphServices = []string{"application_control", "geoip"}
+
+// ItemRef identifies a settings item.
+type ItemRef struct {
+	Kind ItemKind
+	ID   string
+}
+
+func (ref ItemRef) String() string {
+	return fmt.Sprintf("%s %s", ref.Kind, ref.ID)
+}
+
+// SettingsItem is an item of the settings, such as an interface or a
+// rule, found at Path.
+type SettingsItem struct {
+	ItemRef
+	// Name is the name or description of the item, for display.
+	Name    string
+	Enabled bool
+	Path    []string
+}
+
+// DependencyGraph holds the items of a settings object and which items
+// they reference: a rule depends on its WAN policy, which depends on
+// its interfaces. References to items that do not exist are ignored.
+type DependencyGraph struct {
+	items []*SettingsItem
+	byRef map[ItemRef]*SettingsItem
+	// dependsOn and dependents are the edges in both directions, in
+	// the order the items appear in the settings.
+	dependsOn  map[ItemRef][]ItemRef
+	dependents map[ItemRef][]ItemRef
+}
+
+// reference is a reference from an item to the item id of one of
+// kinds, resolved once every item is known.
+type reference struct {
+	from  ItemRef
+	kinds []ItemKind
+	id    string
+}
+
+// graphBuilder collects the items and references of the settings.
+type graphBuilder struct {
+	graph      *DependencyGraph
+	references []reference
+}
+
+// NewDependencyGraph builds the dependency graph of jsonSettings, the
+// whole settings object.
+func NewDependencyGraph(jsonSettings map[string]interface{}) *DependencyGraph {
+	builder := &graphBuilder{graph: &DependencyGraph{
+		byRef:      map[ItemRef]*SettingsItem{},
+		dependsOn:  map[ItemRef][]ItemRef{},
+		dependents: map[ItemRef][]ItemRef{},
+	}}
+	builder.addInterfaces(jsonSettings)
+	builder.addWAN(jsonSettings)
+	builder.addFirewall(jsonSettings)
+	builder.addPolicyManager(jsonSettings)
+	builder.addServices(jsonSettings)
+	builder.resolve()
+	return builder.graph
+}
+
+// DependencyGraph builds the dependency graph of the settings in file.
+func (file *SettingsFile) DependencyGraph() (*DependencyGraph, error) {
+	jsonSettings, err := file.GetAllSettings()
+	if err != nil {
+		return nil, err
+	}
+	return NewDependencyGraph(jsonSettings), nil
+}
+
+// Items returns every item, in the order they appear in the settings.
+func (graph *DependencyGraph) Items() []SettingsItem {
+	items := make([]SettingsItem, 0, len(graph.items))
+	for _, item := range graph.items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+// Item returns the item ref.
+func (graph *DependencyGraph) Item(ref ItemRef) (SettingsItem, bool) {
+	item, ok := graph.byRef[ref]
+	if !ok {
+		return SettingsItem{}, false
+	}
+	return *item, true
+}
+
+// ItemAt returns the item found exactly at path, such as
+// wan/policies/0.
+func (graph *DependencyGraph) ItemAt(path []string) (SettingsItem, bool) {
+	for _, item := range graph.items {
+		if equalPaths(item.Path, path) {
+			return *item, true
+		}
+	}
+	return SettingsItem{}, false
+}
+
+// ItemsUnder returns the items found at path or below it, for example
+// every interface for network.
+func (graph *DependencyGraph) ItemsUnder(path []string) []SettingsItem {
+	items := []SettingsItem{}
+	for _, item := range graph.items {
+		if len(item.Path) >= len(path) && equalPaths(item.Path[:len(path)], path) {
+			items = append(items, *item)
+		}
+	}
+	return items
+}
+
+// DependsOn returns the items ref directly depends on.
+func (graph *DependencyGraph) DependsOn(ref ItemRef) []SettingsItem {
+	return graph.itemsOf(graph.dependsOn[ref])
+}
+
+// Dependents returns the items directly depending on ref.
+func (graph *DependencyGraph) Dependents(ref ItemRef) []SettingsItem {
+	return graph.itemsOf(graph.dependents[ref])
+}
+
+// AllDependsOn returns every item ref depends on, directly or not,
+// nearest first.
+func (graph *DependencyGraph) AllDependsOn(ref ItemRef) []SettingsItem {
+	return graph.walk(ref, graph.dependsOn)
+}
+
+// AllDependents returns every item depending on ref, directly or not,
+// nearest first.
+func (graph *DependencyGraph) AllDependents(ref ItemRef) []SettingsItem {
+	return graph.walk(ref, graph.dependents)
+}
+
+// walk returns the items reachable from ref through edges, breadth
+// first and without ref itself.
+func (graph *DependencyGraph) walk(ref ItemRef, edges map[ItemRef][]ItemRef) []SettingsItem {
+	seen := map[ItemRef]bool{ref: true}
+	queue := []ItemRef{ref}
+	found := []ItemRef{}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, next := range edges[current] {
+			if seen[next] {
+				continue
+			}
+			seen[next] = true
+			found = append(found, next)
+			queue = append(queue, next)
+		}
+	}
+	return graph.itemsOf(found)
+}
+
+func (graph *DependencyGraph) itemsOf(refs []ItemRef) []SettingsItem {
+	items := make([]SettingsItem, 0, len(refs))
+	for _, ref := range refs {
+		items = append(items, *graph.byRef[ref])
+	}
+	return items
+}
+
+// add adds the item of kind described by value at path, unless it has
+// no id. The name is the first of nameKeys found in value.
+func (builder *graphBuilder) add(kind ItemKind, path []string, value map[string]interface{}, idKey string, nameKeys ...string) (ItemRef, bool) {
+	id, ok := graphID(value[idKey])
+	if !ok {
+		return ItemRef{}, false
+	}
+	ref := ItemRef{Kind: kind, ID: id}
+	if _, exists := builder.graph.byRef[ref]; exists {
+		logger.Debug("Duplicate settings item %s at %s\n", ref, strings.Join(path, "/"))
+		return ItemRef{}, false
+	}
+	item := &SettingsItem{ItemRef: ref, Name: id, Path: append([]string{}, path...)}
+	for _, key := range nameKeys {
+		if name, ok := value[key].(string); ok && name != "" {
+			item.Name = name
+			break
+		}
+	}
+	if enabled, ok := value["enabled"].(bool); ok {
+		item.Enabled = enabled
+	} else {
+		// items without an enabled flag, such as objects, are always on.
+		item.Enabled = true
+	}
+	builder.graph.items = append(builder.graph.items, item)
+	builder.graph.byRef[ref] = item
+	return ref, true
+}
+
+// reference records that from references id, an item of one of kinds.
+func (builder *graphBuilder) reference(from ItemRef, id interface{}, kinds ...ItemKind) {
+	if idString, ok := graphID(id); ok {
+		builder.references = append(builder.references, reference{from: from, kinds: kinds, id: idString})
+	}
+}
+
+// referenceAll records a reference for each of the ids.
+func (builder *graphBuilder) referenceAll(from ItemRef, ids interface{}, kinds ...ItemKind) {
+	for _, id := range graphSlice(ids) {
+		builder.reference(from, id, kinds...)
+	}
+}
+
+// resolve turns the references into edges.
+func (builder *graphBuilder) resolve() {
+	graph := builder.graph
+	for _, ref := range builder.references {
+		for _, kind := range ref.kinds {
+			to := ItemRef{Kind: kind, ID: ref.id}
+			if _, ok := graph.byRef[to]; !ok || to == ref.from || containsRef(graph.dependsOn[ref.from], to) {
+				continue
+			}
+			graph.dependsOn[ref.from] = append(graph.dependsOn[ref.from], to)
+			graph.dependents[to] = append(graph.dependents[to], ref.from)
+			break
+		}
+	}
+}
+
+// addInterfaces adds network/interfaces, which depend on the
+// interfaces they are bound or bridged to.
+func (builder *graphBuilder) addInterfaces(jsonSettings map[string]interface{}) {
+	path := []string{"network", "interfaces"}
+	for index, intf := range graphSlice(graphValue(jsonSettings, path)) {
+		intfMap, ok := intf.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref, ok := builder.add(ItemInterface, append(path, strconv.Itoa(index)), intfMap, "interfaceId", "name")
+		if !ok {
+			continue
+		}
+		builder.reference(ref, intfMap["boundInterfaceId"], ItemInterface)
+		builder.reference(ref, intfMap["bridgedTo"], ItemInterface)
+	}
+}
+
+// addWAN adds the WAN policies, which depend on their interfaces, and
+// the rules of the WAN policy chains.
+func (builder *graphBuilder) addWAN(jsonSettings map[string]interface{}) {
+	path := []string{"wan", "policies"}
+	for index, policy := range graphSlice(graphValue(jsonSettings, path)) {
+		policyMap, ok := policy.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref, ok := builder.add(ItemPolicy, append(path, strconv.Itoa(index)), policyMap, "policyId", "description", "name")
+		if !ok {
+			continue
+		}
+		for _, intf := range graphSlice(policyMap["interfaces"]) {
+			if intfMap, ok := intf.(map[string]interface{}); ok {
+				builder.reference(ref, intfMap["interfaceId"], ItemInterface)
+			}
+		}
+	}
+
+	path = []string{"wan", "policy_chains"}
+	for index, chain := range graphSlice(graphValue(jsonSettings, path)) {
+		if chainMap, ok := chain.(map[string]interface{}); ok {
+			builder.addRules(append(path, strconv.Itoa(index), "rules"), chainMap["rules"])
+		}
+	}
+}
+
+// addFirewall adds the rules of every chain of every firewall table.
+func (builder *graphBuilder) addFirewall(jsonSettings map[string]interface{}) {
+	path := []string{"firewall", "tables"}
+	tables, _ := graphValue(jsonSettings, path).(map[string]interface{})
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table, ok := tables[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for index, chain := range graphSlice(table["chains"]) {
+			if chainMap, ok := chain.(map[string]interface{}); ok {
+				builder.addRules(append(path, name, "chains", strconv.Itoa(index), "rules"), chainMap["rules"])
+			}
+		}
+	}
+}
+
+// addRules adds WAN and firewall rules, which depend on the WAN policy
+// of their action and the interfaces of their conditions.
+func (builder *graphBuilder) addRules(path []string, rules interface{}) {
+	for index, rule := range graphSlice(rules) {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref, ok := builder.add(ItemRule, append(path, strconv.Itoa(index)), ruleMap, "ruleId", "description", "name")
+		if !ok {
+			continue
+		}
+		if action, ok := ruleMap["action"].(map[string]interface{}); ok {
+			builder.reference(ref, action["policy"], ItemPolicy)
+		}
+		for _, condition := range graphSlice(ruleMap["conditions"]) {
+			conditionMap, ok := condition.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			conditionType, _ := conditionMap["type"].(string)
+			if !strings.Contains(conditionType, "INTERFACE_ZONE") {
+				continue
+			}
+			value := conditionMap["value"]
+			if values, ok := value.(string); ok {
+				for _, id := range strings.Split(values, ",") {
+					builder.reference(ref, strings.TrimSpace(id), ItemInterface)
+				}
+				continue
+			}
+			builder.reference(ref, value, ItemInterface)
+		}
+	}
+}
+
+// addPolicyManager adds the policy manager items. Policies depend on
+// their rules, conditions and configurations, rules on their
+// conditions and configuration, conditions on the objects they match,
+// and groups on their members.
+func (builder *graphBuilder) addPolicyManager(jsonSettings map[string]interface{}) {
+	path := []string{"policy_manager"}
+	sections := []struct {
+		key  string
+		kind ItemKind
+	}{
+		{"objects", ItemObject},
+		{"object_groups", ItemObjectGroup},
+		{"conditions", ItemCondition},
+		{"condition_groups", ItemConditionGroup},
+		{"configurations", ItemConfiguration},
+		{"quotas", ItemQuota},
+		{"rules", ItemRule},
+		{"policies", ItemPolicy},
+	}
+	for _, section := range sections {
+		sectionPath := append(append([]string{}, path...), section.key)
+		for index, object := range graphSlice(graphValue(jsonSettings, sectionPath)) {
+			objectMap, ok := object.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ref, ok := builder.add(section.kind, append(sectionPath, strconv.Itoa(index)), objectMap, "id", "name", "description")
+			if !ok {
+				continue
+			}
+			builder.addPolicyReferences(ref, objectMap)
+		}
+	}
+}
+
+// addPolicyReferences records the references of the policy manager
+// item ref.
+func (builder *graphBuilder) addPolicyReferences(ref ItemRef, object map[string]interface{}) {
+	switch ref.Kind {
+	case ItemObject:
+		if objectType, _ := object["type"].(string); strings.HasPrefix(objectType, "mfw-object-interfacezone") {
+			builder.referenceAll(ref, object["items"], ItemInterface)
+		}
+	case ItemObjectGroup:
+		builder.referenceAll(ref, object["items"], ItemObject)
+	case ItemCondition:
+		for _, condition := range graphSlice(object["items"]) {
+			if conditionMap, ok := condition.(map[string]interface{}); ok {
+				builder.referenceAll(ref, conditionMap["value"], ItemObject, ItemObjectGroup)
+				builder.referenceAll(ref, conditionMap["object"], ItemObject, ItemObjectGroup)
+			}
+		}
+	case ItemConditionGroup:
+		builder.referenceAll(ref, object["items"], ItemCondition)
+	case ItemRule:
+		builder.referenceAll(ref, object["conditions"], ItemCondition, ItemConditionGroup)
+		if action, ok := object["action"].(map[string]interface{}); ok {
+			builder.reference(ref, action["configuration_id"], ItemConfiguration)
+			builder.reference(ref, action["policy"], ItemPolicy)
+		}
+	case ItemPolicy:
+		builder.referenceAll(ref, object["rules"], ItemRule)
+		builder.referenceAll(ref, object["conditions"], ItemCondition, ItemConditionGroup)
+		builder.referenceAll(ref, object["configurations"], ItemConfiguration)
+	}
+}
+
+// addServices adds the service sections, identified by their key.
+func (builder *graphBuilder) addServices(jsonSettings map[string]interface{}) {
+	for _, key := range graphServices {
+		service, ok := jsonSettings[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		item := map[string]interface{}{"id": key, "enabled": service["enabled"]}
+		builder.add(ItemService, []string{key}, item, "id")
+	}
+}
+
+// graphValue returns the value at path in jsonSettings, or nil.
+func graphValue(jsonSettings map[string]interface{}, path []string) interface{} {
+	var value interface{} = jsonSettings
+	for _, segment := range path {
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = valueMap[segment]
+	}
+	return value
+}
+
+// graphSlice returns value as a slice, a single value is a slice of
+// one.
+func graphSlice(value interface{}) []interface{} {
+	switch typed := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return typed
+	default:
+		return []interface{}{typed}
+	}
+}
+
+// graphID returns the string form of an item id, which is a string or
+// a JSON number.
+func graphID(value interface{}) (string, bool) {
+	switch id := value.(type) {
+	case string:
+		return id, id != ""
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64), id != 0
+	case int:
+		return strconv.Itoa(id), id != 0
+	default:
+		return "", false
+	}
+}
+
+func equalPaths(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsRef(refs []ItemRef, ref ItemRef) bool {
+	for _, existing := range refs {
+		if existing == ref {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/diff/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadGraphSettings reads a fresh copy of the graph test settings.
+func loadGraphSettings(t *testing.T) map[string]interface{} {
+	raw, err := os.ReadFile("testdata/graph_settings.json")
+	require.NoError(t, err)
+	jsonSettings := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(raw, &jsonSettings))
+	return jsonSettings
+}
+
+func refsOf(items []SettingsItem) []ItemRef {
+	refs := make([]ItemRef, 0, len(items))
+	for _, item := range items {
+		refs = append(refs, item.ItemRef)
+	}
+	return refs
+}
+
+func TestDependencyGraph(t *testing.T) {
+	graph := NewDependencyGraph(loadGraphSettings(t))
+	assert.Len(t, graph.Items(), 18)
+
+	item, ok := graph.ItemAt([]string{"wan", "policies", "0"})
+	require.True(t, ok)
+	assert.Equal(t, SettingsItem{ItemRef: ItemRef{ItemPolicy, "p1"}, Name: "Send to WAN1", Enabled: true,
+		Path: []string{"wan", "policies", "0"}}, item)
+	item, ok = graph.Item(ItemRef{ItemService, "geoip"})
+	require.True(t, ok)
+	assert.False(t, item.Enabled)
+	assert.Len(t, graph.ItemsUnder([]string{"network"}), 4)
+	item, ok = graph.ItemAt([]string{"firewall", "tables", "filter", "chains", "0", "rules", "0"})
+	require.True(t, ok)
+	assert.Equal(t, "Block VLAN10", item.Name)
+	_, ok = graph.ItemAt([]string{"wan"})
+	assert.False(t, ok)
+
+	// what depends on X
+	assert.Equal(t, []ItemRef{{ItemPolicy, "p1"}, {ItemRule, "r1"}}, refsOf(graph.AllDependents(ItemRef{ItemInterface, "1"})))
+	assert.Equal(t, []ItemRef{{ItemInterface, "4"}, {ItemObject, "o2"}}, refsOf(graph.Dependents(ItemRef{ItemInterface, "3"})))
+	assert.Equal(t, []ItemRef{{ItemInterface, "4"}, {ItemObject, "o2"}, {ItemRule, "fw1"}, {ItemCondition, "c2"}, {ItemPolicy, "pol1"}},
+		refsOf(graph.AllDependents(ItemRef{ItemInterface, "3"})))
+	assert.Equal(t, []ItemRef{{ItemObjectGroup, "g1"}, {ItemCondition, "c1"}, {ItemRule, "pr1"}, {ItemPolicy, "pol1"}},
+		refsOf(graph.AllDependents(ItemRef{ItemObject, "o1"})))
+
+	// what X depends on, references to missing items are ignored
+	assert.Equal(t, []ItemRef{{ItemInterface, "2"}}, refsOf(graph.DependsOn(ItemRef{ItemPolicy, "p2"})))
+	assert.Equal(t, []ItemRef{{ItemPolicy, "p1"}, {ItemInterface, "1"}}, refsOf(graph.AllDependsOn(ItemRef{ItemRule, "r1"})))
+	assert.Equal(t, []ItemRef{
+		{ItemRule, "pr1"}, {ItemCondition, "c2"}, {ItemCondition, "c1"}, {ItemConfiguration, "cfg1"},
+		{ItemObject, "o2"}, {ItemObjectGroup, "g1"}, {ItemInterface, "3"}, {ItemObject, "o1"},
+	}, refsOf(graph.AllDependsOn(ItemRef{ItemPolicy, "pol1"})))
+	assert.Empty(t, graph.AllDependsOn(ItemRef{ItemRule, "unknown"}))
+}
+
+// buildGraphMessage builds the message for the change of newSettings,
+// and returns the messages.
+func buildGraphMessage(t *testing.T, oldSettings map[string]interface{}, newSettings map[string]interface{}, confirm string) []SetSettingsErrorUI {
+	message, err := buildMessage(oldSettings, newSettings, errors.New(confirm))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(message, confirmPrefix))
+	messages := []SetSettingsErrorUI{}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(message, confirmPrefix)), &messages))
+	return messages
+}
+
+func TestBuildMessageFromGraph(t *testing.T) {
+	interfaceSettings := func(jsonSettings map[string]interface{}, index int) map[string]interface{} {
+		return jsonSettings["network"].(map[string]interface{})["interfaces"].([]interface{})[index].(map[string]interface{})
+	}
+
+	// sync-settings only reports the policy, the rule is found in the graph.
+	oldSettings := loadGraphSettings(t)
+	newSettings := loadGraphSettings(t)
+	interfaceSettings(newSettings, 0)["enabled"] = false
+	messages := buildGraphMessage(t, oldSettings, newSettings,
+		`{"CONFIRM": {"invalidItems": {"1": {"reason": "disabled", "type": "interface", "value": "1"},
+		"p1": {"reason": "disabled", "type": "policy", "value": "Send to WAN1", "parentId": "1"},
+		"x": {"reason": "disabled", "type": "rule", "value": "Unknown rule", "parentId": "p1"}}}}`)
+	assert.Equal(t, []SetSettingsErrorUI{{
+		MainTranslationString: "affected_item_disabled_or_deleted",
+		InvalidReason:         "disabled",
+		AffectedValues: []AffectedValue{
+			{AffectedType: "policy", AffectedValue: "Send to WAN1"},
+			{AffectedType: "rule", AffectedValue: "Route LAN via WAN1"},
+			{AffectedType: "rule", AffectedValue: "Unknown rule"},
+		},
+	}}, messages)
+
+	// enabling a rule lists the disabled items it depends on.
+	newSettings = loadGraphSettings(t)
+	rules := newSettings["wan"].(map[string]interface{})["policy_chains"].([]interface{})[0].(map[string]interface{})["rules"].([]interface{})
+	rules[1].(map[string]interface{})["enabled"] = true
+	messages = buildGraphMessage(t, oldSettings, newSettings, `{"CONFIRM": {"invalidItems": {}}}`)
+	assert.Equal(t, []SetSettingsErrorUI{{
+		MainTranslationString: "affected_item_on_enable",
+		InvalidReason:         "enabled",
+		AffectedValues:        []AffectedValue{{AffectedType: "policy", AffectedValue: "Send to WAN2"}},
+	}}, messages)
+
+	// deleting an object affects everything using it, except what is
+	// deleted or disabled along with it.
+	newSettings = loadGraphSettings(t)
+	policyManager := newSettings["policy_manager"].(map[string]interface{})
+	policyManager["objects"] = policyManager["objects"].([]interface{})[1:]
+	policyManager["rules"].([]interface{})[0].(map[string]interface{})["enabled"] = false
+	messages = buildGraphMessage(t, oldSettings, newSettings, `{"CONFIRM": {"invalidItems": {}}}`)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "deleted", messages[0].InvalidReason)
+	assert.Equal(t, []AffectedValue{
+		{AffectedType: "object_group", AffectedValue: "Offices"},
+		{AffectedType: "condition", AffectedValue: "From offices"},
+		{AffectedType: "policy", AffectedValue: "Students"},
+	}, messages[0].AffectedValues)
+	assert.Equal(t, "disabled", messages[1].InvalidReason)
+	assert.Equal(t, []AffectedValue{{AffectedType: "policy", AffectedValue: "Students"}}, messages[1].AffectedValues)
+
+	// an error that is not a sync-settings confirmation is not explained.
+	_, err := buildMessage(oldSettings, newSettings, errors.New("CONFIRM is not JSON"))
+	assert.Error(t, err)
+
+	// changes that affect nothing cannot explain the error.
+	newSettings = loadGraphSettings(t)
+	interfaceSettings(newSettings, 3)["enabled"] = false
+	newSettings["firewall"].(map[string]interface{})["tables"].(map[string]interface{})["filter"].(map[string]interface{})["chains"].([]interface{})[0].(map[string]interface{})["rules"] = []interface{}{}
+	_, err = buildMessage(oldSettings, newSettings, errors.New(`{"CONFIRM": {"invalidItems": {}}}`))
+	assert.Error(t, err)
+}
+
+func TestDetermineMessageFromGraph(t *testing.T) {
+	settingsError := func(confirm string) *SetSettingsError {
+		parsed, err := getSettingsErrorStruct(errors.New(confirm))
+		require.NoError(t, err)
+		return parsed
+	}
+	oldGraph := NewDependencyGraph(loadGraphSettings(t))
+
+	tests := []struct {
+		name          string
+		invalidReason string
+		change        diff.Change
+		settingsError *SetSettingsError
+		expected      []AffectedValue
+	}{
+		{
+			name:          "disabling a WAN policy lists its rules, not the policy manager policies",
+			invalidReason: "disabled",
+			change:        diff.Change{Type: "update", Path: []string{"wan", "policies", "0", "enabled"}, From: true, To: false},
+			settingsError: settingsError(`{"CONFIRM": {"invalidItems": {"p1": {"type": "policy", "value": "Send to WAN1"},
+				"r1": {"type": "rule", "value": "Route LAN via WAN1", "parentId": "p1"}}}}`),
+			expected: []AffectedValue{{AffectedType: "rule", AffectedValue: "Route LAN via WAN1"}},
+		},
+		{
+			name:          "disabling a policy manager rule lists the policy manager policy using it",
+			invalidReason: "disabled",
+			change:        diff.Change{Type: "update", Path: []string{"policy_manager", "rules", "0", "enabled"}, From: true, To: false},
+			expected:      []AffectedValue{{AffectedType: "policy", AffectedValue: "Students"}},
+		},
+		{
+			name:          "disabling an interface lists both kinds of policies depending on it",
+			invalidReason: "disabled",
+			change:        diff.Change{Type: "update", Path: []string{"network", "interfaces", "0", "enabled"}, From: true, To: false},
+			settingsError: settingsError(`{"CONFIRM": {"invalidItems": {"1": {"type": "interface", "value": "WAN1"},
+				"pol1": {"type": "policy", "value": "Students", "parentId": "1"}}}}`),
+			expected: []AffectedValue{
+				{AffectedType: "policy", AffectedValue: "Send to WAN1"},
+				{AffectedType: "rule", AffectedValue: "Route LAN via WAN1"},
+				{AffectedType: "policy", AffectedValue: "Students"},
+			},
+		},
+		{
+			name:          "enabling a WAN rule lists its disabled WAN policy",
+			invalidReason: "enabled",
+			change:        diff.Change{Type: "update", Path: []string{"wan", "policy_chains", "0", "rules", "1", "enabled"}, From: false, To: true},
+			expected:      []AffectedValue{{AffectedType: "policy", AffectedValue: "Send to WAN2"}},
+		},
+	}
+
+	for _, test := range tests {
+		newSettings := loadGraphSettings(t)
+		_, err := patchReplace(newSettings, test.change.Path, test.change.To)
+		require.NoError(t, err, test.name)
+		newGraph := NewDependencyGraph(newSettings)
+
+		message := determineMessage(test.settingsError, test.invalidReason, []diff.Change{test.change}, oldGraph, newGraph)
+		assert.Equal(t, test.invalidReason, message.InvalidReason, test.name)
+		assert.Equal(t, test.expected, message.AffectedValues, test.name)
+	}
+}
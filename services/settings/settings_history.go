@@ -0,0 +1,356 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/r3labs/diff/v2"
+)
+
+const (
+	// DefaultMaxRevisions is the number of revisions kept by a
+	// RevisionHistory unless WithMaxRevisions is used.
+	DefaultMaxRevisions = 20
+
+	// revisionIndexFile is the file in the history directory listing
+	// the revisions.
+	revisionIndexFile = "revisions.json"
+)
+
+// ErrRevisionNotFound is returned for revision IDs that are not in the
+// history.
+var ErrRevisionNotFound = errors.New("settings revision not found")
+
+// Revision describes a revision of the settings file kept in a
+// RevisionHistory.
+type Revision struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Author    string    `json:"author,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	// Hash is the SettingsFile.Version of the contents.
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// RevisionHistory is a bounded on-disk ring of settings file
+// revisions. Each revision is stored as a file in the history
+// directory, next to an index with the revision metadata.
+type RevisionHistory struct {
+	dir          string
+	maxRevisions int
+	maxAge       time.Duration
+	now          func() time.Time
+
+	mutex sync.Mutex
+}
+
+// HistoryOption is an option for NewRevisionHistory.
+type HistoryOption func(*RevisionHistory)
+
+// WithMaxRevisions sets how many revisions are kept.
+func WithMaxRevisions(max int) HistoryOption {
+	return func(h *RevisionHistory) {
+		h.maxRevisions = max
+	}
+}
+
+// WithMaxRevisionAge sets how long revisions are kept. The newest
+// revision is kept regardless of its age.
+func WithMaxRevisionAge(age time.Duration) HistoryOption {
+	return func(h *RevisionHistory) {
+		h.maxAge = age
+	}
+}
+
+// NewRevisionHistory creates a RevisionHistory storing revisions in
+// dir, which is created if needed.
+func NewRevisionHistory(dir string, opts ...HistoryOption) (*RevisionHistory, error) {
+	history := &RevisionHistory{
+		dir:          dir,
+		maxRevisions: DefaultMaxRevisions,
+		now:          time.Now,
+	}
+	for _, opt := range opts {
+		opt(history)
+	}
+	if history.maxRevisions < 1 {
+		return nil, fmt.Errorf("settings history: invalid max revisions: %d", history.maxRevisions)
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, fmt.Errorf("settings history: unable to create %s: %w", dir, err)
+	}
+	return history, nil
+}
+
+// revisionHistories holds the history of each settings file given one,
+// so every write of the file is recorded, whether through a
+// SettingsFile or the package level functions.
+var revisionHistories = struct {
+	sync.Mutex
+	histories map[string]*RevisionHistory
+}{histories: map[string]*RevisionHistory{}}
+
+// SetRevisionHistory records the revisions of the settings file
+// filename in history whenever it is changed. A nil history stops
+// recording them.
+func SetRevisionHistory(filename string, history *RevisionHistory) {
+	revisionHistories.Lock()
+	defer revisionHistories.Unlock()
+	if history == nil {
+		delete(revisionHistories.histories, filename)
+		return
+	}
+	revisionHistories.histories[filename] = history
+}
+
+// GetRevisionHistory returns the history of the settings file
+// filename, nil if it has none.
+func GetRevisionHistory(filename string) *RevisionHistory {
+	revisionHistories.Lock()
+	defer revisionHistories.Unlock()
+	return revisionHistories.histories[filename]
+}
+
+// WithRevisionHistory records the revisions of the settings file in
+// history whenever it is changed, see SetRevisionHistory.
+func WithRevisionHistory(history *RevisionHistory) SettingsOption {
+	return func(file *SettingsFile) {
+		SetRevisionHistory(file.filename, history)
+	}
+}
+
+// revisionFile returns the filename of the contents of revision id.
+func (h *RevisionHistory) revisionFile(id string) string {
+	return filepath.Join(h.dir, "settings-"+id+".json")
+}
+
+// readIndex reads the revision index, newest revision first. The mutex
+// must be held.
+func (h *RevisionHistory) readIndex() ([]Revision, error) {
+	raw, err := os.ReadFile(filepath.Join(h.dir, revisionIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Revision{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	revisions := []Revision{}
+	if err := json.Unmarshal(raw, &revisions); err != nil {
+		return nil, fmt.Errorf("settings history: corrupt index: %w", err)
+	}
+	return revisions, nil
+}
+
+// writeIndex replaces the revision index. The mutex must be held.
+func (h *RevisionHistory) writeIndex(revisions []Revision) error {
+	raw, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(h.dir, revisionIndexFile+".tmp")
+	if err := os.WriteFile(tmpName, raw, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(h.dir, revisionIndexFile))
+}
+
+// Record adds the settings file contents raw as a new revision, unless
+// it is identical to the newest revision, in which case that one is
+// returned. Revisions beyond the retention limits are removed.
+func (h *RevisionHistory) Record(raw []byte, author string, reason string) (*Revision, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	revisions, err := h.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	hash := settingsVersion(raw)
+	if len(revisions) > 0 && revisions[0].Hash == hash {
+		return &revisions[0], nil
+	}
+
+	now := h.now()
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	if len(revisions) > 0 && revisions[0].ID >= id {
+		// clock went backwards, keep the IDs ordered.
+		latest, _ := strconv.ParseInt(revisions[0].ID, 10, 64)
+		id = strconv.FormatInt(latest+1, 10)
+	}
+	revision := Revision{
+		ID:        id,
+		Timestamp: now,
+		Author:    author,
+		Reason:    reason,
+		Hash:      hash,
+		Size:      len(raw),
+	}
+	if err := os.WriteFile(h.revisionFile(id), raw, 0660); err != nil {
+		return nil, fmt.Errorf("settings history: unable to save revision: %w", err)
+	}
+
+	revisions = append([]Revision{revision}, revisions...)
+	kept, removed := h.retain(revisions, now)
+	if err := h.writeIndex(kept); err != nil {
+		return nil, fmt.Errorf("settings history: unable to save index: %w", err)
+	}
+	for _, old := range removed {
+		if err := os.Remove(h.revisionFile(old.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Unable to remove settings revision %s: %s\n", old.ID, err.Error())
+		}
+	}
+	return &revision, nil
+}
+
+// retain splits revisions, newest first, into those within the
+// retention limits and those to remove.
+func (h *RevisionHistory) retain(revisions []Revision, now time.Time) ([]Revision, []Revision) {
+	kept := []Revision{}
+	removed := []Revision{}
+	for i, revision := range revisions {
+		tooOld := h.maxAge > 0 && i > 0 && now.Sub(revision.Timestamp) > h.maxAge
+		if i >= h.maxRevisions || tooOld {
+			removed = append(removed, revision)
+			continue
+		}
+		kept = append(kept, revision)
+	}
+	return kept, removed
+}
+
+// List returns the revisions in the history, newest first.
+func (h *RevisionHistory) List() ([]Revision, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.readIndex()
+}
+
+// Get returns the revision with the given id and its contents.
+func (h *RevisionHistory) Get(id string) (*Revision, []byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	revisions, err := h.readIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	index := sort.Search(len(revisions), func(i int) bool { return revisions[i].ID <= id })
+	if index == len(revisions) || revisions[index].ID != id {
+		return nil, nil, fmt.Errorf("%w: %s", ErrRevisionNotFound, id)
+	}
+	raw, err := os.ReadFile(h.revisionFile(id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("settings history: unable to read revision %s: %w", id, err)
+	}
+	if settingsVersion(raw) != revisions[index].Hash {
+		return nil, nil, fmt.Errorf("settings history: revision %s does not match its hash", id)
+	}
+	return &revisions[index], raw, nil
+}
+
+// getSettings returns the decoded contents of revision id.
+func (h *RevisionHistory) getSettings(id string) (map[string]interface{}, error) {
+	_, raw, err := h.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonSettings); err != nil {
+		return nil, fmt.Errorf("settings history: revision %s is not valid JSON: %w", id, err)
+	}
+	return jsonSettings, nil
+}
+
+// Diff returns the changes going from revision fromID to revision
+// toID.
+func (h *RevisionHistory) Diff(fromID string, toID string) (diff.Changelog, error) {
+	from, err := h.getSettings(fromID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := h.getSettings(toID)
+	if err != nil {
+		return nil, err
+	}
+	return diff.Diff(from, to)
+}
+
+// recordRevision records the current contents of the settings file
+// filename in its history, if it has one. lock is the lock of the
+// file. Failures are only logged, they must not fail the settings
+// change itself. The lock must not be held.
+func recordRevision(filename string, lock *sync.RWMutex, author string, reason string) {
+	history := GetRevisionHistory(filename)
+	if history == nil {
+		return
+	}
+	lock.RLock()
+	raw, err := readSettingsBytes(filename)
+	lock.RUnlock()
+	if err != nil {
+		logger.Warn("Unable to record settings revision of %s: %s\n", filename, err.Error())
+		return
+	}
+	recordRevisionBytes(filename, raw, author, reason)
+}
+
+// recordRevisionBytes records raw, contents of filename, in the history
+// of filename if it has one. It needs no lock.
+func recordRevisionBytes(filename string, raw []byte, author string, reason string) {
+	history := GetRevisionHistory(filename)
+	if history == nil {
+		return
+	}
+	if _, err := history.Record(raw, author, reason); err != nil {
+		logger.Warn("Unable to record settings revision of %s: %s\n", filename, err.Error())
+	}
+}
+
+// recordRevision records the current settings file contents in the
+// history, if the file has one. The file lock must not be held.
+func (file *SettingsFile) recordRevision(author string, reason string) {
+	recordRevision(file.filename, file.mutex, author, reason)
+}
+
+// History returns the RevisionHistory of the settings file, nil if it
+// has none.
+func (file *SettingsFile) History() *RevisionHistory {
+	return GetRevisionHistory(file.filename)
+}
+
+// RestoreRevision sets the whole settings file back to revision id of
+// its history, going through sync-settings like SetSettings. The
+// optional audit says who restores it and why.
+func (file *SettingsFile) RestoreRevision(id string, force bool, skipEosConfig bool, audit ...AuditInfo) (interface{}, error) {
+	history := file.History()
+	if history == nil {
+		err := errors.New("settings file has no revision history")
+		return createJSONErrorObject(err), err
+	}
+	jsonSettings, err := history.getSettings(id)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	tx, err := file.Begin()
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	info := auditInfo(audit)
+	if info.Reason == "" {
+		info.Reason = "restore of revision " + id
+	}
+	tx.Annotate(info.Actor, info.Reason)
+	tx.operation = AuditOperationRestore
+	if err := tx.Set(nil, jsonSettings); err != nil {
+		return createJSONErrorObject(err), err
+	}
+	return tx.Commit(force, skipEosConfig)
+}
@@ -0,0 +1,149 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// newTestHistory creates a RevisionHistory in a temp dir whose clock
+// advances a minute on every revision.
+func newTestHistory(t *testing.T, opts ...HistoryOption) *RevisionHistory {
+	history, err := NewRevisionHistory(filepath.Join(t.TempDir(), "history"), opts...)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	history.now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	return history
+}
+
+func TestRevisionHistoryRecord(t *testing.T) {
+	history := newTestHistory(t, WithMaxRevisions(3))
+
+	first, err := history.Record([]byte(`{"a": 1}`), "admin", "first")
+	require.NoError(t, err)
+	assert.Equal(t, "admin", first.Author)
+	assert.Equal(t, "first", first.Reason)
+
+	// identical contents are not recorded twice.
+	same, err := history.Record([]byte(`{"a": 1}`), "", "")
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, same.ID)
+
+	for _, raw := range []string{`{"a": 2}`, `{"a": 3}`, `{"a": 4}`} {
+		_, err := history.Record([]byte(raw), "", "")
+		require.NoError(t, err)
+	}
+	revisions, err := history.List()
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.True(t, revisions[0].Timestamp.After(revisions[1].Timestamp))
+
+	_, raw, err := history.Get(revisions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a": 4}`, string(raw))
+
+	// the pruned revision is gone, from the index and the disk.
+	_, _, err = history.Get(first.ID)
+	assert.ErrorIs(t, err, ErrRevisionNotFound)
+	files, err := os.ReadDir(history.dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+
+	changes, err := history.Diff(revisions[2].ID, revisions[0].ID)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, []string{"a"}, changes[0].Path)
+	assert.Equal(t, float64(2), changes[0].From)
+	assert.Equal(t, float64(4), changes[0].To)
+}
+
+func TestRevisionHistoryMaxAge(t *testing.T) {
+	history := newTestHistory(t, WithMaxRevisionAge(90*time.Second))
+	for _, raw := range []string{`{"a": 1}`, `{"a": 2}`, `{"a": 3}`} {
+		_, err := history.Record([]byte(raw), "", "")
+		require.NoError(t, err)
+	}
+	revisions, err := history.List()
+	require.NoError(t, err)
+	assert.Len(t, revisions, 2)
+
+	_, err = NewRevisionHistory(t.TempDir(), WithMaxRevisions(0))
+	assert.Error(t, err)
+}
+
+func TestRestoreRevision(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	history := newTestHistory(t)
+	sf := NewSettingsFile(tempfile, WithRevisionHistory(history))
+
+	_, err := sf.SetSettings([]string{"a", "b", "foo"}, "changed", false, false)
+	require.NoError(t, err)
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	tx.Annotate("admin", "bad push")
+	require.NoError(t, tx.Set([]string{"a"}, "broken"))
+	_, err = tx.Commit(false, false)
+	require.NoError(t, err)
+
+	revisions, err := sf.History().List()
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, "admin", revisions[0].Author)
+	assert.Equal(t, "bad push", revisions[0].Reason)
+
+	// restore the original file.
+	original := revisions[2]
+	_, err = sf.RestoreRevision(original.ID, false, false)
+	require.NoError(t, err)
+	version, err := sf.Version()
+	require.NoError(t, err)
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", settings["a"].(map[string]interface{})["b"].(map[string]interface{})["foo"])
+
+	revisions, err = sf.History().List()
+	require.NoError(t, err)
+	assert.Equal(t, version, revisions[0].Hash)
+	assert.Equal(t, "restore of revision "+original.ID, revisions[0].Reason)
+
+	_, err = sf.RestoreRevision("nope", false, false)
+	assert.ErrorIs(t, err, ErrRevisionNotFound)
+	otherfile, otherCleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer otherCleanup()
+	_, err = NewSettingsFile(otherfile).RestoreRevision(original.ID, false, false)
+	assert.Error(t, err)
+}
+
+func TestPackageWritesRecordRevisions(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	history := newTestHistory(t)
+	SetRevisionHistory(tempfile, history)
+	defer SetRevisionHistory(tempfile, nil)
+
+	_, err := SetSettingsFile([]string{"a", "b", "foo"}, "changed", tempfile, false, false,
+		AuditInfo{Actor: "admin", Reason: "package set"})
+	require.NoError(t, err)
+	_, err = TrimSettingsFile([]string{"a", "b", "bar"}, tempfile, AuditInfo{Actor: "admin", Reason: "package trim"})
+	require.NoError(t, err)
+
+	revisions, err := history.List()
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, "package trim", revisions[0].Reason)
+	assert.Equal(t, "package set", revisions[1].Reason)
+
+	// every SettingsFile of the file shares its history.
+	assert.Same(t, history, NewSettingsFile(tempfile).History())
+}
@@ -0,0 +1,369 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	utilhttp "github.com/untangle/golang-shared/util/http"
+)
+
+const (
+	// jsonPatchContentType selects an RFC 6902 JSON Patch for PATCH
+	// requests, any other content type is an RFC 7396 Merge Patch.
+	jsonPatchContentType = "application/json-patch+json"
+
+	// confirmPrefix starts the error of a set settings response when
+	// sync-settings asks for a confirmation.
+	confirmPrefix = "CONFIRM: "
+)
+
+// Types of the ErrorResponses of the settings API.
+const (
+	SettingsAPIInvalidRequest         = "invalid_request"
+	SettingsAPINotFound               = "not_found"
+	SettingsAPIInvalidSettings        = "invalid_settings"
+	SettingsAPIConfirm                = "confirm"
+	SettingsAPIConcurrentModification = "concurrent_modification"
+	SettingsAPIPatchTestFailed        = "patch_test_failed"
+	SettingsAPIFailed                 = "failed_sync_settings"
+)
+
+// ConfirmResponse is the ErrorResponse sent when sync-settings asks for
+// a confirmation. Confirm lists what the change would affect, for the
+// UI to show; the request is confirmed by sending it again with
+// force=true.
+type ConfirmResponse struct {
+	utilhttp.ErrorResponse
+	Confirm []SetSettingsErrorUI `json:"confirm"`
+}
+
+// SettingsAPI serves a settings file over HTTP as a set of
+// HTTPGinPlugins:
+//
+//	GET, PUT, PATCH, DELETE <prefix>/settings/*path
+//	GET                     <prefix>/defaults/*path
+//	GET                     <prefix>/current/*path
+//
+// PUT, PATCH and DELETE accept the force and skipEosConfig query
+// parameters. They are audited with the AuditInfo of the request
+// context, which middleware sets with ContextWithAuditInfo.
+type SettingsAPI struct {
+	file             *SettingsFile
+	defaultsFilename string
+	currentFilename  string
+	prefix           string
+}
+
+// SettingsAPIOption is an option for NewSettingsAPI.
+type SettingsAPIOption func(*SettingsAPI)
+
+// WithSettingsAPIPrefix serves the settings API below prefix, such as
+// "/api".
+func WithSettingsAPIPrefix(prefix string) SettingsAPIOption {
+	return func(api *SettingsAPI) {
+		api.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithSettingsAPIDefaults serves the defaults view from filename,
+// instead of the defaults file of the system.
+func WithSettingsAPIDefaults(filename string) SettingsAPIOption {
+	return func(api *SettingsAPI) {
+		api.defaultsFilename = filename
+	}
+}
+
+// WithSettingsAPICurrent serves the current view from filename,
+// instead of the current file of the system.
+func WithSettingsAPICurrent(filename string) SettingsAPIOption {
+	return func(api *SettingsAPI) {
+		api.currentFilename = filename
+	}
+}
+
+// NewSettingsAPI creates a SettingsAPI for the settings file.
+func NewSettingsAPI(file *SettingsFile, opts ...SettingsAPIOption) *SettingsAPI {
+	api := &SettingsAPI{
+		file:             file,
+		defaultsFilename: defaultsFile,
+		currentFilename:  currentFile,
+	}
+	for _, opt := range opts {
+		opt(api)
+	}
+	return api
+}
+
+// Plugins returns the HTTPGinPlugins of the settings API, registered
+// with ginEndpointHandler on Startup.
+func (api *SettingsAPI) Plugins(ginEndpointHandler utilhttp.GinEndpointHandler) []*utilhttp.HandlerFuncWrapper {
+	return []*utilhttp.HandlerFuncWrapper{
+		utilhttp.NewHTTPGinPlugin(
+			api.prefix+"/settings/*path",
+			[]string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			api.handleSettings,
+			ginEndpointHandler),
+		utilhttp.NewHTTPGinPlugin(
+			api.prefix+"/defaults/*path",
+			[]string{http.MethodGet},
+			api.handleDefaults,
+			ginEndpointHandler),
+		utilhttp.NewHTTPGinPlugin(
+			api.prefix+"/current/*path",
+			[]string{http.MethodGet},
+			api.handleCurrent,
+			ginEndpointHandler),
+	}
+}
+
+// requestSegments returns the settings path of the request.
+func requestSegments(ctx *gin.Context) []string {
+	segments := []string{}
+	for _, segment := range strings.Split(ctx.Param("path"), "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// queryBool returns the boolean query parameter name, false if absent.
+func queryBool(ctx *gin.Context, name string) (bool, error) {
+	value := ctx.Query(name)
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// respondError sends an ErrorResponse of the type with a message.
+func respondError(ctx *gin.Context, status int, errorType string, message string, vars ...string) {
+	ctx.JSON(status, &utilhttp.ErrorResponse{
+		Type:     errorType,
+		Messages: []*utilhttp.Message{{Message: message, Variables: vars}},
+	})
+}
+
+// respondOkay sends an OkayResponse with the result.
+func respondOkay(ctx *gin.Context, result interface{}) {
+	ctx.JSON(http.StatusOK, &utilhttp.OkayResponse{
+		Result:   result,
+		Messages: []*utilhttp.Message{},
+	})
+}
+
+// handleSettings handles the requests on the settings file.
+func (api *SettingsAPI) handleSettings(ctx *gin.Context) {
+	segments := requestSegments(ctx)
+	if ctx.Request.Method == http.MethodGet {
+		jsonSettings, err := api.file.GetAllSettings()
+		if err != nil {
+			respondError(ctx, http.StatusInternalServerError, SettingsAPIFailed, err.Error())
+			return
+		}
+		respondSettingsAt(ctx, api.file.secrets.Redact(jsonSettings), segments)
+		return
+	}
+
+	force, err := queryBool(ctx, "force")
+	if err != nil {
+		respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, "invalid force parameter", ctx.Query("force"))
+		return
+	}
+	skipEosConfig, err := queryBool(ctx, "skipEosConfig")
+	if err != nil {
+		respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, "invalid skipEosConfig parameter", ctx.Query("skipEosConfig"))
+		return
+	}
+
+	audit := AuditInfoFromContext(ctx.Request.Context())
+	var response interface{}
+	switch ctx.Request.Method {
+	case http.MethodPut:
+		var value interface{}
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&value); err != nil {
+			respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, err.Error())
+			return
+		}
+		if len(segments) == 0 {
+			if _, ok := value.(map[string]interface{}); !ok {
+				respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, "settings must be an object")
+				return
+			}
+		}
+		response, err = api.file.SetSettings(segments, value, force, skipEosConfig, audit)
+	case http.MethodPatch:
+		if strings.HasPrefix(ctx.ContentType(), jsonPatchContentType) {
+			var ops []PatchOperation
+			if err := json.NewDecoder(ctx.Request.Body).Decode(&ops); err != nil {
+				respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, err.Error())
+				return
+			}
+			// the paths of the operations are relative to the
+			// path of the request.
+			prefix := segmentsPointer(segments)
+			for i := range ops {
+				ops[i].Path = prefix + ops[i].Path
+				if ops[i].From != "" {
+					ops[i].From = prefix + ops[i].From
+				}
+			}
+			response, err = api.file.PatchSettings(ops, force, skipEosConfig, audit)
+		} else {
+			var patch interface{}
+			if err := json.NewDecoder(ctx.Request.Body).Decode(&patch); err != nil {
+				respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, err.Error())
+				return
+			}
+			response, err = api.file.MergePatchSettings(segments, patch, force, skipEosConfig, audit)
+		}
+	case http.MethodDelete:
+		if len(segments) == 0 {
+			respondError(ctx, http.StatusBadRequest, SettingsAPIInvalidRequest, "invalid trim settings path")
+			return
+		}
+		var tx *SettingsTransaction
+		tx, err = api.file.Begin()
+		if err == nil {
+			tx.Annotate(audit.Actor, audit.Reason)
+			err = tx.Trim(segments)
+		}
+		if err == nil {
+			response, err = tx.Commit(force, skipEosConfig)
+		} else {
+			response = createJSONErrorObject(err)
+		}
+	default:
+		respondError(ctx, http.StatusMethodNotAllowed, SettingsAPIInvalidRequest, "method not allowed", ctx.Request.Method)
+		return
+	}
+
+	if err != nil {
+		respondSetSettingsError(ctx, response, err)
+		return
+	}
+	respondOkay(ctx, response)
+}
+
+// handleDefaults handles the requests on the defaults view.
+func (api *SettingsAPI) handleDefaults(ctx *gin.Context) {
+	api.respondFile(ctx, api.defaultsFilename)
+}
+
+// handleCurrent handles the requests on the current view, which are the
+// settings after the last sync. Systems that do not save them yet serve
+// the settings file.
+func (api *SettingsAPI) handleCurrent(ctx *gin.Context) {
+	filename := api.currentFilename
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		filename = api.file.filename
+	}
+	api.respondFile(ctx, filename)
+}
+
+// respondFile sends the settings of the request path in filename.
+func (api *SettingsAPI) respondFile(ctx *gin.Context, filename string) {
+	jsonSettings, err := readSettingsFileJSON(filename)
+	if err != nil {
+		respondError(ctx, http.StatusInternalServerError, SettingsAPIFailed, err.Error())
+		return
+	}
+	respondSettingsAt(ctx, api.file.secrets.Redact(jsonSettings), requestSegments(ctx))
+}
+
+// respondSettingsAt sends the settings at the segments path, or
+// not_found.
+func respondSettingsAt(ctx *gin.Context, jsonSettings map[string]interface{}, segments []string) {
+	value, err := patchGet(jsonSettings, segments)
+	if err != nil {
+		respondError(ctx, http.StatusNotFound, SettingsAPINotFound, err.Error(), segmentsPointer(segments))
+		return
+	}
+	respondOkay(ctx, value)
+}
+
+// segmentsPointer returns the JSON pointer of the segments path.
+func segmentsPointer(segments []string) string {
+	pointer := ""
+	for _, segment := range segments {
+		pointer += "/" + strings.ReplaceAll(strings.ReplaceAll(segment, "~", "~0"), "/", "~1")
+	}
+	return pointer
+}
+
+// respondSetSettingsError sends the error of a failed change, with the
+// response of the set settings call.
+func respondSetSettingsError(ctx *gin.Context, response interface{}, err error) {
+	var validationErr *SchemaValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		messages := make([]*utilhttp.Message, 0, len(validationErr.Errors))
+		for _, schemaErr := range validationErr.Errors {
+			messages = append(messages, &utilhttp.Message{
+				Message:   schemaErr.Message,
+				Variables: []string{schemaErr.Pointer},
+			})
+		}
+		ctx.JSON(http.StatusBadRequest, &utilhttp.ErrorResponse{
+			Type:     SettingsAPIInvalidSettings,
+			Messages: messages,
+		})
+		return
+	case errors.Is(err, ErrConcurrentModification):
+		respondError(ctx, http.StatusConflict, SettingsAPIConcurrentModification, err.Error())
+		return
+	case errors.Is(err, ErrPatchTestFailed):
+		respondError(ctx, http.StatusPreconditionFailed, SettingsAPIPatchTestFailed, err.Error())
+		return
+	}
+
+	responseMap, _ := response.(map[string]interface{})
+	responseErr, _ := responseMap["error"].(string)
+	output, _ := responseMap["output"].(string)
+	if confirm, ok := parseConfirmation(responseErr); ok {
+		confirmResponse := &ConfirmResponse{
+			ErrorResponse: utilhttp.ErrorResponse{
+				Type:     SettingsAPIConfirm,
+				Messages: make([]*utilhttp.Message, 0, len(confirm)),
+			},
+			Confirm: confirm,
+		}
+		for _, item := range confirm {
+			vars := []string{item.InvalidReason}
+			for _, affected := range item.AffectedValues {
+				vars = append(vars, affected.AffectedType+": "+affected.AffectedValue)
+			}
+			confirmResponse.Messages = append(confirmResponse.Messages, &utilhttp.Message{
+				Message:   item.MainTranslationString,
+				Variables: vars,
+			})
+		}
+		ctx.JSON(http.StatusConflict, confirmResponse)
+		return
+	}
+
+	message := err.Error()
+	if responseErr != "" {
+		message = responseErr
+	}
+	respondError(ctx, http.StatusInternalServerError, SettingsAPIFailed, message, output)
+}
+
+// parseConfirmation returns the UI messages of a CONFIRM set settings
+// error, see buildMessage.
+func parseConfirmation(responseErr string) ([]SetSettingsErrorUI, bool) {
+	if !strings.HasPrefix(responseErr, confirmPrefix) {
+		return nil, false
+	}
+	var confirm []SetSettingsErrorUI
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(responseErr, confirmPrefix)), &confirm); err != nil {
+		logger.Warn("Failed to parse the set settings confirmation: %s\n", err.Error())
+		return nil, false
+	}
+	return confirm, true
+}
@@ -0,0 +1,195 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+	utilhttp "github.com/untangle/golang-shared/util/http"
+)
+
+// ginEngineHandler registers the endpoints of plugins with a gin
+// engine.
+type ginEngineHandler struct {
+	engine *gin.Engine
+}
+
+func (handler *ginEngineHandler) RegisterEndpoint(plugin utilhttp.HTTPGinPlugin) {
+	for _, method := range plugin.Methods() {
+		handler.engine.Handle(method, plugin.Path(), plugin.Handle)
+	}
+}
+
+// newTestSettingsAPI serves a temp copy of testdata/http_settings.json
+// and returns the engine and the copy.
+func newTestSettingsAPI(t *testing.T, opts ...SettingsOption) (*gin.Engine, string) {
+	gin.SetMode(gin.TestMode)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/http_settings.json")
+	t.Cleanup(cleanup)
+
+	handler := &ginEngineHandler{engine: gin.New()}
+	api := NewSettingsAPI(NewSettingsFile(tempfile, opts...),
+		WithSettingsAPIPrefix("/api/"),
+		WithSettingsAPIDefaults("testdata/http_defaults.json"),
+		WithSettingsAPICurrent(filepath.Join(t.TempDir(), "current.json")))
+	for _, plugin := range api.Plugins(handler) {
+		require.NoError(t, plugin.Startup())
+	}
+	return handler.engine, tempfile
+}
+
+// serve sends a request to the engine and returns the recorded
+// response.
+func serve(engine *gin.Engine, method string, target string, contentType string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// decodeOkay decodes an OkayResponse and returns its result.
+func decodeOkay(t *testing.T, recorder *httptest.ResponseRecorder) interface{} {
+	okay, err := utilhttp.DecodeResponse(recorder.Result())
+	require.NoError(t, err, recorder.Body.String())
+	return okay.Result
+}
+
+// decodeError decodes an ErrorResponse.
+func decodeError(t *testing.T, recorder *httptest.ResponseRecorder) *utilhttp.ErrorResponse {
+	_, err := utilhttp.DecodeResponse(recorder.Result())
+	require.True(t, utilhttp.IsApiError(err), recorder.Body.String())
+	return utilhttp.ToApiError(err)
+}
+
+func TestSettingsAPIGet(t *testing.T) {
+	engine, _ := newTestSettingsAPI(t)
+
+	result := decodeOkay(t, serve(engine, http.MethodGet, "/api/settings/system/hostName", "", ""))
+	assert.Equal(t, "mfw", result)
+
+	result = decodeOkay(t, serve(engine, http.MethodGet, "/api/settings/network/interfaces/0/name", "", ""))
+	assert.Equal(t, "wan", result)
+
+	result = decodeOkay(t, serve(engine, http.MethodGet, "/api/settings/", "", ""))
+	assert.Contains(t, result, "network")
+
+	recorder := serve(engine, http.MethodGet, "/api/settings/system/missing", "", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, SettingsAPINotFound, decodeError(t, recorder).Type)
+
+	result = decodeOkay(t, serve(engine, http.MethodGet, "/api/defaults/system/hostName", "", ""))
+	assert.Equal(t, "default", result)
+
+	// without a current file the settings are current.
+	result = decodeOkay(t, serve(engine, http.MethodGet, "/api/current/system/hostName", "", ""))
+	assert.Equal(t, "mfw", result)
+}
+
+func TestSettingsAPIChanges(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	engine, tempfile := newTestSettingsAPI(t)
+	sf := NewSettingsFile(tempfile)
+
+	recorder := serve(engine, http.MethodPut, "/api/settings/system/hostName", "application/json", `"gateway"`)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]interface{}{"output": "synced"}, decodeOkay(t, recorder))
+
+	recorder = serve(engine, http.MethodPatch, "/api/settings/system", "application/merge-patch+json",
+		`{"httpPort": null, "timeZone": "UTC"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	recorder = serve(engine, http.MethodPatch, "/api/settings/network", jsonPatchContentType,
+		`[{"op": "test", "path": "/interfaces/0/name", "value": "wan"},
+		  {"op": "replace", "path": "/interfaces/0/name", "value": "external"}]`)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	recorder = serve(engine, http.MethodDelete, "/api/settings/system/timeZone", "", "")
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, 4, *syncs)
+
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"hostName": "gateway"}, settings["system"])
+	assert.Equal(t, "external", settings["network"].(map[string]interface{})["interfaces"].([]interface{})[0].(map[string]interface{})["name"])
+
+	recorder = serve(engine, http.MethodPatch, "/api/settings/network", jsonPatchContentType,
+		`[{"op": "test", "path": "/interfaces/0/name", "value": "wan"}]`)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	assert.Equal(t, SettingsAPIPatchTestFailed, decodeError(t, recorder).Type)
+
+	for _, request := range []struct{ method, target, body string }{
+		{http.MethodPut, "/api/settings/system", `{`},
+		{http.MethodPut, "/api/settings/", `[]`},
+		{http.MethodPut, "/api/settings/system?force=maybe", `{}`},
+		{http.MethodDelete, "/api/settings/", ""},
+	} {
+		recorder = serve(engine, request.method, request.target, "application/json", request.body)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, request.target)
+		assert.Equal(t, SettingsAPIInvalidRequest, decodeError(t, recorder).Type, request.target)
+	}
+	assert.Equal(t, 4, *syncs)
+}
+
+func TestSettingsAPIInvalidSettings(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	registry := NewSchemaRegistry()
+	require.NoError(t, registry.Register("system", []byte(`{
+		"type": "object",
+		"properties": {"hostName": {"type": "string", "minLength": 1}}
+	}`)))
+	engine, _ := newTestSettingsAPI(t, WithSchemaRegistry(registry))
+
+	recorder := serve(engine, http.MethodPut, "/api/settings/system/hostName", "application/json", `""`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	apiErr := decodeError(t, recorder)
+	assert.Equal(t, SettingsAPIInvalidSettings, apiErr.Type)
+	require.Len(t, apiErr.Messages, 1)
+	assert.Equal(t, []string{"/system/hostName"}, apiErr.Messages[0].Variables)
+	assert.Equal(t, 0, *syncs)
+}
+
+func TestSettingsAPIConfirm(t *testing.T) {
+	confirm := `{"CONFIRM": {"invalidItems": {
+		"4": {"reason": "disabled", "type": "interface", "value": "wan", "parentId": ""},
+		"p1": {"reason": "disabled", "type": "policy", "value": "Policy 1", "parentId": "4"}
+	}}}`
+	syncs := fakeSyncSettings(t, errors.New(confirm))
+	engine, _ := newTestSettingsAPI(t)
+
+	recorder := serve(engine, http.MethodPut, "/api/settings/network/interfaces", "application/json",
+		`[{"interfaceId": 4, "name": "wan", "enabled": false}]`)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	apiErr := decodeError(t, recorder)
+	assert.Equal(t, SettingsAPIConfirm, apiErr.Type)
+	require.Len(t, apiErr.Messages, 1)
+	assert.Equal(t, "affected_item_disabled_or_deleted", apiErr.Messages[0].Message)
+	assert.Equal(t, []string{"disabled", "policy: Policy 1"}, apiErr.Messages[0].Variables)
+
+	var confirmResponse ConfirmResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &confirmResponse))
+	assert.Equal(t, []SetSettingsErrorUI{{
+		MainTranslationString: "affected_item_disabled_or_deleted",
+		InvalidReason:         "disabled",
+		AffectedValues:        []AffectedValue{{AffectedType: "policy", AffectedValue: "Policy 1"}},
+	}}, confirmResponse.Confirm)
+
+	// any other failure of sync-settings.
+	fakeSyncSettings(t, errors.New("boom"))
+	recorder = serve(engine, http.MethodPut, "/api/settings/system/hostName?force=true", "application/json", `"x"`)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	apiErr = decodeError(t, recorder)
+	assert.Equal(t, SettingsAPIFailed, apiErr.Type)
+	assert.Equal(t, "boom", apiErr.Messages[0].Message)
+	assert.Equal(t, 1, *syncs)
+}
@@ -0,0 +1,223 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// SettingsLayer names a layer of LayeredSettings.
+type SettingsLayer string
+
+const (
+	// LayerDefaults is the layer of the factory defaults, defaults.json.
+	LayerDefaults SettingsLayer = "defaults"
+
+	// LayerUser is the layer of the settings the user saved,
+	// settings.json.
+	LayerUser SettingsLayer = "user"
+
+	// LayerCurrent is the layer of the runtime settings after the last
+	// sync, current.json.
+	LayerCurrent SettingsLayer = "current"
+)
+
+// ErrSettingsPathNotFound is returned for paths that are in none of
+// the layers.
+var ErrSettingsPathNotFound = errors.New("settings path not found")
+
+// LayeredSettings is a view of the settings as the user settings laid
+// over the defaults, and the current settings over both. The user
+// settings are a full copy of the defaults the user changed, so they
+// replace the defaults: a key the user deleted stays deleted. An empty
+// user layer, nothing saved yet, shows the defaults. The current
+// settings are merged key by key for objects, any other value replaces
+// the lower one, and a key missing from them shows the value of the
+// lower layers.
+type LayeredSettings struct {
+	defaults map[string]interface{}
+	user     map[string]interface{}
+	current  map[string]interface{}
+
+	// the view up to and including each layer.
+	upToDefaults map[string]interface{}
+	upToUser     map[string]interface{}
+	effective    map[string]interface{}
+}
+
+// NewLayeredSettings creates LayeredSettings from the decoded JSON of
+// each layer. Any layer may be nil. The layers are copied.
+func NewLayeredSettings(defaults map[string]interface{}, user map[string]interface{}, current map[string]interface{}) (*LayeredSettings, error) {
+	layered := &LayeredSettings{}
+	for _, layer := range []struct {
+		from map[string]interface{}
+		to   *map[string]interface{}
+	}{
+		{defaults, &layered.defaults},
+		{user, &layered.user},
+		{current, &layered.current},
+	} {
+		copied, err := copyJSON(layer.from)
+		if err != nil {
+			return nil, fmt.Errorf("settings layers: %w", err)
+		}
+		*layer.to, _ = copied.(map[string]interface{})
+		if *layer.to == nil {
+			*layer.to = map[string]interface{}{}
+		}
+	}
+
+	layered.upToDefaults = layered.defaults
+	layered.upToUser = layered.user
+	if len(layered.user) == 0 {
+		layered.upToUser = layered.upToDefaults
+	}
+	layered.effective = mergeLayer(layered.upToUser, layered.current).(map[string]interface{})
+	return layered, nil
+}
+
+// LoadLayeredSettings reads LayeredSettings from the defaults, user and
+// current settings files. A missing file is an empty layer.
+func LoadLayeredSettings(defaultsFilename string, userFilename string, currentFilename string) (*LayeredSettings, error) {
+	layers := make([]map[string]interface{}, 0, 3)
+	for _, filename := range []string{defaultsFilename, userFilename, currentFilename} {
+		jsonSettings, err := readSettingsFileJSON(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			jsonSettings = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("settings layers: unable to read %s: %w", filename, err)
+		}
+		layers = append(layers, jsonSettings)
+	}
+	return NewLayeredSettings(layers[0], layers[1], layers[2])
+}
+
+// GetLayeredSettings returns the LayeredSettings of the defaults,
+// settings and current files of the system.
+func GetLayeredSettings() (*LayeredSettings, error) {
+	return LoadLayeredSettings(defaultsFile, settingsFile, currentFile)
+}
+
+// mergeLayer returns upper laid over lower. Neither is modified, the
+// result shares the values that are not merged.
+func mergeLayer(lower interface{}, upper interface{}) interface{} {
+	upperObject, upperIsObject := upper.(map[string]interface{})
+	lowerObject, lowerIsObject := lower.(map[string]interface{})
+	if !upperIsObject || !lowerIsObject {
+		return upper
+	}
+	merged := make(map[string]interface{}, len(lowerObject)+len(upperObject))
+	for key, value := range lowerObject {
+		merged[key] = value
+	}
+	for key, value := range upperObject {
+		if lowerValue, ok := lowerObject[key]; ok {
+			merged[key] = mergeLayer(lowerValue, value)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// Effective returns a copy of the effective settings, all layers
+// merged.
+func (layered *LayeredSettings) Effective() map[string]interface{} {
+	copied, _ := copyJSON(layered.effective)
+	return copied.(map[string]interface{})
+}
+
+// Layer returns a copy of the settings of a single layer.
+func (layered *LayeredSettings) Layer(layer SettingsLayer) (map[string]interface{}, error) {
+	var jsonSettings map[string]interface{}
+	switch layer {
+	case LayerDefaults:
+		jsonSettings = layered.defaults
+	case LayerUser:
+		jsonSettings = layered.user
+	case LayerCurrent:
+		jsonSettings = layered.current
+	default:
+		return nil, fmt.Errorf("settings layers: unknown layer %q", layer)
+	}
+	copied, _ := copyJSON(jsonSettings)
+	return copied.(map[string]interface{}), nil
+}
+
+// Get returns the effective value at the segments path and the layer
+// that supplied it. Segments index arrays by number or by id, as in
+// "[id=abc]".
+func (layered *LayeredSettings) Get(segments []string) (interface{}, SettingsLayer, error) {
+	value, err := patchGet(layered.effective, segments)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v: %s", ErrSettingsPathNotFound, segments, err.Error())
+	}
+	copied, _ := copyJSON(value)
+	return copied, layered.provenance(segments, value), nil
+}
+
+// Provenance returns the layer that supplied the effective value at the
+// segments path, which is the lowest layer from which the value is
+// unchanged. For objects, a change anywhere below counts.
+func (layered *LayeredSettings) Provenance(segments []string) (SettingsLayer, error) {
+	value, err := patchGet(layered.effective, segments)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v: %s", ErrSettingsPathNotFound, segments, err.Error())
+	}
+	return layered.provenance(segments, value), nil
+}
+
+// provenance implements Provenance, value is the effective value.
+func (layered *LayeredSettings) provenance(segments []string, value interface{}) SettingsLayer {
+	userValue, err := patchGet(layered.upToUser, segments)
+	if err != nil || !reflect.DeepEqual(userValue, value) {
+		return LayerCurrent
+	}
+	defaultValue, err := patchGet(layered.upToDefaults, segments)
+	if err != nil || !reflect.DeepEqual(defaultValue, userValue) {
+		return LayerUser
+	}
+	return LayerDefaults
+}
+
+// UserOverlay returns the minimal RFC 7396 merge patch that, applied to
+// the defaults with ApplyMergePatch, gives the same settings as the
+// user layer does. These are the changes the user made, without the
+// noise of the defaults. Keys the user deleted are null.
+func (layered *LayeredSettings) UserOverlay() map[string]interface{} {
+	overlay, _ := layerOverlay(layered.defaults, layered.upToUser)
+	copied, _ := copyJSON(overlay)
+	if copiedObject, ok := copied.(map[string]interface{}); ok {
+		return copiedObject
+	}
+	return map[string]interface{}{}
+}
+
+// layerOverlay returns the part of upper that differs from lower, with
+// a null for each key of lower that upper does not have, and whether
+// there is any.
+func layerOverlay(lower interface{}, upper interface{}) (interface{}, bool) {
+	upperObject, upperIsObject := upper.(map[string]interface{})
+	lowerObject, lowerIsObject := lower.(map[string]interface{})
+	if !upperIsObject || !lowerIsObject {
+		return upper, !reflect.DeepEqual(lower, upper)
+	}
+	overlay := map[string]interface{}{}
+	for key, value := range upperObject {
+		lowerValue, ok := lowerObject[key]
+		if !ok {
+			overlay[key] = value
+			continue
+		}
+		if difference, changed := layerOverlay(lowerValue, value); changed {
+			overlay[key] = difference
+		}
+	}
+	for key := range lowerObject {
+		if _, ok := upperObject[key]; !ok {
+			overlay[key] = nil
+		}
+	}
+	return overlay, len(overlay) > 0
+}
@@ -0,0 +1,174 @@
+package settings
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestLayers(t *testing.T) *LayeredSettings {
+	layered, err := LoadLayeredSettings(
+		filepath.Join("testdata", "layers", "defaults.json"),
+		filepath.Join("testdata", "layers", "settings.json"),
+		filepath.Join("testdata", "layers", "current.json"))
+	require.NoError(t, err)
+	return layered
+}
+
+func TestLayeredSettingsProvenance(t *testing.T) {
+	layered := loadTestLayers(t)
+
+	tests := []struct {
+		path     []string
+		expected interface{}
+		layer    SettingsLayer
+	}{
+		{[]string{"system", "timeZone", "value"}, "UTC", LayerDefaults},
+		{[]string{"system", "hostName"}, "gateway", LayerUser},
+		{[]string{"system", "uptime"}, float64(42), LayerCurrent},
+		{[]string{"firewall", "tables", "[id=filter]", "enabled"}, false, LayerUser},
+		{[]string{"firewall", "tables", "0", "id"}, "filter", LayerDefaults},
+		{[]string{"wan"}, map[string]interface{}{"enabled": true}, LayerUser},
+		{[]string{"dns"}, map[string]interface{}{"localServers": []interface{}{}}, LayerDefaults},
+		// a change below an object is a change of the object.
+		{[]string{"system", "timeZone"}, map[string]interface{}{"display": "UTC", "value": "UTC"}, LayerDefaults},
+	}
+	for _, test := range tests {
+		value, layer, err := layered.Get(test.path)
+		require.NoError(t, err, test.path)
+		assert.Equal(t, test.expected, value, test.path)
+		assert.Equal(t, test.layer, layer, test.path)
+
+		layer, err = layered.Provenance(test.path)
+		require.NoError(t, err, test.path)
+		assert.Equal(t, test.layer, layer, test.path)
+	}
+
+	layer, err := layered.Provenance([]string{"system"})
+	require.NoError(t, err)
+	assert.Equal(t, LayerCurrent, layer)
+
+	_, _, err = layered.Get([]string{"system", "missing"})
+	assert.ErrorIs(t, err, ErrSettingsPathNotFound)
+	_, err = layered.Provenance([]string{"firewall", "tables", "[id=nat]"})
+	assert.ErrorIs(t, err, ErrSettingsPathNotFound)
+}
+
+func TestLayeredSettingsEffective(t *testing.T) {
+	layered := loadTestLayers(t)
+
+	effective := layered.Effective()
+	system := effective["system"].(map[string]interface{})
+	assert.Equal(t, "gateway", system["hostName"])
+	assert.Equal(t, float64(42), system["uptime"])
+	assert.Contains(t, effective, "firewall")
+	assert.Contains(t, effective, "dns")
+
+	// the result is a copy.
+	system["hostName"] = "changed"
+	value, _, err := layered.Get([]string{"system", "hostName"})
+	require.NoError(t, err)
+	assert.Equal(t, "gateway", value)
+
+	user, err := layered.Layer(LayerUser)
+	require.NoError(t, err)
+	assert.NotContains(t, user["system"], "uptime")
+	_, err = layered.Layer("other")
+	assert.Error(t, err)
+}
+
+func TestLayeredSettingsUserOverlay(t *testing.T) {
+	layered := loadTestLayers(t)
+
+	overlay := layered.UserOverlay()
+	assert.Equal(t, map[string]interface{}{
+		"system": map[string]interface{}{"hostName": "gateway"},
+		"firewall": map[string]interface{}{
+			"tables": []interface{}{
+				map[string]interface{}{"id": "filter", "enabled": false},
+			},
+		},
+		"wan": map[string]interface{}{"enabled": true},
+	}, overlay)
+
+	// the overlay laid over the defaults gives the user settings back.
+	defaults, err := layered.Layer(LayerDefaults)
+	require.NoError(t, err)
+	user, err := layered.Layer(LayerUser)
+	require.NoError(t, err)
+	patched, err := ApplyMergePatch(defaults, overlay)
+	require.NoError(t, err)
+	assert.Equal(t, user, patched)
+
+	same, err := NewLayeredSettings(defaults, defaults, nil)
+	require.NoError(t, err)
+	assert.Empty(t, same.UserOverlay())
+}
+
+func TestLayeredSettingsDeletedDefault(t *testing.T) {
+	defaults := map[string]interface{}{
+		"system": map[string]interface{}{"hostName": "mfw", "domainName": "example.com"},
+		"dns":    map[string]interface{}{"localServers": []interface{}{}},
+	}
+	user := map[string]interface{}{
+		"system": map[string]interface{}{"hostName": "gateway"},
+	}
+	layered, err := NewLayeredSettings(defaults, user, nil)
+	require.NoError(t, err)
+
+	// keys the user deleted do not come back from the defaults.
+	assert.Equal(t, user, layered.Effective())
+	_, _, err = layered.Get([]string{"system", "domainName"})
+	assert.ErrorIs(t, err, ErrSettingsPathNotFound)
+
+	overlay := layered.UserOverlay()
+	assert.Equal(t, map[string]interface{}{
+		"system": map[string]interface{}{"hostName": "gateway", "domainName": nil},
+		"dns":    nil,
+	}, overlay)
+	patched, err := ApplyMergePatch(defaults, overlay)
+	require.NoError(t, err)
+	assert.Equal(t, user, patched)
+}
+
+func TestLoadLayeredSettingsMissingFiles(t *testing.T) {
+	layered, err := LoadLayeredSettings(
+		filepath.Join("testdata", "layers", "defaults.json"),
+		filepath.Join(t.TempDir(), "settings.json"),
+		filepath.Join(t.TempDir(), "current.json"))
+	require.NoError(t, err)
+
+	value, layer, err := layered.Get([]string{"system", "hostName"})
+	require.NoError(t, err)
+	assert.Equal(t, "mfw", value)
+	assert.Equal(t, LayerDefaults, layer)
+	assert.Empty(t, layered.UserOverlay())
+}
+
+func TestGetCurrentSettings(t *testing.T) {
+	origDefaults, origSettings, origCurrent := defaultsFile, settingsFile, currentFile
+	defer func() { defaultsFile, settingsFile, currentFile = origDefaults, origSettings, origCurrent }()
+	defaultsFile = filepath.Join("testdata", "layers", "defaults.json")
+	settingsFile = filepath.Join("testdata", "layers", "settings.json")
+	currentFile = filepath.Join("testdata", "layers", "current.json")
+
+	// the current settings, with the saved settings they lack.
+	value, err := GetCurrentSettings([]string{"system", "uptime"})
+	require.NoError(t, err)
+	assert.Equal(t, float64(42), value)
+	value, err = GetCurrentSettings([]string{"wan", "enabled"})
+	require.NoError(t, err)
+	assert.Equal(t, true, value)
+	_, err = GetCurrentSettings([]string{"missing"})
+	assert.ErrorIs(t, err, ErrSettingsPathNotFound)
+
+	// the saved settings before current.json exists.
+	currentFile = filepath.Join(t.TempDir(), "current.json")
+	_, err = GetCurrentSettings([]string{"system", "uptime"})
+	assert.Error(t, err)
+	value, err = GetCurrentSettings([]string{"firewall", "tables", "0", "enabled"})
+	require.NoError(t, err)
+	assert.Equal(t, false, value)
+}
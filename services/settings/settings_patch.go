@@ -0,0 +1,440 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrPatchTestFailed is returned when a test operation of a JSON Patch
+// does not match the settings.
+var ErrPatchTestFailed = errors.New("settings patch: test operation failed")
+
+// PatchOperation is a single operation of an RFC 6902 JSON Patch. Paths
+// are JSON pointers, whose array elements may also be selected by their
+// id with a [id=<id>] suffix, as in /policy_manager/rules[id=abc]/enabled.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// ParseJSONPatch decodes an RFC 6902 JSON Patch document.
+func ParseJSONPatch(raw []byte) ([]PatchOperation, error) {
+	var ops []PatchOperation
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return nil, fmt.Errorf("settings patch: invalid patch document: %w", err)
+	}
+	return ops, nil
+}
+
+// idSelectorPrefix and idSelectorSuffix enclose the id of an array
+// element in a path segment.
+const (
+	idSelectorPrefix = "[id="
+	idSelectorSuffix = "]"
+)
+
+// isIDSelector returns whether segment selects an array element by id.
+func isIDSelector(segment string) bool {
+	return strings.HasPrefix(segment, idSelectorPrefix) && strings.HasSuffix(segment, idSelectorSuffix)
+}
+
+// findArrayIndex returns the index in array of the element selected by
+// segment, which is either a decimal index or an id selector.
+func findArrayIndex(array []interface{}, segment string) (int, error) {
+	if isIDSelector(segment) {
+		id := strings.TrimSuffix(strings.TrimPrefix(segment, idSelectorPrefix), idSelectorSuffix)
+		for i, element := range array {
+			object, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if value, ok := object["id"]; ok && value != nil && fmt.Sprint(value) == id {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("no array element with id %s", id)
+	}
+	i, err := strconv.Atoi(segment)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 || i >= len(array) {
+		return 0, errors.New("array index out of range")
+	}
+	return i, nil
+}
+
+// parsePatchPointer splits a JSON pointer into its unescaped segments.
+// A segment with an id selector suffix is split in two, the key and
+// the selector.
+func parsePatchPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("settings patch: invalid path %q", pointer)
+	}
+	segments := []string{}
+	for _, segment := range strings.Split(pointer[1:], "/") {
+		segment = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+		if start := strings.Index(segment, idSelectorPrefix); start > 0 && isIDSelector(segment[start:]) {
+			segments = append(segments, segment[:start], segment[start:])
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// patchChild returns the child of container at segment.
+func patchChild(container interface{}, segment string) (interface{}, error) {
+	switch typed := container.(type) {
+	case map[string]interface{}:
+		child, ok := typed[segment]
+		if !ok {
+			return nil, fmt.Errorf("missing attribute %s", segment)
+		}
+		return child, nil
+	case []interface{}:
+		i, err := findArrayIndex(typed, segment)
+		if err != nil {
+			return nil, err
+		}
+		return typed[i], nil
+	}
+	return nil, fmt.Errorf("cannot index %T with %s", container, segment)
+}
+
+// patchGet returns the value at segments in doc.
+func patchGet(doc interface{}, segments []string) (interface{}, error) {
+	for _, segment := range segments {
+		var err error
+		if doc, err = patchChild(doc, segment); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// patchUpdate replaces the value at segments in doc with the result of
+// update, called with the parent container and the last segment. It
+// returns the new document, as arrays may be reallocated.
+func patchUpdate(doc interface{}, segments []string,
+	update func(parent interface{}, segment string) (interface{}, error)) (interface{}, error) {
+	if len(segments) == 1 {
+		return update(doc, segments[0])
+	}
+	switch typed := doc.(type) {
+	case map[string]interface{}:
+		child, err := patchChild(typed, segments[0])
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := patchUpdate(child, segments[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		typed[segments[0]] = newChild
+		return typed, nil
+	case []interface{}:
+		// the index is resolved before the update, which may well
+		// change the id an id selector matched.
+		i, err := findArrayIndex(typed, segments[0])
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := patchUpdate(typed[i], segments[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		typed[i] = newChild
+		return typed, nil
+	}
+	return nil, fmt.Errorf("cannot index %T with %s", doc, segments[0])
+}
+
+// patchAdd adds value at segments in doc, inserting into arrays.
+func patchAdd(doc interface{}, segments []string, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	return patchUpdate(doc, segments, func(parent interface{}, segment string) (interface{}, error) {
+		switch typed := parent.(type) {
+		case map[string]interface{}:
+			typed[segment] = value
+			return typed, nil
+		case []interface{}:
+			if segment == "-" {
+				return append(typed, value), nil
+			}
+			i, err := strconv.Atoi(segment)
+			if isIDSelector(segment) {
+				i, err = findArrayIndex(typed, segment)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if i < 0 || i > len(typed) {
+				return nil, errors.New("array index out of range")
+			}
+			typed = append(typed, nil)
+			copy(typed[i+1:], typed[i:])
+			typed[i] = value
+			return typed, nil
+		}
+		return nil, fmt.Errorf("cannot add %s to %T", segment, parent)
+	})
+}
+
+// patchRemove removes the value at segments from doc.
+func patchRemove(doc interface{}, segments []string) (interface{}, error) {
+	if len(segments) == 0 {
+		return nil, errors.New("cannot remove the whole settings")
+	}
+	return patchUpdate(doc, segments, func(parent interface{}, segment string) (interface{}, error) {
+		switch typed := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := typed[segment]; !ok {
+				return nil, fmt.Errorf("missing attribute %s", segment)
+			}
+			delete(typed, segment)
+			return typed, nil
+		case []interface{}:
+			i, err := findArrayIndex(typed, segment)
+			if err != nil {
+				return nil, err
+			}
+			return append(typed[:i], typed[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %s from %T", segment, parent)
+	})
+}
+
+// patchReplace replaces the existing value at segments in doc.
+func patchReplace(doc interface{}, segments []string, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	return patchUpdate(doc, segments, func(parent interface{}, segment string) (interface{}, error) {
+		switch typed := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := typed[segment]; !ok {
+				return nil, fmt.Errorf("missing attribute %s", segment)
+			}
+			typed[segment] = value
+			return typed, nil
+		case []interface{}:
+			i, err := findArrayIndex(typed, segment)
+			if err != nil {
+				return nil, err
+			}
+			typed[i] = value
+			return typed, nil
+		}
+		return nil, fmt.Errorf("cannot replace %s in %T", segment, parent)
+	})
+}
+
+// copyJSON returns a deep copy of value made by a JSON round trip, which
+// also turns go values into their JSON form.
+func copyJSON(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	err = json.Unmarshal(raw, &copied)
+	return copied, err
+}
+
+// ApplyJSONPatch applies the RFC 6902 JSON Patch ops to a copy of doc
+// and returns it. Either all operations apply or an error is returned;
+// a failing test operation returns ErrPatchTestFailed.
+func ApplyJSONPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	doc, err := copyJSON(doc)
+	if err != nil {
+		return nil, fmt.Errorf("settings patch: %w", err)
+	}
+	for i, op := range ops {
+		if doc, err = applyPatchOperation(doc, op); err != nil {
+			if errors.Is(err, ErrPatchTestFailed) {
+				return nil, fmt.Errorf("%w: operation %d at %s", ErrPatchTestFailed, i, op.Path)
+			}
+			return nil, fmt.Errorf("settings patch: operation %d (%s %s) failed: %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyPatchOperation applies a single operation to doc.
+func applyPatchOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	segments, err := parsePatchPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := copyJSON(op.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return patchAdd(doc, segments, value)
+	case "remove":
+		return patchRemove(doc, segments)
+	case "replace":
+		return patchReplace(doc, segments, value)
+	case "move", "copy":
+		from, err := parsePatchPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		moved, err := patchGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			if doc, err = patchRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else if moved, err = copyJSON(moved); err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, segments, moved)
+	case "test":
+		current, err := patchGet(doc, segments)
+		if err != nil || !reflect.DeepEqual(current, value) {
+			return nil, ErrPatchTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// ApplyMergePatch applies the RFC 7396 Merge Patch patch to a copy of
+// doc and returns it.
+func ApplyMergePatch(doc interface{}, patch interface{}) (interface{}, error) {
+	doc, err := copyJSON(doc)
+	if err != nil {
+		return nil, fmt.Errorf("settings patch: %w", err)
+	}
+	patch, err = copyJSON(patch)
+	if err != nil {
+		return nil, fmt.Errorf("settings patch: %w", err)
+	}
+	return mergePatch(doc, patch), nil
+}
+
+// mergePatch implements the MergePatch function of RFC 7396.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Patch adds applying the JSON Patch ops to the whole settings to the
+// transaction. Test operations are evaluated on the settings as they
+// are when the transaction commits.
+func (tx *SettingsTransaction) Patch(ops []PatchOperation) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	// the values are copied so the caller may reuse them.
+	copied := make([]PatchOperation, len(ops))
+	for i, op := range ops {
+		value, err := copyJSON(op.Value)
+		if err != nil {
+			return fmt.Errorf("settings transaction: invalid value in patch operation %d: %w", i, err)
+		}
+		op.Value = value
+		copied[i] = op
+	}
+	tx.operations = append(tx.operations, settingsOperation{
+		patch: func(jsonSettings interface{}) (interface{}, error) {
+			return ApplyJSONPatch(jsonSettings, copied)
+		},
+	})
+	return nil
+}
+
+// MergePatch adds applying the Merge Patch patch to the value at the
+// segments path to the transaction.
+func (tx *SettingsTransaction) MergePatch(segments []string, patch interface{}) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	copied, err := copyJSON(patch)
+	if err != nil {
+		return fmt.Errorf("settings transaction: invalid merge patch: %w", err)
+	}
+	segments = append([]string{}, segments...)
+	tx.operations = append(tx.operations, settingsOperation{
+		segments: segments,
+		patch: func(jsonSettings interface{}) (interface{}, error) {
+			current, _ := getSettingsFromJSON(jsonSettings, segments)
+			merged, err := ApplyMergePatch(current, copied)
+			if err != nil {
+				return nil, err
+			}
+			return setSettingsInJSON(jsonSettings, segments, merged)
+		},
+	})
+	return nil
+}
+
+// PatchSettings applies the RFC 6902 JSON Patch ops to the settings and
+// runs sync-settings on the result, like SetSettings. If a test
+// operation fails nothing is written and the error wraps
+// ErrPatchTestFailed. The optional audit says who makes the change and
+// why.
+func (file *SettingsFile) PatchSettings(ops []PatchOperation, force bool, skipEosConfig bool, audit ...AuditInfo) (interface{}, error) {
+	tx, err := file.Begin()
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	info := auditInfo(audit)
+	tx.Annotate(info.Actor, info.Reason)
+	if err := tx.Patch(ops); err != nil {
+		return createJSONErrorObject(err), err
+	}
+	return tx.Commit(force, skipEosConfig)
+}
+
+// MergePatchSettings applies the RFC 7396 Merge Patch patch to the
+// settings at the segments path and runs sync-settings on the result,
+// like SetSettings. The optional audit says who makes the change and
+// why.
+func (file *SettingsFile) MergePatchSettings(segments []string, patch interface{}, force bool, skipEosConfig bool, audit ...AuditInfo) (interface{}, error) {
+	tx, err := file.Begin()
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	info := auditInfo(audit)
+	tx.Annotate(info.Actor, info.Reason)
+	if err := tx.MergePatch(segments, patch); err != nil {
+		return createJSONErrorObject(err), err
+	}
+	return tx.Commit(force, skipEosConfig)
+}
@@ -0,0 +1,192 @@
+package settings
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"policy_manager": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{"id": "abc", "enabled": true},
+				map[string]interface{}{"id": "def", "enabled": true},
+			},
+		},
+		"a~b": map[string]interface{}{"c/d": 1},
+	}
+
+	tests := []struct {
+		name  string
+		patch string
+		// path whose patched value is expected, or nil for an error.
+		path     string
+		expected interface{}
+		err      error
+	}{
+		{
+			name:     "replace by id",
+			path:     "/policy_manager/rules/1/enabled",
+			patch:    `[{"op": "replace", "path": "/policy_manager/rules[id=def]/enabled", "value": false}]`,
+			expected: false,
+		},
+		{
+			// the renamed element is the one selected, not the first.
+			name:     "rename by id",
+			path:     "/policy_manager/rules/1/id",
+			patch:    `[{"op": "replace", "path": "/policy_manager/rules[id=def]/id", "value": "xyz"}]`,
+			expected: "xyz",
+		},
+		{
+			name:     "rename by id keeps the others",
+			path:     "/policy_manager/rules/0/id",
+			patch:    `[{"op": "replace", "path": "/policy_manager/rules[id=def]/id", "value": "xyz"}]`,
+			expected: "abc",
+		},
+		{
+			name:     "add appends",
+			path:     "/policy_manager/rules/2",
+			patch:    `[{"op": "add", "path": "/policy_manager/rules/-", "value": {"id": "ghi"}}]`,
+			expected: map[string]interface{}{"id": "ghi"},
+		},
+		{
+			name:     "escaped keys",
+			path:     "/a~0b/c~1d",
+			patch:    `[{"op": "replace", "path": "/a~0b/c~1d", "value": 2}]`,
+			expected: float64(2),
+		},
+		{
+			name: "test then remove",
+			path: "/policy_manager/rules/0/id",
+			patch: `[{"op": "test", "path": "/policy_manager/rules/0/id", "value": "abc"},
+			         {"op": "remove", "path": "/policy_manager/rules[id=abc]"}]`,
+			expected: "def",
+		},
+		{
+			name: "move and copy",
+			path: "/policy_manager/enabled",
+			patch: `[{"op": "copy", "from": "/policy_manager/rules/0", "path": "/policy_manager/rules/0"},
+			         {"op": "move", "from": "/policy_manager/rules/1/enabled", "path": "/policy_manager/enabled"}]`,
+			expected: true,
+		},
+		{
+			name:  "failing test",
+			patch: `[{"op": "test", "path": "/policy_manager/rules[id=abc]/enabled", "value": false}]`,
+			err:   ErrPatchTestFailed,
+		},
+		{
+			name:  "unknown id",
+			patch: `[{"op": "replace", "path": "/policy_manager/rules[id=nope]/enabled", "value": false}]`,
+		},
+		{
+			name:  "replace missing",
+			patch: `[{"op": "replace", "path": "/missing", "value": 1}]`,
+		},
+		{
+			name:  "unknown op",
+			patch: `[{"op": "frobnicate", "path": "/a~0b"}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops, err := ParseJSONPatch([]byte(test.patch))
+			require.NoError(t, err)
+			patched, err := ApplyJSONPatch(doc, ops)
+			if test.expected == nil {
+				require.Error(t, err)
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+				return
+			}
+			require.NoError(t, err)
+			segments, err := parsePatchPointer(test.path)
+			require.NoError(t, err)
+			value, err := patchGet(patched, segments)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, value)
+		})
+	}
+
+	// the document itself is never modified.
+	assert.Len(t, doc["policy_manager"].(map[string]interface{})["rules"], 2)
+	assert.Equal(t, true, doc["policy_manager"].(map[string]interface{})["rules"].([]interface{})[1].(map[string]interface{})["enabled"])
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	// examples from appendix A of RFC 7396.
+	tests := []struct {
+		doc, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		var doc, patch, expected interface{}
+		require.NoError(t, json.Unmarshal([]byte(test.doc), &doc))
+		require.NoError(t, json.Unmarshal([]byte(test.patch), &patch))
+		require.NoError(t, json.Unmarshal([]byte(test.expected), &expected))
+		merged, err := ApplyMergePatch(doc, patch)
+		require.NoError(t, err)
+		assert.Equal(t, expected, merged, "%s + %s", test.doc, test.patch)
+	}
+}
+
+func TestPatchSettings(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile)
+
+	_, err := sf.PatchSettings([]PatchOperation{
+		{Op: "test", Path: "/a/b/foo", Value: "hello"},
+		{Op: "add", Path: "/a/rules", Value: []interface{}{map[string]interface{}{"id": 7, "enabled": true}}},
+		{Op: "replace", Path: "/a/rules[id=7]/enabled", Value: false},
+	}, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, *syncs)
+
+	// a stale test leaves the file untouched.
+	before, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	_, err = sf.PatchSettings([]PatchOperation{
+		{Op: "test", Path: "/a/b/foo", Value: "hello again"},
+		{Op: "remove", Path: "/a/b"},
+	}, false, false)
+	assert.ErrorIs(t, err, ErrPatchTestFailed)
+	after, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.Equal(t, 1, *syncs)
+
+	_, err = sf.MergePatchSettings([]string{"a", "b"}, map[string]interface{}{"foo": nil, "baz": "x"}, false, false)
+	require.NoError(t, err)
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t,
+		map[string]interface{}{
+			"b":     map[string]interface{}{"bar": float64(1), "baz": "x"},
+			"rules": []interface{}{map[string]interface{}{"id": float64(7), "enabled": false}},
+		},
+		settings["a"])
+
+	// segments may select array elements by id too.
+	value, err := getSettingsFromJSON(settings, []string{"a", "rules", "[id=7]", "enabled"})
+	require.NoError(t, err)
+	assert.Equal(t, false, value)
+
+	_, err = sf.PatchSettings([]PatchOperation{{Op: "replace", Path: "", Value: "not an object"}}, false, false)
+	assert.Error(t, err)
+}
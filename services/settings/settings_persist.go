@@ -0,0 +1,279 @@
+package settings
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/untangle/golang-shared/services/alerts"
+	protoAlerts "github.com/untangle/golang-shared/structs/protocolbuffers/Alerts"
+)
+
+const (
+	// checksumSuffix is appended to the name of a settings file to get
+	// the file holding its checksum.
+	checksumSuffix = ".sha256"
+
+	// lastGoodSuffix is appended to the name of a settings file to get
+	// its last-known-good copy.
+	lastGoodSuffix = ".good"
+)
+
+// ErrSettingsCorrupt is returned when a settings file is truncated or
+// not JSON and there is no usable last-known-good copy.
+var ErrSettingsCorrupt = errors.New("settings file is corrupt")
+
+// settingsAlertPublisher returns the publisher of the SETTINGS alerts
+// raised on corruption. Replaced in tests.
+var settingsAlertPublisher = func() alerts.AlertPublisher {
+	return alerts.Publisher(logger)
+}
+
+// reportedCorruption holds, per settings file, the checksum of the
+// corrupt contents last alerted on, so each corruption alerts once.
+var reportedCorruption = struct {
+	sync.Mutex
+	checksums map[string]string
+}{checksums: map[string]string{}}
+
+// checksumFilename returns the file holding the checksum of filename.
+func checksumFilename(filename string) string {
+	return filename + checksumSuffix
+}
+
+// lastGoodFilename returns the last-known-good copy of filename.
+func lastGoodFilename(filename string) string {
+	return filename + lastGoodSuffix
+}
+
+// encodeSettings encodes jsonSettings the way every settings file is
+// stored, so equal settings have the same version whichever call wrote
+// them.
+func encodeSettings(jsonSettings map[string]interface{}) ([]byte, error) {
+	return json.MarshalIndent(jsonSettings, "", "  ")
+}
+
+// writeFileAtomic replaces filename with data. The data is written to a
+// temporary file in the same directory, synced to storage and renamed
+// over filename, so a crash leaves either the old or the new contents.
+func writeFileAtomic(filename string, data []byte) error {
+	perm := os.FileMode(0660)
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(filename)
+	tmpfile, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	if _, err := tmpfile.Write(data); err != nil {
+		return err
+	}
+	if err := tmpfile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpfile.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile.Name(), filename); err != nil {
+		return err
+	}
+
+	// sync the directory too, so the rename itself is durable.
+	if dirFile, err := os.Open(dir); err == nil {
+		if err := dirFile.Sync(); err != nil {
+			logger.Debug("Failed to sync directory %s: %s\n", dir, err.Error())
+		}
+		dirFile.Close()
+	}
+	return nil
+}
+
+// writeVerifiedFile atomically writes data to filename, followed by its
+// checksum.
+func writeVerifiedFile(filename string, data []byte) error {
+	if err := writeFileAtomic(filename, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(checksumFilename(filename), []byte(settingsVersion(data)+"\n"))
+}
+
+// writeSettingsBytes crash-safely replaces the settings file with data,
+// updating its checksum and last-known-good copy.
+func writeSettingsBytes(filename string, data []byte) error {
+	if err := writeVerifiedFile(filename, data); err != nil {
+		return fmt.Errorf("unable to write %s: %w", filename, err)
+	}
+	if err := writeVerifiedFile(lastGoodFilename(filename), data); err != nil {
+		logger.Warn("Unable to save last-known-good copy of %s: %s\n", filename, err.Error())
+	}
+	return nil
+}
+
+// errSettingsChanged is returned by verifySettingsBytes when a valid
+// settings file does not match its checksum, it was changed by
+// something else than this package.
+var errSettingsChanged = errors.New("settings file changed externally")
+
+// verifySettingsBytes reads filename and checks its integrity: it must
+// hold a JSON object. Files without a checksum were not written by
+// this package and are returned unchecked, those not matching their
+// checksum are returned with errSettingsChanged.
+func verifySettingsBytes(filename string) ([]byte, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := os.ReadFile(checksumFilename(filename))
+	if errors.Is(err, os.ErrNotExist) {
+		return raw, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(checksum)) == settingsVersion(raw) {
+		return raw, nil
+	}
+	var jsonObject map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &jsonObject); err != nil || jsonObject == nil {
+		return raw, fmt.Errorf("%w: %s is not a JSON object", ErrSettingsCorrupt, filename)
+	}
+	return raw, errSettingsChanged
+}
+
+// readSettingsBytes returns the contents of the settings file. A file
+// edited by something else is returned as is, see
+// SettingsFile.AcceptExternalChange. If it is truncated or not JSON the
+// last-known-good copy is returned instead, and a SETTINGS alert is
+// raised. Reading never writes the file or its companions.
+func readSettingsBytes(filename string) ([]byte, error) {
+	raw, err := verifySettingsBytes(filename)
+	if errors.Is(err, errSettingsChanged) {
+		return raw, nil
+	}
+	if !errors.Is(err, ErrSettingsCorrupt) {
+		return raw, err
+	}
+
+	lastGood, lastGoodErr := verifySettingsBytes(lastGoodFilename(filename))
+	if errors.Is(lastGoodErr, errSettingsChanged) {
+		lastGoodErr = nil
+	}
+	if lastGoodErr != nil {
+		reportCorruption(filename, raw, err, false)
+		return nil, err
+	}
+	reportCorruption(filename, raw, err, true)
+	return lastGood, nil
+}
+
+// memoryReader is a bytes.Reader to close like a file.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.
+func (memoryReader) Close() error {
+	return nil
+}
+
+// openSettingsReader opens the settings file to be streamed. A file
+// matching its checksum, checked with a first streaming pass, or
+// without one is read in place. Any other is read by readSettingsBytes
+// and streamed from memory.
+func openSettingsReader(filename string) (io.ReadSeekCloser, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := os.ReadFile(checksumFilename(filename))
+	if errors.Is(err, os.ErrNotExist) {
+		return reader, nil
+	} else if err == nil {
+		hash := sha256.New()
+		if _, err = io.Copy(hash, reader); err == nil && hex.EncodeToString(hash.Sum(nil)) == strings.TrimSpace(string(checksum)) {
+			if _, err = reader.Seek(0, io.SeekStart); err == nil {
+				return reader, nil
+			}
+		}
+	}
+	reader.Close()
+
+	raw, err := readSettingsBytes(filename)
+	if err != nil {
+		return nil, err
+	}
+	return memoryReader{bytes.NewReader(raw)}, nil
+}
+
+// AcceptExternalChange makes the current contents of the settings file,
+// edited by something else than this package, its verified state: its
+// checksum and last-known-good copy are refreshed and its watchers
+// notified. Until then, a later corruption of the file falls back to
+// the copy from before the edit. A file that was not edited is left
+// alone, and a corrupt one is refused with ErrSettingsCorrupt.
+func (file *SettingsFile) AcceptExternalChange() error {
+	file.mutex.Lock()
+	raw, err := verifySettingsBytes(file.filename)
+	if !errors.Is(err, errSettingsChanged) {
+		file.mutex.Unlock()
+		return err
+	}
+	logger.Info("%s was changed externally, accepting the change\n", file.filename)
+	err = writeFileAtomic(checksumFilename(file.filename), []byte(settingsVersion(raw)+"\n"))
+	if err == nil {
+		err = writeVerifiedFile(lastGoodFilename(file.filename), raw)
+	}
+	file.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to accept the change of %s: %w", file.filename, err)
+	}
+	settingsFileChanged(file.filename)
+	return nil
+}
+
+// reportCorruption logs and alerts on the corrupt contents raw of
+// filename, once per distinct contents.
+func reportCorruption(filename string, raw []byte, corruption error, recovered bool) {
+	checksum := settingsVersion(raw)
+	reportedCorruption.Lock()
+	alreadyReported := reportedCorruption.checksums[filename] == checksum
+	reportedCorruption.checksums[filename] = checksum
+	reportedCorruption.Unlock()
+	if alreadyReported {
+		return
+	}
+
+	message := "ALERT_SETTINGS_CORRUPT"
+	severity := protoAlerts.AlertSeverity_CRITICAL
+	if recovered {
+		logger.Err("%s, using the last-known-good copy\n", corruption.Error())
+		message = "ALERT_SETTINGS_CORRUPT_RECOVERED"
+		severity = protoAlerts.AlertSeverity_ERROR
+	} else {
+		logger.Err("%s, and there is no usable last-known-good copy\n", corruption.Error())
+	}
+	settingsAlertPublisher().Send(&protoAlerts.Alert{
+		Type:     protoAlerts.AlertType_SETTINGS,
+		Severity: severity,
+		Message:  message,
+		Params: map[string]string{
+			"filename": filename,
+			"error":    corruption.Error(),
+		},
+	})
+}
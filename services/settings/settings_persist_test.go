@@ -0,0 +1,132 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/alerts"
+	"github.com/untangle/golang-shared/services/events"
+	protoAlerts "github.com/untangle/golang-shared/structs/protocolbuffers/Alerts"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// fakeAlertPublisher records the SETTINGS alerts of the test.
+func fakeAlertPublisher(t *testing.T) *events.MockEventPublisher {
+	publisher := &events.MockEventPublisher{}
+	orig := settingsAlertPublisher
+	settingsAlertPublisher = func() alerts.AlertPublisher { return publisher }
+	t.Cleanup(func() { settingsAlertPublisher = orig })
+	return publisher
+}
+
+func TestWriteSettingsBytes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "settings.json")
+	require.NoError(t, writeSettingsBytes(filename, []byte(`{"a": 1}`)))
+	require.NoError(t, writeSettingsBytes(filename, []byte(`{"a": 2}`)))
+
+	for _, name := range []string{filename, lastGoodFilename(filename)} {
+		raw, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, `{"a": 2}`, string(raw))
+		checksum, err := os.ReadFile(checksumFilename(name))
+		require.NoError(t, err)
+		assert.Equal(t, settingsVersion(raw)+"\n", string(checksum))
+	}
+
+	// no temporary files are left behind.
+	files, err := os.ReadDir(filepath.Dir(filename))
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+}
+
+func TestCorruptSettingsFallback(t *testing.T) {
+	publisher := fakeAlertPublisher(t)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile)
+
+	// files without a checksum are not checked.
+	_, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "foo"}, "good"))
+
+	// a partial write is detected and the last good copy used.
+	require.NoError(t, os.WriteFile(tempfile, []byte(`{"a": {"b": {"fo`), 0660))
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "good", settings["a"].(map[string]interface{})["b"].(map[string]interface{})["foo"])
+	var foo string
+	require.NoError(t, sf.UnmarshalSettingsAtPath(&foo, "a", "b", "foo"))
+	assert.Equal(t, "good", foo)
+
+	// each corruption alerts once.
+	_, err = sf.GetAllSettings()
+	require.NoError(t, err)
+	require.Len(t, publisher.Alerts, 1)
+	assert.Equal(t, protoAlerts.AlertType_SETTINGS, publisher.LastAlert.Type)
+	assert.Equal(t, "ALERT_SETTINGS_CORRUPT_RECOVERED", publisher.LastAlert.Message)
+	assert.Equal(t, tempfile, publisher.LastAlert.Params["filename"])
+
+	// the next write repairs the file.
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "foo"}, "repaired"))
+	_, err = verifySettingsBytes(tempfile)
+	assert.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(tempfile, []byte(`garbage`), 0660))
+	require.NoError(t, os.WriteFile(lastGoodFilename(tempfile), []byte(`garbage`), 0660))
+	_, err = sf.GetAllSettings()
+	assert.ErrorIs(t, err, ErrSettingsCorrupt)
+	assert.Equal(t, "ALERT_SETTINGS_CORRUPT", publisher.LastAlert.Message)
+	assert.Equal(t, protoAlerts.AlertSeverity_CRITICAL, publisher.LastAlert.Severity)
+}
+
+func TestExternalSettingsChange(t *testing.T) {
+	publisher := fakeAlertPublisher(t)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithWatchPollInterval(time.Hour))
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "foo"}, "good"))
+
+	changes := make(chan any, 1)
+	cancel := sf.Watch([]string{"a", "b", "foo"}, func(old, new any) { changes <- new })
+	defer cancel()
+
+	// valid JSON not matching the checksum is an external edit, not a
+	// corruption. Reading it changes nothing.
+	edited := []byte(`{"a": {"b": {"foo": "edited"}}}`)
+	require.NoError(t, os.WriteFile(tempfile, edited, 0660))
+	var foo string
+	require.NoError(t, sf.UnmarshalSettingsAtPath(&foo, "a", "b", "foo"))
+	assert.Equal(t, "edited", foo)
+	assert.Empty(t, publisher.Alerts)
+	_, err := verifySettingsBytes(tempfile)
+	assert.ErrorIs(t, err, errSettingsChanged)
+	lastGood, err := verifySettingsBytes(lastGoodFilename(tempfile))
+	assert.NoError(t, err)
+	assert.NotEqual(t, edited, lastGood)
+	assert.Empty(t, changes)
+
+	// once accepted, the edit is the verified and last-known-good state
+	// and the watchers are notified.
+	require.NoError(t, sf.AcceptExternalChange())
+	select {
+	case value := <-changes:
+		assert.Equal(t, "edited", value)
+	default:
+		t.Fatal("the watchers were not notified of the external change")
+	}
+	_, err = verifySettingsBytes(tempfile)
+	assert.NoError(t, err)
+	lastGood, err = verifySettingsBytes(lastGoodFilename(tempfile))
+	assert.NoError(t, err)
+	assert.Equal(t, edited, lastGood)
+	assert.NoError(t, sf.AcceptExternalChange())
+
+	// corrupt contents are not accepted.
+	require.NoError(t, os.WriteFile(tempfile, []byte(`{"a": `), 0660))
+	assert.ErrorIs(t, sf.AcceptExternalChange(), ErrSettingsCorrupt)
+}
@@ -0,0 +1,261 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaFileSuffix is the suffix of schema files in a schema directory,
+// the rest of the filename is the top level settings key.
+const schemaFileSuffix = ".schema.json"
+
+// schemaURLPrefix is the prefix of the URLs the schemas are registered
+// under in the compiler, they are never fetched.
+const schemaURLPrefix = "settings:///"
+
+// SchemaError is a single schema violation found in the settings.
+type SchemaError struct {
+	// Key is the top level settings key whose schema was violated.
+	Key string `json:"key"`
+	// Pointer is the JSON pointer of the invalid value, from the root
+	// of the settings.
+	Pointer string `json:"pointer"`
+	// SchemaPointer is the location of the failing keyword in the
+	// schema.
+	SchemaPointer string `json:"schemaPointer"`
+	Message       string `json:"message"`
+}
+
+// SchemaValidationError is returned when settings do not match their
+// registered schemas. It lists every violation found.
+type SchemaValidationError struct {
+	Errors []SchemaError `json:"errors"`
+}
+
+// Error implements error.
+func (e *SchemaValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, schemaErr := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", schemaErr.Pointer, schemaErr.Message))
+	}
+	return "settings do not match schema: " + strings.Join(messages, "; ")
+}
+
+// SchemaRegistry holds the JSON schemas of top level settings keys and
+// validates settings against them. Schemas are compiled in-process,
+// references to anything that is not a registered schema fail.
+type SchemaRegistry struct {
+	mutex   sync.RWMutex
+	schemas map[string]*jsonschema.Schema
+}
+
+// NewSchemaRegistry returns an empty SchemaRegistry.
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas: make(map[string]*jsonschema.Schema),
+	}
+}
+
+// noRemoteSchemas is the loader of the schema compiler, which keeps
+// validation offline.
+func noRemoteSchemas(url string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("settings schema: refusing to load %s, only registered schemas can be referenced", url)
+}
+
+// Register compiles schema and registers it for the top level settings
+// key, replacing any schema registered before.
+func (r *SchemaRegistry) Register(key string, schema []byte) error {
+	if key == "" {
+		return errors.New("settings schema: empty settings key")
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = noRemoteSchemas
+	url := schemaURLPrefix + key + schemaFileSuffix
+	if err := compiler.AddResource(url, bytes.NewReader(schema)); err != nil {
+		return fmt.Errorf("settings schema: invalid schema for %s: %w", key, err)
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return fmt.Errorf("settings schema: invalid schema for %s: %w", key, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.schemas[key] = compiled
+	return nil
+}
+
+// Unregister removes the schema of the top level settings key.
+func (r *SchemaRegistry) Unregister(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.schemas, key)
+}
+
+// Keys returns the sorted settings keys with a registered schema.
+func (r *SchemaRegistry) Keys() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	keys := make([]string, 0, len(r.schemas))
+	for key := range r.schemas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LoadDirectory registers every <key>.schema.json file in dir. A
+// missing directory is not an error.
+func (r *SchemaRegistry) LoadDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("settings schema: unable to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), schemaFileSuffix) {
+			continue
+		}
+		schema, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("settings schema: unable to read %s: %w", entry.Name(), err)
+		}
+		if err := r.Register(strings.TrimSuffix(entry.Name(), schemaFileSuffix), schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate validates every top level key of jsonSettings that has a
+// registered schema. It returns a *SchemaValidationError listing all
+// violations, or nil. A nil registry accepts any settings.
+func (r *SchemaRegistry) Validate(jsonSettings map[string]interface{}) error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	keys := make([]string, 0, len(r.schemas))
+	for key := range r.schemas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	validationErr := &SchemaValidationError{Errors: []SchemaError{}}
+	for _, key := range keys {
+		value, ok := jsonSettings[key]
+		if !ok {
+			continue
+		}
+		// values set through SetSettings may be any go type, validate
+		// what would be written to the file.
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("settings schema: unable to marshal %s: %w", key, err)
+		}
+		var instance interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&instance); err != nil {
+			return fmt.Errorf("settings schema: unable to unmarshal %s: %w", key, err)
+		}
+
+		err = r.schemas[key].Validate(instance)
+		var schemaErr *jsonschema.ValidationError
+		if errors.As(err, &schemaErr) {
+			validationErr.Errors = append(validationErr.Errors, leafSchemaErrors(key, schemaErr)...)
+		} else if err != nil {
+			return fmt.Errorf("settings schema: unable to validate %s: %w", key, err)
+		}
+	}
+
+	if len(validationErr.Errors) > 0 {
+		return validationErr
+	}
+	return nil
+}
+
+// leafSchemaErrors flattens the tree of a jsonschema.ValidationError to
+// its leaves, which are the actual violations.
+func leafSchemaErrors(key string, validationErr *jsonschema.ValidationError) []SchemaError {
+	if len(validationErr.Causes) == 0 {
+		return []SchemaError{{
+			Key:           key,
+			Pointer:       "/" + key + validationErr.InstanceLocation,
+			SchemaPointer: validationErr.KeywordLocation,
+			Message:       validationErr.Message,
+		}}
+	}
+	schemaErrors := []SchemaError{}
+	for _, cause := range validationErr.Causes {
+		schemaErrors = append(schemaErrors, leafSchemaErrors(key, cause)...)
+	}
+	return schemaErrors
+}
+
+// settingsSchemas is the registry used by the package level functions
+// and by SettingsFiles not given another one.
+var settingsSchemas = NewSchemaRegistry()
+
+// RegisterSettingsSchema registers the JSON schema for a top level
+// settings key, such as "network" or "policy_manager". Settings
+// violating it are rejected before sync-settings runs.
+func RegisterSettingsSchema(key string, schema []byte) error {
+	return settingsSchemas.Register(key, schema)
+}
+
+// GetSchemaRegistry returns the registry of the package level
+// settings functions.
+func GetSchemaRegistry() *SchemaRegistry {
+	return settingsSchemas
+}
+
+// WithSchemaRegistry validates settings written through the
+// SettingsFile against the schemas of registry instead of the package
+// registry.
+func WithSchemaRegistry(registry *SchemaRegistry) SettingsOption {
+	return func(file *SettingsFile) {
+		file.schemas = registry
+	}
+}
+
+// defaultSchemaDirectory returns the directory next to the defaults
+// file holding the schema files.
+func defaultSchemaDirectory() string {
+	return filepath.Join(filepath.Dir(defaultsFile), "schemas")
+}
+
+// LoadDefaultSchemas registers the schemas found in the schemas
+// directory next to the defaults file.
+func LoadDefaultSchemas() error {
+	return settingsSchemas.LoadDirectory(defaultSchemaDirectory())
+}
+
+// validateSettings validates jsonSettings with registry before they are
+// synced. It returns the response object and error of a failed set
+// settings call, or nil for valid settings.
+func validateSettings(registry *SchemaRegistry, jsonSettings map[string]interface{}) (interface{}, error) {
+	err := registry.Validate(jsonSettings)
+	if err == nil {
+		return nil, nil
+	}
+	logger.Warn("Rejecting settings: %s\n", err.Error())
+	var validationErr *SchemaValidationError
+	if errors.As(err, &validationErr) {
+		return map[string]interface{}{"error": "invalid_settings", "validationErrors": validationErr.Errors}, err
+	}
+	return createJSONErrorObject(err), err
+}
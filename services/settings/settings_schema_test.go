@@ -0,0 +1,94 @@
+package settings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+func TestSchemaRegistryValidate(t *testing.T) {
+	registry := NewSchemaRegistry()
+	require.NoError(t, registry.LoadDirectory("testdata/schemas"))
+	require.NoError(t, registry.LoadDirectory("testdata/missing"))
+	assert.Equal(t, []string{"a"}, registry.Keys())
+
+	assert.NoError(t, registry.Validate(map[string]interface{}{
+		"a":     map[string]interface{}{"b": map[string]interface{}{"foo": "x", "bar": 2}},
+		"other": "not validated",
+	}))
+	assert.NoError(t, registry.Validate(map[string]interface{}{}))
+
+	err := registry.Validate(map[string]interface{}{
+		"a": map[string]interface{}{"b": map[string]interface{}{"foo": "", "bar": -1}},
+	})
+	var validationErr *SchemaValidationError
+	require.ErrorAs(t, err, &validationErr)
+	pointers := []string{}
+	for _, schemaErr := range validationErr.Errors {
+		assert.Equal(t, "a", schemaErr.Key)
+		assert.NotEmpty(t, schemaErr.Message)
+		pointers = append(pointers, schemaErr.Pointer)
+	}
+	assert.ElementsMatch(t, []string{"/a/b/foo", "/a/b/bar"}, pointers)
+
+	// go values are validated as their JSON.
+	type b struct {
+		Bar int `json:"bar"`
+	}
+	err = registry.Validate(map[string]interface{}{"a": map[string]interface{}{"b": b{Bar: 1}}})
+	require.ErrorAs(t, err, &validationErr)
+	require.Len(t, validationErr.Errors, 1)
+	assert.Equal(t, "/a/b", validationErr.Errors[0].Pointer)
+}
+
+func TestSchemaRegistryRegister(t *testing.T) {
+	registry := NewSchemaRegistry()
+	assert.Error(t, registry.Register("", []byte(`{}`)))
+	assert.Error(t, registry.Register("a", []byte(`{"type": 1}`)))
+	assert.Error(t, registry.Register("a", []byte(`not json`)))
+	// remote references are never fetched.
+	assert.Error(t, registry.Register("a", []byte(`{"$ref": "https://example.com/a.json"}`)))
+
+	require.NoError(t, registry.Register("a", []byte(`{"type": "string"}`)))
+	assert.Error(t, registry.Validate(map[string]interface{}{"a": 1}))
+	registry.Unregister("a")
+	assert.NoError(t, registry.Validate(map[string]interface{}{"a": 1}))
+}
+
+func TestSetSettingsSchemaValidation(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	registry := NewSchemaRegistry()
+	require.NoError(t, registry.LoadDirectory("testdata/schemas"))
+	sf := NewSettingsFile(tempfile, WithSchemaRegistry(registry))
+
+	response, err := sf.SetSettings([]string{"a", "b", "bar"}, "nope", false, false)
+	var validationErr *SchemaValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "invalid_settings", response.(map[string]interface{})["error"])
+	assert.Equal(t, validationErr.Errors, response.(map[string]interface{})["validationErrors"])
+	assert.Equal(t, 0, *syncs)
+
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Trim([]string{"a", "b", "foo"}))
+	_, err = tx.Commit(false, false)
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "/a/b", validationErr.Errors[0].Pointer)
+	assert.Equal(t, 0, *syncs)
+
+	_, err = sf.SetSettings([]string{"a", "b", "bar"}, 3, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, *syncs)
+
+	// the package level functions use the package registry.
+	require.NoError(t, RegisterSettingsSchema("c", []byte(`{"type": "boolean"}`)))
+	defer GetSchemaRegistry().Unregister("c")
+	_, err = SetSettingsFile([]string{"c"}, "true", tempfile, false, false)
+	require.ErrorAs(t, err, &validationErr)
+	_, err = SetSettingsFile([]string{"c"}, true, tempfile, false, false)
+	require.NoError(t, err)
+}
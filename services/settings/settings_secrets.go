@@ -0,0 +1,825 @@
+package settings
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/untangle/golang-shared/platform"
+)
+
+const (
+	// RedactedSecret replaces the secrets of exported settings. Setting
+	// a secret to it keeps the current secret.
+	RedactedSecret = "********"
+
+	// sealedPrefix starts every sealed secret, followed by the id of the
+	// key and the base64 of the nonce and ciphertext.
+	sealedPrefix = "$sealed$v1$"
+
+	// secretKeySize is the size of the AES-256 keys.
+	secretKeySize = 32
+
+	// defaultSecretKeyFilename is the key file of platforms without a
+	// mapping.
+	defaultSecretKeyFilename = "/etc/config/settings.key"
+)
+
+var (
+	// ErrSecretKeyUnavailable is returned when a secret is sealed with a
+	// key that is not in the key file, or the key file can't be read.
+	ErrSecretKeyUnavailable = errors.New("settings secret key unavailable")
+
+	// ErrSecretCorrupt is returned for sealed secrets that can't be
+	// opened with their key.
+	ErrSecretCorrupt = errors.New("settings secret is corrupt")
+)
+
+// secretKeyFilenames maps the name of each platform to its key file.
+// The key file is never part of a settings backup.
+var secretKeyFilenames = map[string]string{
+	platform.OpenWrt.Name:  "/etc/config/settings.key",
+	platform.Vittoria.Name: "/opt/mfw/etc/settings.key",
+	platform.EOS.Name:      "/mnt/flash/mfw-settings/settings.key",
+}
+
+// SecretKeyFilename returns the key file of secrets on the host.
+func SecretKeyFilename(host platform.HostType) string {
+	if filename, ok := secretKeyFilenames[host.Name]; ok {
+		return filename
+	}
+	return defaultSecretKeyFilename
+}
+
+// secretKeyFile is the JSON of a key file. Keys are base64 encoded and
+// indexed by their id; secrets are sealed with the current one.
+type secretKeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// SecretStore seals the secret fields of settings with AES-GCM, using
+// keys local to the device. Secret fields are selected by path
+// patterns, such as "database_settings/databases/*/db_password", in
+// which "*" matches any key or array index.
+type SecretStore struct {
+	mutex       sync.Mutex
+	keyFilename string
+	patterns    [][]string
+
+	// keys by id, loaded from the key file on first use.
+	loaded  bool
+	keys    map[string][]byte
+	current string
+}
+
+// NewSecretStore creates a SecretStore keeping its keys in
+// keyFilename. An empty keyFilename is the key file of the detected
+// platform, see SecretKeyFilename.
+func NewSecretStore(keyFilename string, patterns ...string) *SecretStore {
+	store := &SecretStore{keyFilename: keyFilename}
+	for _, pattern := range patterns {
+		store.Register(pattern)
+	}
+	return store
+}
+
+// Register marks the fields at the "/" separated path pattern as
+// secret.
+func (store *SecretStore) Register(pattern string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.patterns = append(store.patterns, splitSecretPattern(pattern))
+}
+
+// Patterns returns the registered path patterns.
+func (store *SecretStore) Patterns() []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	patterns := make([]string, 0, len(store.patterns))
+	for _, pattern := range store.patterns {
+		patterns = append(patterns, strings.Join(pattern, "/"))
+	}
+	return patterns
+}
+
+// hasPatterns returns whether any field is secret, a nil store has
+// none.
+func (store *SecretStore) hasPatterns() bool {
+	if store == nil {
+		return false
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return len(store.patterns) > 0
+}
+
+// matchesUnder returns whether a secret field may be at path or below
+// it, a nil store has none.
+func (store *SecretStore) matchesUnder(path []string) bool {
+	if store == nil {
+		return false
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, pattern := range store.patterns {
+		matches := true
+		for i := 0; i < len(pattern) && i < len(path); i++ {
+			if pattern[i] != "*" && pattern[i] != path[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSecretPattern splits a path pattern into its segments.
+func splitSecretPattern(pattern string) []string {
+	segments := []string{}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// IsSealedSecret returns whether value is a sealed secret.
+func IsSealedSecret(value interface{}) bool {
+	str, ok := value.(string)
+	return ok && strings.HasPrefix(str, sealedPrefix)
+}
+
+// secretKeyID returns the id of a key, derived from its hash.
+func secretKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// filenameLocked returns the key file. The store lock must be held.
+func (store *SecretStore) filenameLocked() string {
+	if store.keyFilename == "" {
+		store.keyFilename = SecretKeyFilename(platform.DetectPlatform())
+	}
+	return store.keyFilename
+}
+
+// loadKeysLocked reads the key file, once. A missing key file is no
+// keys. The store lock must be held.
+func (store *SecretStore) loadKeysLocked() error {
+	if store.loaded {
+		return nil
+	}
+	raw, err := os.ReadFile(store.filenameLocked())
+	if errors.Is(err, os.ErrNotExist) {
+		store.keys = map[string][]byte{}
+		store.loaded = true
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", ErrSecretKeyUnavailable, err.Error())
+	}
+
+	var keyFile secretKeyFile
+	if err := json.Unmarshal(raw, &keyFile); err != nil {
+		return fmt.Errorf("%w: invalid key file %s: %s", ErrSecretKeyUnavailable, store.keyFilename, err.Error())
+	}
+	keys := map[string][]byte{}
+	for id, encoded := range keyFile.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != secretKeySize {
+			return fmt.Errorf("%w: invalid key %s in %s", ErrSecretKeyUnavailable, id, store.keyFilename)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[keyFile.Current]; !ok && len(keys) > 0 {
+		return fmt.Errorf("%w: current key %s is not in %s", ErrSecretKeyUnavailable, keyFile.Current, store.keyFilename)
+	}
+	store.keys = keys
+	store.current = keyFile.Current
+	store.loaded = true
+	return nil
+}
+
+// writeKeysLocked writes the keys to the key file, readable by its
+// owner only. The store lock must be held.
+func (store *SecretStore) writeKeysLocked() error {
+	keyFile := secretKeyFile{Current: store.current, Keys: map[string]string{}}
+	for id, key := range store.keys {
+		keyFile.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	raw, err := json.Marshal(keyFile)
+	if err != nil {
+		return err
+	}
+	filename := store.filenameLocked()
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		// writeFileAtomic keeps the mode of an existing file.
+		if err := os.WriteFile(filename, nil, 0600); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filename, raw)
+}
+
+// addKeyLocked generates a new key, makes it the current one and saves
+// the key file. The store lock must be held.
+func (store *SecretStore) addKeyLocked() (string, error) {
+	if err := store.loadKeysLocked(); err != nil {
+		return "", err
+	}
+	key := make([]byte, secretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	id := secretKeyID(key)
+	previous := store.current
+	store.keys[id] = key
+	store.current = id
+	if err := store.writeKeysLocked(); err != nil {
+		delete(store.keys, id)
+		store.current = previous
+		return "", fmt.Errorf("unable to save settings secret key: %w", err)
+	}
+	logger.Info("Generated settings secret key %s\n", id)
+	return id, nil
+}
+
+// currentKeyLocked returns the current key, generating one if there is
+// none yet. The store lock must be held.
+func (store *SecretStore) currentKeyLocked() (string, []byte, error) {
+	if err := store.loadKeysLocked(); err != nil {
+		return "", nil, err
+	}
+	if store.current == "" {
+		if _, err := store.addKeyLocked(); err != nil {
+			return "", nil, err
+		}
+	}
+	return store.current, store.keys[store.current], nil
+}
+
+// sealLocked encrypts plaintext with the current key. The store lock
+// must be held.
+func (store *SecretStore) sealLocked(plaintext string) (string, error) {
+	id, key, err := store.currentKeyLocked()
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newSecretGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + id + "$" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openLocked decrypts a sealed secret. The store lock must be held.
+func (store *SecretStore) openLocked(sealed string) (string, error) {
+	if err := store.loadKeysLocked(); err != nil {
+		return "", err
+	}
+	id, encoded, found := strings.Cut(strings.TrimPrefix(sealed, sealedPrefix), "$")
+	if !found {
+		return "", fmt.Errorf("%w: malformed", ErrSecretCorrupt)
+	}
+	key, ok := store.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: no key %s", ErrSecretKeyUnavailable, id)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSecretCorrupt, err.Error())
+	}
+	gcm, err := newSecretGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("%w: too short", ErrSecretCorrupt)
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSecretCorrupt, err.Error())
+	}
+	return string(plaintext), nil
+}
+
+// newSecretGCM returns the AES-GCM cipher of key.
+func newSecretGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// visitSecretsLocked calls visit with the path and value of every
+// secret field of a copy of jsonSettings, replacing the value with the
+// result. The store lock must be held.
+func (store *SecretStore) visitSecretsLocked(jsonSettings map[string]interface{},
+	visit func(path []string, value interface{}) (interface{}, error)) (map[string]interface{}, error) {
+	copied, err := copyJSON(jsonSettings)
+	if err != nil {
+		return nil, err
+	}
+	doc, _ := copied.(map[string]interface{})
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	for _, pattern := range store.patterns {
+		if _, err := visitSecretPattern(doc, pattern, nil, visit); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// visitSecretPattern visits the values of node matching pattern,
+// path is the path of node. It returns the new node.
+func visitSecretPattern(node interface{}, pattern []string, path []string,
+	visit func(path []string, value interface{}) (interface{}, error)) (interface{}, error) {
+	if len(pattern) == 0 {
+		return visit(path, node)
+	}
+	switch container := node.(type) {
+	case map[string]interface{}:
+		for key, child := range container {
+			if pattern[0] != "*" && pattern[0] != key {
+				continue
+			}
+			newChild, err := visitSecretPattern(child, pattern[1:], append(path[:len(path):len(path)], key), visit)
+			if err != nil {
+				return nil, err
+			}
+			container[key] = newChild
+		}
+	case []interface{}:
+		for i, child := range container {
+			index := strconv.Itoa(i)
+			if pattern[0] != "*" && pattern[0] != index {
+				continue
+			}
+			newChild, err := visitSecretPattern(child, pattern[1:], append(path[:len(path):len(path)], index), visit)
+			if err != nil {
+				return nil, err
+			}
+			container[i] = newChild
+		}
+	}
+	return node, nil
+}
+
+// Seal returns a copy of jsonSettings with every plaintext secret
+// sealed. current are the settings being replaced, as stored: a secret
+// that is unchanged, or set to RedactedSecret, keeps its sealed value
+// from current, so saving the same settings does not change them. A
+// secret set to RedactedSecret whose current value is still plaintext
+// gets that value sealed.
+func (store *SecretStore) Seal(jsonSettings map[string]interface{}, current map[string]interface{}) (map[string]interface{}, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.visitSecretsLocked(jsonSettings, func(path []string, value interface{}) (interface{}, error) {
+		plaintext, ok := value.(string)
+		if !ok || plaintext == "" || IsSealedSecret(plaintext) {
+			return value, nil
+		}
+		currentValue, _ := patchGet(current, path)
+		if plaintext == RedactedSecret {
+			if IsSealedSecret(currentValue) {
+				return currentValue, nil
+			}
+			// a secret stored before the field was secret is kept, and
+			// sealed now.
+			legacy, ok := currentValue.(string)
+			if !ok || legacy == "" || legacy == RedactedSecret {
+				logger.Warn("No secret to keep for redacted settings field %s, clearing it\n", strings.Join(path, "/"))
+				return "", nil
+			}
+			plaintext = legacy
+		}
+		if IsSealedSecret(currentValue) {
+			if opened, err := store.openLocked(currentValue.(string)); err == nil && opened == plaintext {
+				return currentValue, nil
+			}
+		}
+		return store.sealLocked(plaintext)
+	})
+}
+
+// plaintext returns a copy of jsonSettings with every secret in
+// plaintext, for the sync: sealed secrets are opened, and those set to
+// RedactedSecret get the secret of current, the settings as stored.
+func (store *SecretStore) plaintext(jsonSettings map[string]interface{}, current map[string]interface{}) (map[string]interface{}, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.visitSecretsLocked(jsonSettings, func(path []string, value interface{}) (interface{}, error) {
+		if value == RedactedSecret {
+			value, _ = patchGet(current, path)
+			if str, ok := value.(string); !ok || str == RedactedSecret {
+				logger.Warn("No secret to keep for redacted settings field %s, clearing it\n", strings.Join(path, "/"))
+				return "", nil
+			}
+		}
+		if !IsSealedSecret(value) {
+			return value, nil
+		}
+		plaintext, err := store.openLocked(value.(string))
+		if err != nil {
+			return nil, fmt.Errorf("settings field %s: %w", strings.Join(path, "/"), err)
+		}
+		return plaintext, nil
+	})
+}
+
+// Open returns a copy of jsonSettings with every sealed secret
+// decrypted.
+func (store *SecretStore) Open(jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.visitSecretsLocked(jsonSettings, func(path []string, value interface{}) (interface{}, error) {
+		if !IsSealedSecret(value) {
+			return value, nil
+		}
+		plaintext, err := store.openLocked(value.(string))
+		if err != nil {
+			return nil, fmt.Errorf("settings field %s: %w", strings.Join(path, "/"), err)
+		}
+		return plaintext, nil
+	})
+}
+
+// Redact returns a copy of jsonSettings with every secret, sealed or
+// not, replaced by RedactedSecret.
+func (store *SecretStore) Redact(jsonSettings map[string]interface{}) map[string]interface{} {
+	if !store.hasPatterns() {
+		return jsonSettings
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	redacted, err := store.visitSecretsLocked(jsonSettings, func(path []string, value interface{}) (interface{}, error) {
+		if str, ok := value.(string); ok && str != "" {
+			return RedactedSecret, nil
+		}
+		return value, nil
+	})
+	if err != nil {
+		// only copying can fail, and the settings are JSON already.
+		logger.Warn("Failed to redact settings: %s\n", err.Error())
+		return map[string]interface{}{}
+	}
+	return redacted
+}
+
+// KeyIDs returns the ids of the keys, sorted, and the id of the
+// current key.
+func (store *SecretStore) KeyIDs() ([]string, string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.loadKeysLocked(); err != nil {
+		return nil, "", err
+	}
+	ids := make([]string, 0, len(store.keys))
+	for id := range store.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, store.current, nil
+}
+
+// rotateKey generates a new current key, keeping the old ones until
+// pruneKeys so secrets sealed with them can still be opened.
+func (store *SecretStore) rotateKey() (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.addKeyLocked()
+}
+
+// pruneKeys drops every key but the current one and those in
+// referenced, and returns the ids of the dropped keys.
+func (store *SecretStore) pruneKeys(referenced map[string]bool) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.loadKeysLocked(); err != nil {
+		return nil, err
+	}
+	dropped := []string{}
+	for id := range store.keys {
+		if id != store.current && !referenced[id] {
+			dropped = append(dropped, id)
+		}
+	}
+	if len(dropped) == 0 {
+		return dropped, nil
+	}
+	sort.Strings(dropped)
+	for _, id := range dropped {
+		delete(store.keys, id)
+	}
+	return dropped, store.writeKeysLocked()
+}
+
+// sealedKeyIDs adds the ids of the keys sealing the secrets of the raw
+// settings to ids.
+func sealedKeyIDs(raw []byte, ids map[string]bool) {
+	rest := string(raw)
+	for {
+		start := strings.Index(rest, sealedPrefix)
+		if start < 0 {
+			return
+		}
+		rest = rest[start+len(sealedPrefix):]
+		if id, _, found := strings.Cut(rest, "$"); found {
+			ids[id] = true
+		}
+	}
+}
+
+// settingsSecrets is the store of the SettingsFiles not given another
+// one.
+var settingsSecrets = NewSecretStore("")
+
+// RegisterSecretPath marks the fields at the path pattern as secret in
+// the package store, see SecretStore.
+func RegisterSecretPath(pattern string) {
+	settingsSecrets.Register(pattern)
+}
+
+// GetSecretStore returns the package store.
+func GetSecretStore() *SecretStore {
+	return settingsSecrets
+}
+
+// WithSecretStore seals the secrets of the SettingsFile with store
+// instead of the package store.
+func WithSecretStore(store *SecretStore) SettingsOption {
+	return func(file *SettingsFile) {
+		file.secrets = store
+	}
+}
+
+// WithSecrets makes the SettingsFile an authorized reader of the
+// secrets: its reads and watchers get them in plaintext. Without it
+// they get RedactedSecret instead, which writes turn back into the
+// stored secret.
+func WithSecrets() SettingsOption {
+	return func(file *SettingsFile) {
+		file.withSecrets = true
+	}
+}
+
+// readableSecrets returns jsonSettings read from a settings file with
+// the secrets sealed with secrets as readers see them: opened if
+// withSecrets is set, redacted otherwise.
+func readableSecrets(secrets *SecretStore, jsonSettings map[string]interface{}, withSecrets bool) (map[string]interface{}, error) {
+	if withSecrets {
+		return openStoredSecrets(secrets, jsonSettings)
+	}
+	return secrets.Redact(jsonSettings), nil
+}
+
+// readerSecrets returns jsonSettings read from the file as the readers
+// of the file see it, see WithSecrets.
+func (file *SettingsFile) readerSecrets(jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	return readableSecrets(file.secrets, jsonSettings, file.withSecrets)
+}
+
+// unmarshalReadable unmarshals raw, the value at path of the file, into
+// target with its secrets as the readers of the file see them.
+func (file *SettingsFile) unmarshalReadable(path []string, raw json.RawMessage, target any) error {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+
+	// the value is placed at its path, for the patterns to match.
+	doc := map[string]interface{}{}
+	parent := doc
+	if len(path) == 0 {
+		if doc, _ = value.(map[string]interface{}); doc == nil {
+			return json.Unmarshal(raw, target)
+		}
+	} else {
+		for _, segment := range path[:len(path)-1] {
+			child := map[string]interface{}{}
+			parent[segment] = child
+			parent = child
+		}
+		parent[path[len(path)-1]] = value
+	}
+	readable, err := file.readerSecrets(doc)
+	if err != nil {
+		return err
+	}
+	if value, err = patchGet(readable, path); err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// redactSecretsBytes redacts the secrets of the raw settings read from
+// the file, for export.
+func (file *SettingsFile) redactSecretsBytes(raw []byte) ([]byte, error) {
+	if !file.secrets.hasPatterns() {
+		return raw, nil
+	}
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonSettings); err != nil {
+		return nil, err
+	}
+	return json.Marshal(file.secrets.Redact(jsonSettings))
+}
+
+// sealSecrets seals the secrets of jsonSettings before they replace
+// the file. The file lock must be held.
+func (file *SettingsFile) sealSecrets(jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	if !file.secrets.hasPatterns() {
+		return jsonSettings, nil
+	}
+	var current map[string]interface{}
+	if raw, err := readSettingsBytes(file.filename); err == nil {
+		_ = json.Unmarshal(raw, &current)
+	}
+	return file.secrets.Seal(jsonSettings, current)
+}
+
+// plaintextSecrets returns jsonSettings with its secrets in plaintext
+// for the sync, see SecretStore.plaintext. The file lock must be held.
+func (file *SettingsFile) plaintextSecrets(jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	if !file.secrets.hasPatterns() {
+		return jsonSettings, nil
+	}
+	var current map[string]interface{}
+	if raw, err := readSettingsBytes(file.filename); err == nil {
+		_ = json.Unmarshal(raw, &current)
+	}
+	return file.secrets.plaintext(jsonSettings, current)
+}
+
+// openStoredSecrets decrypts the secrets of jsonSettings read from a
+// settings file, with secrets.
+func openStoredSecrets(secrets *SecretStore, jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	if !secrets.hasPatterns() {
+		return jsonSettings, nil
+	}
+	return secrets.Open(jsonSettings)
+}
+
+// sealSettingsBytes seals with secrets the raw settings about to
+// replace filename, and encodes them the way they are stored. Secrets
+// unchanged from the stored ones keep their sealed value.
+func sealSettingsBytes(secrets *SecretStore, filename string, raw []byte) ([]byte, error) {
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonSettings); err != nil {
+		return nil, err
+	}
+	if secrets.hasPatterns() {
+		var current map[string]interface{}
+		if currentRaw, err := readSettingsBytes(filename); err == nil {
+			_ = json.Unmarshal(currentRaw, &current)
+		}
+		sealed, err := secrets.Seal(jsonSettings, current)
+		if err != nil {
+			return nil, err
+		}
+		jsonSettings = sealed
+	}
+	return encodeSettings(jsonSettings)
+}
+
+// RotateSecretKey generates a new secret key and reseals every secret
+// of the settings file with it. sync-settings does not run, as the
+// settings themselves do not change, but the rotation is audited and
+// recorded in the history like any other change. The old keys are
+// kept as long as the last-known-good copy or a revision of the history
+// has secrets sealed with them; backups never do, they are redacted.
+// The optional audit says who rotates the key and why.
+func (file *SettingsFile) RotateSecretKey(audit ...AuditInfo) error {
+	if !file.secrets.hasPatterns() {
+		return errors.New("settings file has no secret fields")
+	}
+	info := auditInfo(audit)
+	if info.Reason == "" {
+		info.Reason = "secret key rotation"
+	}
+
+	file.recordRevision("", "")
+	file.mutex.Lock()
+	change, resealed, err := file.resealSecretsLocked(info)
+	file.mutex.Unlock()
+	if change != nil {
+		change.finish(resealed, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to rotate secret key: %w", err)
+	}
+	file.recordRevision(info.Actor, info.Reason)
+	settingsFileChanged(file.filename)
+
+	if err := file.pruneSecretKeys(); err != nil {
+		logger.Warn("Unable to drop the unused secret keys of %s: %s\n", file.filename, err.Error())
+	}
+	return nil
+}
+
+// resealSecretsLocked generates a new secret key and writes the
+// settings file with its secrets sealed with it. It returns the audit
+// of the change, once the write was attempted, and the settings
+// written. The file lock must be held.
+func (file *SettingsFile) resealSecretsLocked(info AuditInfo) (*auditedChange, map[string]interface{}, error) {
+	raw, err := readSettingsBytes(file.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonSettings); err != nil {
+		return nil, nil, err
+	}
+	opened, err := file.secrets.Open(jsonSettings)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := file.secrets.rotateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	resealed, err := file.secrets.Seal(opened, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeSettings(resealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	change := file.beginAudit(AuditOperationRotateKey, info)
+	if err := writeSettingsBytes(file.filename, data); err != nil {
+		return change, resealed, err
+	}
+	logger.Info("Resealed settings secrets of %s with key %s\n", file.filename, id)
+	return change, resealed, nil
+}
+
+// pruneSecretKeys drops the keys no longer sealing any secret of the
+// settings file, its last-known-good copy or its history.
+func (file *SettingsFile) pruneSecretKeys() error {
+	referenced := map[string]bool{}
+	file.mutex.RLock()
+	for _, filename := range []string{file.filename, lastGoodFilename(file.filename)} {
+		raw, err := os.ReadFile(filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			file.mutex.RUnlock()
+			return err
+		}
+		sealedKeyIDs(raw, referenced)
+	}
+	file.mutex.RUnlock()
+
+	if history := file.History(); history != nil {
+		revisions, err := history.List()
+		if err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			_, raw, err := history.Get(revision.ID)
+			if err != nil {
+				return err
+			}
+			sealedKeyIDs(raw, referenced)
+		}
+	}
+
+	dropped, err := file.secrets.pruneKeys(referenced)
+	if err != nil {
+		return err
+	}
+	if len(dropped) > 0 {
+		logger.Info("Dropped the unused settings secret keys %s\n", strings.Join(dropped, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package settings
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/platform"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// newTestSecretStore returns a store of the secrets of
+// testdata/secret_settings.json with a key file in a temp dir.
+func newTestSecretStore(t *testing.T) *SecretStore {
+	return NewSecretStore(filepath.Join(t.TempDir(), "settings.key"),
+		"database_settings/databases/*/db_password",
+		"/cloud/token/")
+}
+
+// readSecretSettings reads the JSON of the file without opening the
+// secrets.
+func readSecretSettings(t *testing.T, filename string) map[string]interface{} {
+	raw, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	var jsonSettings map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &jsonSettings))
+	return jsonSettings
+}
+
+func TestSecretKeyFilename(t *testing.T) {
+	assert.Equal(t, "/etc/config/settings.key", SecretKeyFilename(platform.OpenWrt))
+	assert.Equal(t, "/opt/mfw/etc/settings.key", SecretKeyFilename(platform.Vittoria))
+	assert.Equal(t, "/mnt/flash/mfw-settings/settings.key", SecretKeyFilename(platform.EOS))
+	assert.Equal(t, defaultSecretKeyFilename, SecretKeyFilename(platform.Unclassified))
+}
+
+func TestSecretStoreSealOpen(t *testing.T) {
+	store := newTestSecretStore(t)
+	assert.Equal(t, []string{"database_settings/databases/*/db_password", "cloud/token"}, store.Patterns())
+	plain := readSecretSettings(t, "testdata/secret_settings.json")
+
+	sealed, err := store.Seal(plain, nil)
+	require.NoError(t, err)
+	databases := sealed["database_settings"].(map[string]interface{})["databases"].([]interface{})
+	assert.True(t, IsSealedSecret(databases[0].(map[string]interface{})["db_password"]))
+	assert.Equal(t, "", databases[1].(map[string]interface{})["db_password"])
+	assert.True(t, IsSealedSecret(sealed["cloud"].(map[string]interface{})["token"]))
+	assert.Equal(t, true, sealed["cloud"].(map[string]interface{})["enabled"])
+	// the input is not modified.
+	assert.Equal(t, readSecretSettings(t, "testdata/secret_settings.json"), plain)
+
+	info, err := os.Stat(store.keyFilename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	opened, err := store.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, plain, opened)
+
+	// unchanged and redacted secrets keep their sealed value, changed
+	// ones are sealed again.
+	changed, err := copyJSON(plain)
+	require.NoError(t, err)
+	changed.(map[string]interface{})["cloud"].(map[string]interface{})["token"] = "new token"
+	changed.(map[string]interface{})["database_settings"].(map[string]interface{})["databases"].([]interface{})[0].(map[string]interface{})["db_password"] = RedactedSecret
+	resealed, err := store.Seal(changed.(map[string]interface{}), sealed)
+	require.NoError(t, err)
+	assert.Equal(t, sealed["database_settings"], resealed["database_settings"])
+	assert.NotEqual(t, sealed["cloud"], resealed["cloud"])
+	resealedAgain, err := store.Seal(plain, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, sealed, resealedAgain)
+
+	// a redacted secret with nothing to keep is cleared.
+	cleared, err := store.Seal(map[string]interface{}{"cloud": map[string]interface{}{"token": RedactedSecret}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", cleared["cloud"].(map[string]interface{})["token"])
+
+	redacted := store.Redact(sealed)
+	assert.Equal(t, RedactedSecret, redacted["cloud"].(map[string]interface{})["token"])
+	assert.Equal(t, "", redacted["database_settings"].(map[string]interface{})["databases"].([]interface{})[1].(map[string]interface{})["db_password"])
+
+	// tampered secrets and unknown keys don't open.
+	token := sealed["cloud"].(map[string]interface{})["token"].(string)
+	tampered := map[string]interface{}{"cloud": map[string]interface{}{"token": token[:len(token)-4] + "AAA="}}
+	_, err = store.Open(tampered)
+	assert.ErrorIs(t, err, ErrSecretCorrupt)
+	_, err = newTestSecretStore(t).Open(sealed)
+	assert.ErrorIs(t, err, ErrSecretKeyUnavailable)
+}
+
+// captureSyncSettings replaces sync-settings for the test with one
+// recording the settings it is given.
+func captureSyncSettings(t *testing.T) *[]string {
+	synced := []string{}
+	orig := syncSettingsRunner
+	syncSettingsRunner = func(filename string, force bool, skipEosConfig bool) (string, error) {
+		raw, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		synced = append(synced, string(raw))
+		return "synced", nil
+	}
+	t.Cleanup(func() { syncSettingsRunner = orig })
+	return &synced
+}
+
+func TestSettingsFileSecrets(t *testing.T) {
+	synced := captureSyncSettings(t)
+	usePlatform(t, "OpenWrt")
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/secret_settings.json")
+	defer cleanup()
+	store := newTestSecretStore(t)
+	sf := NewSettingsFile(tempfile, WithSecretStore(store))
+	reader := NewSettingsFile(tempfile, WithSecretStore(store), WithSecrets())
+
+	// a secret stored in plaintext before its field was secret is kept
+	// when it is written back redacted.
+	require.NoError(t, sf.SetSettingsNoSync([]string{"cloud", "token"}, RedactedSecret))
+	raw, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "abc123")
+	var token string
+	require.NoError(t, reader.UnmarshalSettingsAtPath(&token, "cloud", "token"))
+	assert.Equal(t, "abc123", token)
+
+	_, err = sf.SetSettings([]string{"cloud", "enabled"}, false, false, false)
+	require.NoError(t, err)
+	raw, err = os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "hunter2")
+	assert.NotContains(t, string(raw), "abc123")
+	raw, err = os.ReadFile(lastGoodFilename(tempfile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "abc123")
+
+	// sync-settings is given the secrets in plaintext, only the stored
+	// settings are sealed.
+	require.Len(t, *synced, 1)
+	assert.Contains(t, (*synced)[0], "hunter2")
+	assert.Contains(t, (*synced)[0], "abc123")
+	assert.NotContains(t, (*synced)[0], sealedPrefix)
+
+	// as do transactions, and the sync handlers.
+	log := []string{}
+	handler := &recordingSyncHandler{fakeSyncHandler: fakeSyncHandler{name: "cloud", log: &log}}
+	registry := NewSyncHandlerRegistry()
+	require.NoError(t, registry.Register("cloud", handler))
+	useSyncHandlers(t, registry)
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Set([]string{"cloud", "enabled"}, true))
+	_, err = tx.Commit(false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", handler.new.(map[string]interface{})["token"])
+	assert.Equal(t, "abc123", handler.old.(map[string]interface{})["token"])
+	raw, err = os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "abc123")
+
+	// readers get the secrets redacted, unless they are authorized.
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, RedactedSecret, settings["cloud"].(map[string]interface{})["token"])
+	require.NoError(t, sf.UnmarshalSettingsAtPath(&token, "cloud", "token"))
+	assert.Equal(t, RedactedSecret, token)
+	settings, err = reader.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", settings["cloud"].(map[string]interface{})["token"])
+	require.NoError(t, reader.UnmarshalSettingsAtPath(&token, "cloud", "token"))
+	assert.Equal(t, "abc123", token)
+
+	// values holding secrets are redacted or opened in a streaming
+	// read too, the others are streamed as they are.
+	type database struct {
+		Name     string `json:"name"`
+		Password string `json:"db_password"`
+	}
+	var databases []database
+	var enabled bool
+	err = sf.UnmarshalSettingsAtPaths(map[string]any{
+		"database_settings/databases": &databases,
+		"cloud/enabled":               &enabled,
+		"cloud/missing":               &token,
+	})
+	var notFound *PathsNotFoundError
+	require.ErrorAs(t, err, &notFound)
+	assert.Equal(t, []string{"cloud/missing"}, notFound.Paths)
+	assert.Equal(t, []database{{"local", RedactedSecret}, {"remote", ""}}, databases)
+	assert.True(t, enabled)
+	var local database
+	require.NoError(t, reader.UnmarshalSettingsAtPaths(map[string]any{
+		"database_settings/databases/0": &local,
+		"cloud/token":                   &token,
+	}))
+	assert.Equal(t, database{"local", "hunter2"}, local)
+	assert.Equal(t, "abc123", token)
+
+	// as do the watchers.
+	watched := make(chan any, 1)
+	cancel := reader.Watch([]string{"cloud", "token"}, func(old, new any) { watched <- new })
+	defer cancel()
+	_, err = sf.SetSettings([]string{"cloud", "token"}, "def456", false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "def456", <-watched)
+	_, err = sf.SetSettings([]string{"cloud", "token"}, "abc123", false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", <-watched)
+
+	// saving the same settings again leaves the file as it is, whatever
+	// call writes it.
+	raw, err = os.ReadFile(tempfile)
+	require.NoError(t, err)
+	require.NoError(t, sf.SetSettingsNoSync([]string{"cloud", "enabled"}, true))
+	rewritten, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, string(raw), string(rewritten))
+
+	// backups are redacted, and restoring one keeps the secrets.
+	data, _, err := sf.CreateBackup()
+	require.NoError(t, err)
+	backup, err := ReadBackup(data)
+	require.NoError(t, err)
+	assert.NotContains(t, string(backup.Files[BackupSettingsName]), "$sealed$")
+	assert.Contains(t, string(backup.Files[BackupSettingsName]), RedactedSecret)
+	_, err = sf.SetSettings(nil, readSecretSettings(t, "testdata/secret_settings.json"), true, false)
+	require.NoError(t, err)
+	var redacted map[string]interface{}
+	require.NoError(t, json.Unmarshal(backup.Files[BackupSettingsName], &redacted))
+	_, err = sf.SetSettings(nil, redacted, true, false)
+	require.NoError(t, err)
+	settings, err = reader.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, readSecretSettings(t, "testdata/secret_settings.json")["database_settings"], settings["database_settings"])
+}
+
+// recordingSyncHandler is a fakeSyncHandler keeping the settings it
+// was last applied with.
+type recordingSyncHandler struct {
+	fakeSyncHandler
+	new, old interface{}
+}
+
+func (h *recordingSyncHandler) Apply(new interface{}, old interface{}) error {
+	h.new, h.old = new, old
+	return h.fakeSyncHandler.Apply(new, old)
+}
+
+func TestPackageSettingsSecrets(t *testing.T) {
+	synced := captureSyncSettings(t)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/secret_settings.json")
+	defer cleanup()
+	orig := settingsSecrets
+	settingsSecrets = newTestSecretStore(t)
+	t.Cleanup(func() { settingsSecrets = orig })
+
+	// the package level functions seal the secrets as the SettingsFile
+	// does, and their readers get them redacted.
+	_, err := SetSettingsFile([]string{"cloud", "enabled"}, false, tempfile, false, false)
+	require.NoError(t, err)
+	_, err = TrimSettingsFile([]string{"database_settings", "databases"}, tempfile)
+	require.NoError(t, err)
+	raw, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "abc123")
+	require.Len(t, *synced, 2)
+	for _, settings := range *synced {
+		assert.Contains(t, settings, "abc123")
+	}
+
+	token, err := GetSettingsFile([]string{"cloud", "token"}, tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, RedactedSecret, token)
+}
+
+func TestRotateSecretKey(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/secret_settings.json")
+	defer cleanup()
+	store := newTestSecretStore(t)
+	sf := NewSettingsFile(tempfile, WithSecretStore(store))
+	assert.Error(t, NewSettingsFile(tempfile, WithSecretStore(NewSecretStore(store.keyFilename))).RotateSecretKey())
+
+	_, err := sf.SetSettings(nil, readSecretSettings(t, "testdata/secret_settings.json"), false, false)
+	require.NoError(t, err)
+	ids, oldID, err := store.KeyIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{oldID}, ids)
+	before := readSecretSettings(t, tempfile)
+
+	require.NoError(t, sf.RotateSecretKey())
+	ids, newID, err := store.KeyIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{newID}, ids)
+	assert.NotEqual(t, oldID, newID)
+
+	after := readSecretSettings(t, tempfile)
+	token := after["cloud"].(map[string]interface{})["token"].(string)
+	assert.True(t, strings.HasPrefix(token, sealedPrefix+newID+"$"))
+	assert.NotEqual(t, before["cloud"], after["cloud"])
+
+	// a fresh store reads the rotated key file.
+	opened, err := NewSecretStore(store.keyFilename, store.Patterns()...).Open(after)
+	require.NoError(t, err)
+	assert.Equal(t, readSecretSettings(t, "testdata/secret_settings.json"), opened)
+	_, err = store.Open(before)
+	assert.ErrorIs(t, err, ErrSecretKeyUnavailable)
+}
+
+func TestRotateSecretKeyHistory(t *testing.T) {
+	synced := captureSyncSettings(t)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/secret_settings.json")
+	defer cleanup()
+	store := newTestSecretStore(t)
+	history := newTestHistory(t)
+	sf := NewSettingsFile(tempfile, WithSecretStore(store), WithRevisionHistory(history),
+		WithAuditLog(NewAuditLog(filepath.Join(t.TempDir(), "audit"))))
+	defer SetRevisionHistory(tempfile, nil)
+
+	_, err := sf.SetSettings([]string{"cloud", "enabled"}, false, false, false)
+	require.NoError(t, err)
+	_, oldID, err := store.KeyIDs()
+	require.NoError(t, err)
+	revisions, err := history.List()
+	require.NoError(t, err)
+	sealedRevision := revisions[0].ID
+
+	// the rotation is audited and recorded like any other change, the
+	// old key is kept as the history still uses it.
+	require.NoError(t, sf.RotateSecretKey(AuditInfo{Actor: "admin"}))
+	ids, newID, err := store.KeyIDs()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{oldID, newID}, ids)
+	revisions, err = history.List()
+	require.NoError(t, err)
+	assert.Equal(t, "secret key rotation", revisions[0].Reason)
+	records, err := sf.AuditLog().Query(AuditQuery{})
+	require.NoError(t, err)
+	require.NotEmpty(t, records)
+	assert.Equal(t, AuditOperationRotateKey, records[0].Operation)
+	assert.Equal(t, "admin", records[0].Actor)
+
+	// so a revision sealed with it can still be restored, in plaintext
+	// for sync-settings.
+	_, err = sf.RestoreRevision(sealedRevision, false, false)
+	require.NoError(t, err)
+	assert.Contains(t, (*synced)[len(*synced)-1], "abc123")
+	assert.NotContains(t, (*synced)[len(*synced)-1], sealedPrefix)
+	settings, err := NewSettingsFile(tempfile, WithSecretStore(store), WithSecrets()).GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", settings["cloud"].(map[string]interface{})["token"])
+}
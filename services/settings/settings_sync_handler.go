@@ -0,0 +1,502 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SyncHandler applies the settings of one top level settings key
+// in-process, instead of the external sync-settings executable. The
+// settings are passed as decoded JSON; old is nil when the key is new
+// and new is nil when it is removed.
+type SyncHandler interface {
+	// Validate checks the new settings before any handler applies
+	// anything. Return a *SetSettingsError to ask the user for a
+	// confirmation, as sync-settings does with CONFIRM.
+	Validate(new interface{}, old interface{}) error
+
+	// Apply makes the system use the new settings.
+	Apply(new interface{}, old interface{}) error
+
+	// Rollback restores the system to the old settings after Apply
+	// succeeded but a later handler, or sync-settings, failed.
+	Rollback(old interface{}) error
+}
+
+// Error implements error so a SyncHandler can return the CONFIRM
+// protocol of sync-settings from Validate.
+func (e *SetSettingsError) Error() string {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return "CONFIRM"
+	}
+	return string(raw)
+}
+
+// registeredHandler is a SyncHandler and the keys it depends on.
+type registeredHandler struct {
+	handler   SyncHandler
+	dependsOn []string
+}
+
+// SyncHandlerRegistry holds the SyncHandlers of the settings keys that
+// were migrated off the sync-settings executable.
+type SyncHandlerRegistry struct {
+	mutex    sync.RWMutex
+	handlers map[string]registeredHandler
+
+	// applied are the settings the handlers last applied, by settings
+	// filename and key.
+	applied map[string]map[string]interface{}
+}
+
+// NewSyncHandlerRegistry returns an empty SyncHandlerRegistry.
+func NewSyncHandlerRegistry() *SyncHandlerRegistry {
+	return &SyncHandlerRegistry{
+		handlers: make(map[string]registeredHandler),
+		applied:  make(map[string]map[string]interface{}),
+	}
+}
+
+// Register registers handler for the top level settings key. The
+// handler is validated and applied after the handlers of the keys in
+// dependsOn, and rolled back before them. Registering a handler that
+// creates a dependency cycle fails.
+func (r *SyncHandlerRegistry) Register(key string, handler SyncHandler, dependsOn ...string) error {
+	if key == "" || handler == nil {
+		return errors.New("sync handler: a key and handler are required")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, replaced := r.handlers[key]
+	r.handlers[key] = registeredHandler{
+		handler:   handler,
+		dependsOn: append([]string{}, dependsOn...),
+	}
+	if _, err := r.orderLocked(r.keysLocked()); err != nil {
+		if replaced {
+			r.handlers[key] = previous
+		} else {
+			delete(r.handlers, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unregister removes the handler of the settings key, which goes back
+// to being synced by sync-settings.
+func (r *SyncHandlerRegistry) Unregister(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.handlers, key)
+	for _, applied := range r.applied {
+		delete(applied, key)
+	}
+}
+
+// keysLocked returns the sorted keys with a handler. The mutex must be
+// held.
+func (r *SyncHandlerRegistry) keysLocked() []string {
+	keys := make([]string, 0, len(r.handlers))
+	for key := range r.handlers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// orderLocked sorts keys so that every key comes after the keys it
+// depends on. Dependencies outside of keys are ignored. The mutex must
+// be held.
+func (r *SyncHandlerRegistry) orderLocked(keys []string) ([]string, error) {
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(keys))
+	ordered := make([]string, 0, len(keys))
+	var visit func(key string, chain []string) error
+	visit = func(key string, chain []string) error {
+		switch state[key] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("sync handler: dependency cycle: %s", strings.Join(append(chain, key), " -> "))
+		}
+		state[key] = visiting
+		dependencies := append([]string{}, r.handlers[key].dependsOn...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if !wanted[dependency] {
+				continue
+			}
+			if err := visit(dependency, append(chain, key)); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		ordered = append(ordered, key)
+		return nil
+	}
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		if err := visit(key, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// syncStep is a handler to run for a changed settings key.
+type syncStep struct {
+	key      string
+	handler  SyncHandler
+	new, old interface{}
+}
+
+// syncPlan is what has to run to go from one version of the settings
+// to another.
+type syncPlan struct {
+	// steps are the handlers of the changed keys, in dependency order.
+	steps []syncStep
+
+	// external is whether the sync-settings executable has to run,
+	// because changed keys have no handler.
+	external bool
+
+	// unhandled are the changed keys without a handler.
+	unhandled []string
+
+	// handled are the new settings of every key with a handler, changed
+	// or not. They are kept from sync-settings.
+	handled map[string]interface{}
+}
+
+// plan returns the syncPlan from the old to the new settings. With no
+// handlers registered at all sync-settings always runs, as before
+// handlers existed.
+func (r *SyncHandlerRegistry) plan(old map[string]interface{}, new map[string]interface{}) (*syncPlan, error) {
+	return r.buildPlan(old, new, false)
+}
+
+// planFull returns the syncPlan applying every key with a handler, as
+// a full sync does, whether or not it changed since old.
+func (r *SyncHandlerRegistry) planFull(old map[string]interface{}, new map[string]interface{}) (*syncPlan, error) {
+	return r.buildPlan(old, new, true)
+}
+
+// buildPlan implements plan and planFull.
+func (r *SyncHandlerRegistry) buildPlan(old map[string]interface{}, new map[string]interface{}, full bool) (*syncPlan, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	plan := &syncPlan{}
+	if len(r.handlers) == 0 {
+		plan.external = true
+		return plan, nil
+	}
+
+	// new may hold go values set through SetSettings, compare and pass
+	// on the JSON form, as read back from the file.
+	normalized, err := copyJSON(new)
+	if err != nil {
+		return nil, fmt.Errorf("sync handler: %w", err)
+	}
+	new, _ = normalized.(map[string]interface{})
+
+	changed := []string{}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	for key, value := range new {
+		if full || !reflect.DeepEqual(old[key], value) {
+			changed = append(changed, key)
+		}
+	}
+
+	plan.handled = map[string]interface{}{}
+	for key := range r.handlers {
+		if value, ok := new[key]; ok {
+			plan.handled[key] = value
+		}
+	}
+
+	handled := []string{}
+	for _, key := range changed {
+		if _, ok := r.handlers[key]; ok {
+			handled = append(handled, key)
+		} else {
+			plan.unhandled = append(plan.unhandled, key)
+		}
+	}
+	sort.Strings(plan.unhandled)
+	plan.external = len(plan.unhandled) > 0
+
+	ordered, err := r.orderLocked(handled)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range ordered {
+		plan.steps = append(plan.steps, syncStep{
+			key:     key,
+			handler: r.handlers[key].handler,
+			new:     new[key],
+			old:     old[key],
+		})
+	}
+	return plan, nil
+}
+
+// validate runs Validate of every step. The error of the first failing
+// handler is returned as is, so a CONFIRM reaches syncResponse.
+func (plan *syncPlan) validate() error {
+	for _, step := range plan.steps {
+		if err := step.handler.Validate(step.new, step.old); err != nil {
+			logger.Warn("Sync handler for %s rejected the settings: %s\n", step.key, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// apply runs Apply of every step, in order. It returns the number of
+// steps applied, on failure the failing step is not counted.
+func (plan *syncPlan) apply() (int, error) {
+	for i, step := range plan.steps {
+		logger.Info("Applying %s settings in-process\n", step.key)
+		if err := step.handler.Apply(step.new, step.old); err != nil {
+			logger.Warn("Sync handler for %s failed: %s\n", step.key, err.Error())
+			return i, err
+		}
+	}
+	return len(plan.steps), nil
+}
+
+// rollback rolls back the first applied steps, in reverse order.
+func (plan *syncPlan) rollback(applied int) {
+	for i := applied - 1; i >= 0; i-- {
+		step := plan.steps[i]
+		logger.Warn("Rolling back %s settings\n", step.key)
+		if err := step.handler.Rollback(step.old); err != nil {
+			logger.Err("Failed to roll back %s settings: %s\n", step.key, err.Error())
+		}
+	}
+}
+
+// externalSettings returns a shallow copy of settings without the keys
+// with a handler, which is what sync-settings is given.
+func (plan *syncPlan) externalSettings(settings map[string]interface{}) map[string]interface{} {
+	external := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if _, ok := plan.handled[key]; !ok {
+			external[key] = value
+		}
+	}
+	return external
+}
+
+// mergeHandled puts the keys with a handler back into raw, the settings
+// as sync-settings left them.
+func (plan *syncPlan) mergeHandled(raw []byte) ([]byte, error) {
+	if len(plan.handled) == 0 {
+		return raw, nil
+	}
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonSettings); err != nil {
+		return nil, err
+	}
+	if jsonSettings == nil {
+		jsonSettings = map[string]interface{}{}
+	}
+	for key, value := range plan.handled {
+		jsonSettings[key] = value
+	}
+	return encodeSettings(jsonSettings)
+}
+
+// appliedSettings returns the settings the handlers last applied from
+// filename, by key. Keys not applied since the process started are
+// missing.
+func (r *SyncHandlerRegistry) appliedSettings(filename string) map[string]interface{} {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	applied := make(map[string]interface{}, len(r.applied[filename]))
+	for key, value := range r.applied[filename] {
+		applied[key] = value
+	}
+	return applied
+}
+
+// recordApplied records the settings of the steps of plan as applied
+// from filename, once the whole sync succeeded.
+func (r *SyncHandlerRegistry) recordApplied(filename string, plan *syncPlan) {
+	if len(plan.steps) == 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	applied := r.applied[filename]
+	if applied == nil {
+		applied = map[string]interface{}{}
+		r.applied[filename] = applied
+	}
+	for _, step := range plan.steps {
+		if step.new == nil {
+			delete(applied, step.key)
+		} else {
+			applied[step.key] = step.new
+		}
+	}
+}
+
+// output describes what the in-process handlers did, in the style of
+// the sync-settings output.
+func (plan *syncPlan) output(simulate bool) string {
+	if len(plan.steps) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(plan.steps))
+	for _, step := range plan.steps {
+		keys = append(keys, step.key)
+	}
+	verb := "applied"
+	if simulate {
+		verb = "validated"
+	}
+	return fmt.Sprintf("in-process handlers %s: %s\n", verb, strings.Join(keys, ", "))
+}
+
+// syncHandlers are the handlers used by syncAndSave.
+var syncHandlers = NewSyncHandlerRegistry()
+
+// RegisterSyncHandler registers handler to apply the settings of the
+// top level key in-process, after the keys in dependsOn. Changes to
+// keys with a handler no longer run sync-settings.
+func RegisterSyncHandler(key string, handler SyncHandler, dependsOn ...string) error {
+	return syncHandlers.Register(key, handler, dependsOn...)
+}
+
+// UnregisterSyncHandler removes the handler of the settings key.
+func UnregisterSyncHandler(key string) {
+	syncHandlers.Unregister(key)
+}
+
+// readCurrentSettingsForSync reads the settings in filename that a
+// sync starts from, with the secrets sealed with secrets opened. A
+// missing or unreadable file is an empty settings object, so all keys
+// are seen as changed.
+func readCurrentSettingsForSync(filename string, secrets *SecretStore) map[string]interface{} {
+	raw, err := readSettingsBytes(filename)
+	if err == nil {
+		var jsonSettings map[string]interface{}
+		if err = json.Unmarshal(raw, &jsonSettings); err == nil && jsonSettings != nil {
+			if jsonSettings, err = openStoredSecrets(secrets, jsonSettings); err == nil {
+				return jsonSettings
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("Unable to read the current settings of %s: %s\n", filename, err.Error())
+	}
+	return map[string]interface{}{}
+}
+
+// syncSettingsSimulator is the function used to run sync-settings in
+// simulation mode.
+var syncSettingsSimulator = runSimulateSyncSettings
+
+// runSimulateSyncSettings runs sync-settings on the specified filename
+// with the simulate flag, so nothing is written or restarted.
+func runSimulateSyncSettings(filename string, force bool, skipEosConfig bool) (string, error) {
+	cmd := exec.Command("/usr/bin/sync-settings", "-s", "-f", filename, "-v", "force="+strconv.FormatBool(force), "-v", "skipEosConfig="+strconv.FormatBool(skipEosConfig))
+	outBytes, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Warn("Failed to simulate sync-settings: %v\n", err.Error())
+	}
+	return string(outBytes), err
+}
+
+// simulateSync validates jsonObject as syncAndSave would apply it over
+// filename, without applying or writing anything. sync-settings is run
+// in simulation mode for the keys without a handler.
+func simulateSync(jsonObject map[string]interface{}, filename string, secrets *SecretStore, force bool, skipEosConfig bool) (string, error) {
+	plan, err := syncHandlers.plan(readCurrentSettingsForSync(filename, secrets), jsonObject)
+	if err != nil {
+		return "", err
+	}
+	if err := plan.validate(); err != nil {
+		return "", err
+	}
+	output := plan.output(true)
+	if !plan.external {
+		return output, nil
+	}
+
+	tmpfile, err := tempFile("", "settings.json.")
+	if err != nil {
+		return "Failed to generate tmpfile.", err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+	if _, err := writeSettingsFileJSON(plan.externalSettings(jsonObject), tmpfile); err != nil {
+		return "Failed to write settings.", err
+	}
+	externalOutput, err := syncSettingsSimulator(tmpfile.Name(), force, skipEosConfig)
+	return output + externalOutput, err
+}
+
+// SimulateSetSettingsFile checks setting value at the segments path of
+// the settings in filename the way SetSettingsFile would, without
+// applying or writing anything. The response is the same as
+// SetSettingsFile returns.
+func SimulateSetSettingsFile(segments []string, value interface{}, filename string, force bool, skipEosConfig bool) (interface{}, error) {
+	return settingsFileAt(filename).SimulateSetSettings(segments, value, force, skipEosConfig)
+}
+
+// SimulateSetSettings checks setting value at the segments path the
+// way SetSettings would, without applying or writing anything.
+func (file *SettingsFile) SimulateSetSettings(segments []string, value interface{}, force bool, skipEosConfig bool) (interface{}, error) {
+	jsonSettings, err := file.GetAllSettings()
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	newSettings, err := setSettingsInJSON(jsonSettings, segments, value)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	var ok bool
+	if jsonSettings, ok = newSettings.(map[string]interface{}); !ok {
+		err = errors.New("invalid global settings object")
+		return createJSONErrorObject(err), err
+	}
+	if response, err := validateSettings(file.schemas, jsonSettings); err != nil {
+		return response, err
+	}
+
+	file.mutex.RLock()
+	jsonSettings, err = file.plaintextSecrets(jsonSettings)
+	file.mutex.RUnlock()
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	output, err := simulateSync(jsonSettings, file.filename, file.secrets, force, skipEosConfig)
+	return syncResponse(output, err, file.filename, jsonSettings)
+}
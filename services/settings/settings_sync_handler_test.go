@@ -0,0 +1,270 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// fakeSyncHandler records the calls made to it in a shared log.
+type fakeSyncHandler struct {
+	name        string
+	log         *[]string
+	validateErr error
+	applyErr    error
+
+	// rolledBack is the old value of the last Rollback.
+	rolledBack interface{}
+}
+
+func (h *fakeSyncHandler) Validate(new interface{}, old interface{}) error {
+	*h.log = append(*h.log, "validate "+h.name)
+	return h.validateErr
+}
+
+func (h *fakeSyncHandler) Apply(new interface{}, old interface{}) error {
+	*h.log = append(*h.log, "apply "+h.name)
+	return h.applyErr
+}
+
+func (h *fakeSyncHandler) Rollback(old interface{}) error {
+	*h.log = append(*h.log, "rollback "+h.name)
+	h.rolledBack = old
+	return nil
+}
+
+// useSyncHandlers replaces the package handlers for the test.
+func useSyncHandlers(t *testing.T, registry *SyncHandlerRegistry) {
+	orig := syncHandlers
+	syncHandlers = registry
+	t.Cleanup(func() { syncHandlers = orig })
+}
+
+func TestSyncHandlerRegistryOrder(t *testing.T) {
+	registry := NewSyncHandlerRegistry()
+	log := []string{}
+	require.NoError(t, registry.Register("policy_manager", &fakeSyncHandler{log: &log}, "network", "firewall"))
+	require.NoError(t, registry.Register("firewall", &fakeSyncHandler{log: &log}, "network"))
+	require.NoError(t, registry.Register("network", &fakeSyncHandler{log: &log}))
+	assert.Error(t, registry.Register("network", &fakeSyncHandler{log: &log}, "policy_manager"))
+	assert.Error(t, registry.Register("", &fakeSyncHandler{log: &log}))
+
+	plan, err := registry.plan(
+		map[string]interface{}{"network": "1", "firewall": "1", "system": "1"},
+		map[string]interface{}{"network": "2", "policy_manager": "1", "firewall": "1", "system": "1"})
+	require.NoError(t, err)
+	keys := []string{}
+	for _, step := range plan.steps {
+		keys = append(keys, step.key)
+	}
+	assert.Equal(t, []string{"network", "policy_manager"}, keys)
+	assert.False(t, plan.external)
+
+	plan, err = registry.plan(map[string]interface{}{"system": "1"}, map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Empty(t, plan.steps)
+	assert.True(t, plan.external)
+	assert.Equal(t, []string{"system"}, plan.unhandled)
+}
+
+func TestSyncAndSaveWithHandlers(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	log := []string{}
+	registry := NewSyncHandlerRegistry()
+	a := &fakeSyncHandler{name: "a", log: &log}
+	c := &fakeSyncHandler{name: "c", log: &log}
+	require.NoError(t, registry.Register("c", c, "a"))
+	require.NoError(t, registry.Register("a", a))
+	useSyncHandlers(t, registry)
+	sf := NewSettingsFile(tempfile)
+
+	// only handled keys change, sync-settings does not run.
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Set([]string{"c"}, "new"))
+	require.NoError(t, tx.Set([]string{"a", "b", "foo"}, "changed"))
+	_, err = tx.Commit(false, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"validate a", "validate c", "apply a", "apply c"}, log)
+	assert.Equal(t, 0, *syncs)
+
+	// an unhandled key falls back to sync-settings.
+	log = log[:0]
+	_, err = sf.SetSettings([]string{"d"}, 1, false, false)
+	require.NoError(t, err)
+	assert.Empty(t, log)
+	assert.Equal(t, 1, *syncs)
+
+	// a failing handler rolls back those applied before it.
+	log = log[:0]
+	c.applyErr = errors.New("boom")
+	before, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	tx, err = sf.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Set([]string{"c"}, "newer"))
+	require.NoError(t, tx.Set([]string{"a"}, "newer"))
+	_, err = tx.Commit(false, false)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"validate a", "validate c", "apply a", "apply c", "rollback a"}, log)
+	after, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// as does a failing sync-settings.
+	log = log[:0]
+	c.applyErr = nil
+	fakeSyncSettings(t, errors.New("sync failed"))
+	tx, err = sf.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Set([]string{"c"}, "newer"))
+	require.NoError(t, tx.Set([]string{"d"}, 2))
+	_, err = tx.Commit(false, false)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"validate c", "apply c", "rollback c"}, log)
+}
+
+func TestSyncAndSaveStripsHandledKeys(t *testing.T) {
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	log := []string{}
+	registry := NewSyncHandlerRegistry()
+	require.NoError(t, registry.Register("a", &fakeSyncHandler{name: "a", log: &log}))
+	useSyncHandlers(t, registry)
+
+	// sync-settings does not see the handled key, and its changes to
+	// the others are stored.
+	var given map[string]interface{}
+	orig := syncSettingsRunner
+	syncSettingsRunner = func(filename string, force bool, skipEosConfig bool) (string, error) {
+		raw, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(raw, &given))
+		given["synced"] = true
+		raw, err = json.Marshal(given)
+		require.NoError(t, err)
+		return "synced", os.WriteFile(filename, raw, 0660)
+	}
+	t.Cleanup(func() { syncSettingsRunner = orig })
+
+	sf := NewSettingsFile(tempfile)
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Set([]string{"a", "b", "foo"}, "changed"))
+	require.NoError(t, tx.Set([]string{"d"}, 1))
+	_, err = tx.Commit(false, false)
+	require.NoError(t, err)
+	assert.NotContains(t, given, "a")
+	assert.Contains(t, given, "d")
+
+	var stored map[string]interface{}
+	require.NoError(t, sf.UnmarshalSettingsAtPath(&stored))
+	assert.Equal(t, "changed", stored["a"].(map[string]interface{})["b"].(map[string]interface{})["foo"])
+	assert.Equal(t, true, stored["synced"])
+	assert.Equal(t, float64(1), stored["d"])
+}
+
+func TestSyncAndSaveWriteFailure(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	log := []string{}
+	registry := NewSyncHandlerRegistry()
+	require.NoError(t, registry.Register("c", &fakeSyncHandler{name: "c", log: &log}))
+	useSyncHandlers(t, registry)
+
+	// the settings can't be stored, the applied handlers are rolled
+	// back.
+	filename := filepath.Join(t.TempDir(), "missing", "settings.json")
+	_, err := syncAndSave(map[string]interface{}{"c": "new"}, filename, settingsSecrets, false, false)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"validate c", "apply c", "rollback c"}, log)
+	assert.Equal(t, 0, *syncs)
+}
+
+func TestNormalSyncWithHandlers(t *testing.T) {
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	log := []string{}
+	registry := NewSyncHandlerRegistry()
+	a := &fakeSyncHandler{name: "a", log: &log}
+	require.NoError(t, registry.Register("a", a))
+	useSyncHandlers(t, registry)
+
+	// every handled key is applied along with sync-settings.
+	sync := NewSyncSettings(tempfile, "", "", "openwrt", "", "true", "")
+	require.NoError(t, sync.NormalSync())
+	assert.Equal(t, []string{"validate a", "apply a"}, log)
+	var applied interface{}
+	require.NoError(t, NewSettingsFile(tempfile).UnmarshalSettingsAtPath(&applied, "a"))
+
+	// and rolled back to the settings applied before if sync-settings
+	// fails.
+	log = log[:0]
+	require.NoError(t, os.WriteFile(tempfile, []byte(`{"a": {"b": {"foo": "edited"}}}`), 0660))
+	sync.SyncSettingsExecutable = "false"
+	assert.Error(t, sync.NormalSync())
+	assert.Equal(t, []string{"validate a", "apply a", "rollback a"}, log)
+	assert.Equal(t, applied, a.rolledBack)
+}
+
+func TestSyncHandlerConfirm(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	log := []string{}
+	confirm := &SetSettingsError{Confirm: Confirmation{InvalidItems: map[string]InvalidItem{
+		"1": {Reason: "disabled", Type: "policy", Value: "p1"},
+	}}}
+	registry := NewSyncHandlerRegistry()
+	require.NoError(t, registry.Register("a", &fakeSyncHandler{name: "a", log: &log, validateErr: confirm}))
+	useSyncHandlers(t, registry)
+
+	_, err := SetSettingsFile([]string{"a", "b", "foo"}, "changed", tempfile, false, false)
+	require.Error(t, err)
+	parsed, err := getSettingsErrorStruct(err)
+	require.NoError(t, err)
+	assert.Equal(t, confirm, parsed)
+	assert.Equal(t, []string{"validate a"}, log)
+}
+
+func TestSimulateSetSettings(t *testing.T) {
+	syncs := fakeSyncSettings(t, nil)
+	simulations := 0
+	orig := syncSettingsSimulator
+	syncSettingsSimulator = func(filename string, force bool, skipEosConfig bool) (string, error) {
+		simulations++
+		return "simulated", nil
+	}
+	defer func() { syncSettingsSimulator = orig }()
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	log := []string{}
+	registry := NewSyncHandlerRegistry()
+	require.NoError(t, registry.Register("a", &fakeSyncHandler{name: "a", log: &log}))
+	useSyncHandlers(t, registry)
+	sf := NewSettingsFile(tempfile)
+	before, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+
+	_, err = sf.SimulateSetSettings([]string{"a", "b", "foo"}, "changed", false, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"validate a"}, log)
+	assert.Equal(t, 0, simulations)
+
+	response, err := SimulateSetSettingsFile([]string{"e"}, true, tempfile, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "simulated", response.(map[string]interface{})["output"])
+	assert.Equal(t, 1, simulations)
+
+	after, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.Equal(t, 0, *syncs)
+}
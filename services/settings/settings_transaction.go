@@ -0,0 +1,259 @@
+package settings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrConcurrentModification is returned when committing a
+// SettingsTransaction if the settings file changed after the
+// transaction began.
+var ErrConcurrentModification = errors.New("settings file was modified after the transaction began")
+
+// ErrTransactionDone is returned when using a SettingsTransaction that
+// was already committed or rolled back.
+var ErrTransactionDone = errors.New("settings transaction already committed or rolled back")
+
+// settingsOperation is a single Set, Trim or patch in a transaction.
+type settingsOperation struct {
+	trim     bool
+	segments []string
+	value    interface{}
+
+	// patch, if set, computes the new settings from the current ones.
+	patch func(jsonSettings interface{}) (interface{}, error)
+}
+
+// SettingsTransaction collects changes to several paths of a
+// SettingsFile and applies them with a single sync-settings run. Create
+// one with SettingsFile.Begin.
+type SettingsTransaction struct {
+	file        *SettingsFile
+	baseVersion string
+	operations  []settingsOperation
+	done        bool
+
+	// recorded with the revision, if the file keeps a history, and in
+	// the audit log.
+	author string
+	reason string
+
+	// operation the commit is audited as.
+	operation string
+}
+
+// settingsVersion returns the version of the settings file contents,
+// which is a hash of the raw bytes.
+func settingsVersion(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Version returns the current version of the settings file, which
+// changes whenever its contents change.
+func (file *SettingsFile) Version() (string, error) {
+	file.mutex.RLock()
+	defer file.mutex.RUnlock()
+	raw, err := readSettingsBytes(file.filename)
+	if err != nil {
+		return "", err
+	}
+	return settingsVersion(raw), nil
+}
+
+// Begin starts a transaction on the settings file. Changes added with
+// Set and Trim are only written by Commit, which fails with
+// ErrConcurrentModification if the file changed since Begin.
+func (file *SettingsFile) Begin() (*SettingsTransaction, error) {
+	version, err := file.Version()
+	if err != nil {
+		return nil, fmt.Errorf("settings transaction: unable to read %s: %w", file.filename, err)
+	}
+	return &SettingsTransaction{
+		file:        file,
+		baseVersion: version,
+	}, nil
+}
+
+// BaseVersion returns the version of the settings file the transaction
+// was started on.
+func (tx *SettingsTransaction) BaseVersion() string {
+	return tx.baseVersion
+}
+
+// Set adds setting the value at the segments path to the
+// transaction. The value is copied, it must be marshallable to JSON.
+func (tx *SettingsTransaction) Set(segments []string, value interface{}) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("settings transaction: invalid value for %v: %w", segments, err)
+	}
+	var copied interface{}
+	if err := json.Unmarshal(raw, &copied); err != nil {
+		return fmt.Errorf("settings transaction: invalid value for %v: %w", segments, err)
+	}
+	tx.operations = append(tx.operations, settingsOperation{
+		segments: append([]string{}, segments...),
+		value:    copied,
+	})
+	return nil
+}
+
+// Trim adds deleting the value at the segments path to the
+// transaction.
+func (tx *SettingsTransaction) Trim(segments []string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	if len(segments) == 0 {
+		return errors.New("invalid trim settings path")
+	}
+	tx.operations = append(tx.operations, settingsOperation{
+		trim:     true,
+		segments: append([]string{}, segments...),
+	})
+	return nil
+}
+
+// Annotate sets the author and reason recorded with the revision
+// created by Commit, if the settings file keeps a revision history, and
+// in the audit log as its actor and reason.
+func (tx *SettingsTransaction) Annotate(author string, reason string) {
+	tx.author = author
+	tx.reason = reason
+}
+
+// Rollback discards the transaction without touching the settings
+// file.
+func (tx *SettingsTransaction) Rollback() {
+	tx.done = true
+	tx.operations = nil
+}
+
+// apply applies the operations of the transaction, in order, to
+// jsonSettings and returns the result.
+func (tx *SettingsTransaction) apply(jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	for i, op := range tx.operations {
+		if op.patch != nil {
+			newSettings, err := op.patch(jsonSettings)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if jsonSettings, ok = newSettings.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("settings transaction: patch %d did not produce a settings object", i)
+			}
+			continue
+		}
+		if op.trim {
+			if err := trimSettingsInJSON(jsonSettings, op.segments); err != nil {
+				return nil, fmt.Errorf("settings transaction: trim %d (%v) failed: %w", i, op.segments, err)
+			}
+			continue
+		}
+		newSettings, err := setSettingsInJSON(jsonSettings, op.segments, op.value)
+		if err != nil {
+			return nil, fmt.Errorf("settings transaction: set %d (%v) failed: %w", i, op.segments, err)
+		}
+		var ok bool
+		if jsonSettings, ok = newSettings.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("settings transaction: set %d (%v) did not produce a settings object", i, op.segments)
+		}
+	}
+	return jsonSettings, nil
+}
+
+// Commit applies all changes of the transaction and runs sync-settings
+// once on the result. Either all changes are saved or, on any error,
+// the settings file is left as it was before the commit. The returned
+// object is the same as SettingsFile.SetSettings returns.
+func (tx *SettingsTransaction) Commit(force bool, skipEosConfig bool) (interface{}, error) {
+	if tx.done {
+		return createJSONErrorObject(ErrTransactionDone), ErrTransactionDone
+	}
+	tx.done = true
+
+	file := tx.file
+	file.mutex.Lock()
+	raw, err := readSettingsBytes(file.filename)
+	if err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	if settingsVersion(raw) != tx.baseVersion {
+		file.mutex.Unlock()
+		return createJSONErrorObject(ErrConcurrentModification), ErrConcurrentModification
+	}
+
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	if jsonSettings == nil {
+		err = errors.New("invalid settings file format")
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	if jsonSettings, err = openStoredSecrets(file.secrets, jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	if jsonSettings, err = tx.apply(jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+	if response, err := validateSettings(file.schemas, jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return response, err
+	}
+	if jsonSettings, err = file.plaintextSecrets(jsonSettings); err != nil {
+		file.mutex.Unlock()
+		return createJSONErrorObject(err), err
+	}
+
+	operation := tx.operation
+	if operation == "" {
+		operation = AuditOperationTransaction
+	}
+	paths := make([][]string, 0, len(tx.operations))
+	for _, op := range tx.operations {
+		paths = append(paths, op.segments)
+	}
+	change := file.beginAudit(operation, AuditInfo{Actor: tx.author, Reason: tx.reason}, paths...)
+	output, err := syncAndSave(jsonSettings, file.filename, file.secrets, force, skipEosConfig)
+	if err != nil {
+		tx.restore(raw)
+	}
+	// syncResponse may read the settings file, so the lock has to be
+	// released first.
+	file.mutex.Unlock()
+	change.finish(jsonSettings, err)
+	if err == nil {
+		// only a commit that went through is recorded, with the
+		// settings it replaced.
+		recordRevisionBytes(file.filename, raw, "", "")
+		file.recordRevision(tx.author, tx.reason)
+		settingsFileChanged(file.filename)
+	}
+	return syncResponse(output, err, file.filename, jsonSettings)
+}
+
+// restore writes the pre-transaction contents back to the settings
+// file if a failed commit changed it. The file lock must be held.
+func (tx *SettingsTransaction) restore(raw []byte) {
+	current, err := readSettingsBytes(tx.file.filename)
+	if err == nil && settingsVersion(current) == tx.baseVersion {
+		return
+	}
+	logger.Warn("Settings transaction failed, restoring %s\n", tx.file.filename)
+	if err := writeSettingsBytes(tx.file.filename, raw); err != nil {
+		logger.Err("Failed to restore %s after failed transaction: %s\n", tx.file.filename, err.Error())
+	}
+}
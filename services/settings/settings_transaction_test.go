@@ -0,0 +1,166 @@
+package settings
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// fakeSyncSettings replaces the sync-settings runner for the duration
+// of a test, recording the number of runs.
+func fakeSyncSettings(t *testing.T, err error) *int {
+	runs := 0
+	orig := syncSettingsRunner
+	syncSettingsRunner = func(filename string, force bool, skipEosConfig bool) (string, error) {
+		runs++
+		return "synced", err
+	}
+	t.Cleanup(func() { syncSettingsRunner = orig })
+	return &runs
+}
+
+func TestSettingsTransactionCommit(t *testing.T) {
+	runs := fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile)
+
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	assert.NoError(t, tx.Set([]string{"a", "b", "foo"}, "bye"))
+	assert.NoError(t, tx.Set([]string{"c"}, map[string]int{"d": 2}))
+	assert.NoError(t, tx.Trim([]string{"a", "b", "bar"}))
+	assert.Error(t, tx.Set([]string{"x"}, make(chan int)))
+	assert.Error(t, tx.Trim(nil))
+
+	result, err := tx.Commit(false, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"output": "synced"}, result)
+	assert.Equal(t, 1, *runs)
+
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Equal(t,
+		map[string]interface{}{
+			"a": map[string]interface{}{"b": map[string]interface{}{"foo": "bye"}},
+			"c": map[string]interface{}{"d": float64(2)},
+		},
+		settings)
+
+	// the transaction can't be reused.
+	assert.ErrorIs(t, tx.Set([]string{"a"}, 1), ErrTransactionDone)
+	_, err = tx.Commit(false, false)
+	assert.ErrorIs(t, err, ErrTransactionDone)
+}
+
+func TestSettingsTransactionConcurrentModification(t *testing.T) {
+	runs := fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithRevisionHistory(newTestHistory(t)))
+
+	first, err := sf.Begin()
+	require.NoError(t, err)
+	second, err := sf.Begin()
+	require.NoError(t, err)
+	assert.Equal(t, first.BaseVersion(), second.BaseVersion())
+
+	assert.NoError(t, first.Set([]string{"first"}, true))
+	assert.NoError(t, second.Set([]string{"second"}, true))
+
+	_, err = first.Commit(false, false)
+	assert.NoError(t, err)
+	revisions, err := sf.History().List()
+	require.NoError(t, err)
+	assert.Len(t, revisions, 2)
+	// an external edit, that a commit going through would record.
+	raw, err := os.ReadFile(tempfile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tempfile, append(raw, '\n'), 0660))
+	_, err = second.Commit(false, false)
+	assert.ErrorIs(t, err, ErrConcurrentModification)
+	assert.Equal(t, 1, *runs)
+
+	// a commit that did not go through is not recorded.
+	revisions, err = sf.History().List()
+	require.NoError(t, err)
+	assert.Len(t, revisions, 2)
+
+	settings, err := sf.GetAllSettings()
+	require.NoError(t, err)
+	assert.Contains(t, settings, "first")
+	assert.NotContains(t, settings, "second")
+}
+
+func TestSettingsTransactionFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		syncErr error
+		ops     func(tx *SettingsTransaction)
+	}{
+		{
+			name:    "sync-settings fails",
+			syncErr: errors.New("Failed to save settings"),
+			ops: func(tx *SettingsTransaction) {
+				tx.Set([]string{"a", "b", "foo"}, "bye")
+			},
+		},
+		{
+			name: "trim through a non-dict",
+			ops: func(tx *SettingsTransaction) {
+				tx.Set([]string{"a", "new"}, 1)
+				tx.Trim([]string{"a", "b", "foo", "x"})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSyncSettings(t, tt.syncErr)
+			tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+			defer cleanup()
+			before, err := os.ReadFile(tempfile)
+			require.NoError(t, err)
+
+			sf := NewSettingsFile(tempfile, WithRevisionHistory(newTestHistory(t)))
+			tx, err := sf.Begin()
+			require.NoError(t, err)
+			tt.ops(tx)
+			result, err := tx.Commit(false, false)
+			assert.Error(t, err)
+			assert.Contains(t, result, "error")
+
+			after, err := os.ReadFile(tempfile)
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+			revisions, err := sf.History().List()
+			require.NoError(t, err)
+			assert.Empty(t, revisions)
+		})
+	}
+}
+
+func TestSettingsTransactionRollback(t *testing.T) {
+	runs := fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile)
+	version, err := sf.Version()
+	require.NoError(t, err)
+
+	tx, err := sf.Begin()
+	require.NoError(t, err)
+	assert.NoError(t, tx.Set([]string{"a"}, 1))
+	tx.Rollback()
+	_, err = tx.Commit(false, false)
+	assert.ErrorIs(t, err, ErrTransactionDone)
+	assert.Equal(t, 0, *runs)
+
+	after, err := sf.Version()
+	require.NoError(t, err)
+	assert.Equal(t, version, after)
+}
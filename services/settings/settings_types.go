@@ -0,0 +1,347 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrSettingsTypeNotRegistered is returned for typed settings of a path
+// no type was registered for.
+var ErrSettingsTypeNotRegistered = errors.New("no settings type registered")
+
+// SettingsValidator is implemented by registered settings types that
+// check more than what decoding them from JSON does. Elements of
+// registered slices are validated too.
+type SettingsValidator interface {
+	Validate() error
+}
+
+// TypeError is a registered settings section that could not be
+// decoded into its type, or that failed its validation.
+type TypeError struct {
+	// Path is the "/" separated path of the section.
+	Path string `json:"path"`
+	// Type is the Go type registered for the section.
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	err     error
+}
+
+// Error implements error.
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Path, e.Type, e.Message)
+}
+
+// Unwrap returns the decoding or validation error.
+func (e *TypeError) Unwrap() error {
+	return e.err
+}
+
+// TypeValidationError is returned when registered settings sections
+// are invalid. It lists every invalid section.
+type TypeValidationError struct {
+	Errors []TypeError `json:"errors"`
+}
+
+// Error implements error.
+func (e *TypeValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for i := range e.Errors {
+		messages = append(messages, e.Errors[i].Error())
+	}
+	return "invalid settings sections: " + strings.Join(messages, "; ")
+}
+
+// typedSection is a settings path with a registered type and its last
+// decoded value.
+type typedSection struct {
+	path  []string
+	typ   reflect.Type
+	value reflect.Value
+	// decoded is set once the section was decoded successfully.
+	decoded bool
+	// present is set if the path was in the last decoded settings.
+	present bool
+	err     *TypeError
+}
+
+// TypeRegistry holds the Go types of settings sections and a cache of
+// their decoded values. Decode refreshes the cache, so readers get
+// values that were decoded and validated once instead of unmarshalling
+// the settings every time.
+type TypeRegistry struct {
+	mutex    sync.RWMutex
+	sections map[string]*typedSection
+}
+
+// NewTypeRegistry returns an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		sections: make(map[string]*typedSection),
+	}
+}
+
+// typePathKey returns the key of path in the registry, path segments
+// are joined with "/".
+func typePathKey(path []string) string {
+	return strings.Join(path, "/")
+}
+
+// Register registers the type of prototype for the settings section at
+// path, for example []interfaces.Interface{} for
+// network/interfaces. A pointer prototype registers the type it points
+// to. The section is decoded on the next Decode, registering it again
+// replaces the type and forgets the cached value.
+func (r *TypeRegistry) Register(path []string, prototype interface{}) error {
+	if len(path) == 0 {
+		return errors.New("settings type: empty settings path")
+	}
+	if prototype == nil {
+		return fmt.Errorf("settings type: nil prototype for %s", typePathKey(path))
+	}
+	typ := reflect.TypeOf(prototype)
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sections[typePathKey(path)] = &typedSection{
+		path: append([]string{}, path...),
+		typ:  typ,
+	}
+	return nil
+}
+
+// Unregister removes the type of the settings section at path.
+func (r *TypeRegistry) Unregister(path []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sections, typePathKey(path))
+}
+
+// Paths returns the sorted "/" separated paths with a registered type.
+func (r *TypeRegistry) Paths() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	paths := make([]string, 0, len(r.sections))
+	for key := range r.sections {
+		paths = append(paths, key)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Decode decodes and validates every registered section of
+// jsonSettings and caches the values. A section that is not in the
+// settings is not an error. An invalid section keeps its last valid
+// value. It returns a *TypeValidationError listing every invalid
+// section, or nil.
+func (r *TypeRegistry) Decode(jsonSettings map[string]interface{}) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, section := range r.sections {
+		section.decode(jsonSettings)
+	}
+	return r.errLocked()
+}
+
+// Err returns the *TypeValidationError of the last Decode, or nil if
+// every section was valid.
+func (r *TypeRegistry) Err() error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.errLocked()
+}
+
+// errLocked implements Err, the mutex must be held.
+func (r *TypeRegistry) errLocked() error {
+	report := &TypeValidationError{}
+	for _, section := range r.sections {
+		if section.err != nil {
+			report.Errors = append(report.Errors, *section.err)
+		}
+	}
+	if len(report.Errors) == 0 {
+		return nil
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Path < report.Errors[j].Path
+	})
+	return report
+}
+
+// Get returns the cached value of the section at path, of the
+// registered type. Values are shared between callers and must not be
+// modified. If the section is invalid the last valid value, if any, is
+// returned along with its *TypeError. ErrSettingsPathNotFound is
+// returned if the section was not in the settings.
+func (r *TypeRegistry) Get(path []string) (interface{}, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	section, ok := r.sections[typePathKey(path)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSettingsTypeNotRegistered, typePathKey(path))
+	}
+	var value interface{}
+	if section.decoded {
+		value = section.value.Interface()
+	}
+	if section.err != nil {
+		return value, section.err
+	}
+	if !section.present {
+		return value, fmt.Errorf("%w: %s", ErrSettingsPathNotFound, typePathKey(path))
+	}
+	return value, nil
+}
+
+// Watch decodes the settings of file now and after every change of
+// it, logging the sections that are invalid. The returned function
+// stops watching.
+func (r *TypeRegistry) Watch(file *SettingsFile) (cancel func()) {
+	decode := func() {
+		jsonSettings, err := file.GetAllSettings()
+		if err != nil {
+			logger.Warn("Unable to read %s to decode the settings types: %s\n", file.filename, err.Error())
+			return
+		}
+		if err := r.Decode(jsonSettings); err != nil {
+			logger.Warn("%s\n", err.Error())
+		}
+	}
+	cancel = file.Watch(nil, func(_, _ any) {
+		// the watched values are the raw file, with sealed secrets.
+		decode()
+	})
+	decode()
+	return cancel
+}
+
+// decode decodes the section from jsonSettings. The registry mutex
+// must be held.
+func (section *typedSection) decode(jsonSettings map[string]interface{}) {
+	raw, err := patchGet(jsonSettings, section.path)
+	if err != nil {
+		section.present = false
+		section.err = nil
+		return
+	}
+	section.present = true
+
+	value := reflect.New(section.typ)
+	if err := remarshal(raw, value.Interface()); err != nil {
+		section.fail(err)
+		return
+	}
+	if err := validateSettingsValue(value); err != nil {
+		section.fail(err)
+		return
+	}
+	section.value = value.Elem()
+	section.decoded = true
+	section.err = nil
+}
+
+// fail records err as the error of the section.
+func (section *typedSection) fail(err error) {
+	section.err = &TypeError{
+		Path:    typePathKey(section.path),
+		Type:    section.typ.String(),
+		Message: err.Error(),
+		err:     err,
+	}
+}
+
+// remarshal decodes the JSON value into target.
+func remarshal(value interface{}, target interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, target)
+}
+
+// validateSettingsValue calls Validate on the value pointed to by ptr,
+// or on each of its elements if it is a slice, where they implement
+// SettingsValidator.
+func validateSettingsValue(ptr reflect.Value) error {
+	if validator, ok := ptr.Interface().(SettingsValidator); ok {
+		return validator.Validate()
+	}
+	value := ptr.Elem()
+	if value.Kind() != reflect.Slice {
+		return nil
+	}
+	for i := 0; i < value.Len(); i++ {
+		if validator, ok := value.Index(i).Addr().Interface().(SettingsValidator); ok {
+			if err := validator.Validate(); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// settingsTypes is the registry of the package level functions, it
+// decodes the settings file at Startup and on every change.
+var settingsTypes = NewTypeRegistry()
+
+// stopTypesWatch stops the decoding of settingsTypes started by
+// Startup.
+var stopTypesWatch func()
+
+// RegisterSettingsType registers the Go type of prototype for the
+// settings at path, such as database_settings.Databases{} for
+// database_settings. Register types before Startup, which decodes and
+// validates every registered section.
+func RegisterSettingsType(path []string, prototype interface{}) error {
+	return settingsTypes.Register(path, prototype)
+}
+
+// GetTypeRegistry returns the registry of the package level settings
+// types.
+func GetTypeRegistry() *TypeRegistry {
+	return settingsTypes
+}
+
+// GetTypedSettings returns the cached value of the settings at path,
+// which must have been registered with type T. See TypeRegistry.Get.
+func GetTypedSettings[T any](path ...string) (T, error) {
+	return GetTyped[T](settingsTypes, path...)
+}
+
+// GetTyped returns the cached value of the settings at path in
+// registry, which must have been registered with type T. See
+// TypeRegistry.Get.
+func GetTyped[T any](registry *TypeRegistry, path ...string) (T, error) {
+	var typed T
+	value, err := registry.Get(path)
+	if value == nil {
+		return typed, err
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return typed, fmt.Errorf("settings type: %s is registered as %T, not %T", typePathKey(path), value, typed)
+	}
+	return typed, err
+}
+
+// startTypesWatch decodes the settings file singleton with
+// settingsTypes if any type is registered, and keeps decoding it on
+// every change.
+func startTypesWatch() {
+	if len(settingsTypes.Paths()) == 0 {
+		return
+	}
+	file, err := GetSettingsFileSingleton()
+	if err != nil {
+		logger.Warn("Unable to locate the settings to decode the settings types: %s\n", err.Error())
+	}
+	stopTypesWatch = settingsTypes.Watch(file)
+}
@@ -0,0 +1,115 @@
+package settings
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/services/settings/database_settings"
+	"github.com/untangle/golang-shared/services/settings/dynamic_lists"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// testInterface is a registered element type with a validation.
+type testInterface struct {
+	Name string `json:"name"`
+}
+
+func (i *testInterface) Validate() error {
+	if i.Name == "" {
+		return errors.New("interface without a name")
+	}
+	return nil
+}
+
+func TestTypeRegistryDecode(t *testing.T) {
+	registry := NewTypeRegistry()
+	require.NoError(t, registry.Register([]string{"database_settings"}, &database_settings.Databases{}))
+	require.NoError(t, registry.Register([]string{"dynamic_lists", "configurations"}, []dynamic_lists.Config{}))
+	require.NoError(t, registry.Register([]string{"network", "interfaces"}, []testInterface{}))
+	require.NoError(t, registry.Register([]string{"missing"}, ""))
+	assert.Error(t, registry.Register(nil, ""))
+	assert.Error(t, registry.Register([]string{"nil"}, nil))
+	assert.Equal(t, []string{"database_settings", "dynamic_lists/configurations", "missing", "network/interfaces"}, registry.Paths())
+
+	_, err := GetTyped[database_settings.Databases](registry, "database_settings")
+	assert.ErrorIs(t, err, ErrSettingsPathNotFound)
+
+	require.NoError(t, registry.Decode(map[string]interface{}{
+		"database_settings": map[string]interface{}{
+			"databases": []interface{}{map[string]interface{}{"db_name": "reports", "default": true}},
+		},
+		"dynamic_lists": map[string]interface{}{
+			"configurations": []interface{}{map[string]interface{}{"name": "blocked", "pollingTime": 10}},
+		},
+		"network": map[string]interface{}{
+			"interfaces": []interface{}{map[string]interface{}{"name": "wan"}},
+		},
+	}))
+	databases, err := GetTyped[database_settings.Databases](registry, "database_settings")
+	require.NoError(t, err)
+	assert.Equal(t, "reports", databases.Databases[0].Database)
+	lists, err := GetTyped[[]dynamic_lists.Config](registry, "dynamic_lists", "configurations")
+	require.NoError(t, err)
+	assert.Equal(t, 10, lists[0].PollingTime)
+	_, err = GetTyped[string](registry, "missing")
+	assert.ErrorIs(t, err, ErrSettingsPathNotFound)
+	_, err = GetTyped[string](registry, "network", "interfaces")
+	assert.Error(t, err)
+	_, err = GetTyped[string](registry, "unregistered")
+	assert.ErrorIs(t, err, ErrSettingsTypeNotRegistered)
+
+	// every invalid section is reported, and keeps its last valid value.
+	err = registry.Decode(map[string]interface{}{
+		"database_settings": map[string]interface{}{"databases": "none"},
+		"dynamic_lists": map[string]interface{}{
+			"configurations": []interface{}{map[string]interface{}{"name": "blocked", "pollingTime": 20}},
+		},
+		"network": map[string]interface{}{
+			"interfaces": []interface{}{map[string]interface{}{"name": "wan"}, map[string]interface{}{}},
+		},
+	})
+	var report *TypeValidationError
+	require.ErrorAs(t, err, &report)
+	require.Len(t, report.Errors, 2)
+	assert.Equal(t, "database_settings", report.Errors[0].Path)
+	assert.Equal(t, "database_settings.Databases", report.Errors[0].Type)
+	assert.Equal(t, "network/interfaces", report.Errors[1].Path)
+	assert.Equal(t, "element 1: interface without a name", report.Errors[1].Message)
+	assert.Equal(t, err, registry.Err())
+
+	databases, err = GetTyped[database_settings.Databases](registry, "database_settings")
+	var typeErr *TypeError
+	assert.ErrorAs(t, err, &typeErr)
+	assert.Equal(t, "reports", databases.Databases[0].Database)
+	lists, err = GetTyped[[]dynamic_lists.Config](registry, "dynamic_lists", "configurations")
+	require.NoError(t, err)
+	assert.Equal(t, 20, lists[0].PollingTime)
+}
+
+func TestTypeRegistryWatch(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile)
+	registry := NewTypeRegistry()
+	require.NoError(t, registry.Register([]string{"a", "b", "bar"}, 0))
+
+	cancel := registry.Watch(sf)
+	defer cancel()
+	bar, err := GetTyped[int](registry, "a", "b", "bar")
+	require.NoError(t, err)
+	assert.Equal(t, 1, bar)
+
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "bar"}, 5))
+	bar, err = GetTyped[int](registry, "a", "b", "bar")
+	require.NoError(t, err)
+	assert.Equal(t, 5, bar)
+
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "bar"}, "five"))
+	bar, err = GetTyped[int](registry, "a", "b", "bar")
+	assert.Error(t, registry.Err())
+	assert.Error(t, err)
+	assert.Equal(t, 5, bar)
+}
@@ -0,0 +1,287 @@
+package settings
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/r3labs/diff/v2"
+)
+
+// DefaultWatchPollInterval is how often a watched settings file is
+// checked for external changes, unless WithWatchPollInterval is used.
+const DefaultWatchPollInterval = 5 * time.Second
+
+// WatchHandler is called with the values before and after a change to
+// the watched path. A value is nil if the path did not exist.
+type WatchHandler func(old, new any)
+
+// settingsWatcher is a handler registered with SettingsFile.Watch.
+type settingsWatcher struct {
+	path    []string
+	handler WatchHandler
+}
+
+// settingsWatchState is the state of the watchers of a SettingsFile.
+type settingsWatchState struct {
+	mutex    sync.Mutex
+	watchers map[int]*settingsWatcher
+	nextID   int
+
+	// the settings the watchers were last notified about.
+	snapshot map[string]interface{}
+	version  string
+	modTime  time.Time
+	size     int64
+
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// WithWatchPollInterval sets how often the settings file is checked for
+// external changes while it is watched.
+func WithWatchPollInterval(interval time.Duration) SettingsOption {
+	return func(file *SettingsFile) {
+		file.watch.interval = interval
+	}
+}
+
+// watchedFiles maps settings filenames to the watched SettingsFiles for
+// them, so writes through the package level functions reach them too.
+var watchedFiles = map[string][]*SettingsFile{}
+var watchedFilesLocker sync.Mutex
+
+// settingsFileChanged notifies the watchers of filename after it was
+// written by this package. It must be called without holding the
+// settings file locks.
+func settingsFileChanged(filename string) {
+	watchedFilesLocker.Lock()
+	files := append([]*SettingsFile{}, watchedFiles[filename]...)
+	watchedFilesLocker.Unlock()
+
+	for _, file := range files {
+		if err := file.checkForChanges(true); err != nil {
+			logger.Warn("Unable to check %s for changes: %s\n", filename, err.Error())
+		}
+	}
+}
+
+// Watch registers handler to be called whenever the value at path
+// changes, whether through this package or by an external edit of the
+// file, which is detected by polling. An empty path watches the whole
+// file. The returned function unregisters the handler.
+func (file *SettingsFile) Watch(path []string, handler func(old, new any)) (cancel func()) {
+	state := &file.watch
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.snapshot == nil {
+		if err := state.load(file); err != nil {
+			logger.Warn("Unable to read %s to watch it: %s\n", file.filename, err.Error())
+		}
+	}
+	if state.watchers == nil {
+		state.watchers = map[int]*settingsWatcher{}
+	}
+	id := state.nextID
+	state.nextID++
+	state.watchers[id] = &settingsWatcher{
+		path:    append([]string{}, path...),
+		handler: handler,
+	}
+	if state.stop == nil {
+		file.startPolling()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			state.mutex.Lock()
+			defer state.mutex.Unlock()
+			delete(state.watchers, id)
+			if len(state.watchers) == 0 {
+				file.stopPolling()
+			}
+		})
+	}
+}
+
+// CheckForChanges compares the settings file with the last state the
+// watchers saw and calls the handlers of every watched path that
+// changed. It is called periodically while the file is watched, and
+// after every write made through this package.
+func (file *SettingsFile) CheckForChanges() error {
+	return file.checkForChanges(true)
+}
+
+// checkForChanges implements CheckForChanges. Unless force is set the
+// file is only read if its modification time or size changed.
+func (file *SettingsFile) checkForChanges(force bool) error {
+	state := &file.watch
+	state.mutex.Lock()
+	if len(state.watchers) == 0 {
+		state.mutex.Unlock()
+		return nil
+	}
+	oldSnapshot := state.snapshot
+	changed, err := state.refresh(file, force)
+	if err != nil || !changed {
+		state.mutex.Unlock()
+		return err
+	}
+
+	type notification struct {
+		handler  WatchHandler
+		old, new any
+	}
+	notifications := []notification{}
+	for _, watcher := range state.watchers {
+		oldValue := valueAtPath(oldSnapshot, watcher.path)
+		newValue := valueAtPath(state.snapshot, watcher.path)
+		if valuesDiffer(oldValue, newValue) {
+			notifications = append(notifications, notification{watcher.handler, oldValue, newValue})
+		}
+	}
+	state.mutex.Unlock()
+
+	// handlers are called without the lock, they may well write the
+	// settings themselves.
+	for _, n := range notifications {
+		n.handler(n.old, n.new)
+	}
+	return nil
+}
+
+// load reads the settings file into the snapshot. The state mutex must
+// be held.
+func (state *settingsWatchState) load(file *SettingsFile) error {
+	_, err := state.refresh(file, true)
+	return err
+}
+
+// refresh re-reads the settings file if it may have changed, or always
+// if force is set, and returns true if its contents changed since the
+// last snapshot. The state mutex must be held.
+func (state *settingsWatchState) refresh(file *SettingsFile, force bool) (bool, error) {
+	file.mutex.RLock()
+	defer file.mutex.RUnlock()
+
+	info, err := os.Stat(file.filename)
+	if err != nil {
+		return false, err
+	}
+	if !force && state.snapshot != nil && info.ModTime().Equal(state.modTime) && info.Size() == state.size {
+		return false, nil
+	}
+	raw, err := readSettingsBytes(file.filename)
+	if err != nil {
+		return false, err
+	}
+	state.modTime = info.ModTime()
+	state.size = info.Size()
+	version := settingsVersion(raw)
+	if state.snapshot != nil && version == state.version {
+		return false, nil
+	}
+
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		// most likely caught in the middle of a write, the next
+		// check will pick it up.
+		return false, err
+	}
+	// the handlers see the secrets as the settings readers do.
+	if snapshot, err = file.readerSecrets(snapshot); err != nil {
+		return false, err
+	}
+	if snapshot == nil {
+		snapshot = map[string]interface{}{}
+	}
+	state.snapshot = snapshot
+	state.version = version
+	return true, nil
+}
+
+// startPolling starts the goroutine checking the file for external
+// changes. The state mutex must be held.
+func (file *SettingsFile) startPolling() {
+	state := &file.watch
+	interval := state.interval
+	if interval <= 0 {
+		interval = DefaultWatchPollInterval
+	}
+	state.stop = make(chan struct{})
+
+	watchedFilesLocker.Lock()
+	watchedFiles[file.filename] = append(watchedFiles[file.filename], file)
+	watchedFilesLocker.Unlock()
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := file.checkForChanges(false); err != nil {
+					logger.Debug("Unable to check %s for changes: %s\n", file.filename, err.Error())
+				}
+			}
+		}
+	}(state.stop)
+}
+
+// stopPolling stops the polling goroutine. It does not wait for it, as
+// it may be called from a handler running on that goroutine. The state
+// mutex must be held, so a concurrent Watch can't start polling again
+// before the goroutine is told to stop.
+func (file *SettingsFile) stopPolling() {
+	state := &file.watch
+	if state.stop == nil {
+		return
+	}
+	close(state.stop)
+	state.stop = nil
+	state.snapshot = nil
+
+	watchedFilesLocker.Lock()
+	defer watchedFilesLocker.Unlock()
+	files := watchedFiles[file.filename]
+	for i, f := range files {
+		if f == file {
+			files = append(files[:i], files[i+1:]...)
+			break
+		}
+	}
+	if len(files) == 0 {
+		delete(watchedFiles, file.filename)
+	} else {
+		watchedFiles[file.filename] = files
+	}
+}
+
+// valueAtPath returns the value at path in settings, or nil if there
+// is none.
+func valueAtPath(settings map[string]interface{}, path []string) any {
+	if settings == nil {
+		return nil
+	}
+	value, err := getSettingsFromJSON(settings, path)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// valuesDiffer returns true if the two JSON values are different.
+func valuesDiffer(old, new any) bool {
+	changes, err := diff.Diff(old, new)
+	if err != nil {
+		// diff can't compare values of different types.
+		return !reflect.DeepEqual(old, new)
+	}
+	return len(changes) > 0
+}
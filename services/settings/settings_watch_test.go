@@ -0,0 +1,129 @@
+package settings
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/untangle/golang-shared/testing/util/settingsutil"
+)
+
+// watchRecorder records the calls of a WatchHandler.
+type watchRecorder struct {
+	mutex sync.Mutex
+	calls [][2]any
+}
+
+func (r *watchRecorder) handler(old, new any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = append(r.calls, [2]any{old, new})
+}
+
+func (r *watchRecorder) get() [][2]any {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([][2]any{}, r.calls...)
+}
+
+func TestWatchLibraryChanges(t *testing.T) {
+	fakeSyncSettings(t, nil)
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithWatchPollInterval(time.Hour))
+
+	foo := &watchRecorder{}
+	bar := &watchRecorder{}
+	missing := &watchRecorder{}
+	cancelFoo := sf.Watch([]string{"a", "b", "foo"}, foo.handler)
+	defer sf.Watch([]string{"a", "b", "bar"}, bar.handler)()
+	defer sf.Watch([]string{"c"}, missing.handler)()
+
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "foo"}, "bye"))
+	assert.Equal(t, [][2]any{{"hello", "bye"}}, foo.get())
+	assert.Empty(t, bar.get())
+
+	// writes through the package level functions are seen too.
+	_, err := SetSettingsFile([]string{"c"}, map[string]interface{}{"d": 1}, tempfile, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, [][2]any{{nil, map[string]interface{}{"d": float64(1)}}}, missing.get())
+
+	_, err = TrimSettingsFile([]string{"a", "b", "bar"}, tempfile)
+	require.NoError(t, err)
+	assert.Equal(t, [][2]any{{float64(1), nil}}, bar.get())
+
+	// an unchanged value does not notify.
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "foo"}, "bye"))
+	assert.Len(t, foo.get(), 1)
+
+	cancelFoo()
+	cancelFoo()
+	require.NoError(t, sf.SetSettingsNoSync([]string{"a", "b", "foo"}, "again"))
+	assert.Len(t, foo.get(), 1)
+}
+
+func TestWatchExternalChanges(t *testing.T) {
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithWatchPollInterval(10*time.Millisecond))
+
+	whole := &watchRecorder{}
+	defer sf.Watch(nil, whole.handler)()
+
+	require.NoError(t, os.WriteFile(tempfile, []byte(`{"a": {"b": {"foo": "edited", "bar": 1}}}`), 0666))
+	assert.Eventually(t, func() bool { return len(whole.get()) == 1 }, time.Second, 10*time.Millisecond)
+
+	calls := whole.get()
+	assert.Equal(t,
+		map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"foo": "edited", "bar": float64(1)}}},
+		calls[0][1])
+}
+
+func TestWatchCancelRace(t *testing.T) {
+	tempfile, cleanup := settingsutil.CopySettingsToTemp(t, "testdata/settings.json")
+	defer cleanup()
+	sf := NewSettingsFile(tempfile, WithWatchPollInterval(time.Hour))
+	baseline := runtime.NumGoroutine()
+
+	// cancelling the last watcher while another registers must never
+	// leave a polling goroutine without a way to stop it. The window is
+	// narrow, so this is a stress test best run with -race.
+	for i := 0; i < 500; i++ {
+		cancel := sf.Watch(nil, func(old, new any) {})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var next func()
+		start := make(chan struct{})
+		go func() {
+			defer wg.Done()
+			<-start
+			cancel()
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			next = sf.Watch(nil, func(old, new any) {})
+		}()
+		close(start)
+		wg.Wait()
+		next()
+	}
+
+	sf.watch.mutex.Lock()
+	assert.Nil(t, sf.watch.stop)
+	sf.watch.mutex.Unlock()
+	watchedFilesLocker.Lock()
+	assert.Empty(t, watchedFiles[tempfile])
+	watchedFilesLocker.Unlock()
+	// not assert.Eventually, which runs the condition on a goroutine
+	// of its own.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline)
+}
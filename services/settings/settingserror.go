@@ -3,7 +3,6 @@ package settings
 import (
 	"encoding/json"
 	"errors"
-	"strconv"
 	"strings"
 
 	"github.com/r3labs/diff/v2"
@@ -18,19 +17,24 @@ the policy = parent
 rule = child
 interface can be parent to policy
 
+The parents/children of the changed items are found in the DependencyGraph of the settings (see settings_graph.go),
+the invalid items reported by sync-settings are added to them.
+
 Steps of execution :
 1. Sync-settings returns an error with the CONFIRM object as a string in it.
 2. We determine the current settings.
 3. We determine the changeset between the current settings the newly created settings that failed.
 4. From the changeset we put each change into an enabled, deleted, or disabled array.
-5. For each of the three arrays:
+5. We build the dependency graphs of the current and the newly created settings.
+6. For each of the three arrays:
 	1. For each change in the array:
-		1. find the affected item given the change. If enabling a rule, the affected item would be the rule.
-		2. Based on the affected item id, collect the parents/children invalid items based on the type of change from the sync-settings error
-			enable          = build based on parents
-			disable/deleted = build based on children
-	2. From all invalid items for change, put into a UI message
-6. Put all three arrays UI messages into one message and send to UI
+		1. find the changed items given the change. If enabling a rule, the changed item would be the rule.
+		2. Based on the changed item, collect the affected items from the graphs based on the type of change
+			enable          = disabled items it depends on
+			disable/deleted = enabled items depending on it
+		3. Add the parents/children invalid items from the sync-settings error that were not found
+	2. From all affected items for change, put into a UI message
+7. Put all three arrays UI messages into one message and send to UI
 */
 
 // SetSettingsError represents the top structure from sync-settings with CONFIRM
@@ -77,7 +81,8 @@ func determineSetSettingsError(origErr error, output string, settingsFile string
 	var err error = nil
 
 	// get old settings to compare with new settings to determine changes
-	jsonSettingsOld, oldSettingsErr := readSettingsFileJSON(settingsFile)
+	// with the secrets in plaintext, as in jsonSettings
+	jsonSettingsOld, oldSettingsErr := readSettingsFileJSONSecrets(settingsFile, true)
 	if oldSettingsErr == nil {
 		// build messages for delete, disable, and enable
 		errorMessage, buildMessageErr := buildMessage(jsonSettingsOld, jsonSettings, origErr)
@@ -112,36 +117,43 @@ func buildMessage(jsonSettingsOld map[string]interface{}, jsonSettings map[strin
 		return "", changeSetErr
 	}
 
-	// create the SetSettingsError golang struct from original error for easier handling
+	// create the SetSettingsError golang struct from original error for easier handling,
+	// the items it reports complete the ones found in the dependency graphs
 	settingsError, settingsErrorStructErr := getSettingsErrorStruct(origErr)
 	if settingsErrorStructErr != nil {
 		return "", settingsErrorStructErr
 	}
 
+	// build the dependency graphs of the old and new settings
+	oldGraph := NewDependencyGraph(jsonSettingsOld)
+	newGraph := NewDependencyGraph(jsonSettings)
+
 	// create array of SetSettingsErrorUI and process deleted, disabled, and enabled changes
 	messages := make([]SetSettingsErrorUI, 0)
-	if len(deletedChanges) > 0 {
-		deleteMessage, deleteMsgErr := determineMessage(settingsError, "deleted", "child", deletedChanges, jsonSettingsOld)
-		if deleteMsgErr != nil {
-			return "", deleteMsgErr
-		}
-		messages = append(messages, deleteMessage)
+	hasChanges := false
+	changeSets := []struct {
+		invalidReason string
+		changes       []diff.Change
+	}{
+		{"deleted", deletedChanges},
+		{"disabled", disableChanges},
+		{"enabled", enableChanges},
 	}
-
-	if len(disableChanges) > 0 {
-		disableMessage, disableMsgErr := determineMessage(settingsError, "disabled", "child", disableChanges, jsonSettingsOld)
-		if disableMsgErr != nil {
-			return "", disableMsgErr
+	for _, changeSet := range changeSets {
+		if len(changeSet.changes) == 0 {
+			continue
+		}
+		hasChanges = true
+		message := determineMessage(settingsError, changeSet.invalidReason, changeSet.changes, oldGraph, newGraph)
+		if len(message.AffectedValues) > 0 {
+			messages = append(messages, message)
 		}
-		messages = append(messages, disableMessage)
 	}
 
-	if len(enableChanges) > 0 {
-		enableMessage, enableMsgErr := determineMessage(settingsError, "enabled", "parent", enableChanges, jsonSettingsOld)
-		if enableMsgErr != nil {
-			return "", enableMsgErr
-		}
-		messages = append(messages, enableMessage)
+	// if no values found, sync-settings did not error because of something in these changes, which is wrong
+	if hasChanges && len(messages) == 0 {
+		logger.Warn("No valid affected values found, erroring\n")
+		return "", errors.New("No affected values found")
 	}
 
 	// convert structs into string to send to UI
@@ -151,7 +163,7 @@ func buildMessage(jsonSettingsOld map[string]interface{}, jsonSettings map[strin
 		return "", bytesErr
 	}
 
-	return "CONFIRM: " + string(bytes), nil
+	return confirmPrefix + string(bytes), nil
 }
 
 // determineChangeSet determines changes that occured from new/old so we can show relevant information for each change
@@ -228,113 +240,162 @@ func getSettingsErrorStruct(origErr error) (*SetSettingsError, error) {
 }
 
 // determineMessage determines the message for a single change set found - enable/disable/deleted changes
-// @param settingsError *SetSettingsError - struct of respones from sync-settings
+// @param settingsError *SetSettingsError - struct of respones from sync-settings, nil if there is none
 // @param invalidReason string - why sync-settings returned an error, could be enabled, deleted, or disabled
-// @param buildFrom string - how to build the message. Build based on parents of items (for enabled changes) or child (for deleted/disabled)
 // @param changes []diff.Change - array of changes to build message for
-// @param jsonSettingsOld map[string]interface{} - current settings on system to get current values from
+// @param oldGraph *DependencyGraph - dependency graph of the current settings on system
+// @param newGraph *DependencyGraph - dependency graph of the newly created settings that failed to save
 // @return SetSettingsErrorUI - UI message for the changes
-// @return error - error from determining message, nil if none
-func determineMessage(settingsError *SetSettingsError, invalidReason string, buildFrom string, changes []diff.Change, jsonSettingsOld map[string]interface{}) (SetSettingsErrorUI, error) {
+func determineMessage(settingsError *SetSettingsError, invalidReason string, changes []diff.Change, oldGraph *DependencyGraph, newGraph *DependencyGraph) SetSettingsErrorUI {
 	// create SetSettingsErrorUI and set the translation string
 	newErr := SetSettingsErrorUI{}
 	newErr.MainTranslationString = "affected_item_disabled_or_deleted"
+	buildFrom := "child"
 	if invalidReason == "enabled" {
 		newErr.MainTranslationString = "affected_item_on_enable"
+		buildFrom = "parent"
 	}
 	newErr.InvalidReason = invalidReason
 	newErr.AffectedValues = make([]AffectedValue, 0)
 
+	// the changed items are not affected items, and each affected item is listed once
+	changedItems := make([]SettingsItem, 0)
+	listed := map[ItemRef]bool{}
 	for _, change := range changes {
-		// goal from getAffectedItemId is to get the item object's id, like a policy or a rule
-		pathForAffectedItem := change.Path // use path for deletes only
-		// use all except last item for disable/enable
-		if invalidReason == "disabled" || invalidReason == "enabled" {
-			pathForAffectedItem = pathForAffectedItem[:len(pathForAffectedItem)-1]
+		for _, item := range getChangedItems(invalidReason, change, oldGraph, newGraph) {
+			changedItems = append(changedItems, item)
+			listed[item.ItemRef] = true
 		}
-		affectedItemID, err := getAffectedItemID(jsonSettingsOld, pathForAffectedItem)
-		if err != nil {
-			return newErr, errors.New("Could not find affected item id")
+	}
+
+	for _, item := range changedItems {
+		for _, affected := range getAffectedItems(invalidReason, item, oldGraph, newGraph) {
+			if listed[affected.ItemRef] {
+				continue
+			}
+			listed[affected.ItemRef] = true
+			newErr.AffectedValues = append(newErr.AffectedValues, AffectedValue{
+				AffectedType:  string(affected.Kind),
+				AffectedValue: affected.Name,
+			})
 		}
 
-		// for each change build a message
-		messages, buildErr := buildIndividualMessage(affectedItemID, invalidReason, buildFrom, settingsError)
-		if buildErr != nil {
-			logger.Warn("Failed to create whole individual message: %s\n", buildErr.Error())
-			return newErr, buildErr
+		// add what sync-settings reported and the graphs did not find
+		if settingsError == nil {
+			continue
+		}
+		ids, err := getInvalidItemIds(item.ID, buildFrom, settingsError)
+		if err != nil {
+			logger.Warn("Failed to read the invalid items of %s: %s\n", item.ItemRef, err.Error())
+		}
+		for _, id := range ids {
+			invalidItem := settingsError.Confirm.InvalidItems[id]
+			ref := ItemRef{Kind: ItemKind(invalidItem.Type), ID: id}
+			if listed[ref] {
+				continue
+			}
+			listed[ref] = true
+			newErr.AffectedValues = append(newErr.AffectedValues, AffectedValue{
+				AffectedType:  invalidItem.Type,
+				AffectedValue: invalidItem.Value,
+			})
 		}
-		newErr.AffectedValues = append(newErr.AffectedValues, messages...)
 	}
 
-	// if no values found, sync-settings did not error because of something in this change, which is wrong
-	if len(newErr.AffectedValues) == 0 {
-		logger.Warn("No valid affected values found, erroring\n")
-		return newErr, errors.New("No affected values found")
+	return newErr
+}
+
+// getChangedItems gets the items of a change, like a policy or a rule
+// @param invalidReason string - what the change is doing, could be enabled, deleted, or disabled
+// @param change diff.Change - the change
+// @param oldGraph *DependencyGraph - dependency graph of the current settings on system
+// @param newGraph *DependencyGraph - dependency graph of the newly created settings that failed to save
+// @return []SettingsItem - the changed items, empty if the change is not about a whole item
+func getChangedItems(invalidReason string, change diff.Change, oldGraph *DependencyGraph, newGraph *DependencyGraph) []SettingsItem {
+	// deletes remove every item under their path
+	if invalidReason == "deleted" {
+		return oldGraph.ItemsUnder(change.Path)
 	}
 
-	return newErr, nil
+	// use all except last item for disable/enable
+	if len(change.Path) < 2 {
+		return []SettingsItem{}
+	}
+	item, found := newGraph.ItemAt(change.Path[:len(change.Path)-1])
+	if !found {
+		logger.Debug("No settings item changed at %s\n", strings.Join(change.Path, "/"))
+		return []SettingsItem{}
+	}
+	return []SettingsItem{item}
 }
 
-// getAffectedItemId gets the item object Id, like a policyId or a ruleId
-// @param jsonSettingsOld map[string]interface{} - current settings on system to get current values from
-// @param path []string - path of settings to get from
-// @return string - id of the affected item
-// @return error - error from getting item, nil if none
-func getAffectedItemID(jsonSettingsOld map[string]interface{}, path []string) (string, error) {
-	valueRaw, err := getSettingsFromJSON(jsonSettingsOld, path)
-	if err != nil {
-		logger.Warn("Failed to get settings items\n")
-		return "", errors.New("Failed to get affected item")
+// getAffectedItems gets the items affected by the change of item
+// enabled          = disabled items the item depends on
+// disabled/deleted = enabled items depending on the item, that are not deleted
+// @param invalidReason string - what the change is doing, could be enabled, deleted, or disabled
+// @param item SettingsItem - the changed item
+// @param oldGraph *DependencyGraph - dependency graph of the current settings on system
+// @param newGraph *DependencyGraph - dependency graph of the newly created settings that failed to save
+// @return []SettingsItem - the affected items, as found in newGraph
+func getAffectedItems(invalidReason string, item SettingsItem, oldGraph *DependencyGraph, newGraph *DependencyGraph) []SettingsItem {
+	affected := make([]SettingsItem, 0)
+	if invalidReason == "enabled" {
+		for _, dependency := range newGraph.AllDependsOn(item.ItemRef) {
+			if !dependency.Enabled {
+				affected = append(affected, dependency)
+			}
+		}
+		return affected
 	}
 
-	value, ok := valueRaw.(map[string]interface{})
-	if !ok {
-		logger.Warn("Failed to get rule as could not convert to right type\n")
-		return "", errors.New("Failed to get affected item")
+	graph := newGraph
+	if invalidReason == "deleted" {
+		graph = oldGraph
 	}
-
-	return determineID(path, value)
+	for _, dependent := range graph.AllDependents(item.ItemRef) {
+		current, found := newGraph.Item(dependent.ItemRef)
+		if found && current.Enabled {
+			affected = append(affected, current)
+		}
+	}
+	return affected
 }
 
-// buildIndividualMessage builds the message's affected values from a single change i.e. disabling interface would return enabled policies/rules
+// getInvalidItemIds gets the ids of the invalid items reported by sync-settings for a single change, following
+// the children/parents of each invalid item found
 // @param id string - id of object of the change
-// @param invalidReason string - what the change is attempting to do, like enable/delete/disabled
 // @param buildFrom string - how to build the message. Build based on parents of items (for enabled changes) or child (for deleted/disabled)
 // @param settingsError *SetSettingsError - settings error struct from sync settings
-func buildIndividualMessage(id string, invalidReason string, buildFrom string, settingsError *SetSettingsError) ([]AffectedValue, error) {
-	affectedValues := make([]AffectedValue, 0)
-
-	// determine the nextId to use, the child/parent
-	nextIds := determineNextIds(settingsError.Confirm.InvalidItems, id, buildFrom)
-
-	for _, nextId := range nextIds {
-		if len(nextId) <= 0 {
-			continue
-		}
-
-		// get the child/parent to add next to affectedValues
-		invalidItemToAdd, found := settingsError.Confirm.InvalidItems[nextId]
-		if !found {
-			logger.Warn("Could not find invalid id: %s\n", nextId)
-			return affectedValues, errors.New("Could not find invalid item id")
-		}
-
-		affectedValue := AffectedValue{
-			AffectedType:  invalidItemToAdd.Type,
-			AffectedValue: invalidItemToAdd.Value,
-		}
-		affectedValues = append(affectedValues, affectedValue)
+// @return []string - ids of the invalid items found, each once
+// @return error - error if an invalid item refers to an id sync-settings did not report, nil if none
+func getInvalidItemIds(id string, buildFrom string, settingsError *SetSettingsError) ([]string, error) {
+	ids := make([]string, 0)
+	seen := map[string]bool{id: true}
+
+	var collect func(currentId string) error
+	collect = func(currentId string) error {
+		// determine the nextId to use, the child/parent
+		for _, nextId := range determineNextIds(settingsError.Confirm.InvalidItems, currentId, buildFrom) {
+			if len(nextId) <= 0 || seen[nextId] {
+				continue
+			}
+			if _, found := settingsError.Confirm.InvalidItems[nextId]; !found {
+				logger.Warn("Could not find invalid id: %s\n", nextId)
+				return errors.New("Could not find invalid item id")
+			}
+			seen[nextId] = true
+			ids = append(ids, nextId)
 
-		// looks for children/parents of the newly added affected value and adds them
-		moreValues, buildErr := buildIndividualMessage(nextId, invalidReason, buildFrom, settingsError)
-		if buildErr != nil {
-			logger.Warn("Failed to create whole individual message: %s\n", buildErr.Error())
-			return affectedValues, buildErr
+			// looks for children/parents of the newly added id and adds them
+			if err := collect(nextId); err != nil {
+				return err
+			}
 		}
-		affectedValues = append(affectedValues, moreValues...)
+		return nil
 	}
 
-	return affectedValues, nil
+	err := collect(id)
+	return ids, err
 }
 
 // determineNextIds determines the next ids to look at, whether the childIds or parentId
@@ -372,43 +433,3 @@ func determineNextIds(allInvalidItems map[string]InvalidItem, currentId string,
 	logger.Warn("determineNextIds called with unknown buildFrom: %s\n", buildFrom)
 	return []string{}
 }
-
-// determineID determines the id of a given affectedItem
-// @param path []string - path of change to look at, determines what type of object we're changing
-// @param value map[string]interface{} - object of affectedItem
-// @return string - id of affected item
-// @return error - any error, nil if none
-func determineID(path []string, value map[string]interface{}) (string, error) {
-	var rawID interface{}
-	var found bool = false
-	if path[0] == "wan" && path[1] == "policy_chains" && path[3] == "rules" { // rules
-		rawID, found = value["ruleId"]
-	} else if path[0] == "wan" && path[1] == "policies" { // policies
-		rawID, found = value["policyId"]
-	} else if path[0] == "network" && path[1] == "interfaces" { // interfaces
-		rawID, found = value["interfaceId"]
-	} else if path[0] == "firewall" && path[1] == "tables" { // Firewall Rules and tables
-		rawID, found = value["ruleId"]
-	} else if path[0] == "application_control" || path[0] == "geoip" { // services
-		rawID, found = path[0], true
-	}
-
-	if !found {
-		logger.Warn("Failed to find given changed id: %v\n", rawID)
-		return "", errors.New("Failed to find changed id")
-	}
-
-	// string for policies/rules
-	id, ok := rawID.(string)
-	if !ok {
-		// float64 for interfaces
-		idFloat, ok := rawID.(float64)
-		if !ok {
-			logger.Warn("Failed to get id\n")
-			return "", errors.New("Failed to get id")
-		}
-		id = strconv.FormatFloat(idFloat, 'f', -1, 64)
-	}
-
-	return id, nil
-}
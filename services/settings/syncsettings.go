@@ -67,22 +67,63 @@ func (s *SyncSettings) CreateDefaults() error {
 }
 
 // NormalSync runs sync settings with OS and filename specified
+// The keys with an in-process SyncHandler are applied by it first, as
+// sync-settings no longer applies them. They are rolled back to the
+// settings they last applied if sync-settings fails.
 func (s *SyncSettings) NormalSync() error {
+	settings, err := readSettingsFileJSONSecrets(s.SettingsFile, true)
+	if err != nil {
+		logger.Warn("Error reading settings to sync: %s\n", err.Error())
+		return err
+	}
+	plan, err := syncHandlers.planFull(syncHandlers.appliedSettings(s.SettingsFile), settings)
+	if err != nil {
+		return err
+	}
+	if err := plan.validate(); err != nil {
+		return err
+	}
+	applied, err := plan.apply()
+	if err != nil {
+		plan.rollback(applied)
+		return err
+	}
+
 	cmdArgs := []string{"-o", s.OS, "-f", s.SettingsFile}
-	err := s.runSyncSettings(cmdArgs)
+	err = s.runSyncSettings(cmdArgs)
 	if err != nil {
 		logger.Warn("Error running sync-settings: %s\n", err.Error())
+		plan.rollback(applied)
 		return err
 	}
+	syncHandlers.recordApplied(s.SettingsFile, plan)
 	return nil
 }
 
 // SimulateSync will run sync-settings with simulation flag on the given filePath
 // This will not write any files out or restart any services
 // but will get the return result as if the file was run properly
+// Keys with an in-process SyncHandler are only validated by it, and
+// sync-settings is not run if no other keys changed.
 func (s *SyncSettings) SimulateSync(filePath string) error {
+	newSettings, err := readSettingsFileJSONSecrets(filePath, true)
+	if err != nil {
+		logger.Warn("Error reading settings to simulate: %s\n", err.Error())
+		return err
+	}
+	plan, err := syncHandlers.plan(readCurrentSettingsForSync(s.SettingsFile, settingsSecrets), newSettings)
+	if err != nil {
+		return err
+	}
+	if err := plan.validate(); err != nil {
+		return err
+	}
+	if !plan.external {
+		return nil
+	}
+
 	cmdArgs := []string{"-o", s.OS, "-s", "-f", filePath}
-	err := s.runSyncSettings(cmdArgs)
+	err = s.runSyncSettings(cmdArgs)
 	if err != nil {
 		logger.Warn("Error running sync-settings with simulate flag : %s\n", err.Error())
 		return err
@@ -0,0 +1,346 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.33.0
+// 	protoc        v4.24.4
+// source: DiscoverySnapshot.proto
+
+package Discoverd
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// DevicesSnapshot is the container of a snapshot of the known devices
+// written to disk. version is incremented on incompatible changes.
+type DevicesSnapshot struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version uint32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	// createdAt is the time the snapshot was taken, in unix nanoseconds.
+	CreatedAt int64             `protobuf:"varint,2,opt,name=createdAt,proto3" json:"createdAt,omitempty"`
+	Devices   []*DeviceSnapshot `protobuf:"bytes,3,rep,name=devices,proto3" json:"devices,omitempty"`
+}
+
+func (x *DevicesSnapshot) Reset() {
+	*x = DevicesSnapshot{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_DiscoverySnapshot_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DevicesSnapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DevicesSnapshot) ProtoMessage() {}
+
+func (x *DevicesSnapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_DiscoverySnapshot_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DevicesSnapshot.ProtoReflect.Descriptor instead.
+func (*DevicesSnapshot) Descriptor() ([]byte, []int) {
+	return file_DiscoverySnapshot_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *DevicesSnapshot) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *DevicesSnapshot) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+func (x *DevicesSnapshot) GetDevices() []*DeviceSnapshot {
+	if x != nil {
+		return x.Devices
+	}
+	return nil
+}
+
+// DeviceSnapshot is a device with its data use.
+type DeviceSnapshot struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Entry   *DiscoveryEntry    `protobuf:"bytes,1,opt,name=entry,proto3" json:"entry,omitempty"`
+	DataUse []*DataUseInterval `protobuf:"bytes,2,rep,name=dataUse,proto3" json:"dataUse,omitempty"`
+}
+
+func (x *DeviceSnapshot) Reset() {
+	*x = DeviceSnapshot{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_DiscoverySnapshot_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeviceSnapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeviceSnapshot) ProtoMessage() {}
+
+func (x *DeviceSnapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_DiscoverySnapshot_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeviceSnapshot.ProtoReflect.Descriptor instead.
+func (*DeviceSnapshot) Descriptor() ([]byte, []int) {
+	return file_DiscoverySnapshot_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DeviceSnapshot) GetEntry() *DiscoveryEntry {
+	if x != nil {
+		return x.Entry
+	}
+	return nil
+}
+
+func (x *DeviceSnapshot) GetDataUse() []*DataUseInterval {
+	if x != nil {
+		return x.DataUse
+	}
+	return nil
+}
+
+// DataUseInterval is an interval of data use of a device, with times in
+// unix nanoseconds.
+type DataUseInterval struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Start   int64  `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	End     int64  `protobuf:"varint,2,opt,name=end,proto3" json:"end,omitempty"`
+	RxBytes uint64 `protobuf:"varint,3,opt,name=rxBytes,proto3" json:"rxBytes,omitempty"`
+	TxBytes uint64 `protobuf:"varint,4,opt,name=txBytes,proto3" json:"txBytes,omitempty"`
+}
+
+func (x *DataUseInterval) Reset() {
+	*x = DataUseInterval{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_DiscoverySnapshot_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DataUseInterval) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DataUseInterval) ProtoMessage() {}
+
+func (x *DataUseInterval) ProtoReflect() protoreflect.Message {
+	mi := &file_DiscoverySnapshot_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DataUseInterval.ProtoReflect.Descriptor instead.
+func (*DataUseInterval) Descriptor() ([]byte, []int) {
+	return file_DiscoverySnapshot_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DataUseInterval) GetStart() int64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *DataUseInterval) GetEnd() int64 {
+	if x != nil {
+		return x.End
+	}
+	return 0
+}
+
+func (x *DataUseInterval) GetRxBytes() uint64 {
+	if x != nil {
+		return x.RxBytes
+	}
+	return 0
+}
+
+func (x *DataUseInterval) GetTxBytes() uint64 {
+	if x != nil {
+		return x.TxBytes
+	}
+	return 0
+}
+
+var File_DiscoverySnapshot_proto protoreflect.FileDescriptor
+
+var file_DiscoverySnapshot_proto_rawDesc = []byte{
+	0x0a, 0x17, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x79, 0x53, 0x6e, 0x61, 0x70, 0x73,
+	0x68, 0x6f, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x09, 0x64, 0x69, 0x73, 0x63, 0x6f,
+	0x76, 0x65, 0x72, 0x64, 0x1a, 0x0f, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x79, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x7e, 0x0a, 0x0f, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x73,
+	0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x09, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74,
+	0x12, 0x33, 0x0a, 0x07, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x19, 0x2e, 0x64, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x64, 0x2e, 0x44, 0x65,
+	0x76, 0x69, 0x63, 0x65, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x52, 0x07, 0x64, 0x65,
+	0x76, 0x69, 0x63, 0x65, 0x73, 0x22, 0x77, 0x0a, 0x0e, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x53,
+	0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x12, 0x2f, 0x0a, 0x05, 0x65, 0x6e, 0x74, 0x72, 0x79,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x64, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65,
+	0x72, 0x64, 0x2e, 0x44, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x79, 0x45, 0x6e, 0x74, 0x72,
+	0x79, 0x52, 0x05, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x34, 0x0a, 0x07, 0x64, 0x61, 0x74, 0x61,
+	0x55, 0x73, 0x65, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x64, 0x69, 0x73, 0x63,
+	0x6f, 0x76, 0x65, 0x72, 0x64, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x55, 0x73, 0x65, 0x49, 0x6e, 0x74,
+	0x65, 0x72, 0x76, 0x61, 0x6c, 0x52, 0x07, 0x64, 0x61, 0x74, 0x61, 0x55, 0x73, 0x65, 0x22, 0x6d,
+	0x0a, 0x0f, 0x44, 0x61, 0x74, 0x61, 0x55, 0x73, 0x65, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61,
+	0x6c, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x65, 0x6e, 0x64, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x03, 0x65, 0x6e, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x78, 0x42,
+	0x79, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x72, 0x78, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x74, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x74, 0x78, 0x42, 0x79, 0x74, 0x65, 0x73, 0x42, 0x45, 0x5a,
+	0x43, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x75, 0x6e, 0x74, 0x61,
+	0x6e, 0x67, 0x6c, 0x65, 0x2f, 0x67, 0x6f, 0x6c, 0x61, 0x6e, 0x67, 0x2d, 0x73, 0x68, 0x61, 0x72,
+	0x65, 0x64, 0x2f, 0x73, 0x74, 0x72, 0x75, 0x63, 0x74, 0x73, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x63, 0x6f, 0x6c, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x73, 0x2f, 0x44, 0x69, 0x73, 0x63, 0x6f,
+	0x76, 0x65, 0x72, 0x64, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_DiscoverySnapshot_proto_rawDescOnce sync.Once
+	file_DiscoverySnapshot_proto_rawDescData = file_DiscoverySnapshot_proto_rawDesc
+)
+
+func file_DiscoverySnapshot_proto_rawDescGZIP() []byte {
+	file_DiscoverySnapshot_proto_rawDescOnce.Do(func() {
+		file_DiscoverySnapshot_proto_rawDescData = protoimpl.X.CompressGZIP(file_DiscoverySnapshot_proto_rawDescData)
+	})
+	return file_DiscoverySnapshot_proto_rawDescData
+}
+
+var file_DiscoverySnapshot_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_DiscoverySnapshot_proto_goTypes = []interface{}{
+	(*DevicesSnapshot)(nil), // 0: discoverd.DevicesSnapshot
+	(*DeviceSnapshot)(nil),  // 1: discoverd.DeviceSnapshot
+	(*DataUseInterval)(nil), // 2: discoverd.DataUseInterval
+	(*DiscoveryEntry)(nil),  // 3: discoverd.DiscoveryEntry
+}
+var file_DiscoverySnapshot_proto_depIdxs = []int32{
+	1, // 0: discoverd.DevicesSnapshot.devices:type_name -> discoverd.DeviceSnapshot
+	3, // 1: discoverd.DeviceSnapshot.entry:type_name -> discoverd.DiscoveryEntry
+	2, // 2: discoverd.DeviceSnapshot.dataUse:type_name -> discoverd.DataUseInterval
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_DiscoverySnapshot_proto_init() }
+func file_DiscoverySnapshot_proto_init() {
+	if File_DiscoverySnapshot_proto != nil {
+		return
+	}
+	file_Discovery_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_DiscoverySnapshot_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DevicesSnapshot); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_DiscoverySnapshot_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeviceSnapshot); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_DiscoverySnapshot_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DataUseInterval); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_DiscoverySnapshot_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_DiscoverySnapshot_proto_goTypes,
+		DependencyIndexes: file_DiscoverySnapshot_proto_depIdxs,
+		MessageInfos:      file_DiscoverySnapshot_proto_msgTypes,
+	}.Build()
+	File_DiscoverySnapshot_proto = out.File
+	file_DiscoverySnapshot_proto_rawDesc = nil
+	file_DiscoverySnapshot_proto_goTypes = nil
+	file_DiscoverySnapshot_proto_depIdxs = nil
+}
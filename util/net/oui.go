@@ -0,0 +1,197 @@
+package net
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// OUIRegistry is an IEEE registry of MAC address blocks.
+type OUIRegistry string
+
+const (
+	// RegistryMAL is the MA-L registry, of 24 bits prefixes.
+	RegistryMAL OUIRegistry = "MA-L"
+
+	// RegistryMAM is the MA-M registry, of 28 bits prefixes.
+	RegistryMAM OUIRegistry = "MA-M"
+
+	// RegistryMAS is the MA-S registry, of 36 bits prefixes.
+	RegistryMAS OUIRegistry = "MA-S"
+)
+
+// prefix lengths in hex digits of the assignments of each registry,
+// longest first.
+var ouiPrefixDigits = map[OUIRegistry]int{
+	RegistryMAS: 9,
+	RegistryMAM: 7,
+	RegistryMAL: 6,
+}
+
+var ouiLookupDigits = []int{9, 7, 6}
+
+// OUIAssignment is a MAC address block assigned to an organization.
+type OUIAssignment struct {
+	Registry OUIRegistry
+	// Prefix is the assigned prefix, in upper case hex digits.
+	Prefix       string
+	Organization string
+	Address      string
+}
+
+// Bits returns the length of the prefix in bits.
+func (assignment *OUIAssignment) Bits() int {
+	return len(assignment.Prefix) * 4
+}
+
+// OUIDatabase is a database of the IEEE MAC address assignments.
+type OUIDatabase struct {
+	// assignments by prefix, prefixes of different registries have
+	// different lengths so they never collide.
+	assignments map[string]*OUIAssignment
+}
+
+// NewOUIDatabase returns an empty OUIDatabase.
+func NewOUIDatabase() *OUIDatabase {
+	return &OUIDatabase{assignments: map[string]*OUIAssignment{}}
+}
+
+// LoadOUIDatabase returns a database of the registry CSV files at
+// filenames, as published by the IEEE for MA-L (oui.csv), MA-M
+// (mam.csv) and MA-S (oui36.csv). The registries may also be
+// concatenated in a single file.
+func LoadOUIDatabase(filenames ...string) (*OUIDatabase, error) {
+	db := NewOUIDatabase()
+	for _, filename := range filenames {
+		if err := db.loadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (db *OUIDatabase) loadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := db.Load(file); err != nil {
+		return fmt.Errorf("unable to load the OUI registry %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Load adds the assignments of a registry CSV to the database. The
+// columns are the registry, the assignment, the organization name and
+// address, header lines are skipped.
+func (db *OUIDatabase) Load(reader io.Reader) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 3 || strings.TrimSpace(record[0]) == "Registry" {
+			continue
+		}
+
+		registry := OUIRegistry(strings.TrimSpace(record[0]))
+		digits, ok := ouiPrefixDigits[registry]
+		if !ok {
+			line, _ := csvReader.FieldPos(0)
+			return fmt.Errorf("line %d: unknown registry %q", line, registry)
+		}
+		prefix := strings.ToUpper(strings.TrimSpace(record[1]))
+		if len(prefix) != digits || !isHex(prefix) {
+			line, _ := csvReader.FieldPos(1)
+			return fmt.Errorf("line %d: invalid %s assignment %q", line, registry, record[1])
+		}
+		assignment := &OUIAssignment{
+			Registry:     registry,
+			Prefix:       prefix,
+			Organization: strings.TrimSpace(record[2]),
+		}
+		if len(record) > 3 {
+			assignment.Address = strings.TrimSpace(record[3])
+		}
+		db.assignments[prefix] = assignment
+	}
+}
+
+// Len returns the number of assignments in the database.
+func (db *OUIDatabase) Len() int {
+	return len(db.assignments)
+}
+
+// Lookup returns the assignment with the longest prefix of mac, in
+// any of the formats of net.ParseMAC.
+func (db *OUIDatabase) Lookup(mac string) (*OUIAssignment, bool) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, false
+	}
+	return db.LookupHardwareAddr(hwAddr)
+}
+
+// LookupHardwareAddr returns the assignment with the longest prefix
+// of hwAddr.
+func (db *OUIDatabase) LookupHardwareAddr(hwAddr net.HardwareAddr) (*OUIAssignment, bool) {
+	digits := strings.ToUpper(fmt.Sprintf("%x", []byte(hwAddr)))
+	for _, length := range ouiLookupDigits {
+		if len(digits) < length {
+			continue
+		}
+		if assignment, ok := db.assignments[digits[:length]]; ok {
+			return assignment, true
+		}
+	}
+	return nil, false
+}
+
+// Vendor returns the organization mac is assigned to, or an empty
+// string.
+func (db *OUIDatabase) Vendor(mac string) string {
+	if assignment, ok := db.Lookup(mac); ok {
+		return assignment.Organization
+	}
+	return ""
+}
+
+// IsLocallyAdministeredMAC returns true if the U/L bit of hwAddr is
+// set, the address was not assigned by the IEEE to the manufacturer.
+func IsLocallyAdministeredMAC(hwAddr net.HardwareAddr) bool {
+	return len(hwAddr) > 0 && hwAddr[0]&0x02 != 0
+}
+
+// IsMulticastMAC returns true if the I/G bit of hwAddr is set.
+func IsMulticastMAC(hwAddr net.HardwareAddr) bool {
+	return len(hwAddr) > 0 && hwAddr[0]&0x01 != 0
+}
+
+// IsRandomizedMAC returns true if hwAddr may be randomly generated, as
+// with the private addresses of phones and laptops: any locally
+// administered unicast address. Addresses of the Extended Local
+// Identifier quadrant (x[A]:xx:xx...) are included, as the SLAP
+// quadrants are not followed by every randomizing implementation.
+func IsRandomizedMAC(hwAddr net.HardwareAddr) bool {
+	return IsLocallyAdministeredMAC(hwAddr) && !IsMulticastMAC(hwAddr)
+}
+
+func isHex(value string) bool {
+	for _, char := range value {
+		if !strings.ContainsRune("0123456789ABCDEFabcdef", char) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package net
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOUIDatabaseLookup(t *testing.T) {
+	db, err := LoadOUIDatabase("testdata/oui.csv")
+	require.NoError(t, err)
+	assert.Equal(t, 6, db.Len())
+
+	tests := []struct {
+		name         string
+		mac          string
+		found        bool
+		registry     OUIRegistry
+		organization string
+	}{
+		{"MA-L", "00:1b:63:84:45:e6", true, RegistryMAL, "Apple, Inc."},
+		{"dashes", "00-40-8C-01-02-03", true, RegistryMAL, "Axis Communications AB"},
+		{"dots", "001b.7801.0203", true, RegistryMAL, "Hewlett Packard"},
+		{"MA-S", "70:b3:d5:12:34:56", true, RegistryMAS, "Example Small Block, Ltd."},
+		{"MA-M", "70:b3:d5:1f:ff:ff", true, RegistryMAM, "Example Medium Block Inc."},
+		{"MA-L of MA-M", "70:b3:d5:20:00:00", true, RegistryMAL, "IEEE Registration Authority"},
+		{"unknown", "00:11:22:33:44:55", false, "", ""},
+		{"invalid", "not a mac", false, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assignment, found := db.Lookup(test.mac)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.organization, db.Vendor(test.mac))
+			if test.found {
+				assert.Equal(t, test.registry, assignment.Registry)
+			}
+		})
+	}
+
+	assignment, _ := db.Lookup("70:b3:d5:12:34:56")
+	assert.Equal(t, "70B3D5123", assignment.Prefix)
+	assert.Equal(t, 36, assignment.Bits())
+	assert.Equal(t, "Elsewhere GB", assignment.Address)
+}
+
+func TestLoadOUIDatabaseErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadOUIDatabase(filepath.Join(dir, "missing.csv"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	for name, content := range map[string]string{
+		"registry":   "Registry,Assignment,Organization Name,Organization Address\nCID,0A1B2C,Example,Address\n",
+		"length":     "MA-M,001B63,Example,Address\n",
+		"assignment": "MA-L,00XX63,Example,Address\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, NewOUIDatabase().Load(strings.NewReader(content)))
+		})
+	}
+
+	// several files add up.
+	filename := filepath.Join(dir, "mam.csv")
+	require.NoError(t, os.WriteFile(filename, []byte("MA-M,0011223,Other Block,Address\n"), 0600))
+	db, err := LoadOUIDatabase("testdata/oui.csv", filename)
+	require.NoError(t, err)
+	assert.Equal(t, "Other Block", db.Vendor("00:11:22:33:44:55"))
+}
+
+func TestMACAddressKinds(t *testing.T) {
+	tests := []struct {
+		mac                 string
+		locallyAdministered bool
+		multicast           bool
+		randomized          bool
+	}{
+		{"00:1b:63:84:45:e6", false, false, false},
+		{"de:a1:19:00:00:01", true, false, true},
+		{"da:a1:19:00:00:01", true, false, true},
+		{"02:42:ac:11:00:02", true, false, true},
+		{"01:00:5e:00:00:fb", false, true, false},
+		{"33:33:00:00:00:01", true, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.mac, func(t *testing.T) {
+			hwAddr, err := net.ParseMAC(test.mac)
+			require.NoError(t, err)
+			assert.Equal(t, test.locallyAdministered, IsLocallyAdministeredMAC(hwAddr))
+			assert.Equal(t, test.multicast, IsMulticastMAC(hwAddr))
+			assert.Equal(t, test.randomized, IsRandomizedMAC(hwAddr))
+		})
+	}
+	assert.False(t, IsRandomizedMAC(nil))
+}